@@ -8,29 +8,122 @@ import (
 //go:embed default-config.json
 var defaultConfigJSON []byte
 
+// Enforcement modes
+const (
+	EnforcementEnforce = "enforce" // Deny operations not permitted by the policy
+	EnforcementAudit   = "audit"   // Allow everything, reporting what would be denied
+)
+
 // Config represents the sandbox configuration
 type Config struct {
+	Enforcement       string              `json:"enforcement"` // "enforce" or "audit"
 	Network           NetworkConfig       `json:"network"`
 	Filesystem        FilesystemConfig    `json:"filesystem"`
 	Process           ProcessConfig       `json:"process"`
 	ScanAndBlockFiles []string            `json:"scanAndBlockFiles"`
 	ScanAndBlockDirs  []string            `json:"scanAndBlockDirs"`
-	Violations        map[string][]string `json:"ignoreViolations"`
+	Violations        map[string][]string `json:"ignoreViolations"` // Legacy ignores: process name to target paths
+	ViolationSettings ViolationsConfig    `json:"violations"`
 	Ripgrep           RipgrepConfig       `json:"ripgrep"`
 	Verbose           bool                `json:"-"` // Not from JSON
+	NoSummary         bool                `json:"-"` // Suppress the end-of-run violation summary, not from JSON
+	LearnMode         bool                `json:"-"` // Run report-only and propose a policy, not from JSON
 }
 
 // NetworkConfig contains network-related settings
 type NetworkConfig struct {
-	DefaultPolicy     string   `json:"defaultPolicy"` // "allow" or "deny"
-	AllowedDomains    []string `json:"allowedDomains"`
-	DeniedDomains     []string `json:"deniedDomains"`
-	AllowUnixSockets  []string `json:"allowUnixSockets"`
-	AllowLocalBinding bool     `json:"allowLocalBinding"`
-	HTTPProxyPort     int      `json:"httpProxyPort"`
-	SOCKSProxyPort    int      `json:"socksProxyPort"`
+	DefaultPolicy     string          `json:"defaultPolicy"`  // "allow" or "deny"
+	AllowedDomains    []string        `json:"allowedDomains"` // Optionally with a port or range, e.g. "github.com:443"
+	DeniedDomains     []string        `json:"deniedDomains"`
+	DefaultPorts      []string        `json:"defaultPorts"` // Ports allowed for entries without one, empty for any port
+	AllowedCIDRs      []string        `json:"allowedCIDRs"` // Address ranges allowed, also lifting the protected range denial
+	DeniedCIDRs       []string        `json:"deniedCIDRs"`
+	MissingSNI        string          `json:"missingSNI"` // "allow" or "deny" tunnels without a TLS server name
+	TLSIntercept      InterceptConfig `json:"tlsIntercept"`
+	HTTPRules         []HTTPRule      `json:"httpRules"` // Checked in order against plain HTTP and intercepted HTTPS requests
+	Quotas            QuotaConfig     `json:"quotas"`
+	UpstreamProxy     UpstreamConfig  `json:"upstreamProxy"`
+	Secrets           []SecretConfig  `json:"secrets"`
+	ProxyTools        []string        `json:"proxyTools"` // Tools whose own settings are pointed at the proxies, from ProxyToolNames
+	AllowUnixSockets  []string        `json:"allowUnixSockets"`
+	AllowLocalBinding bool            `json:"allowLocalBinding"`
+	HTTPProxyPort     int             `json:"httpProxyPort"`
+	SOCKSProxyPort    int             `json:"socksProxyPort"`
+	DNSServer         bool            `json:"dnsServer"`     // Answer the command's DNS queries for allowed names, alongside the proxies
+	DNSServerPort     int             `json:"dnsServerPort"` // UDP port of the DNS server, 0 to auto-assign
+}
+
+// InterceptConfig enables TLS interception, so HTTP rules also apply to HTTPS
+// requests. The proxy decrypts traffic with a local CA kept in ~/.srt.
+type InterceptConfig struct {
+	Domains []string `json:"domains"` // Domains to decrypt, patterns as in allowedDomains, empty disables interception
+}
+
+// HTTPRule allows or denies requests by method, host and path. The first
+// matching rule decides and requests no rule matches are allowed.
+// Empty fields match anything; all set fields must match.
+type HTTPRule struct {
+	Name    string   `json:"name,omitempty"`    // Shown in denied responses and violations, defaults to "httpRules[N]"
+	Action  string   `json:"action"`            // "allow" or "deny"
+	Methods []string `json:"methods,omitempty"` // e.g. ["GET", "HEAD"]
+	Host    string   `json:"host,omitempty"`    // Domain pattern, e.g. "*.github.com"
+	Path    string   `json:"path,omitempty"`    // Glob, "*" within a segment and "**" across segments, e.g. "/my-org/**"
+}
+
+// QuotaConfig limits traffic through the proxies, across the run and per
+// domain. A connection that exceeds a quota is cut and reported as a violation.
+type QuotaConfig struct {
+	Run     Quota         `json:"run"`
+	Domains []DomainQuota `json:"domains"` // Every entry matching a destination applies
+}
+
+// Quota limits on proxied traffic. Zero fields are unlimited.
+type Quota struct {
+	BytesUp     int64 `json:"bytesUp,omitempty"`     // Sent by the sandboxed command
+	BytesDown   int64 `json:"bytesDown,omitempty"`   // Received from destinations
+	Requests    int64 `json:"requests,omitempty"`    // Connections opened, plus requests in intercepted tunnels
+	Connections int64 `json:"connections,omitempty"` // Connections open at once
+}
+
+// DomainQuota limits traffic to the hosts matching a domain pattern, which
+// share the limits
+type DomainQuota struct {
+	Domain string `json:"domain"` // Pattern as in allowedDomains, e.g. "*.github.com"
+	Quota
+}
+
+// UpstreamConfig chains the proxies through another proxy, e.g. a corporate
+// proxy all egress must use. The srt proxies still decide what is allowed.
+type UpstreamConfig struct {
+	URL             string   `json:"url"`                       // "http://host:port" or "socks5://host:port", empty connects directly
+	CredentialsEnv  string   `json:"credentialsEnv,omitempty"`  // Variable holding "user:password", removed from the command's environment
+	CredentialsFile string   `json:"credentialsFile,omitempty"` // File holding "user:password", denied to the command
+	NoProxy         []string `json:"noProxy,omitempty"`         // Domains, as in allowedDomains, and CIDRs connected to directly
+	RemoteDNS       bool     `json:"remoteDNS,omitempty"`       // Pass host names on for the upstream to resolve, unchecked by address
 }
 
+// SecretPlaceholderPrefix starts the placeholder the sandboxed command sees
+// in place of a secret, e.g. "SRT_SECRET_GITHUB"
+const SecretPlaceholderPrefix = "SRT_SECRET_"
+
+// SecretConfig keeps a credential out of the sandbox. The command sees a
+// placeholder, which the HTTP proxy replaces with the value in the headers of
+// requests to the bound domains.
+type SecretConfig struct {
+	Name    string   `json:"name"`           // Upper case letters, digits and underscores, e.g. "GITHUB"
+	Env     string   `json:"env,omitempty"`  // Variable holding the value, set to the placeholder in the command's environment
+	File    string   `json:"file,omitempty"` // File holding the value, denied to the command
+	Domains []string `json:"domains"`        // Domains the value may be sent to, patterns as in allowedDomains
+}
+
+// Placeholder returns what the sandboxed command sees in place of the secret
+func (s SecretConfig) Placeholder() string {
+	return SecretPlaceholderPrefix + s.Name
+}
+
+// ProxyToolNames are the tools proxyTools can configure
+var ProxyToolNames = []string{"npm", "pip", "git", "cargo", "java"}
+
 // FilesystemConfig contains filesystem-related settings
 type FilesystemConfig struct {
 	DenyRead    []string `json:"denyRead"`
@@ -47,12 +140,70 @@ type ProcessConfig struct {
 	AllowPosixShm   bool `json:"allowPosixShm"`   // Allow POSIX shared memory
 }
 
+// ViolationsConfig contains violation reporting settings
+type ViolationsConfig struct {
+	Ignore    []IgnoreRule `json:"ignore"`
+	KillRules []KillRule   `json:"killRules"`
+	Sinks     SinksConfig  `json:"sinks"`
+}
+
+// KillRule terminates the sandboxed command when a matching violation occurs.
+// Empty fields match anything; all set fields must match.
+type KillRule struct {
+	Name      string `json:"name,omitempty"`      // Shown when the rule fires, defaults to a description of the rule
+	Operation string `json:"operation,omitempty"` // Operation, category or glob, e.g. "file-read*"
+	Target    string `json:"target,omitempty"`    // Anchored path glob, plain paths also match paths beneath them
+	Domain    string `json:"domain,omitempty"`    // Domain pattern matched against proxy denials, e.g. "*.example.com"
+}
+
+// SinksConfig configures where violations are forwarded in addition to ~/.srt/deny.log
+type SinksConfig struct {
+	Syslog  SyslogSinkConfig  `json:"syslog"`
+	Socket  SocketSinkConfig  `json:"socket"`
+	Webhook WebhookSinkConfig `json:"webhook"`
+}
+
+// SyslogSinkConfig configures forwarding to the local syslog daemon
+type SyslogSinkConfig struct {
+	Enabled bool   `json:"enabled"`
+	Tag     string `json:"tag,omitempty"` // Defaults to "srt"
+}
+
+// SocketSinkConfig configures streaming JSON lines to a unix-domain socket
+type SocketSinkConfig struct {
+	Path string `json:"path"` // Socket to connect to, empty disables the sink
+}
+
+// WebhookSinkConfig configures batched HTTP delivery of violations
+type WebhookSinkConfig struct {
+	URL             string            `json:"url"`                       // Empty disables the sink
+	Headers         map[string]string `json:"headers,omitempty"`         // Values may reference environment variables, e.g. "Bearer ${TOKEN}"
+	BatchSize       int               `json:"batchSize,omitempty"`       // Records per request, defaults to 50
+	FlushIntervalMs int               `json:"flushIntervalMs,omitempty"` // Maximum time a record waits for a batch, defaults to 2000
+	MaxRetries      *int              `json:"maxRetries,omitempty"`      // Retries per batch after the first attempt, defaults to 3 when unset, 0 disables
+	QueueSize       int               `json:"queueSize,omitempty"`       // Records buffered before new ones are dropped, defaults to 1000
+}
+
+// IgnoreRule matches violations to leave out of logs and summaries.
+// Empty fields match anything; all set fields must match.
+type IgnoreRule struct {
+	Process     string `json:"process,omitempty"`     // Process name glob, e.g. "node" or "python3*"
+	Operation   string `json:"operation,omitempty"`   // Operation, category or glob, e.g. "file-read*"
+	Target      string `json:"target,omitempty"`      // Anchored path glob, plain paths also match paths beneath them
+	TargetRegex string `json:"targetRegex,omitempty"` // Anchored regular expression, alternative to target
+}
+
 // RipgrepConfig contains ripgrep-specific settings
 type RipgrepConfig struct {
 	Command string   `json:"command"`
 	Args    []string `json:"args"`
 }
 
+// IsAudit reports whether the configuration uses audit enforcement
+func (c *Config) IsAudit() bool {
+	return c.Enforcement == EnforcementAudit
+}
+
 // DefaultConfig returns a configuration from the embedded default
 func DefaultConfig() (*Config, error) {
 	var cfg Config
@@ -64,6 +215,9 @@ func DefaultConfig() (*Config, error) {
 
 // Merge merges another config into this one (other takes precedence)
 func (c *Config) Merge(other *Config) {
+	if other.Enforcement != "" {
+		c.Enforcement = other.Enforcement
+	}
 	if other.Network.DefaultPolicy != "" {
 		c.Network.DefaultPolicy = other.Network.DefaultPolicy
 	}
@@ -73,6 +227,36 @@ func (c *Config) Merge(other *Config) {
 	if len(other.Network.DeniedDomains) > 0 {
 		c.Network.DeniedDomains = other.Network.DeniedDomains
 	}
+	if len(other.Network.DefaultPorts) > 0 {
+		c.Network.DefaultPorts = other.Network.DefaultPorts
+	}
+	if len(other.Network.AllowedCIDRs) > 0 {
+		c.Network.AllowedCIDRs = other.Network.AllowedCIDRs
+	}
+	if len(other.Network.DeniedCIDRs) > 0 {
+		c.Network.DeniedCIDRs = other.Network.DeniedCIDRs
+	}
+	if other.Network.MissingSNI != "" {
+		c.Network.MissingSNI = other.Network.MissingSNI
+	}
+	if len(other.Network.TLSIntercept.Domains) > 0 {
+		c.Network.TLSIntercept = other.Network.TLSIntercept
+	}
+	if len(other.Network.HTTPRules) > 0 {
+		c.Network.HTTPRules = other.Network.HTTPRules
+	}
+	if other.Network.Quotas.Run != (Quota{}) || len(other.Network.Quotas.Domains) > 0 {
+		c.Network.Quotas = other.Network.Quotas
+	}
+	if other.Network.UpstreamProxy.URL != "" {
+		c.Network.UpstreamProxy = other.Network.UpstreamProxy
+	}
+	if len(other.Network.Secrets) > 0 {
+		c.Network.Secrets = other.Network.Secrets
+	}
+	if len(other.Network.ProxyTools) > 0 {
+		c.Network.ProxyTools = other.Network.ProxyTools
+	}
 	if len(other.Network.AllowUnixSockets) > 0 {
 		c.Network.AllowUnixSockets = other.Network.AllowUnixSockets
 	}
@@ -82,6 +266,12 @@ func (c *Config) Merge(other *Config) {
 	if other.Network.SOCKSProxyPort != 0 {
 		c.Network.SOCKSProxyPort = other.Network.SOCKSProxyPort
 	}
+	if other.Network.DNSServer {
+		c.Network.DNSServer = true
+	}
+	if other.Network.DNSServerPort != 0 {
+		c.Network.DNSServerPort = other.Network.DNSServerPort
+	}
 	if len(other.Filesystem.DenyRead) > 0 {
 		c.Filesystem.DenyRead = other.Filesystem.DenyRead
 	}
@@ -103,6 +293,21 @@ func (c *Config) Merge(other *Config) {
 	if len(other.Violations) > 0 {
 		c.Violations = other.Violations
 	}
+	if len(other.ViolationSettings.Ignore) > 0 {
+		c.ViolationSettings.Ignore = other.ViolationSettings.Ignore
+	}
+	if len(other.ViolationSettings.KillRules) > 0 {
+		c.ViolationSettings.KillRules = other.ViolationSettings.KillRules
+	}
+	if other.ViolationSettings.Sinks.Syslog.Enabled {
+		c.ViolationSettings.Sinks.Syslog = other.ViolationSettings.Sinks.Syslog
+	}
+	if other.ViolationSettings.Sinks.Socket.Path != "" {
+		c.ViolationSettings.Sinks.Socket = other.ViolationSettings.Sinks.Socket
+	}
+	if other.ViolationSettings.Sinks.Webhook.URL != "" {
+		c.ViolationSettings.Sinks.Webhook = other.ViolationSettings.Sinks.Webhook
+	}
 	if other.Ripgrep.Command != "" {
 		c.Ripgrep.Command = other.Ripgrep.Command
 	}
@@ -17,6 +17,8 @@ func DeepCopy(cfg *Config) (*Config, error) {
 
 	// Preserve runtime fields that aren't in JSON
 	copy.Verbose = cfg.Verbose
+	copy.NoSummary = cfg.NoSummary
+	copy.LearnMode = cfg.LearnMode
 
 	return &copy, nil
 }
@@ -45,6 +47,10 @@ func MergeConfigs(base, override *Config) (*Config, error) {
 		return nil, err
 	}
 
+	if _, ok := overrideMap["enforcement"]; ok {
+		merged.Enforcement = override.Enforcement
+	}
+
 	// Merge network settings
 	if networkMap, ok := overrideMap["network"].(map[string]interface{}); ok {
 		mergeNetworkConfig(&merged.Network, &override.Network, networkMap)
@@ -70,6 +76,9 @@ func MergeConfigs(base, override *Config) (*Config, error) {
 	if _, ok := overrideMap["ignoreViolations"]; ok {
 		merged.Violations = override.Violations
 	}
+	if violationsMap, ok := overrideMap["violations"].(map[string]interface{}); ok {
+		mergeViolationsConfig(&merged.ViolationSettings, &override.ViolationSettings, violationsMap)
+	}
 	if ripgrepMap, ok := overrideMap["ripgrep"].(map[string]interface{}); ok {
 		if _, hasCommand := ripgrepMap["command"]; hasCommand {
 			merged.Ripgrep.Command = override.Ripgrep.Command
@@ -92,6 +101,36 @@ func mergeNetworkConfig(base, override *NetworkConfig, overrideMap map[string]in
 	if _, ok := overrideMap["deniedDomains"]; ok {
 		base.DeniedDomains = override.DeniedDomains
 	}
+	if _, ok := overrideMap["defaultPorts"]; ok {
+		base.DefaultPorts = override.DefaultPorts
+	}
+	if _, ok := overrideMap["allowedCIDRs"]; ok {
+		base.AllowedCIDRs = override.AllowedCIDRs
+	}
+	if _, ok := overrideMap["deniedCIDRs"]; ok {
+		base.DeniedCIDRs = override.DeniedCIDRs
+	}
+	if _, ok := overrideMap["missingSNI"]; ok {
+		base.MissingSNI = override.MissingSNI
+	}
+	if _, ok := overrideMap["tlsIntercept"]; ok {
+		base.TLSIntercept = override.TLSIntercept
+	}
+	if _, ok := overrideMap["httpRules"]; ok {
+		base.HTTPRules = override.HTTPRules
+	}
+	if _, ok := overrideMap["quotas"]; ok {
+		base.Quotas = override.Quotas
+	}
+	if _, ok := overrideMap["upstreamProxy"]; ok {
+		base.UpstreamProxy = override.UpstreamProxy
+	}
+	if _, ok := overrideMap["secrets"]; ok {
+		base.Secrets = override.Secrets
+	}
+	if _, ok := overrideMap["proxyTools"]; ok {
+		base.ProxyTools = override.ProxyTools
+	}
 	if _, ok := overrideMap["allowUnixSockets"]; ok {
 		base.AllowUnixSockets = override.AllowUnixSockets
 	}
@@ -104,6 +143,12 @@ func mergeNetworkConfig(base, override *NetworkConfig, overrideMap map[string]in
 	if _, ok := overrideMap["socksProxyPort"]; ok {
 		base.SOCKSProxyPort = override.SOCKSProxyPort
 	}
+	if _, ok := overrideMap["dnsServer"]; ok {
+		base.DNSServer = override.DNSServer
+	}
+	if _, ok := overrideMap["dnsServerPort"]; ok {
+		base.DNSServerPort = override.DNSServerPort
+	}
 }
 
 func mergeFilesystemConfig(base, override *FilesystemConfig, overrideMap map[string]interface{}) {
@@ -135,3 +180,15 @@ func mergeProcessConfig(base, override *ProcessConfig, overrideMap map[string]in
 		base.AllowPosixShm = override.AllowPosixShm
 	}
 }
+
+func mergeViolationsConfig(base, override *ViolationsConfig, overrideMap map[string]interface{}) {
+	if _, ok := overrideMap["ignore"]; ok {
+		base.Ignore = override.Ignore
+	}
+	if _, ok := overrideMap["killRules"]; ok {
+		base.KillRules = override.KillRules
+	}
+	if _, ok := overrideMap["sinks"]; ok {
+		base.Sinks = override.Sinks
+	}
+}
@@ -2,8 +2,14 @@ package config
 
 import (
 	"fmt"
+	"net/netip"
+	"net/url"
+	"path"
 	"regexp"
+	"slices"
 	"strings"
+
+	"github.com/sammcj/srt-go/internal/network"
 )
 
 var (
@@ -13,6 +19,13 @@ var (
 
 // Validate checks if the configuration is valid
 func Validate(cfg *Config) error {
+	// Validate enforcement mode (empty means enforce)
+	switch cfg.Enforcement {
+	case "", EnforcementEnforce, EnforcementAudit:
+	default:
+		return fmt.Errorf("invalid enforcement mode %q: must be %q or %q", cfg.Enforcement, EnforcementEnforce, EnforcementAudit)
+	}
+
 	// Validate network configuration
 	if err := validateNetwork(&cfg.Network); err != nil {
 		return fmt.Errorf("network config: %w", err)
@@ -23,24 +36,104 @@ func Validate(cfg *Config) error {
 		return fmt.Errorf("filesystem config: %w", err)
 	}
 
+	// Validate violation settings
+	if err := validateViolations(&cfg.ViolationSettings); err != nil {
+		return fmt.Errorf("violations config: %w", err)
+	}
+
 	return nil
 }
 
 func validateNetwork(nc *NetworkConfig) error {
 	// Validate allowed domains
 	for _, domain := range nc.AllowedDomains {
-		if err := validateDomain(domain); err != nil {
+		if err := validateDomainEntry(domain); err != nil {
 			return fmt.Errorf("invalid allowed domain %q: %w", domain, err)
 		}
 	}
 
 	// Validate denied domains
 	for _, domain := range nc.DeniedDomains {
-		if err := validateDomain(domain); err != nil {
+		if err := validateDomainEntry(domain); err != nil {
 			return fmt.Errorf("invalid denied domain %q: %w", domain, err)
 		}
 	}
 
+	// Validate address ranges
+	for _, cidr := range nc.AllowedCIDRs {
+		if err := validateCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid allowed CIDR %q: %w", cidr, err)
+		}
+	}
+	for _, cidr := range nc.DeniedCIDRs {
+		if err := validateCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid denied CIDR %q: %w", cidr, err)
+		}
+	}
+
+	// Validate default ports
+	for _, ports := range nc.DefaultPorts {
+		if _, err := network.ParsePortRange(ports); err != nil {
+			return fmt.Errorf("invalid default port %q: %w", ports, err)
+		}
+	}
+
+	// Validate the missing SNI policy (empty means allow)
+	switch nc.MissingSNI {
+	case "", "allow", "deny":
+	default:
+		return fmt.Errorf("invalid missingSNI policy %q: must be \"allow\" or \"deny\"", nc.MissingSNI)
+	}
+
+	// Validate TLS interception and HTTP rules
+	for _, domain := range nc.TLSIntercept.Domains {
+		if err := validateDomainEntry(domain); err != nil {
+			return fmt.Errorf("invalid intercept domain %q: %w", domain, err)
+		}
+	}
+	for i, rule := range nc.HTTPRules {
+		if err := validateHTTPRule(rule); err != nil {
+			return fmt.Errorf("invalid HTTP rule %d: %w", i, err)
+		}
+	}
+
+	// Validate quotas
+	if err := validateQuota(nc.Quotas.Run); err != nil {
+		return fmt.Errorf("invalid run quota: %w", err)
+	}
+	for _, dq := range nc.Quotas.Domains {
+		if err := validateDomainEntry(dq.Domain); err != nil {
+			return fmt.Errorf("invalid quota domain %q: %w", dq.Domain, err)
+		}
+		if err := validateQuota(dq.Quota); err != nil {
+			return fmt.Errorf("invalid quota for %q: %w", dq.Domain, err)
+		}
+	}
+
+	// Validate the upstream proxy
+	if err := validateUpstream(nc.UpstreamProxy); err != nil {
+		return fmt.Errorf("invalid upstream proxy: %w", err)
+	}
+
+	// Validate secrets
+	for i, secret := range nc.Secrets {
+		if err := validateSecret(secret); err != nil {
+			return fmt.Errorf("invalid secret %q: %w", secret.Name, err)
+		}
+		for _, other := range nc.Secrets[:i] {
+			if strings.Contains(secret.Placeholder(), other.Placeholder()) || strings.Contains(other.Placeholder(), secret.Placeholder()) {
+				return fmt.Errorf("secret names %q and %q overlap: one placeholder contains the other", other.Name, secret.Name)
+			}
+		}
+	}
+
+	// Validate proxy tools
+	for _, tool := range nc.ProxyTools {
+		if !slices.Contains(ProxyToolNames, tool) {
+			return fmt.Errorf("invalid proxy tool %q: must be one of %s", tool, strings.Join(ProxyToolNames, ", "))
+		}
+	}
+
 	// Validate ports
 	if nc.HTTPProxyPort < 0 || nc.HTTPProxyPort > 65535 {
 		return fmt.Errorf("invalid HTTP proxy port: %d", nc.HTTPProxyPort)
@@ -50,6 +143,102 @@ func validateNetwork(nc *NetworkConfig) error {
 		return fmt.Errorf("invalid SOCKS proxy port: %d", nc.SOCKSProxyPort)
 	}
 
+	if nc.DNSServerPort < 0 || nc.DNSServerPort > 65535 {
+		return fmt.Errorf("invalid DNS server port: %d", nc.DNSServerPort)
+	}
+
+	return nil
+}
+
+// httpMethodPattern matches an HTTP method token
+var httpMethodPattern = regexp.MustCompile(`^[A-Za-z]+$`)
+
+func validateHTTPRule(rule HTTPRule) error {
+	if rule.Action != "allow" && rule.Action != "deny" {
+		return fmt.Errorf("action %q must be \"allow\" or \"deny\"", rule.Action)
+	}
+
+	for _, method := range rule.Methods {
+		if !httpMethodPattern.MatchString(method) {
+			return fmt.Errorf("invalid method %q", method)
+		}
+	}
+
+	if rule.Host != "" {
+		if err := validateDomainEntry(rule.Host); err != nil {
+			return fmt.Errorf("invalid host %q: %w", rule.Host, err)
+		}
+	}
+
+	if rule.Path != "" && !strings.HasPrefix(rule.Path, "/") {
+		return fmt.Errorf("path %q must start with /", rule.Path)
+	}
+
+	return nil
+}
+
+func validateQuota(q Quota) error {
+	if q.BytesUp < 0 || q.BytesDown < 0 || q.Requests < 0 || q.Connections < 0 {
+		return fmt.Errorf("limits cannot be negative")
+	}
+	return nil
+}
+
+func validateUpstream(uc UpstreamConfig) error {
+	if uc.URL == "" {
+		if uc.CredentialsEnv != "" || uc.CredentialsFile != "" || len(uc.NoProxy) > 0 || uc.RemoteDNS {
+			return fmt.Errorf("url is required")
+		}
+		return nil
+	}
+
+	u, err := url.Parse(uc.URL)
+	if err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "socks5" {
+		return fmt.Errorf("url scheme %q must be \"http\" or \"socks5\"", u.Scheme)
+	}
+	if u.Hostname() == "" || u.Port() == "" {
+		return fmt.Errorf("url must have a host and port")
+	}
+	if u.User != nil {
+		return fmt.Errorf("url must not contain credentials, use credentialsEnv or credentialsFile")
+	}
+
+	if uc.CredentialsEnv != "" && uc.CredentialsFile != "" {
+		return fmt.Errorf("credentialsEnv and credentialsFile are mutually exclusive")
+	}
+
+	for _, entry := range uc.NoProxy {
+		if validateCIDR(entry) == nil {
+			continue
+		}
+		if err := validateDomainEntry(entry); err != nil {
+			return fmt.Errorf("invalid noProxy entry %q: %w", entry, err)
+		}
+	}
+	return nil
+}
+
+// secretNamePattern matches a secret name, which becomes part of an environment variable style placeholder
+var secretNamePattern = regexp.MustCompile(`^[A-Z0-9_]+$`)
+
+func validateSecret(sc SecretConfig) error {
+	if !secretNamePattern.MatchString(sc.Name) {
+		return fmt.Errorf("name must be upper case letters, digits and underscores")
+	}
+	if (sc.Env == "") == (sc.File == "") {
+		return fmt.Errorf("exactly one of env and file is required")
+	}
+	if len(sc.Domains) == 0 {
+		return fmt.Errorf("domains are required")
+	}
+	for _, domain := range sc.Domains {
+		if err := validateDomainEntry(domain); err != nil {
+			return fmt.Errorf("invalid domain %q: %w", domain, err)
+		}
+	}
 	return nil
 }
 
@@ -79,6 +268,36 @@ func validateDomain(domain string) error {
 	return nil
 }
 
+// validateDomainEntry validates a domain optionally followed by a port or
+// port range, e.g. "github.com:443" or "registry.local:8000-8100", split and
+// parsed as the filter will
+func validateDomainEntry(entry string) error {
+	domain, ports, hasPorts := network.SplitDomainPorts(entry)
+	if err := validateDomain(domain); err != nil {
+		return err
+	}
+	if hasPorts {
+		_, err := network.ParsePortRange(ports)
+		return err
+	}
+	return nil
+}
+
+// validateCIDR validates a CIDR ("10.0.0.0/8") or a single IP address
+func validateCIDR(cidr string) error {
+	if strings.Contains(cidr, "/") {
+		if _, err := netip.ParsePrefix(cidr); err != nil {
+			return fmt.Errorf("invalid CIDR")
+		}
+		return nil
+	}
+
+	if _, err := netip.ParseAddr(cidr); err != nil {
+		return fmt.Errorf("invalid IP address")
+	}
+	return nil
+}
+
 func validateFilesystem(fc *FilesystemConfig) error {
 	// Validate deny read paths
 	for _, path := range fc.DenyRead {
@@ -103,3 +322,92 @@ func validateFilesystem(fc *FilesystemConfig) error {
 
 	return nil
 }
+
+func validateViolations(vc *ViolationsConfig) error {
+	for i, rule := range vc.Ignore {
+		if err := validateIgnoreRule(rule); err != nil {
+			return fmt.Errorf("invalid ignore rule %d: %w", i, err)
+		}
+	}
+
+	for i, rule := range vc.KillRules {
+		if err := validateKillRule(rule); err != nil {
+			return fmt.Errorf("invalid kill rule %d: %w", i, err)
+		}
+	}
+
+	if err := validateSinks(&vc.Sinks); err != nil {
+		return fmt.Errorf("sinks: %w", err)
+	}
+
+	return nil
+}
+
+func validateKillRule(rule KillRule) error {
+	if rule.Operation == "" && rule.Target == "" && rule.Domain == "" {
+		return fmt.Errorf("rule must set at least one of operation, target or domain")
+	}
+
+	if rule.Target != "" && rule.Domain != "" {
+		return fmt.Errorf("target and domain are mutually exclusive")
+	}
+
+	if _, err := path.Match(rule.Operation, ""); err != nil {
+		return fmt.Errorf("invalid operation glob %q: %w", rule.Operation, err)
+	}
+
+	// "*" matches every denied domain, which is too broad for allow lists but not here
+	if rule.Domain != "" && rule.Domain != "*" {
+		if err := validateDomain(rule.Domain); err != nil {
+			return fmt.Errorf("invalid domain %q: %w", rule.Domain, err)
+		}
+	}
+
+	return nil
+}
+
+func validateSinks(sc *SinksConfig) error {
+	if p := sc.Socket.Path; p != "" && !strings.HasPrefix(p, "/") && !strings.HasPrefix(p, "~") {
+		return fmt.Errorf("socket path %q must be absolute", p)
+	}
+
+	webhook := sc.Webhook
+	if webhook.URL != "" {
+		u, err := url.Parse(webhook.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhook url %q must be an http or https URL", webhook.URL)
+		}
+	}
+
+	if webhook.BatchSize < 0 || webhook.FlushIntervalMs < 0 || (webhook.MaxRetries != nil && *webhook.MaxRetries < 0) || webhook.QueueSize < 0 {
+		return fmt.Errorf("webhook batchSize, flushIntervalMs, maxRetries and queueSize must not be negative")
+	}
+
+	return nil
+}
+
+func validateIgnoreRule(rule IgnoreRule) error {
+	if rule.Process == "" && rule.Operation == "" && rule.Target == "" && rule.TargetRegex == "" {
+		return fmt.Errorf("rule must set at least one of process, operation, target or targetRegex")
+	}
+
+	if rule.Target != "" && rule.TargetRegex != "" {
+		return fmt.Errorf("target and targetRegex are mutually exclusive")
+	}
+
+	if _, err := path.Match(rule.Process, ""); err != nil {
+		return fmt.Errorf("invalid process glob %q: %w", rule.Process, err)
+	}
+
+	if _, err := path.Match(rule.Operation, ""); err != nil {
+		return fmt.Errorf("invalid operation glob %q: %w", rule.Operation, err)
+	}
+
+	if rule.TargetRegex != "" {
+		if _, err := regexp.Compile(rule.TargetRegex); err != nil {
+			return fmt.Errorf("invalid targetRegex: %w", err)
+		}
+	}
+
+	return nil
+}
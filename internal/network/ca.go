@@ -0,0 +1,290 @@
+package network
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	caCertName   = "ca.pem"
+	caKeyName    = "ca-key.pem"
+	caBundleName = "ca-bundle.pem"
+	caLockName   = "ca.lock"
+
+	caValidity   = 10 * 365 * 24 * time.Hour
+	leafValidity = 7 * 24 * time.Hour
+)
+
+// systemBundles are the usual locations of the system's trusted roots
+var systemBundles = []string{
+	"/etc/ssl/cert.pem",                  // macOS, Alpine
+	"/etc/ssl/certs/ca-certificates.crt", // Debian, Ubuntu
+	"/etc/pki/tls/certs/ca-bundle.crt",   // Fedora, RHEL
+}
+
+// CertificateAuthority is the local CA used to intercept TLS. It mints a
+// certificate for each intercepted host, signed by a CA certificate that the
+// sandboxed command is told to trust.
+type CertificateAuthority struct {
+	cert       *x509.Certificate
+	key        *ecdsa.PrivateKey
+	leafKey    *ecdsa.PrivateKey // Shared by every leaf, generated per run
+	dir        string
+	mu         sync.Mutex
+	leaves     map[string]*tls.Certificate
+	bundlePath string
+}
+
+// LoadOrCreateCA loads the CA from dir, creating it on first use. It also
+// writes a bundle of the system roots plus the CA, for tools that replace
+// rather than extend their trusted roots.
+func LoadOrCreateCA(dir string) (*CertificateAuthority, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create CA directory: %w", err)
+	}
+
+	// Concurrent runs must agree on a single CA
+	lock, err := os.OpenFile(filepath.Join(dir, caLockName), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open CA lock: %w", err)
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return nil, fmt.Errorf("failed to lock CA: %w", err)
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	cert, key, err := loadCA(dir)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && time.Now().Add(leafValidity).After(cert.NotAfter)) {
+		cert, key, err = createCA(dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate certificate key: %w", err)
+	}
+
+	ca := &CertificateAuthority{
+		cert:       cert,
+		key:        key,
+		leafKey:    leafKey,
+		dir:        dir,
+		leaves:     make(map[string]*tls.Certificate),
+		bundlePath: filepath.Join(dir, caBundleName),
+	}
+
+	if err := writeCABundle(ca.bundlePath, cert); err != nil {
+		return nil, err
+	}
+
+	return ca, nil
+}
+
+// CertPath returns the path of the CA certificate
+func (ca *CertificateAuthority) CertPath() string {
+	return filepath.Join(ca.dir, caCertName)
+}
+
+// KeyPath returns the path of the CA private key, which sandboxed commands
+// must not read
+func (ca *CertificateAuthority) KeyPath() string {
+	return filepath.Join(ca.dir, caKeyName)
+}
+
+// BundlePath returns the path of the system roots plus the CA certificate
+func (ca *CertificateAuthority) BundlePath() string {
+	return ca.bundlePath
+}
+
+// Certificate returns the CA certificate
+func (ca *CertificateAuthority) Certificate() *x509.Certificate {
+	return ca.cert
+}
+
+// certificateFor returns a certificate for host, minting it on first use
+func (ca *CertificateAuthority) certificateFor(host string) (*tls.Certificate, error) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	if leaf, ok := ca.leaves[host]; ok && time.Now().Before(leaf.Leaf.NotAfter) {
+		return leaf, nil
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	notAfter := now.Add(leafValidity)
+	if notAfter.After(ca.cert.NotAfter) {
+		notAfter = ca.cert.NotAfter
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &ca.leafKey.PublicKey, ca.key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate for %s: %w", host, err)
+	}
+	parsed, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf := &tls.Certificate{
+		Certificate: [][]byte{der, ca.cert.Raw},
+		PrivateKey:  ca.leafKey,
+		Leaf:        parsed,
+	}
+	ca.leaves[host] = leaf
+	return leaf, nil
+}
+
+func loadCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certPEM, err := os.ReadFile(filepath.Join(dir, caCertName))
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := os.ReadFile(filepath.Join(dir, caKeyName))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	if certBlock == nil || keyBlock == nil {
+		return nil, nil, fmt.Errorf("invalid CA files in %s", dir)
+	}
+
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid CA certificate: %w", err)
+	}
+	parsedKey, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid CA key: %w", err)
+	}
+	key, ok := parsedKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("invalid CA key: not an ECDSA key")
+	}
+
+	return cert, key, nil
+}
+
+func createCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate CA key: %w", err)
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "srt-go local CA", Organization: []string{"srt-go"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create CA certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Key first, so a certificate on disk always has its key
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	if err := writeFileAtomic(filepath.Join(dir, caKeyName), keyPEM, 0600); err != nil {
+		return nil, nil, fmt.Errorf("failed to write CA key: %w", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := writeFileAtomic(filepath.Join(dir, caCertName), certPEM, 0644); err != nil {
+		return nil, nil, fmt.Errorf("failed to write CA certificate: %w", err)
+	}
+
+	return cert, key, nil
+}
+
+// writeCABundle writes the roots the user already trusts, followed by the CA.
+// The roots come from SSL_CERT_FILE if set, otherwise the first system bundle found.
+func writeCABundle(path string, cert *x509.Certificate) error {
+	candidates := systemBundles
+	if current := os.Getenv("SSL_CERT_FILE"); current != "" && current != path {
+		candidates = append([]string{current}, systemBundles...)
+	}
+
+	var bundle []byte
+	for _, candidate := range candidates {
+		if data, err := os.ReadFile(candidate); err == nil {
+			bundle = append(data, '\n')
+			break
+		}
+	}
+	bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+
+	if err := writeFileAtomic(path, bundle, 0644); err != nil {
+		return fmt.Errorf("failed to write CA bundle: %w", err)
+	}
+	return nil
+}
+
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func randomSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+	return serial, nil
+}
@@ -0,0 +1,86 @@
+package network
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadOrCreateCA(t *testing.T) {
+	dir := t.TempDir()
+
+	ca, err := LoadOrCreateCA(dir)
+	if err != nil {
+		t.Fatalf("LoadOrCreateCA() error = %v", err)
+	}
+
+	info, err := os.Stat(ca.KeyPath())
+	if err != nil {
+		t.Fatalf("CA key not written: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("CA key permissions = %o, want 600", perm)
+	}
+
+	// A second run reuses the CA
+	again, err := LoadOrCreateCA(dir)
+	if err != nil {
+		t.Fatalf("LoadOrCreateCA() second call error = %v", err)
+	}
+	if !again.Certificate().Equal(ca.Certificate()) {
+		t.Error("Expected the existing CA to be loaded, got a new one")
+	}
+
+	// The bundle ends with the CA certificate
+	bundle, err := os.ReadFile(ca.BundlePath())
+	if err != nil {
+		t.Fatalf("CA bundle not written: %v", err)
+	}
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate().Raw})
+	if !bytes.HasSuffix(bundle, caPEM) {
+		t.Error("CA bundle does not end with the CA certificate")
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Certificate())
+
+	for _, host := range []string{"github.com", "127.0.0.1"} {
+		leaf, err := ca.certificateFor(host)
+		if err != nil {
+			t.Fatalf("certificateFor(%q) error = %v", host, err)
+		}
+		if _, err := leaf.Leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: roots}); err != nil {
+			t.Errorf("Certificate for %q does not verify: %v", host, err)
+		}
+
+		cached, _ := ca.certificateFor(host)
+		if cached != leaf {
+			t.Errorf("Expected the certificate for %q to be cached", host)
+		}
+	}
+}
+
+func TestCABundleUsesCurrentRoots(t *testing.T) {
+	dir := t.TempDir()
+	current := filepath.Join(dir, "corporate.pem")
+	if err := os.WriteFile(current, []byte("# corporate roots\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SSL_CERT_FILE", current)
+
+	ca, err := LoadOrCreateCA(filepath.Join(dir, "srt"))
+	if err != nil {
+		t.Fatalf("LoadOrCreateCA() error = %v", err)
+	}
+
+	bundle, err := os.ReadFile(ca.BundlePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(bundle, []byte("# corporate roots\n")) {
+		t.Errorf("Bundle should start with the roots from SSL_CERT_FILE, got %q", bundle[:min(len(bundle), 40)])
+	}
+}
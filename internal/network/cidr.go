@@ -0,0 +1,111 @@
+package network
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// protectedRange is an address range denied unless explicitly allowed
+type protectedRange struct {
+	name   string
+	prefix netip.Prefix
+}
+
+// protectedRanges are local, private and cloud metadata ranges that sandboxed
+// commands should not reach through the proxies by default
+var protectedRanges = []protectedRange{
+	{"unspecified", netip.MustParsePrefix("0.0.0.0/8")},
+	{"loopback", netip.MustParsePrefix("127.0.0.0/8")},
+	{"private", netip.MustParsePrefix("10.0.0.0/8")},
+	{"private", netip.MustParsePrefix("172.16.0.0/12")},
+	{"private", netip.MustParsePrefix("192.168.0.0/16")},
+	{"link-local", netip.MustParsePrefix("169.254.0.0/16")},   // Includes the AWS, GCP and Azure metadata endpoint 169.254.169.254
+	{"metadata", netip.MustParsePrefix("100.100.100.200/32")}, // Alibaba Cloud
+	{"shared", netip.MustParsePrefix("100.64.0.0/10")},        // Carrier-grade NAT, also used by Tailscale
+	{"unspecified", netip.MustParsePrefix("::/128")},
+	{"loopback", netip.MustParsePrefix("::1/128")},
+	{"private", netip.MustParsePrefix("fc00::/7")}, // Unique local, includes the AWS metadata endpoint fd00:ec2::254
+	{"link-local", netip.MustParsePrefix("fe80::/10")},
+}
+
+// nat64Prefix is the well-known NAT64 prefix, whose addresses embed an IPv4
+// address in their last four bytes
+var nat64Prefix = netip.MustParsePrefix("64:ff9b::/96")
+
+// unwrapNAT64 returns the IPv4 address a NAT64 address translates to, so
+// ranges can't be reached through the gateway's IPv6 form
+func unwrapNAT64(addr netip.Addr) (netip.Addr, bool) {
+	if !nat64Prefix.Contains(addr) {
+		return netip.Addr{}, false
+	}
+	b := addr.As16()
+	return netip.AddrFrom4([4]byte{b[12], b[13], b[14], b[15]}), true
+}
+
+// ParseCIDR parses a CIDR ("10.0.0.0/8") or a single address ("10.0.0.5"),
+// which becomes a /32 or /128 prefix
+func ParseCIDR(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid CIDR %q: %w", s, err)
+		}
+		return prefix.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid IP address %q: %w", s, err)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func parseCIDRs(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		prefix, err := ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// matchPrefix returns the first prefix containing addr, or the IPv4 address
+// embedded in a NAT64 addr
+func matchPrefix(prefixes []netip.Prefix, addr netip.Addr) (netip.Prefix, bool) {
+	v4, nat64 := unwrapNAT64(addr)
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) || nat64 && prefix.Contains(v4) {
+			return prefix, true
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+// protectedRangeFor returns the protected range containing addr, or the IPv4
+// address embedded in a NAT64 addr, if any
+func protectedRangeFor(addr netip.Addr) (protectedRange, bool) {
+	v4, nat64 := unwrapNAT64(addr)
+	for _, r := range protectedRanges {
+		if r.prefix.Contains(addr) || nat64 && r.prefix.Contains(v4) {
+			return r, true
+		}
+	}
+	return protectedRange{}, false
+}
+
+// parseIP parses a host as an IP address, unmapping IPv4-mapped IPv6
+// addresses so they match IPv4 rules
+func parseIP(host string) (netip.Addr, bool) {
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap().WithZone(""), true
+}
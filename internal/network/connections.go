@@ -0,0 +1,186 @@
+package network
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Connection protocols
+const (
+	ProtocolHTTP     = "http"       // Plain HTTP request through the HTTP proxy
+	ProtocolHTTPS    = "https"      // Intercepted HTTPS request
+	ProtocolConnect  = "connect"    // CONNECT tunnel through the HTTP proxy
+	ProtocolSOCKS    = "socks5"     // SOCKS5 connection
+	ProtocolSOCKSUDP = "socks5-udp" // Datagrams to one destination of a SOCKS5 UDP association
+	ProtocolDNS      = "dns"        // Query to the DNS server
+)
+
+// ConnectionRecord describes one proxied connection, or one request where
+// the proxy can read HTTP
+type ConnectionRecord struct {
+	Time       time.Time `json:"time"`            // When the connection or request started
+	RunID      string    `json:"runId,omitempty"` // Set by the receiver of the record
+	Protocol   string    `json:"protocol"`
+	Host       string    `json:"host"`
+	Port       int       `json:"port"`
+	IP         string    `json:"ip,omitempty"` // Address connected to
+	Decision   string    `json:"decision"`     // "allow" or "deny", what the proxy did
+	Rule       string    `json:"rule,omitempty"`
+	BytesUp    int64     `json:"bytesUp"`   // Sent by the sandboxed client, bodies only for HTTP requests
+	BytesDown  int64     `json:"bytesDown"` // Received from the destination, bodies only for HTTP requests
+	DurationMs int64     `json:"durationMs"`
+	Method     string    `json:"method,omitempty"`
+	Path       string    `json:"path,omitempty"`
+	Status     int       `json:"status,omitempty"`    // HTTP status
+	Error      string    `json:"error,omitempty"`     // Why an allowed connection failed
+	QueryType  string    `json:"queryType,omitempty"` // DNS query type, e.g. "AAAA"
+	Answers    []string  `json:"answers,omitempty"`   // Addresses a DNS query was answered with
+}
+
+// connectionLog reports records to a hook, which may be unset
+type connectionLog struct {
+	hook func(ConnectionRecord)
+}
+
+// SetConnectionHook registers a function called as each connection or
+// request ends, from the goroutine that handled it. It must be set before
+// the proxy starts.
+func (l *connectionLog) SetConnectionHook(hook func(ConnectionRecord)) {
+	l.hook = hook
+}
+
+// start begins a record for a connection to address
+func (l *connectionLog) start(protocol, address string) *ConnectionRecord {
+	host, port := splitAddress(address)
+	return &ConnectionRecord{
+		Time:     time.Now(),
+		Protocol: protocol,
+		Host:     host,
+		Port:     port,
+		Decision: "allow",
+	}
+}
+
+// finish completes a record and passes it to the hook
+func (l *connectionLog) finish(r *ConnectionRecord) {
+	if l.hook == nil {
+		return
+	}
+	r.DurationMs = time.Since(r.Time).Milliseconds()
+	l.hook(*r)
+}
+
+// deny marks a record as denied by rule
+func (r *ConnectionRecord) deny(rule string) {
+	r.Decision = "deny"
+	r.Rule = rule
+}
+
+// fail notes why an allowed connection failed. Addresses denied after
+// resolving are denials rather than failures.
+func (r *ConnectionRecord) fail(err error) {
+	if rule := deniedRule(err); rule != "" {
+		r.deny(rule)
+		return
+	}
+	r.Error = err.Error()
+}
+
+// remoteIP returns the IP of a connection's remote address
+func remoteIP(conn net.Conn) string {
+	switch addr := conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		return addr.IP.String()
+	case *net.UDPAddr:
+		return addr.IP.String()
+	}
+	return ""
+}
+
+// countingConn counts the bytes read from and written to a connection, and
+// calls onClose once when it is closed. Bytes are charged to the quota lease,
+// and the connection is cut when it goes over.
+type countingConn struct {
+	net.Conn
+	read       atomic.Int64
+	written    atomic.Int64
+	lease      *quotaLease
+	clientSide bool // Reads come from the sandboxed client, rather than the destination
+	closeOnce  sync.Once
+	onClose    func(c *countingConn)
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 && !c.transfer(n, 0) {
+		c.Conn.Close()
+		return 0, errQuotaExceeded
+	}
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	if !c.transfer(0, len(p)) {
+		c.Conn.Close()
+		return 0, errQuotaExceeded
+	}
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+// transfer charges bytes read and written to the lease
+func (c *countingConn) transfer(read, written int) bool {
+	if c.clientSide {
+		return c.lease.transfer(int64(read), int64(written))
+	}
+	return c.lease.transfer(int64(written), int64(read))
+}
+
+func (c *countingConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		if c.onClose != nil {
+			c.onClose(c)
+		}
+	})
+	return err
+}
+
+// CloseWrite half-closes the connection when it supports it, so relays can
+// signal the end of one direction
+func (c *countingConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// countingReader counts the bytes read through it, charging them to the
+// quota lease as sent up or down
+type countingReader struct {
+	io.ReadCloser
+	n     int64
+	lease *quotaLease
+	up    bool
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 && !r.transfer(int64(n)) {
+		return 0, errQuotaExceeded
+	}
+	r.n += int64(n)
+	return n, err
+}
+
+func (r *countingReader) transfer(n int64) bool {
+	if r.up {
+		return r.lease.transfer(n, 0)
+	}
+	return r.lease.transfer(0, n)
+}
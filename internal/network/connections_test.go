@@ -0,0 +1,204 @@
+package network
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// echoListener answers each connection's first read with the same bytes,
+// then closes it
+func echoListener(t *testing.T) int {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 64)
+				n, _ := conn.Read(buf)
+				conn.Write(buf[:n])
+			}()
+		}
+	}()
+
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// recordHook returns a connection hook and the channel it sends records on
+func recordHook() (func(ConnectionRecord), chan ConnectionRecord) {
+	records := make(chan ConnectionRecord, 8)
+	return func(r ConnectionRecord) { records <- r }, records
+}
+
+func nextRecord(t *testing.T, records chan ConnectionRecord) ConnectionRecord {
+	t.Helper()
+
+	select {
+	case r := <-records:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("No connection record")
+		return ConnectionRecord{}
+	}
+}
+
+// checkRecord compares the fields of a record that don't vary between runs
+func checkRecord(t *testing.T, got, want ConnectionRecord) {
+	t.Helper()
+
+	if got.Time.IsZero() || got.DurationMs < 0 {
+		t.Errorf("Record time = %v, duration = %dms", got.Time, got.DurationMs)
+	}
+	got.Time, got.DurationMs = time.Time{}, 0
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Record = %+v\nwant %+v", got, want)
+	}
+}
+
+func TestHTTPProxyRecordsConnections(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		io.WriteString(w, "hello")
+	}))
+	defer upstream.Close()
+	upstreamPort := upstream.Listener.Addr().(*net.TCPAddr).Port
+	echoPort := echoListener(t)
+
+	p, err := NewHTTPProxy(proxyTestFilter(t, true), 0)
+	if err != nil {
+		t.Fatalf("NewHTTPProxy() error = %v", err)
+	}
+	p.SetResolver(newStaticResolver(map[string][]string{"app.test": {"127.0.0.1"}}))
+	hook, records := recordHook()
+	p.SetConnectionHook(hook)
+	go p.Start()
+	defer p.Stop()
+
+	proxyURL, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", p.Port()))
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	t.Run("plain HTTP", func(t *testing.T) {
+		resp, err := client.Post(fmt.Sprintf("http://app.test:%d/upload", upstreamPort), "text/plain", strings.NewReader("data"))
+		if err != nil {
+			t.Fatalf("Post() error = %v", err)
+		}
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		checkRecord(t, nextRecord(t, records), ConnectionRecord{
+			Protocol: ProtocolHTTP, Host: "app.test", Port: upstreamPort, IP: "127.0.0.1",
+			Decision: "allow", Rule: "allowedDomains:app.test", BytesUp: 4, BytesDown: 5,
+			Method: "POST", Path: "/upload", Status: http.StatusOK,
+		})
+	})
+
+	t.Run("denied domain", func(t *testing.T) {
+		resp, err := client.Get("http://other.test/")
+		if err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+		resp.Body.Close()
+
+		checkRecord(t, nextRecord(t, records), ConnectionRecord{
+			Protocol: ProtocolHTTP, Host: "other.test", Port: 80,
+			Decision: "deny", Rule: "defaultPolicy:deny",
+			Method: "GET", Path: "/", Status: http.StatusForbidden,
+		})
+	})
+
+	t.Run("tunnel", func(t *testing.T) {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", p.Port()))
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		defer conn.Close()
+
+		fmt.Fprintf(conn, "CONNECT app.test:%d HTTP/1.1\r\nHost: app.test:%d\r\n\r\n", echoPort, echoPort)
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("CONNECT response = %v, %v", resp, err)
+		}
+		io.WriteString(conn, "hello")
+		reply, _ := io.ReadAll(reader)
+		if string(reply) != "hello" {
+			t.Fatalf("Reply = %q, want hello", reply)
+		}
+
+		checkRecord(t, nextRecord(t, records), ConnectionRecord{
+			Protocol: ProtocolConnect, Host: "app.test", Port: echoPort, IP: "127.0.0.1",
+			Decision: "allow", Rule: "allowedDomains:app.test", BytesUp: 5, BytesDown: 5,
+		})
+	})
+}
+
+func TestSOCKSProxyRecordsConnections(t *testing.T) {
+	echoPort := echoListener(t)
+
+	p, err := NewSOCKSProxy(proxyTestFilter(t, true), 0)
+	if err != nil {
+		t.Fatalf("NewSOCKSProxy() error = %v", err)
+	}
+	p.SetResolver(newStaticResolver(map[string][]string{"app.test": {"127.0.0.1"}}))
+	hook, records := recordHook()
+	p.SetConnectionHook(hook)
+	go p.Start()
+	defer p.Stop()
+
+	client, err := proxy.SOCKS5("tcp", fmt.Sprintf("127.0.0.1:%d", p.Port()), nil, proxy.Direct)
+	if err != nil {
+		t.Fatalf("SOCKS5() error = %v", err)
+	}
+
+	t.Run("allowed", func(t *testing.T) {
+		conn, err := client.Dial("tcp", net.JoinHostPort("app.test", strconv.Itoa(echoPort)))
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		io.WriteString(conn, "hello")
+		reply, _ := io.ReadAll(conn)
+		conn.Close()
+		if string(reply) != "hello" {
+			t.Fatalf("Reply = %q, want hello", reply)
+		}
+
+		checkRecord(t, nextRecord(t, records), ConnectionRecord{
+			Protocol: ProtocolSOCKS, Host: "app.test", Port: echoPort, IP: "127.0.0.1",
+			Decision: "allow", Rule: "allowedDomains:app.test", BytesUp: 5, BytesDown: 5,
+		})
+	})
+
+	t.Run("denied", func(t *testing.T) {
+		if conn, err := client.Dial("tcp", "other.test:443"); err == nil {
+			conn.Close()
+			t.Fatal("Dial() succeeded, want other.test denied")
+		}
+
+		checkRecord(t, nextRecord(t, records), ConnectionRecord{
+			Protocol: ProtocolSOCKS, Host: "other.test", Port: 443,
+			Decision: "deny", Rule: "defaultPolicy:deny",
+		})
+	})
+}
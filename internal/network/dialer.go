@@ -0,0 +1,158 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dialTimeout bounds each connection attempt to a resolved address
+const dialTimeout = 10 * time.Second
+
+// ErrAddressDenied is returned when a host name resolves to an address the
+// policy denies
+var ErrAddressDenied = errors.New("resolved address denied by sandbox policy")
+
+// AddressDeniedError is returned with the rule that denied a resolved
+// address. It matches ErrAddressDenied with errors.Is.
+type AddressDeniedError struct {
+	Host string
+	Rule string
+}
+
+func (e *AddressDeniedError) Error() string {
+	return fmt.Sprintf("%s: %s (%s)", e.Host, ErrAddressDenied, e.Rule)
+}
+
+// Is reports whether target is ErrAddressDenied
+func (e *AddressDeniedError) Is(target error) bool {
+	return target == ErrAddressDenied
+}
+
+// deniedRule returns the rule from an AddressDeniedError in err, or ""
+func deniedRule(err error) string {
+	var denied *AddressDeniedError
+	if errors.As(err, &denied) {
+		return denied.Rule
+	}
+	return ""
+}
+
+// Resolver looks up the addresses of a host name. *net.Resolver implements it.
+type Resolver interface {
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+// Dialer connects the proxies to their destinations. Host names are resolved
+// once and every address is checked against the filter's address rules, then
+// an address is dialled directly, so a second lookup can't return a
+// different, unchecked answer (DNS rebinding).
+type Dialer struct {
+	filter   *DomainFilter
+	resolver Resolver
+	upstream *Upstream // Nil to connect directly
+	timeout  time.Duration
+}
+
+// NewDialer creates a dialer using the system resolver
+func NewDialer(filter *DomainFilter) *Dialer {
+	return &Dialer{
+		filter:   filter,
+		resolver: net.DefaultResolver,
+		timeout:  dialTimeout,
+	}
+}
+
+// SetResolver replaces the resolver, e.g. with a fixed table in tests. It must
+// be called before the proxies start.
+func (d *Dialer) SetResolver(r Resolver) {
+	d.resolver = r
+}
+
+// SetUpstream sends connections through an upstream proxy, except those its
+// noProxy entries exclude. It must be called before the proxies start.
+func (d *Dialer) SetUpstream(u *Upstream) {
+	d.upstream = u
+}
+
+// DialContext connects to address ("host:port"). Literal IP addresses have
+// already been checked by the filter and are dialled as they are. Through an
+// upstream proxy, host names are resolved and checked the same way and the
+// upstream is sent a checked address, unless it resolves names itself.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %q", address)
+	}
+
+	viaUpstream := d.upstream != nil && !d.upstream.bypasses(host, port)
+	if viaUpstream && strings.HasPrefix(network, "udp") {
+		return nil, fmt.Errorf("upstream proxy can't carry UDP to %s", address)
+	}
+
+	// The upstream looks the name up where the local resolver may not be able to
+	if _, isIP := parseIP(host); viaUpstream && d.upstream.remoteDNS && !isIP {
+		return d.upstream.dial(ctx, network, address)
+	}
+
+	addrs, err := d.resolve(ctx, host, port)
+	if err != nil {
+		return nil, err
+	}
+
+	connect := (&net.Dialer{Timeout: d.timeout}).DialContext
+	if viaUpstream {
+		connect = d.upstream.dial
+	}
+	return dialEach(ctx, network, addrs, port, connect)
+}
+
+// resolve returns the addresses host resolves to once the filter's address
+// rules have allowed them all. A literal IP address is returned as it is.
+func (d *Dialer) resolve(ctx context.Context, host string, port int) ([]netip.Addr, error) {
+	if addr, ok := parseIP(host); ok {
+		return []netip.Addr{addr}, nil
+	}
+
+	addrs, err := d.resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", host, err)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("failed to resolve %s: no addresses", host)
+	}
+
+	slog.Debug("Proxy resolved destination", "host", host, "addresses", addrs)
+
+	if allowed, rule := d.filter.AllowResolved(host, port, addrs); !allowed {
+		return nil, &AddressDeniedError{Host: host, Rule: rule}
+	}
+
+	return addrs, nil
+}
+
+// dialEach tries each address in turn with connect, returning the first
+// connection made
+func dialEach(ctx context.Context, network string, addrs []netip.Addr, port int,
+	connect func(ctx context.Context, network, address string) (net.Conn, error)) (net.Conn, error) {
+	var lastErr error
+	for _, addr := range addrs {
+		conn, err := connect(ctx, network, netip.AddrPortFrom(addr, uint16(port)).String())
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+
+	return nil, lastErr
+}
@@ -0,0 +1,284 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/proxy"
+)
+
+// staticResolver answers lookups from a fixed table and counts them
+type staticResolver struct {
+	mu      sync.Mutex
+	hosts   map[string][]netip.Addr
+	lookups map[string]int
+}
+
+func newStaticResolver(hosts map[string][]string) *staticResolver {
+	r := &staticResolver{hosts: make(map[string][]netip.Addr), lookups: make(map[string]int)}
+	for host, addrs := range hosts {
+		for _, addr := range addrs {
+			r.hosts[host] = append(r.hosts[host], netip.MustParseAddr(addr))
+		}
+	}
+	return r
+}
+
+func (r *staticResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.lookups[host]++
+	addrs, ok := r.hosts[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+func (r *staticResolver) count(host string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lookups[host]
+}
+
+// localListener accepts and closes connections on a loopback port
+func localListener(t *testing.T) int {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestDialerChecksResolvedAddresses(t *testing.T) {
+	port := localListener(t)
+
+	tests := []struct {
+		name         string
+		addrs        []string
+		allowedCIDRs []string
+		deniedCIDRs  []string
+		reportOnly   bool
+		wantDenied   bool
+		wantRule     string
+	}{
+		{
+			name:       "name rebound to loopback",
+			addrs:      []string{"127.0.0.1"},
+			wantDenied: true,
+			wantRule:   "protected:loopback 127.0.0.0/8 (resolved 127.0.0.1)",
+		},
+		{
+			name:         "loopback explicitly allowed",
+			addrs:        []string{"127.0.0.1"},
+			allowedCIDRs: []string{"127.0.0.1"},
+		},
+		{
+			name:         "any denied address fails the lookup",
+			addrs:        []string{"127.0.0.1", "169.254.169.254"},
+			allowedCIDRs: []string{"127.0.0.1"},
+			wantDenied:   true,
+			wantRule:     "protected:link-local 169.254.0.0/16 (resolved 169.254.169.254)",
+		},
+		{
+			name:         "denied range beats allowed range",
+			addrs:        []string{"127.0.0.1"},
+			allowedCIDRs: []string{"127.0.0.0/8"},
+			deniedCIDRs:  []string{"127.0.0.1"},
+			wantDenied:   true,
+			wantRule:     "deniedCIDRs:127.0.0.1/32 (resolved 127.0.0.1)",
+		},
+		{
+			name:       "report-only connects and reports",
+			addrs:      []string{"127.0.0.1"},
+			reportOnly: true,
+			wantRule:   "protected:loopback 127.0.0.0/8 (resolved 127.0.0.1)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := NewDomainFilter("deny", []string{"app.test"}, nil)
+			if err != nil {
+				t.Fatalf("NewDomainFilter() error = %v", err)
+			}
+			if err := filter.SetCIDRs(tt.allowedCIDRs, tt.deniedCIDRs); err != nil {
+				t.Fatalf("SetCIDRs() error = %v", err)
+			}
+			filter.SetReportOnly(tt.reportOnly)
+
+			var rules []string
+			filter.SetDecisionHook(func(d Decision) { rules = append(rules, d.Rule) })
+
+			dialer := NewDialer(filter)
+			dialer.SetResolver(newStaticResolver(map[string][]string{"app.test": tt.addrs}))
+
+			conn, err := dialer.DialContext(context.Background(), "tcp", net.JoinHostPort("app.test", strconv.Itoa(port)))
+			if conn != nil {
+				conn.Close()
+			}
+
+			if tt.wantDenied {
+				if !errors.Is(err, ErrAddressDenied) {
+					t.Errorf("DialContext() error = %v, want ErrAddressDenied", err)
+				}
+			} else if err != nil {
+				t.Errorf("DialContext() error = %v", err)
+			}
+
+			if tt.wantRule != "" && (len(rules) != 1 || rules[0] != tt.wantRule) {
+				t.Errorf("Hook rules = %q, want [%q]", rules, tt.wantRule)
+			}
+			if tt.wantRule == "" && len(rules) != 0 {
+				t.Errorf("Hook rules = %q, want none", rules)
+			}
+		})
+	}
+}
+
+// proxyTestFilter allows app.test, optionally reaching it on loopback
+func proxyTestFilter(t *testing.T, allowLoopback bool) *DomainFilter {
+	t.Helper()
+
+	filter, err := NewDomainFilter("deny", []string{"app.test"}, nil)
+	if err != nil {
+		t.Fatalf("NewDomainFilter() error = %v", err)
+	}
+	if allowLoopback {
+		if err := filter.SetCIDRs([]string{"127.0.0.1"}, nil); err != nil {
+			t.Fatalf("SetCIDRs() error = %v", err)
+		}
+	}
+	return filter
+}
+
+func TestHTTPProxyDialsResolvedAddress(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer upstream.Close()
+	upstreamPort := upstream.Listener.Addr().(*net.TCPAddr).Port
+
+	for _, allowLoopback := range []bool{true, false} {
+		t.Run(fmt.Sprintf("allowLoopback=%v", allowLoopback), func(t *testing.T) {
+			resolver := newStaticResolver(map[string][]string{"app.test": {"127.0.0.1"}})
+
+			p, err := NewHTTPProxy(proxyTestFilter(t, allowLoopback), 0)
+			if err != nil {
+				t.Fatalf("NewHTTPProxy() error = %v", err)
+			}
+			p.SetResolver(resolver)
+			go p.Start()
+			defer p.Stop()
+
+			proxyURL, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", p.Port()))
+			client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+			resp, err := client.Get(fmt.Sprintf("http://app.test:%d/", upstreamPort))
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			wantStatus := http.StatusForbidden
+			if allowLoopback {
+				wantStatus = http.StatusOK
+			}
+			if resp.StatusCode != wantStatus {
+				t.Errorf("Status = %d (%q), want %d", resp.StatusCode, body, wantStatus)
+			}
+			if resolver.count("app.test") != 1 {
+				t.Errorf("Resolved app.test %d times, want once", resolver.count("app.test"))
+			}
+		})
+	}
+}
+
+func TestSOCKSProxyDialsResolvedAddress(t *testing.T) {
+	port := localListener(t)
+
+	for _, allowLoopback := range []bool{true, false} {
+		t.Run(fmt.Sprintf("allowLoopback=%v", allowLoopback), func(t *testing.T) {
+			resolver := newStaticResolver(map[string][]string{"app.test": {"127.0.0.1"}})
+
+			p, err := NewSOCKSProxy(proxyTestFilter(t, allowLoopback), 0)
+			if err != nil {
+				t.Fatalf("NewSOCKSProxy() error = %v", err)
+			}
+			p.SetResolver(resolver)
+			go p.Start()
+			defer p.Stop()
+
+			client, err := proxy.SOCKS5("tcp", fmt.Sprintf("127.0.0.1:%d", p.Port()), nil, proxy.Direct)
+			if err != nil {
+				t.Fatalf("SOCKS5() error = %v", err)
+			}
+
+			conn, err := client.Dial("tcp", net.JoinHostPort("app.test", strconv.Itoa(port)))
+			if conn != nil {
+				conn.Close()
+			}
+
+			if allowLoopback && err != nil {
+				t.Errorf("Dial() error = %v", err)
+			}
+			if !allowLoopback && err == nil {
+				t.Error("Dial() succeeded, want the loopback address denied")
+			}
+			if resolver.count("app.test") != 1 {
+				t.Errorf("Resolved app.test %d times, want once", resolver.count("app.test"))
+			}
+		})
+	}
+}
+
+func TestSOCKSProxyDoesNotResolveDeniedNames(t *testing.T) {
+	resolver := newStaticResolver(map[string][]string{"other.test": {"127.0.0.1"}})
+
+	p, err := NewSOCKSProxy(proxyTestFilter(t, true), 0)
+	if err != nil {
+		t.Fatalf("NewSOCKSProxy() error = %v", err)
+	}
+	p.SetResolver(resolver)
+	go p.Start()
+	defer p.Stop()
+
+	client, err := proxy.SOCKS5("tcp", fmt.Sprintf("127.0.0.1:%d", p.Port()), nil, proxy.Direct)
+	if err != nil {
+		t.Fatalf("SOCKS5() error = %v", err)
+	}
+
+	if conn, err := client.Dial("tcp", "other.test:80"); err == nil {
+		conn.Close()
+		t.Fatal("Dial() succeeded for a denied name")
+	}
+	if resolver.count("other.test") != 0 {
+		t.Error("Denied name was resolved")
+	}
+}
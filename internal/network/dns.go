@@ -0,0 +1,287 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsTTL is the time to live of every answer
+const dnsTTL = 60 * time.Second
+
+// maxDNSAnswers keeps responses within the 512 bytes of a plain UDP reply
+const maxDNSAnswers = 8
+
+// dnsLookupTimeout bounds the lookup behind each query
+const dnsLookupTimeout = 5 * time.Second
+
+// dnsAnswerLifetime is how long an answered address keeps its name. Clients
+// may cache an answer for the whole TTL and connect a little later.
+const dnsAnswerLifetime = 2 * dnsTTL
+
+// maxDNSAnswerEntries bounds the addresses remembered, the soonest to
+// expire are forgotten first
+const maxDNSAnswerEntries = 4096
+
+// maxDNSQueries bounds the queries answered at once, later ones are dropped
+// and the client retries
+const maxDNSQueries = 64
+
+// DNSServer answers the sandbox's DNS queries for names the filter allows,
+// and NXDOMAIN for every other name. Addresses are looked up with the
+// resolver and checked like the proxies' destinations, and each address
+// answered with is remembered with its name for the SOCKS proxy.
+type DNSServer struct {
+	port     int
+	filter   *DomainFilter
+	resolver Resolver
+	conn     *net.UDPConn
+	answers  *dnsAnswers
+	connectionLog
+}
+
+// dnsAnswers remembers the name each answered address was looked up for,
+// until the answer expires. Only allowed names are answered, so every name
+// kept is an allowed one.
+type dnsAnswers struct {
+	mu    sync.RWMutex
+	names map[netip.Addr]dnsAnswer // The most recent answer with the address
+}
+
+// dnsAnswer is the name an address was answered for
+type dnsAnswer struct {
+	name    string
+	expires time.Time
+}
+
+// NewDNSServer creates a DNS server on a UDP loopback port
+func NewDNSServer(filter *DomainFilter, port int) (*DNSServer, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create DNS listener: %w", err)
+	}
+
+	return &DNSServer{
+		port:     conn.LocalAddr().(*net.UDPAddr).Port,
+		filter:   filter,
+		resolver: net.DefaultResolver,
+		conn:     conn,
+		answers:  &dnsAnswers{names: make(map[netip.Addr]dnsAnswer)},
+	}, nil
+}
+
+// Port returns the server's UDP port
+func (s *DNSServer) Port() int {
+	return s.port
+}
+
+// SetResolver replaces the resolver used for answers, it must be called before Start
+func (s *DNSServer) SetResolver(r Resolver) {
+	s.resolver = r
+}
+
+// NameFor returns the name the server recently answered with addr, if it has
+func (s *DNSServer) NameFor(addr netip.Addr) (string, bool) {
+	return s.answers.name(addr, time.Now())
+}
+
+// Start answers queries until the server is stopped
+func (s *DNSServer) Start() error {
+	slog.Debug("DNS server starting", "port", s.port)
+
+	buf := make([]byte, maxDatagramSize)
+	queries := make(chan struct{}, maxDNSQueries)
+	for {
+		n, client, err := s.conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("failed to read DNS query: %w", err)
+		}
+
+		select {
+		case queries <- struct{}{}:
+		default:
+			slog.Debug("DNS server busy, dropped query", "client", client)
+			continue
+		}
+
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			defer func() { <-queries }()
+			if reply := s.answer(query); reply != nil {
+				s.conn.WriteToUDPAddrPort(reply, client)
+			}
+		}()
+	}
+}
+
+// Stop stops the server
+func (s *DNSServer) Stop() error {
+	return s.conn.Close()
+}
+
+// answer builds the reply to a query, or returns nil for messages that
+// aren't queries
+func (s *DNSServer) answer(query []byte) []byte {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil || header.Response {
+		return nil
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return dnsReply(header, nil, dnsmessage.RCodeFormatError, nil)
+	}
+	if header.OpCode != 0 {
+		return dnsReply(header, &question, dnsmessage.RCodeNotImplemented, nil)
+	}
+
+	name := strings.TrimSuffix(strings.ToLower(question.Name.String()), ".")
+	record := s.start(ProtocolDNS, name)
+	record.QueryType = strings.TrimPrefix(question.Type.String(), "Type")
+	defer s.finish(record)
+
+	rcode, addrs := s.resolve(record, name, question.Type)
+	slog.Debug("DNS query", "name", name, "type", record.QueryType, "decision", record.Decision, "rule", record.Rule, "answers", record.Answers)
+	return dnsReply(header, &question, rcode, addrs)
+}
+
+// resolve decides a query, filling in its record, and returns the response
+// code and the addresses to answer with
+func (s *DNSServer) resolve(record *ConnectionRecord, name string, qtype dnsmessage.Type) (dnsmessage.RCode, []netip.Addr) {
+	allowed, rule := s.filter.Allow(name)
+	record.Rule = rule
+	if !allowed {
+		record.deny(rule)
+		return dnsmessage.RCodeNameError, nil
+	}
+
+	// Other types are answered with no records, as the resolver only
+	// looks up addresses
+	if qtype != dnsmessage.TypeA && qtype != dnsmessage.TypeAAAA {
+		return dnsmessage.RCodeSuccess, nil
+	}
+
+	// Both families are looked up and checked, as the dialer does, so a
+	// name without addresses of the type asked for still exists
+	ctx, cancel := context.WithTimeout(context.Background(), dnsLookupTimeout)
+	defer cancel()
+	resolved, err := s.resolver.LookupNetIP(ctx, "ip", name)
+	if err != nil {
+		record.fail(err)
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return dnsmessage.RCodeNameError, nil
+		}
+		return dnsmessage.RCodeServerFailure, nil
+	}
+
+	if allowed, rule := s.filter.AllowResolved(name, 0, resolved); !allowed {
+		record.deny(rule)
+		return dnsmessage.RCodeNameError, nil
+	}
+
+	var addrs []netip.Addr
+	for _, addr := range resolved {
+		addr = addr.Unmap()
+		if addr.Is4() == (qtype == dnsmessage.TypeA) {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) > maxDNSAnswers {
+		addrs = addrs[:maxDNSAnswers]
+	}
+	for _, addr := range addrs {
+		record.Answers = append(record.Answers, addr.String())
+	}
+	s.answers.add(name, addrs, time.Now())
+	return dnsmessage.RCodeSuccess, addrs
+}
+
+// dnsReply builds a response to the query with header and question
+func dnsReply(query dnsmessage.Header, question *dnsmessage.Question, rcode dnsmessage.RCode, addrs []netip.Addr) []byte {
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 query.ID,
+		Response:           true,
+		OpCode:             query.OpCode,
+		RecursionDesired:   query.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+	builder.EnableCompression()
+
+	if question != nil {
+		builder.StartQuestions()
+		builder.Question(*question)
+		builder.StartAnswers()
+
+		resource := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: uint32(dnsTTL.Seconds())}
+		for _, addr := range addrs {
+			if addr.Is4() {
+				builder.AResource(resource, dnsmessage.AResource{A: addr.As4()})
+			} else {
+				builder.AAAAResource(resource, dnsmessage.AAAAResource{AAAA: addr.As16()})
+			}
+		}
+	}
+
+	reply, err := builder.Finish()
+	if err != nil {
+		slog.Debug("Failed to build DNS reply", "error", err)
+		return nil
+	}
+	return reply
+}
+
+// add remembers that name was answered with addrs at now
+func (a *dnsAnswers) add(name string, addrs []netip.Addr, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	answer := dnsAnswer{name: name, expires: now.Add(dnsAnswerLifetime)}
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+		if _, ok := a.names[addr]; !ok && len(a.names) >= maxDNSAnswerEntries {
+			a.evict(now)
+		}
+		a.names[addr] = answer
+	}
+}
+
+// evict forgets expired answers, or the one expiring soonest if none have
+func (a *dnsAnswers) evict(now time.Time) {
+	var soonest netip.Addr
+	for addr, answer := range a.names {
+		if !answer.expires.After(now) {
+			delete(a.names, addr)
+			continue
+		}
+		if !soonest.IsValid() || answer.expires.Before(a.names[soonest].expires) {
+			soonest = addr
+		}
+	}
+	if len(a.names) >= maxDNSAnswerEntries {
+		delete(a.names, soonest)
+	}
+}
+
+// name returns the name last answered with addr, unless it expired before now
+func (a *dnsAnswers) name(addr netip.Addr, now time.Time) (string, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	answer, ok := a.names[addr.Unmap()]
+	if !ok || !answer.expires.After(now) {
+		return "", false
+	}
+	return answer.name, true
+}
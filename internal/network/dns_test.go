@@ -0,0 +1,318 @@
+package network
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"reflect"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/armon/go-socks5"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsTestServer starts a DNS server allowing app.test, internal.test and
+// missing.test, with app.test resolving to documentation addresses. Records
+// go to hook, if set.
+func dnsTestServer(t *testing.T, hook func(ConnectionRecord)) *DNSServer {
+	t.Helper()
+
+	filter, err := NewDomainFilter("deny", []string{"app.test", "internal.test", "missing.test"}, nil)
+	if err != nil {
+		t.Fatalf("NewDomainFilter() error = %v", err)
+	}
+	s, err := NewDNSServer(filter, 0)
+	if err != nil {
+		t.Fatalf("NewDNSServer() error = %v", err)
+	}
+	s.SetResolver(newStaticResolver(map[string][]string{
+		"app.test":      {"198.51.100.7", "2001:db8::7"},
+		"internal.test": {"10.0.0.5"},
+	}))
+	s.SetConnectionHook(hook)
+	go s.Start()
+	t.Cleanup(func() { s.Stop() })
+	return s
+}
+
+// dnsQuery sends one query to the server, returning the response code and
+// the addresses answered
+func dnsQuery(t *testing.T, port int, name string, qtype dnsmessage.Type) (dnsmessage.RCode, []string) {
+	t.Helper()
+
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 42, RecursionDesired: true})
+	builder.StartQuestions()
+	builder.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET})
+	query, err := builder.Finish()
+	if err != nil {
+		t.Fatalf("Building query error = %v", err)
+	}
+
+	conn, err := net.Dial("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(query); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	buf := make([]byte, 512)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(buf[:n]); err != nil {
+		t.Fatalf("Unpack() error = %v", err)
+	}
+	if msg.ID != 42 || !msg.Response || len(msg.Questions) != 1 {
+		t.Fatalf("Reply header = %+v, questions = %d", msg.Header, len(msg.Questions))
+	}
+
+	var answers []string
+	for _, answer := range msg.Answers {
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			answers = append(answers, netip.AddrFrom4(body.A).String())
+		case *dnsmessage.AAAAResource:
+			answers = append(answers, netip.AddrFrom16(body.AAAA).String())
+		}
+	}
+	return msg.RCode, answers
+}
+
+func TestDNSServerAnswers(t *testing.T) {
+	hook, records := recordHook()
+	s := dnsTestServer(t, hook)
+
+	tests := []struct {
+		name        string
+		query       string
+		qtype       dnsmessage.Type
+		wantRCode   dnsmessage.RCode
+		wantAnswers []string
+		wantRecord  ConnectionRecord
+	}{
+		{
+			name:        "allowed IPv4",
+			query:       "app.test.",
+			qtype:       dnsmessage.TypeA,
+			wantRCode:   dnsmessage.RCodeSuccess,
+			wantAnswers: []string{"198.51.100.7"},
+			wantRecord: ConnectionRecord{Protocol: ProtocolDNS, Host: "app.test", Decision: "allow", Rule: "allowedDomains:app.test",
+				QueryType: "A", Answers: []string{"198.51.100.7"}},
+		},
+		{
+			name:        "allowed IPv6, any case",
+			query:       "APP.test.",
+			qtype:       dnsmessage.TypeAAAA,
+			wantRCode:   dnsmessage.RCodeSuccess,
+			wantAnswers: []string{"2001:db8::7"},
+			wantRecord: ConnectionRecord{Protocol: ProtocolDNS, Host: "app.test", Decision: "allow", Rule: "allowedDomains:app.test",
+				QueryType: "AAAA", Answers: []string{"2001:db8::7"}},
+		},
+		{
+			name:       "other types have no answers",
+			query:      "app.test.",
+			qtype:      dnsmessage.TypeMX,
+			wantRCode:  dnsmessage.RCodeSuccess,
+			wantRecord: ConnectionRecord{Protocol: ProtocolDNS, Host: "app.test", Decision: "allow", Rule: "allowedDomains:app.test", QueryType: "MX"},
+		},
+		{
+			name:       "denied name",
+			query:      "other.test.",
+			qtype:      dnsmessage.TypeA,
+			wantRCode:  dnsmessage.RCodeNameError,
+			wantRecord: ConnectionRecord{Protocol: ProtocolDNS, Host: "other.test", Decision: "deny", Rule: "defaultPolicy:deny", QueryType: "A"},
+		},
+		{
+			name:      "denied address",
+			query:     "internal.test.",
+			qtype:     dnsmessage.TypeA,
+			wantRCode: dnsmessage.RCodeNameError,
+			wantRecord: ConnectionRecord{Protocol: ProtocolDNS, Host: "internal.test", Decision: "deny",
+				Rule: "protected:private 10.0.0.0/8 (resolved 10.0.0.5)", QueryType: "A"},
+		},
+		{
+			name:      "no such name",
+			query:     "missing.test.",
+			qtype:     dnsmessage.TypeA,
+			wantRCode: dnsmessage.RCodeNameError,
+			wantRecord: ConnectionRecord{Protocol: ProtocolDNS, Host: "missing.test", Decision: "allow", Rule: "allowedDomains:missing.test",
+				QueryType: "A", Error: "lookup missing.test: no such host"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rcode, answers := dnsQuery(t, s.Port(), tt.query, tt.qtype)
+			if rcode != tt.wantRCode || !reflect.DeepEqual(answers, tt.wantAnswers) {
+				t.Errorf("Reply = %v %q, want %v %q", rcode, answers, tt.wantRCode, tt.wantAnswers)
+			}
+			checkRecord(t, nextRecord(t, records), tt.wantRecord)
+		})
+	}
+
+	if name, ok := s.NameFor(netip.MustParseAddr("198.51.100.7")); !ok || name != "app.test" {
+		t.Errorf("NameFor(198.51.100.7) = %q, %v, want app.test", name, ok)
+	}
+	if name, ok := s.NameFor(netip.MustParseAddr("10.0.0.5")); ok {
+		t.Errorf("NameFor(10.0.0.5) = %q, want no name for a denied answer", name)
+	}
+}
+
+func TestSOCKSProxyNamesDNSAnswers(t *testing.T) {
+	s := dnsTestServer(t, nil)
+	dnsQuery(t, s.Port(), "app.test.", dnsmessage.TypeA)
+
+	p, err := NewSOCKSProxy(s.filter, 0)
+	if err != nil {
+		t.Fatalf("NewSOCKSProxy() error = %v", err)
+	}
+	defer p.Stop()
+	p.SetDNSServer(s)
+	hook, records := recordHook()
+	p.SetConnectionHook(hook)
+
+	request := func(ip string) *socks5.Request {
+		return &socks5.Request{Command: socks5.ConnectCommand, DestAddr: &socks5.AddrSpec{IP: net.ParseIP(ip), Port: 443}}
+	}
+
+	// An address the DNS server answered with is checked as its name
+	ctx, allowed := p.rules.Allow(context.Background(), request("198.51.100.7"))
+	if !allowed {
+		t.Fatal("Allow() denied an address answered for app.test")
+	}
+	sc := ctx.Value(socksConnectionKey{}).(*socksConnection)
+	if sc.record.Host != "app.test" || sc.record.Rule != "allowedDomains:app.test" {
+		t.Errorf("Record = %+v, want app.test", sc.record)
+	}
+
+	if _, allowed := p.rules.Allow(context.Background(), request("198.51.100.8")); allowed {
+		t.Error("Allow() allowed an address the DNS server didn't answer with")
+	}
+	if r := nextRecord(t, records); r.Host != "198.51.100.8" || r.Decision != "deny" {
+		t.Errorf("Record = %+v, want 198.51.100.8 denied", r)
+	}
+}
+
+func TestDNSAnswersExpire(t *testing.T) {
+	answers := &dnsAnswers{names: make(map[netip.Addr]dnsAnswer)}
+	now := time.Now()
+	addr := netip.MustParseAddr("198.51.100.7")
+	answers.add("app.test", []netip.Addr{addr}, now)
+
+	tests := []struct {
+		name   string
+		at     time.Time
+		wantOK bool
+	}{
+		{name: "fresh", at: now, wantOK: true},
+		{name: "cached for the TTL", at: now.Add(dnsTTL), wantOK: true},
+		{name: "expired", at: now.Add(dnsAnswerLifetime), wantOK: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, ok := answers.name(addr, tt.at)
+			if ok != tt.wantOK || (ok && name != "app.test") {
+				t.Errorf("name() = %q, %v, want ok %v", name, ok, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestDNSAnswersCapped(t *testing.T) {
+	answers := &dnsAnswers{names: make(map[netip.Addr]dnsAnswer)}
+	now := time.Now()
+	first := netip.AddrFrom4([4]byte{198, 51, 100, 0})
+	answers.add("first.test", []netip.Addr{first}, now)
+
+	// Later answers push the size past the cap, so the oldest is forgotten
+	for i := 1; i <= maxDNSAnswerEntries; i++ {
+		addr := netip.AddrFrom4([4]byte{10, byte(i >> 16), byte(i >> 8), byte(i)})
+		answers.add("app.test", []netip.Addr{addr}, now.Add(time.Duration(i)*time.Millisecond))
+	}
+
+	if len(answers.names) != maxDNSAnswerEntries {
+		t.Errorf("Remembered %d addresses, want %d", len(answers.names), maxDNSAnswerEntries)
+	}
+	if name, ok := answers.name(first, now); ok {
+		t.Errorf("name(first) = %q, want the oldest answer forgotten", name)
+	}
+}
+
+func TestDNSServerDropsQueriesWhenBusy(t *testing.T) {
+	filter, err := NewDomainFilter("deny", []string{"app.test"}, nil)
+	if err != nil {
+		t.Fatalf("NewDomainFilter() error = %v", err)
+	}
+	s, err := NewDNSServer(filter, 0)
+	if err != nil {
+		t.Fatalf("NewDNSServer() error = %v", err)
+	}
+	resolver := &blockingResolver{
+		Resolver: newStaticResolver(map[string][]string{"app.test": {"198.51.100.7"}}),
+		name:     "app.test",
+		release:  make(chan struct{}),
+	}
+	s.SetResolver(resolver)
+	go s.Start()
+	defer s.Stop()
+
+	conn, err := net.Dial("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(s.Port())))
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	query := func(id uint16, name string) {
+		t.Helper()
+		builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id})
+		builder.StartQuestions()
+		builder.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+		msg, _ := builder.Finish()
+		if _, err := conn.Write(msg); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+	replies := func(timeout time.Duration) []uint16 {
+		t.Helper()
+		var ids []uint16
+		buf := make([]byte, 512)
+		for {
+			conn.SetReadDeadline(time.Now().Add(timeout))
+			n, err := conn.Read(buf)
+			if err != nil {
+				return ids
+			}
+			var parser dnsmessage.Parser
+			if header, err := parser.Start(buf[:n]); err == nil {
+				ids = append(ids, header.ID)
+			}
+		}
+	}
+
+	// Every slot waits on a lookup, so a query that needs none is dropped
+	for i := range maxDNSQueries {
+		query(uint16(i), "app.test.")
+	}
+	time.Sleep(100 * time.Millisecond)
+	query(1000, "other.test.")
+	if got := replies(200 * time.Millisecond); len(got) != 0 {
+		t.Errorf("Replies while busy = %v, want none", got)
+	}
+
+	close(resolver.release)
+	if got := replies(500 * time.Millisecond); len(got) != maxDNSQueries || slices.Contains(got, 1000) {
+		t.Errorf("Replied to %d queries (%v), want the %d held ones only", len(got), got, maxDNSQueries)
+	}
+	query(1001, "other.test.")
+	if got := replies(500 * time.Millisecond); !reflect.DeepEqual(got, []uint16{1001}) {
+		t.Errorf("Replies once free = %v, want [1001]", got)
+	}
+}
@@ -1,6 +1,10 @@
 package network
 
 import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
 	"strings"
 
 	"github.com/gobwas/glob"
@@ -10,14 +14,67 @@ import (
 type DomainFilter struct {
 	allowed       []DomainPattern
 	denied        []DomainPattern
-	defaultPolicy string // "allow" or "deny"
+	defaultPolicy string      // "allow" or "deny"
+	defaultPorts  []PortRange // Ports permitted by allowed entries without ports, nil for any
+	allowedCIDRs  []netip.Prefix
+	deniedCIDRs   []netip.Prefix
+	missingSNI    string // "allow" or "deny" tunnels whose client sends no TLS server name
+	intercept     []DomainPattern
+	httpRules     []httpRule
+	quotas        *quotaTracker   // Nil without quotas
+	secrets       []secretBinding // Placeholders replaced in requests to their domains
+	reportOnly    bool            // Permit every request, reporting would-be denials to the hook
+	hook          func(Decision)
 }
 
-// DomainPattern represents a domain matching pattern
+// Decision is the outcome of checking a domain against the filter
+type Decision struct {
+	Domain  string
+	Port    int    // Destination port, 0 if the address had none
+	Allowed bool   // Whether the policy allows the domain
+	Rule    string // The rule that decided, e.g. "allowedDomains:*.github.com"
+
+	Method string // Set for decisions about a single HTTP request
+	Path   string
+
+	PortDenied bool // The domain is allowed, but not on this port
+
+	// Denied by the TLS server name check of an allowed tunnel, which
+	// allowing the domain would not fix
+	ServerNameCheck bool
+
+	Quota bool // Denied because a quota was used up
+
+	Secret bool // Denied for carrying a secret's placeholder to a domain it isn't bound to
+}
+
+// Address returns the domain with the port, if there was one
+func (d Decision) Address() string {
+	if d.Port == 0 {
+		return d.Domain
+	}
+	return net.JoinHostPort(d.Domain, strconv.Itoa(d.Port))
+}
+
+// PortRange is an inclusive range of ports
+type PortRange struct {
+	Low  int
+	High int
+}
+
+// Contains reports whether port is within the range
+func (r PortRange) Contains(port int) bool {
+	return port >= r.Low && port <= r.High
+}
+
+// DomainPattern represents a domain matching pattern, optionally limited to a
+// port or port range, e.g. "github.com:443" or "registry.local:8000-8100"
 type DomainPattern struct {
+	entry    string // Pattern as configured, including any port
 	pattern  string
 	isGlob   bool
 	compiled glob.Glob
+	ports    []PortRange // nil when the entry has no port
 }
 
 // NewDomainFilter creates a new domain filter
@@ -54,30 +111,226 @@ func NewDomainFilter(defaultPolicy string, allowedDomains, deniedDomains []strin
 	return filter, nil
 }
 
-// IsAllowed checks if a domain is allowed
-func (f *DomainFilter) IsAllowed(domain string) bool {
-	// Normalise domain (lowercase, strip port)
-	domain = normaliseDomain(domain)
+// SetDefaultPorts limits allowed entries without a port to the given ports
+// or ranges, e.g. "443" or "8000-8100". Without default ports such entries
+// allow every port. Denied entries without a port always match every port.
+func (f *DomainFilter) SetDefaultPorts(specs []string) error {
+	f.defaultPorts = nil
+	for _, spec := range specs {
+		r, err := ParsePortRange(spec)
+		if err != nil {
+			return fmt.Errorf("invalid default port %q: %w", spec, err)
+		}
+		f.defaultPorts = append(f.defaultPorts, r)
+	}
+	return nil
+}
+
+// SetCIDRs sets the address ranges checked when the destination is an IP
+// address. Allowed ranges also lift the built-in denial of loopback,
+// link-local, private and cloud metadata addresses.
+func (f *DomainFilter) SetCIDRs(allowed, denied []string) error {
+	var err error
+	if f.allowedCIDRs, err = parseCIDRs(allowed); err != nil {
+		return err
+	}
+	if f.deniedCIDRs, err = parseCIDRs(denied); err != nil {
+		return err
+	}
+	return nil
+}
+
+// SetMissingSNI sets whether tunnels are kept open when the client sends no
+// TLS server name, including clients that don't speak TLS. Anything other
+// than "deny" allows them.
+func (f *DomainFilter) SetMissingSNI(policy string) {
+	f.missingSNI = policy
+}
+
+// SetReportOnly makes IsAllowed permit every domain. Decisions are still
+// evaluated and passed to the decision hook so would-be denials can be recorded.
+func (f *DomainFilter) SetReportOnly(reportOnly bool) {
+	f.reportOnly = reportOnly
+}
+
+// SetDecisionHook registers a function called with every decision made by IsAllowed.
+// It must be set before the proxies start.
+func (f *DomainFilter) SetDecisionHook(hook func(Decision)) {
+	f.hook = hook
+}
+
+// IsAllowed checks if an address is allowed. The address is a domain or IP,
+// optionally with a port ("github.com:443"). Addresses without a port match
+// entries regardless of their ports, so the proxies always pass one.
+func (f *DomainFilter) IsAllowed(address string) bool {
+	allowed, _ := f.Allow(address)
+	return allowed
+}
+
+// Allow is IsAllowed, also returning the rule that decided
+func (f *DomainFilter) Allow(address string) (bool, string) {
+	decision := f.Decide(address)
+
+	if f.hook != nil {
+		f.hook(decision)
+	}
+
+	if f.reportOnly {
+		return true, decision.Rule
+	}
+
+	return decision.Allowed, decision.Rule
+}
+
+// AllowResolved checks the addresses a host name resolved to. Every address
+// must pass: denied ranges always apply, and protected ranges apply unless
+// an allowed range covers the address. Denials are reported to the decision
+// hook like those from IsAllowed, and the denying rule is returned.
+func (f *DomainFilter) AllowResolved(domain string, port int, addrs []netip.Addr) (bool, string) {
+	for _, addr := range addrs {
+		addr = addr.Unmap().WithZone("")
+
+		rule := f.addressRule(addr)
+		if rule == "" {
+			continue
+		}
+
+		decision := Decision{
+			Domain:  normaliseDomain(domain),
+			Port:    port,
+			Allowed: false,
+			Rule:    fmt.Sprintf("%s (resolved %s)", rule, addr),
+		}
+		if f.hook != nil {
+			f.hook(decision)
+		}
+
+		return f.reportOnly, decision.Rule
+	}
+
+	return true, ""
+}
+
+// AllowServerName checks the server name from the TLS ClientHello sent through
+// a tunnel to address, which IsAllowed has already allowed. A tunnel to a host
+// name must carry the same name, so an allowed host can't front for another.
+// A tunnel to an IP address must carry an allowed name. Tunnels without a name
+// follow the missing SNI policy. Denials are reported to the decision hook,
+// and the denying rule is returned.
+func (f *DomainFilter) AllowServerName(address, serverName string) (bool, string) {
+	host, port := splitAddress(address)
+	host = strings.TrimSuffix(host, ".")
+	serverName = strings.TrimSuffix(normaliseDomain(serverName), ".")
+
+	decision := Decision{Domain: host, Port: port, ServerNameCheck: true}
+	_, isIP := parseIP(host)
+
+	switch {
+	case serverName == "":
+		if f.missingSNI != "deny" {
+			return true, ""
+		}
+		decision.Rule = "missingSNI:deny"
+	case !isIP:
+		if serverName == host {
+			return true, ""
+		}
+		decision.Domain = serverName
+		decision.Rule = "sniMismatch:" + host
+	default:
+		decision = f.Decide(net.JoinHostPort(serverName, strconv.Itoa(port)))
+		if decision.Allowed {
+			return true, ""
+		}
+		decision.Rule += " (SNI)"
+	}
+
+	if f.hook != nil {
+		f.hook(decision)
+	}
+
+	return f.reportOnly, decision.Rule
+}
+
+// addressRule returns the rule denying a resolved address, or "" if none does
+func (f *DomainFilter) addressRule(addr netip.Addr) string {
+	if prefix, ok := matchPrefix(f.deniedCIDRs, addr); ok {
+		return "deniedCIDRs:" + prefix.String()
+	}
+	if _, ok := matchPrefix(f.allowedCIDRs, addr); ok {
+		return ""
+	}
+	if r, ok := protectedRangeFor(addr); ok {
+		return fmt.Sprintf("protected:%s %s", r.name, r.prefix)
+	}
+	return ""
+}
 
-	// Check denied list first (deny takes precedence)
+// Decide evaluates the policy for an address without side effects
+func (f *DomainFilter) Decide(address string) Decision {
+	domain, port := splitAddress(address)
+	addr, isIP := parseIP(domain)
+
+	decision := func(allowed bool, rule string) Decision {
+		return Decision{Domain: domain, Port: port, Allowed: allowed, Rule: rule}
+	}
+
+	// Check denied ranges and list first (deny takes precedence)
+	if isIP {
+		if prefix, ok := matchPrefix(f.deniedCIDRs, addr); ok {
+			return decision(false, "deniedCIDRs:"+prefix.String())
+		}
+	}
 	for _, pattern := range f.denied {
-		if pattern.Matches(domain) {
-			return false
+		if pattern.Matches(domain) && pattern.allowsPort(port, nil) {
+			return decision(false, "deniedDomains:"+pattern.entry)
 		}
 	}
 
-	// Check allowed list
-	for _, pattern := range f.allowed {
-		if pattern.Matches(domain) {
-			return true
+	if isIP {
+		if prefix, ok := matchPrefix(f.allowedCIDRs, addr); ok {
+			return decision(true, "allowedCIDRs:"+prefix.String())
 		}
 	}
 
+	// Local, private and metadata addresses need an explicit allow, which a
+	// glob such as "*" isn't
+	var protected protectedRange
+	isProtected := false
+	if isIP {
+		protected, isProtected = protectedRangeFor(addr)
+	}
+
+	// Check allowed list. A domain listed only for other ports is denied rather
+	// than falling through to the default policy.
+	var portDenied *DomainPattern
+	for i, pattern := range f.allowed {
+		if !pattern.Matches(domain) || isProtected && pattern.isGlob {
+			continue
+		}
+		if pattern.allowsPort(port, f.defaultPorts) {
+			return decision(true, "allowedDomains:"+pattern.entry)
+		}
+		if portDenied == nil {
+			portDenied = &f.allowed[i]
+		}
+	}
+
+	if portDenied != nil {
+		d := decision(false, fmt.Sprintf("allowedDomains:%s (port %d not allowed)", portDenied.entry, port))
+		d.PortDenied = true
+		return d
+	}
+
+	if isProtected {
+		return decision(false, fmt.Sprintf("protected:%s %s", protected.name, protected.prefix))
+	}
+
 	// Use default policy if no match
-	return f.defaultPolicy == "allow"
+	return decision(f.defaultPolicy == "allow", "defaultPolicy:"+f.defaultPolicy)
 }
 
-// Matches checks if a domain matches this pattern
+// Matches checks if a domain matches this pattern, ignoring ports
 func (p *DomainPattern) Matches(domain string) bool {
 	domain = normaliseDomain(domain)
 
@@ -89,9 +342,44 @@ func (p *DomainPattern) Matches(domain string) bool {
 	return domain == p.pattern
 }
 
-func compileDomainPattern(pattern string) (DomainPattern, error) {
+// allowsPort reports whether the pattern covers port. Patterns without a port
+// use defaults, or cover every port when there are none. Port 0 is unknown and
+// always covered.
+func (p *DomainPattern) allowsPort(port int, defaults []PortRange) bool {
+	ranges := p.ports
+	if ranges == nil {
+		ranges = defaults
+	}
+	if port == 0 || ranges == nil {
+		return true
+	}
+
+	for _, r := range ranges {
+		if r.Contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewDomainPattern compiles a domain pattern such as "example.com" or "*.example.com"
+func NewDomainPattern(pattern string) (DomainPattern, error) {
+	return compileDomainPattern(pattern)
+}
+
+func compileDomainPattern(entry string) (DomainPattern, error) {
 	// Normalise
-	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	entry = strings.ToLower(strings.TrimSpace(entry))
+
+	pattern, portSpec, hasPort := SplitDomainPorts(entry)
+	var ports []PortRange
+	if hasPort {
+		r, err := ParsePortRange(portSpec)
+		if err != nil {
+			return DomainPattern{}, fmt.Errorf("invalid port in %q: %w", entry, err)
+		}
+		ports = []PortRange{r}
+	}
 
 	// Check if it's a wildcard pattern
 	if strings.Contains(pattern, "*") {
@@ -101,25 +389,86 @@ func compileDomainPattern(pattern string) (DomainPattern, error) {
 		}
 
 		return DomainPattern{
+			entry:    entry,
 			pattern:  pattern,
 			isGlob:   true,
 			compiled: compiled,
+			ports:    ports,
 		}, nil
 	}
 
 	// Exact match pattern
 	return DomainPattern{
+		entry:   entry,
 		pattern: pattern,
 		isGlob:  false,
+		ports:   ports,
 	}, nil
 }
 
-func normaliseDomain(domain string) string {
-	// Remove port if present
-	if idx := strings.LastIndex(domain, ":"); idx != -1 {
-		domain = domain[:idx]
+// SplitDomainPorts splits a domain entry such as "github.com:443" into the
+// domain and the port specification
+func SplitDomainPorts(entry string) (domain, ports string, ok bool) {
+	// More than one colon is an IPv6 address, which needs brackets to carry a port
+	if strings.Count(entry, ":") != 1 {
+		return entry, "", false
+	}
+	return strings.Cut(entry, ":")
+}
+
+// ParsePortRange parses a port ("443") or an inclusive range ("8000-8100")
+func ParsePortRange(spec string) (PortRange, error) {
+	low, high, isRange := strings.Cut(strings.TrimSpace(spec), "-")
+	if !isRange {
+		high = low
 	}
 
-	// Lowercase
-	return strings.ToLower(strings.TrimSpace(domain))
+	lo, err := parsePort(low)
+	if err != nil {
+		return PortRange{}, err
+	}
+	hi, err := parsePort(high)
+	if err != nil {
+		return PortRange{}, err
+	}
+	if lo > hi {
+		return PortRange{}, fmt.Errorf("port range %d-%d is reversed", lo, hi)
+	}
+
+	return PortRange{Low: lo, High: hi}, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("port %q must be between 1 and 65535", s)
+	}
+	return port, nil
+}
+
+// splitAddress splits "host:port" into the normalised host and port, with
+// port 0 when the address has none
+func splitAddress(address string) (string, int) {
+	address = strings.TrimSpace(address)
+
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		// No port, or a bare IPv6 address
+		host, portStr = address, ""
+	}
+
+	// Lowercase, without IPv6 brackets
+	host = strings.ToLower(strings.Trim(host, "[]"))
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return host, 0
+	}
+	return host, port
+}
+
+func normaliseDomain(domain string) string {
+	// Lowercase, strip port
+	host, _ := splitAddress(domain)
+	return host
 }
@@ -113,3 +113,449 @@ func TestNormaliseDomain(t *testing.T) {
 		})
 	}
 }
+
+func TestDomainFilterReportOnly(t *testing.T) {
+	filter, err := NewDomainFilter("deny", []string{"*.github.com"}, []string{"bad.com"})
+	if err != nil {
+		t.Fatalf("NewDomainFilter() error = %v", err)
+	}
+
+	var decisions []Decision
+	filter.SetReportOnly(true)
+	filter.SetDecisionHook(func(d Decision) {
+		decisions = append(decisions, d)
+	})
+
+	for _, domain := range []string{"api.github.com:443", "bad.com", "other.org"} {
+		if !filter.IsAllowed(domain) {
+			t.Errorf("IsAllowed(%q) = false in report-only mode", domain)
+		}
+	}
+
+	want := []Decision{
+		{Domain: "api.github.com", Port: 443, Allowed: true, Rule: "allowedDomains:*.github.com"},
+		{Domain: "bad.com", Allowed: false, Rule: "deniedDomains:bad.com"},
+		{Domain: "other.org", Allowed: false, Rule: "defaultPolicy:deny"},
+	}
+	if len(decisions) != len(want) {
+		t.Fatalf("Hook received %d decisions, want %d", len(decisions), len(want))
+	}
+	for i := range want {
+		if decisions[i] != want[i] {
+			t.Errorf("Decision %d = %+v, want %+v", i, decisions[i], want[i])
+		}
+	}
+}
+
+func TestDomainFilterPorts(t *testing.T) {
+	tests := []struct {
+		name         string
+		allowed      []string
+		denied       []string
+		defaultPorts []string
+		address      string
+		want         bool
+		wantRule     string
+	}{
+		{
+			name:     "allowed port",
+			allowed:  []string{"github.com:443"},
+			address:  "github.com:443",
+			want:     true,
+			wantRule: "allowedDomains:github.com:443",
+		},
+		{
+			name:     "other port on allowed domain",
+			allowed:  []string{"github.com:443"},
+			address:  "github.com:22",
+			want:     false,
+			wantRule: "allowedDomains:github.com:443 (port 22 not allowed)",
+		},
+		{
+			name:     "port range",
+			allowed:  []string{"registry.local:8000-8100"},
+			address:  "registry.local:8080",
+			want:     true,
+			wantRule: "allowedDomains:registry.local:8000-8100",
+		},
+		{
+			name:     "outside port range",
+			allowed:  []string{"registry.local:8000-8100"},
+			address:  "registry.local:8101",
+			want:     false,
+			wantRule: "allowedDomains:registry.local:8000-8100 (port 8101 not allowed)",
+		},
+		{
+			name:     "second entry covers port",
+			allowed:  []string{"github.com:443", "github.com:22"},
+			address:  "github.com:22",
+			want:     true,
+			wantRule: "allowedDomains:github.com:22",
+		},
+		{
+			name:     "entry without port allows any port",
+			allowed:  []string{"github.com"},
+			address:  "github.com:2222",
+			want:     true,
+			wantRule: "allowedDomains:github.com",
+		},
+		{
+			name:         "default ports limit entries without port",
+			allowed:      []string{"github.com"},
+			defaultPorts: []string{"80", "443"},
+			address:      "github.com:2222",
+			want:         false,
+			wantRule:     "allowedDomains:github.com (port 2222 not allowed)",
+		},
+		{
+			name:         "explicit port overrides default ports",
+			allowed:      []string{"*.example.com:8443"},
+			defaultPorts: []string{"443"},
+			address:      "api.example.com:8443",
+			want:         true,
+			wantRule:     "allowedDomains:*.example.com:8443",
+		},
+		{
+			name:     "denied port",
+			allowed:  []string{"github.com"},
+			denied:   []string{"github.com:22"},
+			address:  "github.com:22",
+			want:     false,
+			wantRule: "deniedDomains:github.com:22",
+		},
+		{
+			name:     "denied port leaves others allowed",
+			allowed:  []string{"github.com"},
+			denied:   []string{"github.com:22"},
+			address:  "github.com:443",
+			want:     true,
+			wantRule: "allowedDomains:github.com",
+		},
+		{
+			name:         "denied entry without port ignores default ports",
+			denied:       []string{"bad.com"},
+			defaultPorts: []string{"443"},
+			address:      "bad.com:8080",
+			want:         false,
+			wantRule:     "deniedDomains:bad.com",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := NewDomainFilter("deny", tt.allowed, tt.denied)
+			if err != nil {
+				t.Fatalf("NewDomainFilter() error = %v", err)
+			}
+			if err := filter.SetDefaultPorts(tt.defaultPorts); err != nil {
+				t.Fatalf("SetDefaultPorts() error = %v", err)
+			}
+
+			d := filter.Decide(tt.address)
+			if d.Allowed != tt.want || d.Rule != tt.wantRule {
+				t.Errorf("Decide(%q) = (%v, %q), want (%v, %q)", tt.address, d.Allowed, d.Rule, tt.want, tt.wantRule)
+			}
+		})
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    PortRange
+		wantErr bool
+	}{
+		{spec: "443", want: PortRange{Low: 443, High: 443}},
+		{spec: "8000-8100", want: PortRange{Low: 8000, High: 8100}},
+		{spec: "0", wantErr: true},
+		{spec: "65536", wantErr: true},
+		{spec: "8100-8000", wantErr: true},
+		{spec: "https", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := ParsePortRange(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParsePortRange(%q) error = %v, wantErr %v", tt.spec, err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("ParsePortRange(%q) = %+v, want %+v", tt.spec, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDomainFilterCIDRs(t *testing.T) {
+	tests := []struct {
+		name          string
+		defaultPolicy string
+		allowedDomain []string
+		allowedCIDRs  []string
+		deniedCIDRs   []string
+		address       string
+		want          bool
+		wantRule      string
+	}{
+		{
+			name:          "metadata endpoint denied under allow policy",
+			defaultPolicy: "allow",
+			address:       "169.254.169.254:80",
+			want:          false,
+			wantRule:      "protected:link-local 169.254.0.0/16",
+		},
+		{
+			name:          "private address denied under allow policy",
+			defaultPolicy: "allow",
+			address:       "10.0.0.5:443",
+			want:          false,
+			wantRule:      "protected:private 10.0.0.0/8",
+		},
+		{
+			name:          "loopback ipv6",
+			defaultPolicy: "allow",
+			address:       "[::1]:8080",
+			want:          false,
+			wantRule:      "protected:loopback ::1/128",
+		},
+		{
+			name:          "ipv4-mapped ipv6 loopback",
+			defaultPolicy: "allow",
+			address:       "[::ffff:127.0.0.1]:8080",
+			want:          false,
+			wantRule:      "protected:loopback 127.0.0.0/8",
+		},
+		{
+			name:          "aws ipv6 metadata",
+			defaultPolicy: "allow",
+			address:       "[fd00:ec2::254]:80",
+			want:          false,
+			wantRule:      "protected:private fc00::/7",
+		},
+		{
+			name:          "carrier-grade nat",
+			defaultPolicy: "allow",
+			address:       "100.101.102.103:443",
+			want:          false,
+			wantRule:      "protected:shared 100.64.0.0/10",
+		},
+		{
+			name:          "nat64 address checked as its ipv4 address",
+			defaultPolicy: "allow",
+			address:       "[64:ff9b::a9fe:a9fe]:80",
+			want:          false,
+			wantRule:      "protected:link-local 169.254.0.0/16",
+		},
+		{
+			name:          "nat64 public address follows default policy",
+			defaultPolicy: "allow",
+			address:       "[64:ff9b::5db8:d822]:443",
+			want:          true,
+			wantRule:      "defaultPolicy:allow",
+		},
+		{
+			name:          "wildcard domain does not allow a protected address",
+			defaultPolicy: "deny",
+			allowedDomain: []string{"*"},
+			address:       "169.254.169.254:80",
+			want:          false,
+			wantRule:      "protected:link-local 169.254.0.0/16",
+		},
+		{
+			name:          "wildcard domain allows a public address",
+			defaultPolicy: "deny",
+			allowedDomain: []string{"*"},
+			address:       "93.184.216.34:443",
+			want:          true,
+			wantRule:      "allowedDomains:*",
+		},
+		{
+			name:          "public address follows default policy",
+			defaultPolicy: "allow",
+			address:       "93.184.216.34:443",
+			want:          true,
+			wantRule:      "defaultPolicy:allow",
+		},
+		{
+			name:          "allowed cidr lifts protection",
+			defaultPolicy: "deny",
+			allowedCIDRs:  []string{"10.1.0.0/16"},
+			address:       "10.1.2.3:5432",
+			want:          true,
+			wantRule:      "allowedCIDRs:10.1.0.0/16",
+		},
+		{
+			name:          "single address allowed",
+			defaultPolicy: "deny",
+			allowedCIDRs:  []string{"127.0.0.1"},
+			address:       "127.0.0.1:3000",
+			want:          true,
+			wantRule:      "allowedCIDRs:127.0.0.1/32",
+		},
+		{
+			name:          "allowed domain entry for an address is explicit",
+			defaultPolicy: "deny",
+			allowedDomain: []string{"192.168.1.10:8080"},
+			address:       "192.168.1.10:8080",
+			want:          true,
+			wantRule:      "allowedDomains:192.168.1.10:8080",
+		},
+		{
+			name:          "denied cidr beats allowed cidr",
+			defaultPolicy: "allow",
+			allowedCIDRs:  []string{"10.0.0.0/8"},
+			deniedCIDRs:   []string{"10.0.5.0/24"},
+			address:       "10.0.5.9:22",
+			want:          false,
+			wantRule:      "deniedCIDRs:10.0.5.0/24",
+		},
+		{
+			name:          "denied cidr covers nat64 form",
+			defaultPolicy: "allow",
+			deniedCIDRs:   []string{"203.0.113.0/24"},
+			address:       "[64:ff9b::cb00:7105]:443",
+			want:          false,
+			wantRule:      "deniedCIDRs:203.0.113.0/24",
+		},
+		{
+			name:          "denied public cidr",
+			defaultPolicy: "allow",
+			deniedCIDRs:   []string{"2001:db8::/32"},
+			address:       "[2001:db8::1]:443",
+			want:          false,
+			wantRule:      "deniedCIDRs:2001:db8::/32",
+		},
+		{
+			name:          "cidrs do not apply to domains",
+			defaultPolicy: "allow",
+			deniedCIDRs:   []string{"0.0.0.0/0"},
+			address:       "example.com:443",
+			want:          true,
+			wantRule:      "defaultPolicy:allow",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := NewDomainFilter(tt.defaultPolicy, tt.allowedDomain, nil)
+			if err != nil {
+				t.Fatalf("NewDomainFilter() error = %v", err)
+			}
+			if err := filter.SetCIDRs(tt.allowedCIDRs, tt.deniedCIDRs); err != nil {
+				t.Fatalf("SetCIDRs() error = %v", err)
+			}
+
+			d := filter.Decide(tt.address)
+			if d.Allowed != tt.want || d.Rule != tt.wantRule {
+				t.Errorf("Decide(%q) = (%v, %q), want (%v, %q)", tt.address, d.Allowed, d.Rule, tt.want, tt.wantRule)
+			}
+		})
+	}
+}
+
+func TestDomainFilterServerName(t *testing.T) {
+	tests := []struct {
+		name       string
+		missingSNI string
+		address    string
+		serverName string
+		want       bool
+		wantDomain string
+		wantRule   string
+	}{
+		{name: "matching name", address: "github.com:443", serverName: "github.com", want: true},
+		{name: "case and trailing dot", address: "github.com:443", serverName: "GitHub.com.", want: true},
+		{
+			name:       "fronted name",
+			address:    "github.com:443",
+			serverName: "api.github.com",
+			want:       false,
+			wantDomain: "api.github.com",
+			wantRule:   "sniMismatch:github.com",
+		},
+		{
+			name:       "disallowed name",
+			address:    "github.com:443",
+			serverName: "evil.example",
+			want:       false,
+			wantDomain: "evil.example",
+			wantRule:   "sniMismatch:github.com",
+		},
+		{name: "ip tunnel with allowed name", address: "140.82.112.3:443", serverName: "api.github.com", want: true},
+		{
+			name:       "ip tunnel with disallowed name",
+			address:    "140.82.112.3:443",
+			serverName: "evil.example",
+			want:       false,
+			wantDomain: "evil.example",
+			wantRule:   "defaultPolicy:deny (SNI)",
+		},
+		{name: "missing name allowed by default", address: "github.com:22", want: true},
+		{
+			name:       "missing name denied",
+			missingSNI: "deny",
+			address:    "github.com:22",
+			want:       false,
+			wantDomain: "github.com",
+			wantRule:   "missingSNI:deny",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := NewDomainFilter("deny", []string{"*.github.com", "github.com", "140.82.112.3"}, nil)
+			if err != nil {
+				t.Fatalf("NewDomainFilter() error = %v", err)
+			}
+			filter.SetMissingSNI(tt.missingSNI)
+
+			var decisions []Decision
+			filter.SetDecisionHook(func(d Decision) { decisions = append(decisions, d) })
+
+			if got, _ := filter.AllowServerName(tt.address, tt.serverName); got != tt.want {
+				t.Errorf("AllowServerName(%q, %q) = %v, want %v", tt.address, tt.serverName, got, tt.want)
+			}
+
+			if tt.want {
+				if len(decisions) != 0 {
+					t.Errorf("Hook called with %+v, want no decisions", decisions)
+				}
+				return
+			}
+			if len(decisions) != 1 {
+				t.Fatalf("Hook called %d times, want 1", len(decisions))
+			}
+			if d := decisions[0]; d.Domain != tt.wantDomain || d.Rule != tt.wantRule || d.Allowed {
+				t.Errorf("Decision = %+v, want domain %q rule %q", d, tt.wantDomain, tt.wantRule)
+			}
+		})
+	}
+}
+
+func TestParseCIDR(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{input: "10.0.0.0/8", want: "10.0.0.0/8"},
+		{input: "10.1.2.3/8", want: "10.0.0.0/8"},
+		{input: "192.168.1.1", want: "192.168.1.1/32"},
+		{input: "::1", want: "::1/128"},
+		{input: "fd00::/8", want: "fd00::/8"},
+		{input: "10.0.0.0/33", wantErr: true},
+		{input: "example.com", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseCIDR(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseCIDR(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			}
+			if !tt.wantErr && got.String() != tt.want {
+				t.Errorf("ParseCIDR(%q) = %s, want %s", tt.input, got, tt.want)
+			}
+		})
+	}
+}
@@ -1,21 +1,29 @@
 package network
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"strings"
 	"time"
 )
 
 // HTTPProxy is an HTTP/HTTPS proxy server with domain filtering
 type HTTPProxy struct {
-	port     int
-	filter   *DomainFilter
-	server   *http.Server
-	listener net.Listener
+	port      int
+	filter    *DomainFilter
+	dialer    *Dialer
+	transport *http.Transport
+	ca        *CertificateAuthority // Set when TLS interception is enabled
+	server    *http.Server
+	listener  net.Listener
+	connectionLog
 }
 
 // NewHTTPProxy creates a new HTTP proxy
@@ -23,6 +31,15 @@ func NewHTTPProxy(filter *DomainFilter, port int) (*HTTPProxy, error) {
 	proxy := &HTTPProxy{
 		port:   port,
 		filter: filter,
+		dialer: NewDialer(filter),
+	}
+
+	// Connect through the checking dialer, never through a proxy from the environment
+	proxy.transport = &http.Transport{
+		DialContext:         proxy.dialer.DialContext,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
 	}
 
 	// Create listener
@@ -55,6 +72,17 @@ func (p *HTTPProxy) Port() int {
 	return p.port
 }
 
+// SetResolver replaces the resolver used for destinations, it must be called before Start
+func (p *HTTPProxy) SetResolver(r Resolver) {
+	p.dialer.SetResolver(r)
+}
+
+// SetUpstream sends the proxy's connections through an upstream proxy, it
+// must be called before Start
+func (p *HTTPProxy) SetUpstream(u *Upstream) {
+	p.dialer.SetUpstream(u)
+}
+
 // Start starts the proxy server
 func (p *HTTPProxy) Start() error {
 	slog.Debug("HTTP proxy starting", "port", p.port)
@@ -63,37 +91,179 @@ func (p *HTTPProxy) Start() error {
 
 // Stop stops the proxy server
 func (p *HTTPProxy) Stop() error {
-	return p.server.Close()
+	p.transport.CloseIdleConnections()
+	err := p.server.Close()
+	// Serve closes the listener itself, this covers a proxy that never started
+	p.listener.Close()
+	return err
 }
 
 func (p *HTTPProxy) handleRequest(w http.ResponseWriter, r *http.Request) {
-	// Extract domain
-	host := r.Host
-	if host == "" {
-		host = r.URL.Host
-	}
+	// Extract the destination, ports are part of the policy
+	address := requestAddress(r)
 
-	domain := strings.Split(host, ":")[0]
+	protocol := ProtocolHTTP
+	if r.Method == http.MethodConnect {
+		protocol = ProtocolConnect
+	}
+	record := p.start(protocol, address)
+	defer p.finish(record)
+	if protocol == ProtocolHTTP {
+		record.Method = r.Method
+		record.Path = r.URL.Path
+	}
 
 	// Check filter
-	if !p.filter.IsAllowed(domain) {
-		slog.Debug("HTTP proxy blocked request", "domain", domain, "method", r.Method)
-		w.Header().Set("X-Proxy-Error", "blocked-by-allowlist")
-		http.Error(w, "Domain not allowed by sandbox policy", http.StatusForbidden)
+	allowed, rule := p.filter.Allow(address)
+	record.Rule = rule
+	if !allowed {
+		slog.Debug("HTTP proxy blocked request", "address", address, "method", r.Method)
+		record.deny(rule)
+		if protocol == ProtocolHTTP {
+			record.Status = http.StatusForbidden
+		}
+		writeDenied(w)
 		return
 	}
 
 	// Handle CONNECT for HTTPS
 	if r.Method == http.MethodConnect {
-		p.handleConnect(w, r)
+		lease, ok := p.acquireQuota(w, address, record)
+		if !ok {
+			return
+		}
+		defer lease.release()
+		p.handleConnect(w, address, record, lease)
+		return
+	}
+
+	// Check method and path rules, which plain HTTP exposes
+	allowed, rule = p.filter.AllowRequest(r.Method, address, r.URL.Path)
+	if rule != "" {
+		record.Rule = rule
+	}
+	if !allowed {
+		slog.Debug("HTTP proxy blocked request", "address", address, "method", r.Method, "path", r.URL.Path, "rule", rule)
+		record.deny(rule)
+		record.Status = http.StatusForbidden
+		for name, values := range deniedRequestHeader(rule) {
+			w.Header()[name] = values
+		}
+		http.Error(w, deniedRequestMessage(rule), http.StatusForbidden)
+		return
+	}
+
+	// Swap secret placeholders for the values bound to the host
+	if allowed, rule := p.filter.applySecrets(r.Method, address, r.URL, r.Header); !allowed {
+		slog.Debug("HTTP proxy blocked request carrying a secret placeholder", "address", address, "rule", rule)
+		record.deny(rule)
+		record.Status = http.StatusForbidden
+		for name, values := range deniedSecretHeader(rule) {
+			w.Header()[name] = values
+		}
+		http.Error(w, deniedSecretMessage(rule), http.StatusForbidden)
 		return
 	}
 
+	lease, ok := p.acquireQuota(w, address, record)
+	if !ok {
+		return
+	}
+	defer lease.release()
+
 	// Handle regular HTTP
-	p.handleHTTP(w, r)
+	p.handleHTTP(w, r, record, lease)
+}
+
+// acquireQuota counts a connection against the quotas, answering the client
+// when one is used up
+func (p *HTTPProxy) acquireQuota(w http.ResponseWriter, address string, record *ConnectionRecord) (*quotaLease, bool) {
+	lease, allowed, rule := p.filter.acquireQuota(address)
+	if !allowed {
+		slog.Debug("HTTP proxy quota exceeded", "address", address, "rule", rule)
+		record.deny(rule)
+		if record.Protocol == ProtocolHTTP {
+			record.Status = http.StatusTooManyRequests
+		}
+		writeQuotaExceeded(w, rule)
+		return nil, false
+	}
+	return lease, true
+}
+
+// writeDenied responds to a request the policy blocks
+func writeDenied(w http.ResponseWriter) {
+	w.Header().Set("X-Proxy-Error", "blocked-by-allowlist")
+	http.Error(w, "Domain not allowed by sandbox policy", http.StatusForbidden)
+}
+
+// writeQuotaExceeded responds to a request over a quota
+func writeQuotaExceeded(w http.ResponseWriter, rule string) {
+	for name, values := range quotaExceededHeader(rule) {
+		w.Header()[name] = values
+	}
+	http.Error(w, quotaExceededMessage(rule), http.StatusTooManyRequests)
 }
 
-func (p *HTTPProxy) handleConnect(w http.ResponseWriter, r *http.Request) {
+// quotaExceededHeader names the quota a request went over
+func quotaExceededHeader(rule string) http.Header {
+	return http.Header{
+		"X-Proxy-Error": {"quota-exceeded"},
+		"X-Proxy-Rule":  {rule},
+	}
+}
+
+// quotaExceededMessage explains which quota a request went over
+func quotaExceededMessage(rule string) string {
+	return fmt.Sprintf("Sandbox quota exceeded: %s", rule)
+}
+
+// deniedRequestHeader names the HTTP rule that denied a request
+func deniedRequestHeader(rule string) http.Header {
+	return http.Header{
+		"X-Proxy-Error": {"blocked-by-http-rule"},
+		"X-Proxy-Rule":  {rule},
+	}
+}
+
+// deniedRequestMessage explains which HTTP rule denied a request
+func deniedRequestMessage(rule string) string {
+	return fmt.Sprintf("Request denied by sandbox rule %s", rule)
+}
+
+// deniedSecretHeader names the secret whose placeholder a request carried
+func deniedSecretHeader(rule string) http.Header {
+	return http.Header{
+		"X-Proxy-Error": {"secret-not-bound"},
+		"X-Proxy-Rule":  {rule},
+	}
+}
+
+// deniedSecretMessage explains why a request carrying a placeholder was denied
+func deniedSecretMessage(rule string) string {
+	return fmt.Sprintf("Request denied by sandbox rule %s: the secret is not bound to this domain", rule)
+}
+
+// requestAddress returns the host and port a request is for, using the
+// scheme's default port when the request does not name one
+func requestAddress(r *http.Request) string {
+	host := r.Host
+	if host == "" {
+		host = r.URL.Host
+	}
+
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+
+	port := "80"
+	if r.Method == http.MethodConnect || r.URL.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+func (p *HTTPProxy) handleConnect(w http.ResponseWriter, address string, record *ConnectionRecord, lease *quotaLease) {
 	// Hijack the connection
 	hijacker, ok := w.(http.Hijacker)
 	if !ok {
@@ -101,31 +271,89 @@ func (p *HTTPProxy) handleConnect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	clientConn, _, err := hijacker.Hijack()
+	hijacked, buffered, err := hijacker.Hijack()
 	if err != nil {
+		record.fail(err)
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		return
 	}
-	defer clientConn.Close()
+	defer hijacked.Close()
+
+	// The server's read and write timeouts don't apply to long-lived tunnels
+	hijacked.SetDeadline(time.Time{})
+
+	// Read through the server's buffer, which holds anything sent early
+	clientConn := &bufferedConn{Conn: hijacked, reader: buffered.Reader}
+
+	// Decrypted tunnels make their own connections for each request, which
+	// are recorded separately
+	if p.ca != nil && p.filter.Intercepts(address) {
+		counted := &countingConn{Conn: clientConn, lease: lease, clientSide: true}
+		clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+		p.intercept(counted, address, record, lease)
+		record.BytesUp = counted.read.Load()
+		record.BytesDown = counted.written.Load()
+		if rule := lease.cutBy(); rule != "" {
+			record.deny(rule)
+		}
+		return
+	}
 
-	// Connect to target
-	targetConn, err := net.DialTimeout("tcp", r.Host, 10*time.Second)
+	// Connect to the address that was checked
+	dialed, err := p.dialer.DialContext(context.Background(), "tcp", address)
 	if err != nil {
-		slog.Debug("HTTP proxy failed to connect", "host", r.Host, "error", err)
+		slog.Debug("HTTP proxy failed to connect", "address", address, "error", err)
+		record.fail(err)
+		if errors.Is(err, ErrAddressDenied) {
+			clientConn.Write([]byte("HTTP/1.1 403 Forbidden\r\nX-Proxy-Error: blocked-by-allowlist\r\n\r\n"))
+			return
+		}
 		clientConn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
 		return
 	}
+	targetConn := &countingConn{Conn: dialed, lease: lease}
 	defer targetConn.Close()
+	record.IP = remoteIP(dialed)
+	defer func() {
+		record.BytesUp = targetConn.written.Load()
+		record.BytesDown = targetConn.read.Load()
+		if rule := lease.cutBy(); rule != "" {
+			record.deny(rule)
+		}
+	}()
 
 	// Send 200 Connection Established
 	clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
 
-	// Tunnel traffic bidirectionally
-	go io.Copy(targetConn, clientConn)
-	io.Copy(clientConn, targetConn)
+	// Relay the destination while waiting for the client, in case it speaks first
+	done := make(chan struct{})
+	go func() {
+		io.Copy(clientConn, targetConn)
+		close(done)
+	}()
+
+	// Check the TLS server name before anything reaches the destination
+	peek, err := peekServerName(clientConn, sniPeekTimeout)
+	if err != nil {
+		return
+	}
+	if allowed, rule := p.filter.AllowServerName(address, peek.serverName); !allowed {
+		slog.Debug("HTTP proxy closed tunnel", "address", address,
+			"serverName", peek.serverName, "tls", peek.isTLS, "timedOut", peek.timedOut)
+		record.deny(rule)
+		return
+	}
+
+	go func() {
+		if _, err := targetConn.Write(peek.peeked); err != nil {
+			return
+		}
+		io.Copy(targetConn, clientConn)
+	}()
+	<-done
 }
 
-func (p *HTTPProxy) handleHTTP(w http.ResponseWriter, r *http.Request) {
+func (p *HTTPProxy) handleHTTP(w http.ResponseWriter, r *http.Request, record *ConnectionRecord, lease *quotaLease) {
 	// Create client request
 	targetURL := r.URL
 	if targetURL.Scheme == "" {
@@ -135,12 +363,20 @@ func (p *HTTPProxy) handleHTTP(w http.ResponseWriter, r *http.Request) {
 		targetURL.Host = r.Host
 	}
 
-	// Create new request
-	proxyReq, err := http.NewRequest(r.Method, targetURL.String(), r.Body)
+	// Create new request, counting the body sent
+	body := &countingReader{ReadCloser: r.Body, lease: lease, up: true}
+	var reqBody io.Reader = body
+	if r.Body == http.NoBody {
+		reqBody = http.NoBody
+	}
+	proxyReq, err := http.NewRequestWithContext(traceConnection(r.Context(), record), r.Method, targetURL.String(), reqBody)
 	if err != nil {
+		record.fail(err)
+		record.Status = http.StatusInternalServerError
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	proxyReq.ContentLength = r.ContentLength
 
 	// Copy headers
 	for name, values := range r.Header {
@@ -152,22 +388,52 @@ func (p *HTTPProxy) handleHTTP(w http.ResponseWriter, r *http.Request) {
 	// Remove hop-by-hop headers
 	removeHopByHopHeaders(proxyReq.Header)
 
+	// Headers can carry data too, so quotas count them
+	if !lease.transfer(int64(len(r.Method)+len(targetURL.String()))+headerSize(proxyReq.Header), 0) {
+		record.deny(lease.cutBy())
+		record.Status = http.StatusTooManyRequests
+		writeQuotaExceeded(w, lease.cutBy())
+		return
+	}
+
 	// Send request
 	client := &http.Client{
-		Timeout: 30 * time.Second,
+		Transport: p.transport,
+		Timeout:   30 * time.Second,
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			return http.ErrUseLastResponse
 		},
 	}
 
 	resp, err := client.Do(proxyReq)
+	record.BytesUp = body.n
 	if err != nil {
 		slog.Debug("HTTP proxy request failed", "url", targetURL.String(), "error", err)
+		if rule := lease.cutBy(); rule != "" {
+			record.deny(rule)
+			record.Status = http.StatusTooManyRequests
+			writeQuotaExceeded(w, rule)
+			return
+		}
+		record.fail(err)
+		if errors.Is(err, ErrAddressDenied) {
+			record.Status = http.StatusForbidden
+			writeDenied(w)
+			return
+		}
+		record.Status = http.StatusBadGateway
 		http.Error(w, err.Error(), http.StatusBadGateway)
 		return
 	}
 	defer resp.Body.Close()
 
+	if !lease.transfer(0, headerSize(resp.Header)) {
+		record.deny(lease.cutBy())
+		record.Status = http.StatusTooManyRequests
+		writeQuotaExceeded(w, lease.cutBy())
+		return
+	}
+
 	// Copy response headers
 	for name, values := range resp.Header {
 		for _, value := range values {
@@ -180,9 +446,48 @@ func (p *HTTPProxy) handleHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// Write status code
 	w.WriteHeader(resp.StatusCode)
+	record.Status = resp.StatusCode
 
 	// Copy body
-	io.Copy(w, resp.Body)
+	received := &countingReader{ReadCloser: resp.Body, lease: lease}
+	io.Copy(w, received)
+	record.BytesDown = received.n
+
+	// Break the response off rather than letting it look complete
+	if rule := lease.cutBy(); rule != "" {
+		record.deny(rule)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// headerSize approximates the bytes headers take on the wire
+func headerSize(h http.Header) int64 {
+	var n int64
+	for name, values := range h {
+		for _, value := range values {
+			n += int64(len(name) + len(value) + 4)
+		}
+	}
+	return n
+}
+
+// traceConnection records the address of the connection a request is sent on
+func traceConnection(ctx context.Context, record *ConnectionRecord) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			record.IP = remoteIP(info.Conn)
+		},
+	})
+}
+
+// bufferedConn reads a hijacked connection through its buffered reader
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
 }
 
 func removeHopByHopHeaders(h http.Header) {
@@ -0,0 +1,194 @@
+package network
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRequestAddress(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		host   string
+		url    string
+		want   string
+	}{
+		{name: "connect with port", method: http.MethodConnect, host: "github.com:22", want: "github.com:22"},
+		{name: "connect without port", method: http.MethodConnect, host: "github.com", want: "github.com:443"},
+		{name: "http default port", method: http.MethodGet, host: "example.com", url: "http://example.com/", want: "example.com:80"},
+		{name: "https default port", method: http.MethodGet, host: "example.com", url: "https://example.com/", want: "example.com:443"},
+		{name: "explicit port", method: http.MethodGet, host: "registry.local:8080", url: "http://registry.local:8080/", want: "registry.local:8080"},
+		{name: "ipv6", method: http.MethodGet, host: "[::1]", url: "http://[::1]/", want: "[::1]:80"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &http.Request{Method: tt.method, Host: tt.host, URL: &url.URL{}}
+			if tt.url != "" {
+				u, err := url.Parse(tt.url)
+				if err != nil {
+					t.Fatal(err)
+				}
+				r.URL = u
+			}
+
+			if got := requestAddress(r); got != tt.want {
+				t.Errorf("requestAddress() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHTTPProxyChecksTunnelServerName(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer upstream.Close()
+	target := fmt.Sprintf("app.test:%d", upstream.Listener.Addr().(*net.TCPAddr).Port)
+
+	tests := []struct {
+		name       string
+		serverName string
+		wantOK     bool
+		wantRule   string
+	}{
+		{name: "matching server name", serverName: "app.test", wantOK: true},
+		{name: "fronted server name", serverName: "other.test", wantRule: "sniMismatch:app.test"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter := proxyTestFilter(t, true)
+			rules := make(chan string, 4)
+			filter.SetDecisionHook(func(d Decision) {
+				if !d.Allowed {
+					rules <- d.Rule
+				}
+			})
+
+			p, err := NewHTTPProxy(filter, 0)
+			if err != nil {
+				t.Fatalf("NewHTTPProxy() error = %v", err)
+			}
+			p.SetResolver(newStaticResolver(map[string][]string{"app.test": {"127.0.0.1"}}))
+			go p.Start()
+			defer p.Stop()
+
+			conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", p.Port()))
+			if err != nil {
+				t.Fatalf("Dial() error = %v", err)
+			}
+			defer conn.Close()
+
+			fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil || resp.StatusCode != http.StatusOK {
+				t.Fatalf("CONNECT response = %v, %v, want 200", resp, err)
+			}
+
+			tlsConn := tls.Client(conn, &tls.Config{ServerName: tt.serverName, InsecureSkipVerify: true})
+			err = tlsConn.Handshake()
+
+			if !tt.wantOK {
+				if err == nil {
+					t.Fatal("Handshake() succeeded, want the tunnel closed")
+				}
+				if rule := <-rules; rule != tt.wantRule {
+					t.Errorf("Rule = %q, want %q", rule, tt.wantRule)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Handshake() error = %v", err)
+			}
+			fmt.Fprintf(tlsConn, "GET / HTTP/1.1\r\nHost: app.test\r\n\r\n")
+			resp, err = http.ReadResponse(bufio.NewReader(tlsConn), nil)
+			if err != nil || resp.StatusCode != http.StatusNoContent {
+				t.Errorf("Response through tunnel = %v, %v, want 204", resp, err)
+			}
+		})
+	}
+}
+
+func TestHTTPProxyAppliesHTTPRules(t *testing.T) {
+	var received atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+	base := fmt.Sprintf("http://app.test:%d", upstream.Listener.Addr().(*net.TCPAddr).Port)
+
+	filter := proxyTestFilter(t, true)
+	err := filter.SetHTTPRules([]HTTPRule{
+		{Action: "allow", Methods: []string{"GET", "HEAD"}, Host: "app.test", Path: "/packages/**"},
+		{Name: "packages-read-only", Action: "deny", Host: "app.test"},
+	})
+	if err != nil {
+		t.Fatalf("SetHTTPRules() error = %v", err)
+	}
+
+	p, err := NewHTTPProxy(filter, 0)
+	if err != nil {
+		t.Fatalf("NewHTTPProxy() error = %v", err)
+	}
+	p.SetResolver(newStaticResolver(map[string][]string{"app.test": {"127.0.0.1"}}))
+	go p.Start()
+	defer p.Stop()
+
+	proxyURL, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", p.Port()))
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		wantStatus int
+		wantRule   string
+	}{
+		{name: "allowed read", method: http.MethodGet, path: "/packages/left-pad", wantStatus: http.StatusOK},
+		{name: "publish", method: http.MethodPut, path: "/packages/left-pad", wantStatus: http.StatusForbidden, wantRule: "httpRules:packages-read-only"},
+		{name: "other path", method: http.MethodGet, path: "/admin", wantStatus: http.StatusForbidden, wantRule: "httpRules:packages-read-only"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := received.Load()
+
+			req, _ := http.NewRequest(tt.method, base+tt.path, nil)
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("Request error = %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("Status = %d (%q), want %d", resp.StatusCode, body, tt.wantStatus)
+			}
+			if tt.wantRule == "" {
+				return
+			}
+
+			if got := resp.Header.Get("X-Proxy-Rule"); got != tt.wantRule {
+				t.Errorf("X-Proxy-Rule = %q, want %q", got, tt.wantRule)
+			}
+			if !strings.Contains(string(body), tt.wantRule) {
+				t.Errorf("Body %q should name rule %q", body, tt.wantRule)
+			}
+			if received.Load() != before {
+				t.Error("Denied request reached the upstream server")
+			}
+		})
+	}
+}
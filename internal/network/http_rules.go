@@ -0,0 +1,168 @@
+package network
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/gobwas/glob"
+)
+
+// HTTPRule allows or denies requests by method, host and path. Rules are
+// checked in order and the first match decides. Requests no rule matches are
+// allowed, as their host already passed the domain rules.
+type HTTPRule struct {
+	Name    string   // Shown in denied responses and violations, defaults to "httpRules[N]"
+	Action  string   // "allow" or "deny"
+	Methods []string // Empty matches any method
+	Host    string   // Domain pattern as in allowedDomains, empty matches any host
+	Path    string   // "*" matches within a segment and "**" across segments, empty matches any path
+}
+
+// httpRule is a compiled HTTPRule
+type httpRule struct {
+	HTTPRule
+	index int
+	host  *DomainPattern
+	path  glob.Glob
+}
+
+func compileHTTPRule(index int, rule HTTPRule) (httpRule, error) {
+	compiled := httpRule{HTTPRule: rule, index: index}
+
+	switch rule.Action {
+	case "allow", "deny":
+	default:
+		return compiled, fmt.Errorf("invalid action %q: must be \"allow\" or \"deny\"", rule.Action)
+	}
+
+	compiled.Methods = make([]string, len(rule.Methods))
+	for i, method := range rule.Methods {
+		compiled.Methods[i] = strings.ToUpper(method)
+	}
+
+	if rule.Host != "" {
+		host, err := compileDomainPattern(rule.Host)
+		if err != nil {
+			return compiled, fmt.Errorf("invalid host %q: %w", rule.Host, err)
+		}
+		compiled.host = &host
+	}
+
+	if rule.Path != "" {
+		if !strings.HasPrefix(rule.Path, "/") {
+			return compiled, fmt.Errorf("path %q must start with /", rule.Path)
+		}
+		g, err := glob.Compile(rule.Path, '/')
+		if err != nil {
+			return compiled, fmt.Errorf("invalid path %q: %w", rule.Path, err)
+		}
+		compiled.path = g
+	}
+
+	return compiled, nil
+}
+
+// matches reports whether the rule covers a request. The path has been cleaned.
+func (r *httpRule) matches(method, domain string, port int, cleanPath string) bool {
+	if len(r.Methods) > 0 && !slices.Contains(r.Methods, method) {
+		return false
+	}
+	if r.host != nil && !(r.host.Matches(domain) && r.host.allowsPort(port, nil)) {
+		return false
+	}
+	if r.path != nil && !r.path.Match(cleanPath) {
+		return false
+	}
+	return true
+}
+
+// name identifies the rule in decisions, e.g. "httpRules:npm-read-only" or "httpRules[2]"
+func (r *httpRule) name() string {
+	if r.Name != "" {
+		return "httpRules:" + r.Name
+	}
+	return fmt.Sprintf("httpRules[%d]", r.index)
+}
+
+// SetHTTPRules sets the rules checked against each request the proxy can
+// read: plain HTTP, and HTTPS to intercepted domains
+func (f *DomainFilter) SetHTTPRules(rules []HTTPRule) error {
+	f.httpRules = make([]httpRule, 0, len(rules))
+	for i, rule := range rules {
+		compiled, err := compileHTTPRule(i, rule)
+		if err != nil {
+			return fmt.Errorf("invalid HTTP rule %d: %w", i, err)
+		}
+		f.httpRules = append(f.httpRules, compiled)
+	}
+	return nil
+}
+
+// SetIntercept sets the domains whose TLS traffic the HTTP proxy decrypts so
+// the HTTP rules can see each request. Patterns are as in allowedDomains.
+func (f *DomainFilter) SetIntercept(domains []string) error {
+	f.intercept = make([]DomainPattern, 0, len(domains))
+	for _, domain := range domains {
+		pattern, err := compileDomainPattern(domain)
+		if err != nil {
+			return fmt.Errorf("invalid intercept domain %q: %w", domain, err)
+		}
+		f.intercept = append(f.intercept, pattern)
+	}
+	return nil
+}
+
+// Intercepts reports whether tunnels to address are decrypted
+func (f *DomainFilter) Intercepts(address string) bool {
+	domain, port := splitAddress(address)
+	for _, pattern := range f.intercept {
+		if pattern.Matches(domain) && pattern.allowsPort(port, nil) {
+			return true
+		}
+	}
+	return false
+}
+
+// DecideRequest evaluates the HTTP rules for a request to address without
+// side effects. Requests no rule matches are allowed with an empty rule.
+func (f *DomainFilter) DecideRequest(method, address, requestPath string) Decision {
+	domain, port := splitAddress(address)
+	method = strings.ToUpper(method)
+
+	decision := Decision{Domain: domain, Port: port, Allowed: true, Method: method, Path: requestPath}
+
+	// Match the path as the server will see it, so "/org/../other" can't
+	// slip past a rule for "/org/**"
+	cleanPath := path.Clean("/" + requestPath)
+	if strings.HasSuffix(requestPath, "/") && cleanPath != "/" {
+		cleanPath += "/"
+	}
+
+	for i := range f.httpRules {
+		rule := &f.httpRules[i]
+		if rule.matches(method, domain, port, cleanPath) {
+			decision.Allowed = rule.Action == "allow"
+			decision.Rule = rule.name()
+			return decision
+		}
+	}
+
+	return decision
+}
+
+// AllowRequest checks a request against the HTTP rules, returning the rule
+// that denied it. Denials are reported to the decision hook.
+func (f *DomainFilter) AllowRequest(method, address, requestPath string) (bool, string) {
+	decision := f.DecideRequest(method, address, requestPath)
+	if decision.Allowed {
+		return true, decision.Rule
+	}
+
+	if f.hook != nil {
+		f.hook(decision)
+	}
+
+	return f.reportOnly, decision.Rule
+}
@@ -0,0 +1,95 @@
+package network
+
+import "testing"
+
+func TestDomainFilterHTTPRules(t *testing.T) {
+	rules := []HTTPRule{
+		{Action: "allow", Methods: []string{"get", "HEAD"}, Host: "registry.npmjs.org"},
+		{Action: "deny", Host: "registry.npmjs.org"},
+		{Action: "allow", Host: "github.com", Path: "/my-org/**"},
+		{Action: "deny", Host: "github.com"},
+		{Action: "allow", Methods: []string{"POST"}, Host: "api.example.com", Path: "/v1/*/events"},
+		{Name: "no-writes", Action: "deny", Methods: []string{"POST", "PUT", "PATCH", "DELETE"}},
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		address  string
+		path     string
+		want     bool
+		wantRule string
+	}{
+		{name: "read from registry", method: "GET", address: "registry.npmjs.org:443", path: "/left-pad", want: true, wantRule: "httpRules[0]"},
+		{name: "publish to registry", method: "PUT", address: "registry.npmjs.org:443", path: "/left-pad", want: false, wantRule: "httpRules[1]"},
+		{name: "own organisation", method: "POST", address: "github.com:443", path: "/my-org/repo.git/git-receive-pack", want: true, wantRule: "httpRules[2]"},
+		{name: "other organisation", method: "GET", address: "github.com:443", path: "/other-org/repo", want: false, wantRule: "httpRules[3]"},
+		{name: "organisation prefix only", method: "GET", address: "github.com:443", path: "/my-org-fork/repo", want: false, wantRule: "httpRules[3]"},
+		{name: "dot segments", method: "GET", address: "github.com:443", path: "/my-org/../other-org/repo", want: false, wantRule: "httpRules[3]"},
+		{name: "listed api endpoint", method: "POST", address: "api.example.com:443", path: "/v1/app/events", want: true, wantRule: "httpRules[4]"},
+		{name: "single segment wildcard", method: "POST", address: "api.example.com:443", path: "/v1/app/x/events", want: false, wantRule: "httpRules:no-writes"},
+		{name: "post anywhere else", method: "POST", address: "example.org:443", path: "/upload", want: false, wantRule: "httpRules:no-writes"},
+		{name: "no rule matches", method: "GET", address: "example.org:443", path: "/", want: true},
+	}
+
+	filter, err := NewDomainFilter("allow", nil, nil)
+	if err != nil {
+		t.Fatalf("NewDomainFilter() error = %v", err)
+	}
+	if err := filter.SetHTTPRules(rules); err != nil {
+		t.Fatalf("SetHTTPRules() error = %v", err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := filter.DecideRequest(tt.method, tt.address, tt.path)
+			if d.Allowed != tt.want || d.Rule != tt.wantRule {
+				t.Errorf("DecideRequest(%s %s%s) = %v (%q), want %v (%q)",
+					tt.method, tt.address, tt.path, d.Allowed, d.Rule, tt.want, tt.wantRule)
+			}
+		})
+	}
+}
+
+func TestSetHTTPRulesInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		rule HTTPRule
+	}{
+		{name: "missing action", rule: HTTPRule{Host: "github.com"}},
+		{name: "relative path", rule: HTTPRule{Action: "deny", Path: "my-org/**"}},
+		{name: "bad glob", rule: HTTPRule{Action: "deny", Path: "/[a"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, _ := NewDomainFilter("allow", nil, nil)
+			if err := filter.SetHTTPRules([]HTTPRule{tt.rule}); err == nil {
+				t.Error("SetHTTPRules() error = nil, want an error")
+			}
+		})
+	}
+}
+
+func TestDomainFilterIntercepts(t *testing.T) {
+	filter, _ := NewDomainFilter("deny", nil, nil)
+	if err := filter.SetIntercept([]string{"github.com", "*.githubusercontent.com:443"}); err != nil {
+		t.Fatalf("SetIntercept() error = %v", err)
+	}
+
+	tests := []struct {
+		address string
+		want    bool
+	}{
+		{"github.com:443", true},
+		{"raw.githubusercontent.com:443", true},
+		{"raw.githubusercontent.com:8443", false},
+		{"api.github.com:443", false},
+	}
+
+	for _, tt := range tests {
+		if got := filter.Intercepts(tt.address); got != tt.want {
+			t.Errorf("Intercepts(%q) = %v, want %v", tt.address, got, tt.want)
+		}
+	}
+}
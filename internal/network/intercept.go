@@ -0,0 +1,182 @@
+package network
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// interceptHandshakeTimeout bounds the TLS handshake with an intercepted client
+const interceptHandshakeTimeout = 10 * time.Second
+
+// errServerNameDenied fails the handshake of an intercepted tunnel whose
+// server name the filter rejected
+var errServerNameDenied = errors.New("server name denied by sandbox policy")
+
+// SetCA enables TLS interception for the domains the filter intercepts, it
+// must be called before Start
+func (p *HTTPProxy) SetCA(ca *CertificateAuthority) {
+	p.ca = ca
+}
+
+// intercept terminates the client's TLS with a certificate minted for the
+// tunnel's host, then checks each request against the HTTP rules and sends
+// it on over a new, verified TLS connection
+func (p *HTTPProxy) intercept(clientConn net.Conn, address string, record *ConnectionRecord, lease *quotaLease) {
+	host, _ := splitAddress(address)
+
+	tlsConn := tls.Server(clientConn, &tls.Config{
+		NextProtos: []string{"http/1.1"},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if allowed, rule := p.filter.AllowServerName(address, hello.ServerName); !allowed {
+				record.deny(rule)
+				return nil, errServerNameDenied
+			}
+			return p.ca.certificateFor(host)
+		},
+	})
+	defer tlsConn.Close()
+
+	tlsConn.SetDeadline(time.Now().Add(interceptHandshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		slog.Debug("HTTP proxy intercept handshake failed", "address", address, "error", err)
+		if record.Decision != "deny" {
+			record.fail(err)
+		}
+		return
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	reader := bufio.NewReader(tlsConn)
+	for {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			if err != io.EOF {
+				slog.Debug("HTTP proxy failed to read intercepted request", "address", address, "error", err)
+			}
+			return
+		}
+
+		if !p.forwardIntercepted(tlsConn, req, address, lease) {
+			return
+		}
+	}
+}
+
+// forwardIntercepted sends one decrypted request upstream and writes the
+// response to the client. It reports whether the connection can be reused.
+// The tunnel's lease counts the request; its bytes are counted on the tunnel.
+func (p *HTTPProxy) forwardIntercepted(w io.Writer, req *http.Request, address string, lease *quotaLease) bool {
+	record := p.start(ProtocolHTTPS, address)
+	defer p.finish(record)
+	record.Method = req.Method
+	record.Path = req.URL.Path
+
+	allowed, rule := p.filter.AllowRequest(req.Method, address, req.URL.Path)
+	record.Rule = rule
+	if !allowed {
+		slog.Debug("HTTP proxy blocked intercepted request", "address", address, "method", req.Method, "path", req.URL.Path, "rule", rule)
+		record.deny(rule)
+		record.Status = http.StatusForbidden
+		writeInterceptedError(w, req, http.StatusForbidden, deniedRequestHeader(rule), deniedRequestMessage(rule))
+		return false
+	}
+	if allowed, rule := p.filter.applySecrets(req.Method, address, req.URL, req.Header); !allowed {
+		slog.Debug("HTTP proxy blocked intercepted request carrying a secret placeholder", "address", address, "rule", rule)
+		record.deny(rule)
+		record.Status = http.StatusForbidden
+		writeInterceptedError(w, req, http.StatusForbidden, deniedSecretHeader(rule), deniedSecretMessage(rule))
+		return false
+	}
+	if rule, ok := lease.request(); !ok {
+		slog.Debug("HTTP proxy intercepted request over quota", "address", address, "rule", rule)
+		record.deny(rule)
+		record.Status = http.StatusTooManyRequests
+		writeInterceptedError(w, req, http.StatusTooManyRequests, quotaExceededHeader(rule), quotaExceededMessage(rule))
+		return false
+	}
+
+	// Send the request to the tunnel's host, whatever Host header the client sent
+	req.RequestURI = ""
+	req.URL.Scheme = "https"
+	req.URL.Host = urlHost(address)
+	req.Host = ""
+	removeHopByHopHeaders(req.Header)
+
+	// Count the bodies sent and received
+	body := &countingReader{ReadCloser: req.Body}
+	if req.Body != http.NoBody {
+		req.Body = body
+	}
+	req = req.WithContext(traceConnection(req.Context(), record))
+
+	resp, err := p.transport.RoundTrip(req)
+	record.BytesUp = body.n
+	if err != nil {
+		slog.Debug("HTTP proxy intercepted request failed", "url", req.URL.String(), "error", err)
+		if rule := lease.cutBy(); rule != "" {
+			record.deny(rule)
+			return false
+		}
+		record.fail(err)
+		if errors.Is(err, ErrAddressDenied) {
+			record.Status = http.StatusForbidden
+			writeInterceptedError(w, req, http.StatusForbidden, http.Header{"X-Proxy-Error": {"blocked-by-allowlist"}}, "Domain not allowed by sandbox policy")
+		} else {
+			record.Status = http.StatusBadGateway
+			writeInterceptedError(w, req, http.StatusBadGateway, http.Header{"X-Proxy-Error": {"upstream-failed"}}, err.Error())
+		}
+		return false
+	}
+	defer resp.Body.Close()
+	record.Status = resp.StatusCode
+
+	received := &countingReader{ReadCloser: resp.Body}
+	resp.Body = received
+	removeHopByHopHeaders(resp.Header)
+	resp.Close = req.Close
+	err = resp.Write(w)
+	record.BytesDown = received.n
+	if err != nil {
+		if rule := lease.cutBy(); rule != "" {
+			record.deny(rule)
+		}
+		return false
+	}
+
+	return !req.Close
+}
+
+// writeInterceptedError answers an intercepted request and closes the connection
+func writeInterceptedError(w io.Writer, req *http.Request, status int, header http.Header, message string) {
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	resp := &http.Response{
+		StatusCode:    status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(message + "\n")),
+		ContentLength: int64(len(message) + 1),
+		Close:         true,
+	}
+	resp.Write(w)
+}
+
+// urlHost returns address as a URL host, leaving out the default HTTPS port
+func urlHost(address string) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || port != "443" {
+		return address
+	}
+	if strings.Contains(host, ":") {
+		return "[" + host + "]"
+	}
+	return host
+}
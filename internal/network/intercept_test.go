@@ -0,0 +1,129 @@
+package network
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestHTTPProxyInterceptsTLS(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s %s", r.Method, r.Host, r.URL.Path)
+	}))
+	defer upstream.Close()
+	port := upstream.Listener.Addr().(*net.TCPAddr).Port
+
+	filter := proxyTestFilter(t, true)
+	if err := filter.SetIntercept([]string{"app.test"}); err != nil {
+		t.Fatalf("SetIntercept() error = %v", err)
+	}
+	err := filter.SetHTTPRules([]HTTPRule{
+		{Action: "allow", Methods: []string{"GET"}, Host: "app.test", Path: "/my-org/**"},
+		{Action: "deny", Host: "app.test"},
+	})
+	if err != nil {
+		t.Fatalf("SetHTTPRules() error = %v", err)
+	}
+	denied := make(chan Decision, 4)
+	filter.SetDecisionHook(func(d Decision) {
+		if !d.Allowed {
+			denied <- d
+		}
+	})
+
+	ca, err := LoadOrCreateCA(t.TempDir())
+	if err != nil {
+		t.Fatalf("LoadOrCreateCA() error = %v", err)
+	}
+
+	p, err := NewHTTPProxy(filter, 0)
+	if err != nil {
+		t.Fatalf("NewHTTPProxy() error = %v", err)
+	}
+	p.SetResolver(newStaticResolver(map[string][]string{"app.test": {"127.0.0.1"}}))
+	p.SetCA(ca)
+
+	// The proxy verifies the upstream server, whose test certificate is for example.com
+	upstreamRoots := x509.NewCertPool()
+	upstreamRoots.AddCert(upstream.Certificate())
+	p.transport.TLSClientConfig = &tls.Config{RootCAs: upstreamRoots, ServerName: "example.com"}
+
+	go p.Start()
+	defer p.Stop()
+
+	// The client trusts only the interception CA
+	clientRoots := x509.NewCertPool()
+	clientRoots.AddCert(ca.Certificate())
+	proxyURL, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", p.Port()))
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: clientRoots},
+	}}
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		wantStatus int
+		wantBody   string
+		wantRule   string
+	}{
+		{name: "allowed path", method: "GET", path: "/my-org/repo", wantStatus: http.StatusOK, wantBody: fmt.Sprintf("GET app.test:%d /my-org/repo", port)},
+		{name: "second request on the connection", method: "GET", path: "/my-org/other", wantStatus: http.StatusOK, wantBody: fmt.Sprintf("GET app.test:%d /my-org/other", port)},
+		{name: "denied path", method: "GET", path: "/other-org/repo", wantStatus: http.StatusForbidden, wantRule: "httpRules[1]"},
+		{name: "denied method", method: "POST", path: "/my-org/repo", wantStatus: http.StatusForbidden, wantRule: "httpRules[1]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, fmt.Sprintf("https://app.test:%d%s", port, tt.path), nil)
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("Request error = %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("Status = %d (%q), want %d", resp.StatusCode, body, tt.wantStatus)
+			}
+			if tt.wantBody != "" && string(body) != tt.wantBody {
+				t.Errorf("Body = %q, want %q", body, tt.wantBody)
+			}
+
+			if tt.wantRule == "" {
+				return
+			}
+			if got := resp.Header.Get("X-Proxy-Error"); got != "blocked-by-http-rule" {
+				t.Errorf("X-Proxy-Error = %q, want blocked-by-http-rule", got)
+			}
+			if got := resp.Header.Get("X-Proxy-Rule"); got != tt.wantRule {
+				t.Errorf("X-Proxy-Rule = %q, want %q", got, tt.wantRule)
+			}
+			d := <-denied
+			if d.Rule != tt.wantRule || d.Method != tt.method || d.Path != tt.path {
+				t.Errorf("Decision = %+v, want %s %s denied by %s", d, tt.method, tt.path, tt.wantRule)
+			}
+		})
+	}
+}
+
+func TestURLHost(t *testing.T) {
+	tests := map[string]string{
+		"github.com:443":  "github.com",
+		"github.com:8443": "github.com:8443",
+		"[::1]:443":       "[::1]",
+		"[::1]:8443":      "[::1]:8443",
+	}
+	for address, want := range tests {
+		if got := urlHost(address); got != want {
+			t.Errorf("urlHost(%q) = %q, want %q", address, got, want)
+		}
+	}
+}
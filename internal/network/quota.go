@@ -0,0 +1,234 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// errQuotaExceeded cuts a connection that went over a quota
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// Quota limits on proxied traffic. Zero fields are unlimited.
+type Quota struct {
+	BytesUp     int64 // Sent by the sandboxed command
+	BytesDown   int64 // Received from destinations
+	Requests    int64 // Connections opened, plus requests in intercepted tunnels
+	Connections int64 // Connections open at once
+}
+
+// DomainQuota limits traffic to the hosts matching a domain pattern, which
+// share the limits
+type DomainQuota struct {
+	Domain string // Pattern as in allowedDomains
+	Quota
+}
+
+// quotaCounter tracks usage against the limits of one quota
+type quotaCounter struct {
+	scope    string         // "run" or the domain entry
+	pattern  *DomainPattern // Nil for the run quota
+	limit    Quota
+	used     Quota
+	reported map[string]bool // Limits reported in report-only mode, which reports each once
+}
+
+// exceeded returns the first limit that adding to the usage would exceed, or ""
+func (c *quotaCounter) exceeded(add Quota) string {
+	switch {
+	case c.limit.Requests > 0 && c.used.Requests+add.Requests > c.limit.Requests:
+		return "requests"
+	case c.limit.Connections > 0 && c.used.Connections+add.Connections > c.limit.Connections:
+		return "connections"
+	case c.limit.BytesUp > 0 && c.used.BytesUp+add.BytesUp > c.limit.BytesUp:
+		return "bytesUp"
+	case c.limit.BytesUp > 0 && add.Requests > 0 && c.used.BytesUp >= c.limit.BytesUp:
+		return "bytesUp"
+	case c.limit.BytesDown > 0 && c.used.BytesDown+add.BytesDown > c.limit.BytesDown:
+		return "bytesDown"
+	case c.limit.BytesDown > 0 && add.Requests > 0 && c.used.BytesDown >= c.limit.BytesDown:
+		return "bytesDown"
+	}
+	return ""
+}
+
+func (c *quotaCounter) add(q Quota) {
+	c.used.BytesUp += q.BytesUp
+	c.used.BytesDown += q.BytesDown
+	c.used.Requests += q.Requests
+	c.used.Connections += q.Connections
+}
+
+// quotaTracker holds the quotas shared by the proxies
+type quotaTracker struct {
+	mu       sync.Mutex
+	counters []*quotaCounter
+}
+
+// SetQuotas limits traffic across the run and to matching domains. Every
+// quota covering a destination applies. Going over one cuts the connection
+// and reports a denial to the decision hook, unless the filter only reports.
+func (f *DomainFilter) SetQuotas(run Quota, domains []DomainQuota) error {
+	tracker := &quotaTracker{}
+	if run != (Quota{}) {
+		tracker.counters = append(tracker.counters, &quotaCounter{scope: "run", limit: run})
+	}
+	for _, dq := range domains {
+		pattern, err := compileDomainPattern(dq.Domain)
+		if err != nil {
+			return fmt.Errorf("invalid quota domain %q: %w", dq.Domain, err)
+		}
+		tracker.counters = append(tracker.counters, &quotaCounter{scope: dq.Domain, pattern: &pattern, limit: dq.Quota})
+	}
+
+	f.quotas = nil
+	if len(tracker.counters) > 0 {
+		f.quotas = tracker
+	}
+	return nil
+}
+
+// quotaLease is one connection's share of the quotas covering its destination
+type quotaLease struct {
+	filter   *DomainFilter
+	domain   string
+	port     int
+	counters []*quotaCounter
+
+	mu       sync.Mutex
+	cut      string // Rule of the quota that cut the connection
+	released bool
+}
+
+// acquireQuota counts a new connection to address against the quotas
+// covering it. A nil lease without a denial means no quota applies; the
+// lease's methods accept nil.
+func (f *DomainFilter) acquireQuota(address string) (*quotaLease, bool, string) {
+	if f.quotas == nil {
+		return nil, true, ""
+	}
+
+	domain, port := splitAddress(address)
+	lease := &quotaLease{filter: f, domain: domain, port: port}
+	for _, c := range f.quotas.counters {
+		if c.pattern == nil || (c.pattern.Matches(domain) && c.pattern.allowsPort(port, nil)) {
+			lease.counters = append(lease.counters, c)
+		}
+	}
+	if len(lease.counters) == 0 {
+		return nil, true, ""
+	}
+
+	if rule, ok := lease.use(Quota{Requests: 1, Connections: 1}); !ok {
+		return nil, false, rule
+	}
+	return lease, true, ""
+}
+
+// use adds usage to every quota of the lease, unless that would go over a
+// limit. Only the filter's report-only mode lets usage go over.
+func (l *quotaLease) use(add Quota) (string, bool) {
+	f := l.filter
+	var denied []Decision
+
+	f.quotas.mu.Lock()
+	for _, c := range l.counters {
+		limit := c.exceeded(add)
+		if limit == "" {
+			continue
+		}
+		if f.reportOnly && c.reported[limit] {
+			continue
+		}
+		if f.reportOnly {
+			if c.reported == nil {
+				c.reported = make(map[string]bool)
+			}
+			c.reported[limit] = true
+		}
+		denied = append(denied, Decision{
+			Domain: l.domain,
+			Port:   l.port,
+			Rule:   fmt.Sprintf("quotas:%s %s", c.scope, limit),
+			Quota:  true,
+		})
+	}
+	allowed := len(denied) == 0 || f.reportOnly
+	if allowed {
+		for _, c := range l.counters {
+			c.add(add)
+		}
+	}
+	f.quotas.mu.Unlock()
+
+	// Report outside the lock, the hook may be slow
+	if f.hook != nil {
+		for _, d := range denied {
+			f.hook(d)
+		}
+	}
+
+	if allowed {
+		return "", true
+	}
+	return denied[0].Rule, false
+}
+
+// request counts a request made inside the connection
+func (l *quotaLease) request() (string, bool) {
+	if l == nil {
+		return "", true
+	}
+	return l.use(Quota{Requests: 1})
+}
+
+// transfer counts bytes sent up and down, and reports false once the
+// connection has gone over a quota and must be cut
+func (l *quotaLease) transfer(up, down int64) bool {
+	if l == nil || (up == 0 && down == 0) {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.cut != "" {
+		return false
+	}
+
+	rule, ok := l.use(Quota{BytesUp: up, BytesDown: down})
+	if !ok {
+		l.cut = rule
+	}
+	return ok
+}
+
+// cutBy returns the rule of the quota that cut the connection, or ""
+func (l *quotaLease) cutBy() string {
+	if l == nil {
+		return ""
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.cut
+}
+
+// release ends the connection's use of the concurrent connection limits
+func (l *quotaLease) release() {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.released {
+		return
+	}
+	l.released = true
+
+	l.filter.quotas.mu.Lock()
+	defer l.filter.quotas.mu.Unlock()
+	for _, c := range l.counters {
+		c.used.Connections--
+	}
+}
@@ -0,0 +1,219 @@
+package network
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/proxy"
+)
+
+func TestDomainFilterQuotas(t *testing.T) {
+	filter, _ := NewDomainFilter("allow", nil, nil)
+	err := filter.SetQuotas(Quota{Connections: 2}, []DomainQuota{
+		{Domain: "*.github.com", Quota: Quota{BytesUp: 100, Requests: 3}},
+	})
+	if err != nil {
+		t.Fatalf("SetQuotas() error = %v", err)
+	}
+	var reported []Decision
+	filter.SetDecisionHook(func(d Decision) { reported = append(reported, d) })
+
+	acquire := func(address, wantRule string) *quotaLease {
+		t.Helper()
+		lease, allowed, rule := filter.acquireQuota(address)
+		if allowed != (wantRule == "") || rule != wantRule {
+			t.Fatalf("acquireQuota(%q) = %v (%q), want rule %q", address, allowed, rule, wantRule)
+		}
+		return lease
+	}
+
+	// Concurrent connections are limited across the run
+	first := acquire("api.github.com:443", "")
+	second := acquire("example.com:443", "")
+	acquire("example.com:443", "quotas:run connections")
+	second.release()
+	second.release()
+	second = acquire("example.com:443", "")
+	second.release()
+
+	// Bytes sent to github.com hosts are shared, and going over cuts the connection
+	if !first.transfer(60, 1000) {
+		t.Fatal("transfer() cut the connection under the limit")
+	}
+	other := acquire("raw.github.com:443", "")
+	if other.transfer(50, 0) {
+		t.Fatal("transfer() allowed going over the bytesUp limit")
+	}
+	if got := other.cutBy(); got != "quotas:*.github.com bytesUp" {
+		t.Errorf("cutBy() = %q, want the github.com bytesUp quota", got)
+	}
+	if other.transfer(1, 0) {
+		t.Error("transfer() allowed bytes on a cut connection")
+	}
+	other.release()
+	first.release()
+
+	// The request count includes the connections that were allowed
+	acquire("api.github.com:443", "").release()
+	acquire("api.github.com:443", "quotas:*.github.com requests")
+
+	if len(reported) != 3 {
+		t.Fatalf("Reported %d decisions, want 3: %+v", len(reported), reported)
+	}
+	for _, d := range reported {
+		if d.Allowed || !d.Quota {
+			t.Errorf("Reported decision %+v, want a quota denial", d)
+		}
+	}
+}
+
+func TestDomainFilterQuotasReportOnly(t *testing.T) {
+	filter, _ := NewDomainFilter("allow", nil, nil)
+	if err := filter.SetQuotas(Quota{Requests: 1}, nil); err != nil {
+		t.Fatalf("SetQuotas() error = %v", err)
+	}
+	filter.SetReportOnly(true)
+	var reported []Decision
+	filter.SetDecisionHook(func(d Decision) { reported = append(reported, d) })
+
+	for i := 0; i < 3; i++ {
+		lease, allowed, _ := filter.acquireQuota("example.com:443")
+		if !allowed {
+			t.Fatalf("acquireQuota() denied request %d in report-only mode", i+1)
+		}
+		lease.release()
+	}
+
+	// Each exceeded limit is reported once, not on every request
+	if len(reported) != 1 || reported[0].Rule != "quotas:run requests" {
+		t.Errorf("Reported %+v, want one run requests denial", reported)
+	}
+}
+
+func TestHTTPProxyEnforcesQuotas(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, strings.Repeat("x", 64))
+	}))
+	defer upstream.Close()
+	upstreamPort := upstream.Listener.Addr().(*net.TCPAddr).Port
+	echoPort := echoListener(t)
+
+	filter := proxyTestFilter(t, true)
+	err := filter.SetQuotas(Quota{}, []DomainQuota{
+		{Domain: fmt.Sprintf("app.test:%d", upstreamPort), Quota: Quota{Requests: 1}},
+		{Domain: fmt.Sprintf("app.test:%d", echoPort), Quota: Quota{BytesUp: 8}},
+	})
+	if err != nil {
+		t.Fatalf("SetQuotas() error = %v", err)
+	}
+	denied := make(chan Decision, 4)
+	filter.SetDecisionHook(func(d Decision) {
+		if !d.Allowed {
+			denied <- d
+		}
+	})
+
+	p, err := NewHTTPProxy(filter, 0)
+	if err != nil {
+		t.Fatalf("NewHTTPProxy() error = %v", err)
+	}
+	p.SetResolver(newStaticResolver(map[string][]string{"app.test": {"127.0.0.1"}}))
+	hook, records := recordHook()
+	p.SetConnectionHook(hook)
+	go p.Start()
+	defer p.Stop()
+
+	proxyURL, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", p.Port()))
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	t.Run("request limit", func(t *testing.T) {
+		for i, wantStatus := range []int{http.StatusOK, http.StatusTooManyRequests} {
+			resp, err := client.Get(fmt.Sprintf("http://app.test:%d/", upstreamPort))
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != wantStatus {
+				t.Fatalf("Request %d status = %d, want %d", i+1, resp.StatusCode, wantStatus)
+			}
+			nextRecord(t, records)
+		}
+
+		if d := <-denied; d.Rule != fmt.Sprintf("quotas:app.test:%d requests", upstreamPort) || !d.Quota {
+			t.Errorf("Decision = %+v, want the requests quota", d)
+		}
+	})
+
+	t.Run("tunnel cut", func(t *testing.T) {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", p.Port()))
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		defer conn.Close()
+
+		fmt.Fprintf(conn, "CONNECT app.test:%d HTTP/1.1\r\nHost: app.test:%d\r\n\r\n", echoPort, echoPort)
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("CONNECT response = %v, %v", resp, err)
+		}
+		io.WriteString(conn, "more than eight bytes")
+		if reply, _ := io.ReadAll(reader); len(reply) != 0 {
+			t.Errorf("Reply = %q, want the tunnel cut before sending", reply)
+		}
+
+		wantRule := fmt.Sprintf("quotas:app.test:%d bytesUp", echoPort)
+		if d := <-denied; d.Rule != wantRule {
+			t.Errorf("Decision = %+v, want rule %q", d, wantRule)
+		}
+		if r := nextRecord(t, records); r.Decision != "deny" || r.Rule != wantRule || r.BytesUp != 0 {
+			t.Errorf("Record = %+v, want denied by %q with nothing sent", r, wantRule)
+		}
+	})
+}
+
+func TestSOCKSProxyEnforcesQuotas(t *testing.T) {
+	echoPort := echoListener(t)
+
+	filter := proxyTestFilter(t, true)
+	if err := filter.SetQuotas(Quota{BytesDown: 2}, nil); err != nil {
+		t.Fatalf("SetQuotas() error = %v", err)
+	}
+
+	p, err := NewSOCKSProxy(filter, 0)
+	if err != nil {
+		t.Fatalf("NewSOCKSProxy() error = %v", err)
+	}
+	p.SetResolver(newStaticResolver(map[string][]string{"app.test": {"127.0.0.1"}}))
+	hook, records := recordHook()
+	p.SetConnectionHook(hook)
+	go p.Start()
+	defer p.Stop()
+
+	client, err := proxy.SOCKS5("tcp", fmt.Sprintf("127.0.0.1:%d", p.Port()), nil, proxy.Direct)
+	if err != nil {
+		t.Fatalf("SOCKS5() error = %v", err)
+	}
+
+	conn, err := client.Dial("tcp", net.JoinHostPort("app.test", strconv.Itoa(echoPort)))
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	io.WriteString(conn, "hello")
+	reply, _ := io.ReadAll(conn)
+	conn.Close()
+	if len(reply) != 0 {
+		t.Errorf("Reply = %q, want the connection cut before receiving", reply)
+	}
+	if r := nextRecord(t, records); r.Decision != "deny" || r.Rule != "quotas:run bytesDown" {
+		t.Errorf("Record = %+v, want denied by the run bytesDown quota", r)
+	}
+}
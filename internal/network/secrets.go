@@ -0,0 +1,162 @@
+package network
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Secret is a credential the sandboxed command only sees as a placeholder.
+// The HTTP proxy puts the value in place of the placeholder in the headers of
+// requests to the secret's domains, and refuses requests carrying the
+// placeholder anywhere else.
+type Secret struct {
+	Name        string   // Identifies the secret in decisions
+	Placeholder string   // e.g. "SRT_SECRET_GITHUB"
+	Value       string   // Never reported or logged
+	Domains     []string // Patterns as in allowedDomains
+}
+
+// secretBinding is a Secret with its domains compiled
+type secretBinding struct {
+	Secret
+	domains []DomainPattern
+}
+
+// rule names the secret in decisions, e.g. "secrets:GITHUB"
+func (b *secretBinding) rule() string {
+	return "secrets:" + b.Name
+}
+
+// boundTo reports whether the secret may be sent to domain and port
+func (b *secretBinding) boundTo(domain string, port int) bool {
+	for _, pattern := range b.domains {
+		if pattern.Matches(domain) && pattern.allowsPort(port, nil) {
+			return true
+		}
+	}
+	return false
+}
+
+// carriedBy reports whether a request's URL or headers hold the placeholder
+func (b *secretBinding) carriedBy(u *url.URL, header http.Header) bool {
+	if strings.Contains(u.String(), b.Placeholder) {
+		return true
+	}
+	for name, values := range header {
+		for _, value := range values {
+			if strings.Contains(value, b.Placeholder) {
+				return true
+			}
+			if decoded, ok := basicCredentials(name, value); ok && strings.Contains(decoded, b.Placeholder) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SetSecrets sets the secrets the HTTP proxy substitutes in plain HTTP and
+// intercepted requests. No placeholder may contain another.
+func (f *DomainFilter) SetSecrets(secrets []Secret) error {
+	f.secrets = make([]secretBinding, 0, len(secrets))
+	for _, secret := range secrets {
+		if secret.Placeholder == "" || secret.Value == "" {
+			return fmt.Errorf("secret %q needs a placeholder and a value", secret.Name)
+		}
+		for _, other := range f.secrets {
+			if strings.Contains(secret.Placeholder, other.Placeholder) || strings.Contains(other.Placeholder, secret.Placeholder) {
+				return fmt.Errorf("secret placeholders %q and %q overlap", other.Placeholder, secret.Placeholder)
+			}
+		}
+
+		binding := secretBinding{Secret: secret}
+		for _, domain := range secret.Domains {
+			pattern, err := compileDomainPattern(domain)
+			if err != nil {
+				return fmt.Errorf("invalid domain %q for secret %q: %w", domain, secret.Name, err)
+			}
+			binding.domains = append(binding.domains, pattern)
+		}
+		f.secrets = append(f.secrets, binding)
+	}
+	return nil
+}
+
+// applySecrets replaces the placeholders in a request's headers with the
+// secrets bound to address. A request carrying a placeholder whose secret
+// isn't bound to address is denied, and reported to the decision hook,
+// returning the secret's rule. Placeholders are only replaced in headers.
+func (f *DomainFilter) applySecrets(method, address string, u *url.URL, header http.Header) (bool, string) {
+	if len(f.secrets) == 0 {
+		return true, ""
+	}
+	domain, port := splitAddress(address)
+
+	var replacements []string
+	for i := range f.secrets {
+		b := &f.secrets[i]
+		if !b.carriedBy(u, header) {
+			continue
+		}
+		if b.boundTo(domain, port) {
+			replacements = append(replacements, b.Placeholder, b.Value)
+			continue
+		}
+
+		decision := Decision{
+			Domain: domain,
+			Port:   port,
+			Rule:   b.rule(),
+			Method: strings.ToUpper(method),
+			Path:   u.Path,
+			Secret: true,
+		}
+		if f.hook != nil {
+			f.hook(decision)
+		}
+		if !f.reportOnly {
+			return false, decision.Rule
+		}
+	}
+
+	if len(replacements) > 0 {
+		replacer := strings.NewReplacer(replacements...)
+		for name, values := range header {
+			for i, value := range values {
+				values[i] = replaceInHeader(replacer, name, value)
+			}
+		}
+	}
+	return true, ""
+}
+
+// basicCredentials decodes the "user:password" of a Basic Authorization
+// header, where tools such as git put tokens
+func basicCredentials(name, value string) (string, bool) {
+	if !strings.EqualFold(name, "Authorization") {
+		return "", false
+	}
+	scheme, encoded, ok := strings.Cut(value, " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", false
+	}
+	return string(decoded), true
+}
+
+// replaceInHeader replaces placeholders in a header value, inside the
+// encoding of Basic credentials too
+func replaceInHeader(replacer *strings.Replacer, name, value string) string {
+	if decoded, ok := basicCredentials(name, value); ok {
+		if replaced := replacer.Replace(decoded); replaced != decoded {
+			return "Basic " + base64.StdEncoding.EncodeToString([]byte(replaced))
+		}
+	}
+	return replacer.Replace(value)
+}
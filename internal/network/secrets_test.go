@@ -0,0 +1,210 @@
+package network
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestDomainFilterApplySecrets(t *testing.T) {
+	basic := func(credentials string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+	}
+
+	tests := []struct {
+		name       string
+		address    string
+		url        string
+		header     http.Header
+		reportOnly bool
+		wantAllow  bool
+		wantRule   string
+		wantHeader http.Header
+	}{
+		{
+			name:       "bound domain",
+			address:    "api.github.com:443",
+			url:        "/user",
+			header:     http.Header{"Authorization": {"Bearer SRT_SECRET_GITHUB"}},
+			wantAllow:  true,
+			wantHeader: http.Header{"Authorization": {"Bearer ghp_real"}},
+		},
+		{
+			name:       "basic credentials",
+			address:    "github.com:443",
+			url:        "/org/repo.git/info/refs",
+			header:     http.Header{"Authorization": {basic("x-access-token:SRT_SECRET_GITHUB")}},
+			wantAllow:  true,
+			wantHeader: http.Header{"Authorization": {basic("x-access-token:ghp_real")}},
+		},
+		{
+			name:       "no placeholder",
+			address:    "example.com:443",
+			url:        "/",
+			header:     http.Header{"Accept": {"*/*"}},
+			wantAllow:  true,
+			wantHeader: http.Header{"Accept": {"*/*"}},
+		},
+		{
+			name:       "unbound domain",
+			address:    "example.com:443",
+			url:        "/collect",
+			header:     http.Header{"X-Token": {"SRT_SECRET_GITHUB"}},
+			wantRule:   "secrets:GITHUB",
+			wantHeader: http.Header{"X-Token": {"SRT_SECRET_GITHUB"}},
+		},
+		{
+			name:       "placeholder in the URL",
+			address:    "example.com:443",
+			url:        "/collect?token=SRT_SECRET_GITHUB",
+			header:     http.Header{},
+			wantRule:   "secrets:GITHUB",
+			wantHeader: http.Header{},
+		},
+		{
+			name:       "one of two placeholders unbound",
+			address:    "api.github.com:443",
+			url:        "/",
+			header:     http.Header{"Authorization": {"Bearer SRT_SECRET_GITHUB"}, "X-Npm": {"SRT_SECRET_NPM"}},
+			wantRule:   "secrets:NPM",
+			wantHeader: http.Header{"Authorization": {"Bearer SRT_SECRET_GITHUB"}, "X-Npm": {"SRT_SECRET_NPM"}},
+		},
+		{
+			name:       "report only",
+			address:    "api.github.com:443",
+			url:        "/",
+			header:     http.Header{"Authorization": {"Bearer SRT_SECRET_GITHUB"}, "X-Npm": {"SRT_SECRET_NPM"}},
+			reportOnly: true,
+			wantAllow:  true,
+			wantRule:   "secrets:NPM",
+			wantHeader: http.Header{"Authorization": {"Bearer ghp_real"}, "X-Npm": {"SRT_SECRET_NPM"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, _ := NewDomainFilter("allow", nil, nil)
+			err := filter.SetSecrets([]Secret{
+				{Name: "GITHUB", Placeholder: "SRT_SECRET_GITHUB", Value: "ghp_real", Domains: []string{"github.com", "*.github.com"}},
+				{Name: "NPM", Placeholder: "SRT_SECRET_NPM", Value: "npm_real", Domains: []string{"registry.npmjs.org"}},
+			})
+			if err != nil {
+				t.Fatalf("SetSecrets() error = %v", err)
+			}
+			filter.SetReportOnly(tt.reportOnly)
+			var reported []Decision
+			filter.SetDecisionHook(func(d Decision) { reported = append(reported, d) })
+
+			u, _ := url.Parse(tt.url)
+			allowed, rule := filter.applySecrets("get", tt.address, u, tt.header)
+			if allowed != tt.wantAllow {
+				t.Errorf("applySecrets() allowed = %v, want %v", allowed, tt.wantAllow)
+			}
+			if !tt.reportOnly && rule != tt.wantRule {
+				t.Errorf("applySecrets() rule = %q, want %q", rule, tt.wantRule)
+			}
+			if fmt.Sprint(tt.header) != fmt.Sprint(tt.wantHeader) {
+				t.Errorf("Header = %v, want %v", tt.header, tt.wantHeader)
+			}
+
+			if tt.wantRule == "" {
+				if len(reported) != 0 {
+					t.Errorf("Reported %+v, want nothing", reported)
+				}
+				return
+			}
+			if len(reported) != 1 || reported[0].Rule != tt.wantRule || !reported[0].Secret || reported[0].Method != "GET" || reported[0].Path != u.Path {
+				t.Errorf("Reported %+v, want one %s denial", reported, tt.wantRule)
+			}
+		})
+	}
+}
+
+func TestDomainFilterSetSecretsOverlap(t *testing.T) {
+	filter, _ := NewDomainFilter("allow", nil, nil)
+	err := filter.SetSecrets([]Secret{
+		{Name: "GH", Placeholder: "SRT_SECRET_GH", Value: "a", Domains: []string{"github.com"}},
+		{Name: "GH2", Placeholder: "SRT_SECRET_GH2", Value: "b", Domains: []string{"github.com"}},
+	})
+	if err == nil {
+		t.Error("SetSecrets() accepted a placeholder containing another")
+	}
+}
+
+func TestHTTPProxySubstitutesSecrets(t *testing.T) {
+	received := make(chan string, 4)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Host + " " + r.Header.Get("Authorization")
+	}))
+	defer upstream.Close()
+	port := upstream.Listener.Addr().(*net.TCPAddr).Port
+
+	filter, _ := NewDomainFilter("deny", []string{"app.test", "mirror.test"}, nil)
+	if err := filter.SetCIDRs([]string{"127.0.0.1"}, nil); err != nil {
+		t.Fatalf("SetCIDRs() error = %v", err)
+	}
+	err := filter.SetSecrets([]Secret{{Name: "APP", Placeholder: "SRT_SECRET_APP", Value: "real-token", Domains: []string{"app.test"}}})
+	if err != nil {
+		t.Fatalf("SetSecrets() error = %v", err)
+	}
+
+	p, err := NewHTTPProxy(filter, 0)
+	if err != nil {
+		t.Fatalf("NewHTTPProxy() error = %v", err)
+	}
+	p.SetResolver(newStaticResolver(map[string][]string{"app.test": {"127.0.0.1"}, "mirror.test": {"127.0.0.1"}}))
+	hook, records := recordHook()
+	p.SetConnectionHook(hook)
+	go p.Start()
+	defer p.Stop()
+
+	proxyURL, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", p.Port()))
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	get := func(t *testing.T, host string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest("GET", fmt.Sprintf("http://%s:%d/", host, port), nil)
+		req.Header.Set("Authorization", "Bearer SRT_SECRET_APP")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Request error = %v", err)
+		}
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+
+	t.Run("bound domain", func(t *testing.T) {
+		if resp := get(t, "app.test"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("Status = %d, want 200", resp.StatusCode)
+		}
+		want := fmt.Sprintf("app.test:%d Bearer real-token", port)
+		if got := <-received; got != want {
+			t.Errorf("Upstream received %q, want %q", got, want)
+		}
+		nextRecord(t, records)
+	})
+
+	t.Run("unbound domain", func(t *testing.T) {
+		resp := get(t, "mirror.test")
+		if resp.StatusCode != http.StatusForbidden || resp.Header.Get("X-Proxy-Error") != "secret-not-bound" {
+			t.Fatalf("Response = %d %v, want 403 secret-not-bound", resp.StatusCode, resp.Header)
+		}
+		if got := resp.Header.Get("X-Proxy-Rule"); got != "secrets:APP" {
+			t.Errorf("X-Proxy-Rule = %q, want secrets:APP", got)
+		}
+		select {
+		case got := <-received:
+			t.Errorf("Upstream received %q, want the request refused", got)
+		default:
+		}
+		if r := nextRecord(t, records); r.Decision != "deny" || r.Rule != "secrets:APP" {
+			t.Errorf("Record = %+v, want denied by secrets:APP", r)
+		}
+	})
+}
@@ -0,0 +1,83 @@
+package network
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// sniPeekTimeout bounds the wait for a client's first bytes in a tunnel
+const sniPeekTimeout = 10 * time.Second
+
+// errHelloRead stops the TLS handshake once the ClientHello has been parsed
+var errHelloRead = errors.New("client hello read")
+
+// peekResult is what a client sent first through a tunnel
+type peekResult struct {
+	serverName string // SNI from the ClientHello, "" if there was none
+	isTLS      bool   // The bytes parsed as a TLS ClientHello
+	peeked     []byte // Bytes read, to be forwarded to the destination
+	timedOut   bool   // The client sent nothing complete before the timeout
+}
+
+// peekServerName reads the client's TLS ClientHello without answering it and
+// returns the server name it asks for. The bytes read are returned so they
+// can be replayed to the destination. Clients that don't speak TLS yield
+// isTLS false. An error means the client went away.
+func peekServerName(conn net.Conn, timeout time.Duration) (peekResult, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return peekResult{}, err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	rec := &recordingConn{Conn: conn}
+	var hello *tls.ClientHelloInfo
+	tls.Server(rec, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = info
+			return nil, errHelloRead
+		},
+	}).Handshake()
+
+	result := peekResult{peeked: rec.buf.Bytes()}
+	if hello != nil {
+		result.serverName = hello.ServerName
+		result.isTLS = true
+		return result, nil
+	}
+
+	var netErr net.Error
+	switch {
+	case rec.err == nil:
+		// Read fine but wasn't a ClientHello
+	case errors.As(rec.err, &netErr) && netErr.Timeout():
+		result.timedOut = true
+	default:
+		return result, rec.err
+	}
+	return result, nil
+}
+
+// recordingConn keeps the bytes read from a connection and discards writes,
+// so the TLS library never answers the client
+type recordingConn struct {
+	net.Conn
+	buf bytes.Buffer
+	err error
+}
+
+func (c *recordingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.buf.Write(p[:n])
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+	return n, err
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
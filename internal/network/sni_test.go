@@ -0,0 +1,74 @@
+package network
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPeekServerName(t *testing.T) {
+	tests := []struct {
+		name           string
+		send           func(conn net.Conn)
+		wantServerName string
+		wantTLS        bool
+		wantTimedOut   bool
+		wantPeeked     []byte
+	}{
+		{
+			name: "client hello with sni",
+			send: func(conn net.Conn) {
+				tls.Client(conn, &tls.Config{ServerName: "github.com"}).Handshake()
+			},
+			wantServerName: "github.com",
+			wantTLS:        true,
+		},
+		{
+			name: "client hello without sni",
+			send: func(conn net.Conn) {
+				tls.Client(conn, &tls.Config{InsecureSkipVerify: true}).Handshake()
+			},
+			wantTLS: true,
+		},
+		{
+			name: "not tls",
+			send: func(conn net.Conn) {
+				conn.Write([]byte("SSH-2.0-OpenSSH_9.6\r\n"))
+			},
+			wantPeeked: []byte("SSH-2.0-OpenSSH_9.6\r\n"),
+		},
+		{
+			name:         "silent client",
+			send:         func(conn net.Conn) {},
+			wantTimedOut: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+
+			go tt.send(client)
+
+			got, err := peekServerName(server, 200*time.Millisecond)
+			if err != nil {
+				t.Fatalf("peekServerName() error = %v", err)
+			}
+
+			if got.serverName != tt.wantServerName || got.isTLS != tt.wantTLS || got.timedOut != tt.wantTimedOut {
+				t.Errorf("peekServerName() = %+v, want server name %q, tls %v, timed out %v",
+					got, tt.wantServerName, tt.wantTLS, tt.wantTimedOut)
+			}
+			if tt.wantPeeked != nil && (len(got.peeked) == 0 || !bytes.HasPrefix(tt.wantPeeked, got.peeked)) {
+				t.Errorf("Peeked %q, want a prefix of %q", got.peeked, tt.wantPeeked)
+			}
+			if tt.wantTLS && len(got.peeked) == 0 {
+				t.Error("Expected the ClientHello bytes to be kept for replay")
+			}
+		})
+	}
+}
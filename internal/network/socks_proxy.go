@@ -3,30 +3,49 @@ package network
 import (
 	"context"
 	"fmt"
+	"log"
 	"log/slog"
 	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/armon/go-socks5"
 )
 
 // SOCKSProxy is a SOCKS5 proxy server with domain filtering
 type SOCKSProxy struct {
-	port     int
-	filter   *DomainFilter
-	server   *socks5.Server
-	listener net.Listener
+	port           int
+	filter         *DomainFilter
+	dialer         *Dialer
+	rules          *domainRuleSet
+	server         *socks5.Server
+	listener       net.Listener
+	udp            *udpRelay
+	udpIdleTimeout time.Duration
+	connectionLog
 }
 
 // NewSOCKSProxy creates a new SOCKS5 proxy
 func NewSOCKSProxy(filter *DomainFilter, port int) (*SOCKSProxy, error) {
 	proxy := &SOCKSProxy{
-		port:   port,
-		filter: filter,
+		port:           port,
+		udpIdleTimeout: udpIdleTimeout,
+		filter:         filter,
+		dialer:         NewDialer(filter),
 	}
+	proxy.rules = &domainRuleSet{filter: filter, log: &proxy.connectionLog}
 
-	// Create SOCKS5 config
+	// Create SOCKS5 config. Names are resolved by the dialer after the rules
+	// have checked them, not by the server before. UDP associations are
+	// taken over after authentication, as the server doesn't support them.
 	conf := &socks5.Config{
-		Rules: &domainRuleSet{filter: filter},
+		AuthMethods: []socks5.Authenticator{associateAuthenticator{proxy: proxy}},
+		Rules:       proxy.rules,
+		Resolver:    deferredResolver{},
+		Dial:        proxy.dial,
+		Logger:      log.New(socksLogWriter{}, "", 0),
 	}
 
 	server, err := socks5.New(conf)
@@ -50,6 +69,14 @@ func NewSOCKSProxy(filter *DomainFilter, port int) (*SOCKSProxy, error) {
 
 	proxy.listener = listener
 
+	// Relay UDP on the same port number
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: proxy.port})
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to create UDP relay: %w", err)
+	}
+	proxy.udp = &udpRelay{conn: udpConn, associations: make(map[netip.AddrPort]*udpAssociation)}
+
 	return proxy, nil
 }
 
@@ -58,44 +85,163 @@ func (p *SOCKSProxy) Port() int {
 	return p.port
 }
 
+// SetResolver replaces the resolver used for destinations, it must be called before Start
+func (p *SOCKSProxy) SetResolver(r Resolver) {
+	p.dialer.SetResolver(r)
+}
+
+// SetUpstream sends the proxy's connections through an upstream proxy, it
+// must be called before Start
+func (p *SOCKSProxy) SetUpstream(u *Upstream) {
+	p.dialer.SetUpstream(u)
+}
+
+// SetDNSServer checks and records connections to addresses the DNS server
+// answered with as the name it answered for. It must be called before Start.
+func (p *SOCKSProxy) SetDNSServer(s *DNSServer) {
+	p.rules.answers = s.answers
+}
+
 // Start starts the proxy server
 func (p *SOCKSProxy) Start() error {
 	slog.Debug("SOCKS5 proxy starting", "port", p.port)
+	go p.serveUDP()
 	return p.server.Serve(p.listener)
 }
 
 // Stop stops the proxy server
 func (p *SOCKSProxy) Stop() error {
+	p.udp.conn.Close()
 	if p.listener != nil {
 		return p.listener.Close()
 	}
 	return nil
 }
 
+// socksLogWriter sends the server's log lines, which go to stdout by
+// default, to the debug log
+type socksLogWriter struct{}
+
+func (socksLogWriter) Write(b []byte) (int, error) {
+	slog.Debug("SOCKS5 server", "message", strings.TrimSpace(string(b)))
+	return len(b), nil
+}
+
+// socksConnection is the state of a SOCKS connection kept in its context,
+// from the rules check to the dial
+type socksConnection struct {
+	record *ConnectionRecord
+	lease  *quotaLease
+}
+
+// socksConnectionKey holds a *socksConnection in a context
+type socksConnectionKey struct{}
+
+// dial connects to an address the rules allowed, recording the connection
+// when it closes or fails
+func (p *SOCKSProxy) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := p.dialer.DialContext(ctx, network, address)
+
+	sc, ok := ctx.Value(socksConnectionKey{}).(*socksConnection)
+	if !ok {
+		return conn, err
+	}
+	if err != nil {
+		sc.lease.release()
+		sc.record.fail(err)
+		p.finish(sc.record)
+		return nil, err
+	}
+
+	sc.record.IP = remoteIP(conn)
+	return &countingConn{
+		Conn:  conn,
+		lease: sc.lease,
+		onClose: func(c *countingConn) {
+			sc.lease.release()
+			sc.record.BytesUp = c.written.Load()
+			sc.record.BytesDown = c.read.Load()
+			if rule := sc.lease.cutBy(); rule != "" {
+				sc.record.deny(rule)
+			}
+			p.finish(sc.record)
+		},
+	}, nil
+}
+
+// deferredResolver leaves names unresolved, so the server dials the name and
+// the Dialer resolves and checks it once
+type deferredResolver struct{}
+
+// Resolve returns no address, keeping the request's FQDN
+func (deferredResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	return ctx, nil, nil
+}
+
 // domainRuleSet implements SOCKS5 rules for domain filtering
 type domainRuleSet struct {
-	filter *DomainFilter
+	filter  *DomainFilter
+	log     *connectionLog
+	answers *dnsAnswers // Nil without a DNS server
 }
 
 // Allow checks if a SOCKS5 request should be allowed
 func (r *domainRuleSet) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
-	// Extract domain from request
-	domain := ""
+	// Extract domain and port from request
+	address := ""
 
 	if req.DestAddr != nil {
-		if req.DestAddr.FQDN != "" {
-			domain = req.DestAddr.FQDN
-		} else if req.DestAddr.IP != nil {
+		domain := req.DestAddr.FQDN
+		if domain == "" && req.DestAddr.IP != nil {
 			domain = req.DestAddr.IP.String()
 		}
+		address = r.named(net.JoinHostPort(domain, strconv.Itoa(req.DestAddr.Port)))
 	}
 
 	// Check filter
-	allowed := r.filter.IsAllowed(domain)
+	allowed, rule := r.filter.Allow(address)
+
+	// Other commands are refused by the server after this check
+	if req.Command != socks5.ConnectCommand {
+		return ctx, allowed
+	}
+
+	record := r.log.start(ProtocolSOCKS, address)
+	record.Rule = rule
+	if !allowed {
+		slog.Debug("SOCKS5 proxy blocked request", "address", address)
+		record.deny(rule)
+		r.log.finish(record)
+		return ctx, false
+	}
 
+	lease, allowed, rule := r.filter.acquireQuota(address)
 	if !allowed {
-		slog.Debug("SOCKS5 proxy blocked request", "domain", domain)
+		slog.Debug("SOCKS5 proxy quota exceeded", "address", address, "rule", rule)
+		record.deny(rule)
+		r.log.finish(record)
+		return ctx, false
 	}
 
-	return ctx, allowed
+	return context.WithValue(ctx, socksConnectionKey{}, &socksConnection{record: record, lease: lease}), true
+}
+
+// named replaces a literal IP in address with the name the DNS server
+// answered with it, so the name's rules apply. The IP is still dialled.
+func (r *domainRuleSet) named(address string) string {
+	if r.answers == nil {
+		return address
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	addr, ok := parseIP(host)
+	if !ok {
+		return address
+	}
+	if name, ok := r.answers.name(addr, time.Now()); ok {
+		return net.JoinHostPort(name, port)
+	}
+	return address
 }
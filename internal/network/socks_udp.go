@@ -0,0 +1,490 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-socks5"
+)
+
+// udpIdleTimeout ends a UDP association after no datagrams in either direction
+const udpIdleTimeout = 2 * time.Minute
+
+// maxDatagramSize is the largest datagram relayed, the UDP maximum
+const maxDatagramSize = 65535
+
+// maxQueuedDatagrams bounds the datagrams held for a destination while it is
+// being dialled, later ones are dropped
+const maxQueuedDatagrams = 16
+
+// SOCKS5 values used by UDP ASSOCIATE, which go-socks5 leaves unsupported
+const (
+	socksVersion        = 5
+	socksSucceeded      = 0
+	socksServerFailure  = 1
+	socksAddrIPv4       = 1
+	socksAddrDomain     = 3
+	socksAddrIPv6       = 4
+	socksAddrNotSupport = 8
+)
+
+// errAssociationEnded stops the SOCKS server once a UDP association it
+// handed over has ended
+var errAssociationEnded = errors.New("UDP association ended")
+
+// associateAuthenticator answers the no-authentication method like
+// go-socks5's own, then takes over connections whose request is UDP
+// ASSOCIATE. Other requests are left for the server to read.
+type associateAuthenticator struct {
+	proxy *SOCKSProxy
+}
+
+func (a associateAuthenticator) GetCode() uint8 {
+	return socks5.NoAuth
+}
+
+func (a associateAuthenticator) Authenticate(reader io.Reader, writer io.Writer) (*socks5.AuthContext, error) {
+	if _, err := writer.Write([]byte{socksVersion, socks5.NoAuth}); err != nil {
+		return nil, err
+	}
+	authContext := &socks5.AuthContext{Method: socks5.NoAuth}
+
+	buffered, ok := reader.(*bufio.Reader)
+	conn, isConn := writer.(net.Conn)
+	if !ok || !isConn {
+		return authContext, nil
+	}
+
+	// Malformed requests are left for the server to reject
+	header, err := buffered.Peek(2)
+	if err != nil || header[1] != socks5.AssociateCommand {
+		return authContext, nil
+	}
+
+	a.proxy.associate(conn, buffered)
+	return nil, errAssociationEnded
+}
+
+// udpRelay is the proxy's UDP socket, on the same port number as its TCP
+// listener so a sandbox allowing the proxy's port allows both. Datagrams are
+// matched to associations by the client's address.
+type udpRelay struct {
+	conn *net.UDPConn
+
+	mu           sync.Mutex
+	associations map[netip.AddrPort]*udpAssociation
+	pending      []*udpAssociation // Waiting for the client's first datagram, oldest first
+}
+
+// udpAssociation relays datagrams between one client and its destinations
+type udpAssociation struct {
+	proxy    *SOCKSProxy
+	clientIP netip.Addr
+	activity atomic.Int64 // Unix nanoseconds of the last datagram relayed
+
+	mu     sync.Mutex
+	client netip.AddrPort // Set by the client's first datagram unless given in the request
+	flows  map[string]*udpFlow
+	closed bool
+}
+
+// udpFlow is the traffic to one destination of an association. Datagrams to
+// a denied destination are dropped without checking the filter again.
+type udpFlow struct {
+	address string
+	record  *ConnectionRecord
+	lease   *quotaLease
+	up      atomic.Int64
+	down    atomic.Int64
+
+	mu      sync.Mutex
+	dialled bool     // Set once the dial has finished, or at once for a denied destination
+	conn    net.Conn // Nil when the destination is denied or unreachable
+	queued  [][]byte // Datagrams sent while dialling
+}
+
+// associate handles a UDP ASSOCIATE request, relaying datagrams until the
+// client closes the control connection or the association is idle
+func (p *SOCKSProxy) associate(conn net.Conn, reader *bufio.Reader) {
+	// The request's address is where the client will send from, often zero
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return
+	}
+	requested, err := readSocksAddr(reader)
+	if err != nil {
+		writeSocksReply(conn, socksAddrNotSupport, netip.AddrPort{})
+		return
+	}
+
+	remote, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		writeSocksReply(conn, socksServerFailure, netip.AddrPort{})
+		return
+	}
+	a := &udpAssociation{
+		proxy:    p,
+		clientIP: remote.AddrPort().Addr().Unmap(),
+		flows:    make(map[string]*udpFlow),
+	}
+	if addr, err := netip.ParseAddrPort(requested); err == nil && addr.Port() != 0 && !addr.Addr().IsUnspecified() {
+		a.client = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+	}
+	a.activity.Store(time.Now().UnixNano())
+
+	p.udp.add(a)
+	defer p.udp.remove(a)
+	defer a.close()
+
+	if err := writeSocksReply(conn, socksSucceeded, p.udp.conn.LocalAddr().(*net.UDPAddr).AddrPort()); err != nil {
+		return
+	}
+	slog.Debug("SOCKS5 proxy opened UDP association", "client", remote)
+
+	// The association lasts as long as the control connection, unless idle
+	controlClosed := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, reader)
+		close(controlClosed)
+	}()
+	defer conn.Close()
+
+	for {
+		idle := time.Until(time.Unix(0, a.activity.Load()).Add(p.udpIdleTimeout))
+		if idle <= 0 {
+			slog.Debug("SOCKS5 proxy closed idle UDP association", "client", remote)
+			return
+		}
+		select {
+		case <-controlClosed:
+			return
+		case <-time.After(idle):
+		}
+	}
+}
+
+// add registers an association, by its client's address when known
+func (r *udpRelay) add(a *udpAssociation) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if a.client.IsValid() {
+		r.associations[a.client] = a
+		return
+	}
+	r.pending = append(r.pending, a)
+}
+
+// remove unregisters an association
+func (r *udpRelay) remove(a *udpAssociation) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pending = slices.DeleteFunc(r.pending, func(p *udpAssociation) bool { return p == a })
+	for client, registered := range r.associations {
+		if registered == a {
+			delete(r.associations, client)
+		}
+	}
+}
+
+// association returns the association a datagram from client belongs to.
+// A new client address is given to the oldest association waiting for one
+// from its host.
+func (r *udpRelay) association(client netip.AddrPort) *udpAssociation {
+	client = netip.AddrPortFrom(client.Addr().Unmap(), client.Port())
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if a, ok := r.associations[client]; ok {
+		return a
+	}
+	for i, a := range r.pending {
+		if a.clientIP != client.Addr() {
+			continue
+		}
+		r.pending = slices.Delete(r.pending, i, i+1)
+		a.mu.Lock()
+		a.client = client
+		a.mu.Unlock()
+		r.associations[client] = a
+		return a
+	}
+	return nil
+}
+
+// serveUDP relays clients' datagrams to their destinations
+func (p *SOCKSProxy) serveUDP() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, from, err := p.udp.conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		a := p.udp.association(from)
+		if a == nil {
+			continue
+		}
+		address, payload, ok := parseUDPDatagram(buf[:n])
+		if !ok {
+			continue
+		}
+		a.activity.Store(time.Now().UnixNano())
+		a.forward(address, payload)
+	}
+}
+
+// forward sends a client's datagram on to address
+func (a *udpAssociation) forward(address string, payload []byte) {
+	if flow := a.flow(address); flow != nil {
+		flow.send(payload)
+	}
+}
+
+// send writes a datagram to the destination, or queues it while the
+// destination is being dialled
+func (f *udpFlow) send(payload []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.dialled {
+		if len(f.queued) < maxQueuedDatagrams {
+			f.queued = append(f.queued, bytes.Clone(payload))
+		}
+		return
+	}
+	f.write(payload)
+}
+
+// write sends a datagram on the flow's connection, f.mu must be held
+func (f *udpFlow) write(payload []byte) {
+	if f.conn == nil {
+		return
+	}
+	if !f.lease.transfer(int64(len(payload)), 0) {
+		f.conn.Close()
+		return
+	}
+	if _, err := f.conn.Write(payload); err == nil {
+		f.up.Add(int64(len(payload)))
+	}
+}
+
+// flow returns the flow to address, checking the destination and starting
+// its dial the first time, or nil once the association is closed. Dialling
+// may resolve a name, so it runs apart from the relay's read loop.
+func (a *udpAssociation) flow(address string) *udpFlow {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return nil
+	}
+	if flow, ok := a.flows[address]; ok {
+		return flow
+	}
+
+	p := a.proxy
+	named := p.rules.named(address)
+	flow := &udpFlow{address: address, record: p.start(ProtocolSOCKSUDP, named)}
+	a.flows[address] = flow
+
+	allowed, rule := p.filter.Allow(named)
+	flow.record.Rule = rule
+	if !allowed {
+		slog.Debug("SOCKS5 proxy blocked UDP destination", "address", address)
+		flow.record.deny(rule)
+		flow.dialled = true
+		return flow
+	}
+
+	lease, allowed, rule := p.filter.acquireQuota(named)
+	if !allowed {
+		slog.Debug("SOCKS5 proxy quota exceeded", "address", address, "rule", rule)
+		flow.record.deny(rule)
+		flow.dialled = true
+		return flow
+	}
+	flow.lease = lease
+
+	go a.connect(flow)
+	return flow
+}
+
+// connect dials a flow's destination, then sends the datagrams queued
+// meanwhile and starts relaying replies
+func (a *udpAssociation) connect(flow *udpFlow) {
+	conn, err := a.proxy.dialer.DialContext(context.Background(), "udp", flow.address)
+
+	// The association may have closed, and recorded the flow, while dialling
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	flow.mu.Lock()
+	defer flow.mu.Unlock()
+
+	flow.dialled = true
+	queued := flow.queued
+	flow.queued = nil
+
+	if a.closed {
+		if conn != nil {
+			conn.Close()
+		}
+		return
+	}
+	if err != nil {
+		slog.Debug("SOCKS5 proxy failed to reach UDP destination", "address", flow.address, "error", err)
+		flow.record.fail(err)
+		return
+	}
+	flow.conn = conn
+	flow.record.IP = remoteIP(conn)
+
+	for _, payload := range queued {
+		flow.write(payload)
+	}
+	go a.relayReplies(flow, conn, a.client)
+}
+
+// relayReplies sends a destination's datagrams back to the client
+func (a *udpAssociation) relayReplies(flow *udpFlow, conn net.Conn, client netip.AddrPort) {
+	header := udpDatagramHeader(flow.address)
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := conn.Read(buf[len(header):])
+		if err != nil {
+			return
+		}
+		if !flow.lease.transfer(0, int64(n)) {
+			conn.Close()
+			return
+		}
+		a.activity.Store(time.Now().UnixNano())
+		flow.down.Add(int64(n))
+
+		copy(buf, header)
+		a.proxy.udp.conn.WriteToUDPAddrPort(buf[:len(header)+n], client)
+	}
+}
+
+// close ends every flow and records them
+func (a *udpAssociation) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.closed = true
+
+	for _, flow := range a.flows {
+		flow.mu.Lock()
+		if flow.conn != nil {
+			flow.conn.Close()
+		}
+		flow.mu.Unlock()
+		flow.lease.release()
+		flow.record.BytesUp = flow.up.Load()
+		flow.record.BytesDown = flow.down.Load()
+		if rule := flow.lease.cutBy(); rule != "" {
+			flow.record.deny(rule)
+		}
+		a.proxy.finish(flow.record)
+	}
+}
+
+// readSocksAddr reads a SOCKS5 address type, address and port as "host:port"
+func readSocksAddr(r io.Reader) (string, error) {
+	addrType := make([]byte, 1)
+	if _, err := io.ReadFull(r, addrType); err != nil {
+		return "", err
+	}
+
+	var host string
+	switch addrType[0] {
+	case socksAddrIPv4, socksAddrIPv6:
+		ip := make([]byte, net.IPv4len)
+		if addrType[0] == socksAddrIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		addr, _ := netip.AddrFromSlice(ip)
+		host = addr.Unmap().String()
+	case socksAddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return "", err
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("unsupported address type %d", addrType[0])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// appendSocksAddr appends the SOCKS5 form of a "host:port" address
+func appendSocksAddr(b []byte, address string) []byte {
+	host, port := splitAddress(address)
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if addr.Is4() {
+			b = append(b, socksAddrIPv4)
+		} else {
+			b = append(b, socksAddrIPv6)
+		}
+		b = append(b, addr.AsSlice()...)
+	} else {
+		b = append(b, socksAddrDomain, byte(len(host)))
+		b = append(b, host...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port))
+}
+
+// writeSocksReply answers a request with the address the server bound
+func writeSocksReply(w io.Writer, reply byte, bound netip.AddrPort) error {
+	if !bound.IsValid() {
+		bound = netip.AddrPortFrom(netip.IPv4Unspecified(), 0)
+	}
+	bound = netip.AddrPortFrom(bound.Addr().Unmap(), bound.Port())
+	msg := appendSocksAddr([]byte{socksVersion, reply, 0}, bound.String())
+	_, err := w.Write(msg)
+	return err
+}
+
+// parseUDPDatagram splits a client datagram into its destination and
+// payload. Fragments, which few clients send, are dropped.
+func parseUDPDatagram(b []byte) (string, []byte, bool) {
+	if len(b) < 4 || b[2] != 0 {
+		return "", nil, false
+	}
+	r := bytes.NewReader(b[3:])
+	address, err := readSocksAddr(r)
+	if err != nil {
+		return "", nil, false
+	}
+	return address, b[len(b)-r.Len():], true
+}
+
+// udpDatagramHeader is the header of datagrams relayed back from address
+func udpDatagramHeader(address string) []byte {
+	return appendSocksAddr([]byte{0, 0, 0}, address)
+}
@@ -0,0 +1,271 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// udpEchoServer answers every datagram with the same bytes
+func udpEchoServer(t *testing.T) int {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP() error = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], from)
+		}
+	}()
+
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// socksAssociate opens a UDP association, returning the control connection
+// and the relay address datagrams are sent to
+func socksAssociate(t *testing.T, proxyPort int) (net.Conn, *net.UDPAddr) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", proxyPort))
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write([]byte{socksVersion, 1, 0})
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(conn, method); err != nil || method[1] != 0 {
+		t.Fatalf("Method selection = %v, %v", method, err)
+	}
+
+	conn.Write([]byte{socksVersion, 3, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+	reply := make([]byte, 3)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != socksSucceeded {
+		t.Fatalf("ASSOCIATE reply = %v, %v", reply, err)
+	}
+	bound, err := readSocksAddr(conn)
+	if err != nil {
+		t.Fatalf("Reading bound address error = %v", err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	relay, err := net.ResolveUDPAddr("udp", bound)
+	if err != nil {
+		t.Fatalf("ResolveUDPAddr(%q) error = %v", bound, err)
+	}
+	return conn, relay
+}
+
+func TestSOCKSProxyRelaysUDP(t *testing.T) {
+	echoPort := udpEchoServer(t)
+
+	p, err := NewSOCKSProxy(proxyTestFilter(t, true), 0)
+	if err != nil {
+		t.Fatalf("NewSOCKSProxy() error = %v", err)
+	}
+	p.SetResolver(newStaticResolver(map[string][]string{"app.test": {"127.0.0.1"}}))
+	hook, records := recordHook()
+	p.SetConnectionHook(hook)
+	go p.Start()
+	defer p.Stop()
+
+	// The sandbox only allows the proxy's port, so the relay must use it too
+	control, relay := socksAssociate(t, p.Port())
+	if relay.Port != p.Port() {
+		t.Errorf("Relay port = %d, want the proxy port %d", relay.Port, p.Port())
+	}
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP() error = %v", err)
+	}
+	defer client.Close()
+
+	send := func(address, payload string) {
+		t.Helper()
+		datagram := append(udpDatagramHeader(address), payload...)
+		if _, err := client.WriteToUDP(datagram, relay); err != nil {
+			t.Fatalf("WriteToUDP() error = %v", err)
+		}
+	}
+	receive := func(timeout time.Duration) (string, string, bool) {
+		t.Helper()
+		buf := make([]byte, 1500)
+		client.SetReadDeadline(time.Now().Add(timeout))
+		n, _, err := client.ReadFromUDP(buf)
+		if err != nil {
+			return "", "", false
+		}
+		address, payload, ok := parseUDPDatagram(buf[:n])
+		if !ok {
+			t.Fatalf("Reply %q is not a SOCKS5 datagram", buf[:n])
+		}
+		return address, string(payload), true
+	}
+
+	allowedAddress := net.JoinHostPort("app.test", strconv.Itoa(echoPort))
+	t.Run("allowed destination", func(t *testing.T) {
+		for _, payload := range []string{"hello", "again"} {
+			send(allowedAddress, payload)
+			address, reply, ok := receive(5 * time.Second)
+			if !ok || address != allowedAddress || reply != payload {
+				t.Fatalf("Reply = %q from %q, want %q from %q", reply, address, payload, allowedAddress)
+			}
+		}
+	})
+
+	t.Run("denied destination", func(t *testing.T) {
+		send("other.test:53", "query")
+		if _, reply, ok := receive(200 * time.Millisecond); ok {
+			t.Errorf("Reply = %q, want the datagram dropped", reply)
+		}
+	})
+
+	// Closing the control connection ends the association and its records
+	control.Close()
+	got := map[string]ConnectionRecord{}
+	for i := 0; i < 2; i++ {
+		r := nextRecord(t, records)
+		got[r.Host] = r
+	}
+	checkRecord(t, got["app.test"], ConnectionRecord{
+		Protocol: ProtocolSOCKSUDP, Host: "app.test", Port: echoPort, IP: "127.0.0.1",
+		Decision: "allow", Rule: "allowedDomains:app.test", BytesUp: 10, BytesDown: 10,
+	})
+	checkRecord(t, got["other.test"], ConnectionRecord{
+		Protocol: ProtocolSOCKSUDP, Host: "other.test", Port: 53,
+		Decision: "deny", Rule: "defaultPolicy:deny",
+	})
+}
+
+func TestSOCKSProxyEndsIdleUDPAssociations(t *testing.T) {
+	p, err := NewSOCKSProxy(proxyTestFilter(t, true), 0)
+	if err != nil {
+		t.Fatalf("NewSOCKSProxy() error = %v", err)
+	}
+	p.udpIdleTimeout = 100 * time.Millisecond
+	go p.Start()
+	defer p.Stop()
+
+	control, _ := socksAssociate(t, p.Port())
+	control.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := control.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Control connection read error = %v, want EOF once idle", err)
+	}
+}
+
+// blockingResolver holds lookups of one name until released
+type blockingResolver struct {
+	Resolver
+	name    string
+	release chan struct{}
+}
+
+func (r *blockingResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	if host == r.name {
+		<-r.release
+	}
+	return r.Resolver.LookupNetIP(ctx, network, host)
+}
+
+func TestSOCKSProxyDialsUDPFlowsApart(t *testing.T) {
+	echoPort := udpEchoServer(t)
+
+	filter, err := NewDomainFilter("deny", []string{"app.test", "slow.test"}, nil)
+	if err != nil {
+		t.Fatalf("NewDomainFilter() error = %v", err)
+	}
+	if err := filter.SetCIDRs([]string{"127.0.0.1"}, nil); err != nil {
+		t.Fatalf("SetCIDRs() error = %v", err)
+	}
+	p, err := NewSOCKSProxy(filter, 0)
+	if err != nil {
+		t.Fatalf("NewSOCKSProxy() error = %v", err)
+	}
+	resolver := &blockingResolver{
+		Resolver: newStaticResolver(map[string][]string{"app.test": {"127.0.0.1"}, "slow.test": {"127.0.0.1"}}),
+		name:     "slow.test",
+		release:  make(chan struct{}),
+	}
+	p.SetResolver(resolver)
+	go p.Start()
+	defer p.Stop()
+
+	_, relay := socksAssociate(t, p.Port())
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP() error = %v", err)
+	}
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	send := func(address, payload string) {
+		t.Helper()
+		if _, err := client.WriteToUDP(append(udpDatagramHeader(address), payload...), relay); err != nil {
+			t.Fatalf("WriteToUDP() error = %v", err)
+		}
+	}
+	receive := func() string {
+		t.Helper()
+		buf := make([]byte, 1500)
+		n, _, err := client.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("ReadFromUDP() error = %v", err)
+		}
+		_, payload, _ := parseUDPDatagram(buf[:n])
+		return string(payload)
+	}
+
+	// A destination still being looked up doesn't hold up the others
+	slowAddress := net.JoinHostPort("slow.test", strconv.Itoa(echoPort))
+	send(slowAddress, "first")
+	send(slowAddress, "second")
+	send(net.JoinHostPort("app.test", strconv.Itoa(echoPort)), "fast")
+	if reply := receive(); reply != "fast" {
+		t.Fatalf("Reply = %q, want fast before the slow destination is dialled", reply)
+	}
+
+	// Datagrams sent while dialling are delivered once it completes, in order
+	close(resolver.release)
+	for _, want := range []string{"first", "second"} {
+		if reply := receive(); reply != want {
+			t.Errorf("Reply = %q, want %q", reply, want)
+		}
+	}
+}
+
+func TestUDPDatagramHeader(t *testing.T) {
+	tests := []string{"example.com:53", "127.0.0.1:443", "[2001:db8::1]:8443"}
+	for _, address := range tests {
+		datagram := append(udpDatagramHeader(address), "payload"...)
+		got, payload, ok := parseUDPDatagram(datagram)
+		if !ok || got != address || string(payload) != "payload" {
+			t.Errorf("parseUDPDatagram() = %q, %q, %v, want %q", got, payload, ok, address)
+		}
+	}
+
+	// Fragments are dropped
+	fragment := append(udpDatagramHeader("example.com:53"), "payload"...)
+	fragment[2] = 1
+	if _, _, ok := parseUDPDatagram(fragment); ok {
+		t.Error("parseUDPDatagram() accepted a fragment")
+	}
+	if _, _, ok := parseUDPDatagram(bytes.Repeat([]byte{0}, 3)); ok {
+		t.Error("parseUDPDatagram() accepted a truncated datagram")
+	}
+}
@@ -0,0 +1,173 @@
+package network
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// Upstream is a proxy the srt proxies connect through after their own checks,
+// e.g. a corporate proxy that all egress must use
+type Upstream struct {
+	url          *url.URL // Without credentials
+	address      string   // The upstream proxy's host and port
+	username     string
+	password     string
+	noProxy      []DomainPattern
+	noProxyCIDRs []netip.Prefix
+	socks        proxy.ContextDialer // Set for SOCKS5 upstreams
+	remoteDNS    bool                // Host names are passed on for the upstream to resolve
+}
+
+// NewUpstream creates an upstream proxy from an "http://host:port" or
+// "socks5://host:port" URL. Destinations matching a noProxy entry, a domain
+// pattern as in allowedDomains or a CIDR, are connected to directly.
+func NewUpstream(rawURL, username, password string, noProxy []string) (*Upstream, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream proxy URL: %w", err)
+	}
+	if u.Hostname() == "" || u.Port() == "" {
+		return nil, fmt.Errorf("upstream proxy URL %q must have a host and port", rawURL)
+	}
+	if u.User != nil {
+		return nil, fmt.Errorf("upstream proxy URL %q must not contain credentials", u.Redacted())
+	}
+
+	upstream := &Upstream{
+		url:      u,
+		address:  u.Host,
+		username: username,
+		password: password,
+	}
+
+	switch u.Scheme {
+	case "http":
+	case "socks5":
+		var auth *proxy.Auth
+		if username != "" {
+			auth = &proxy.Auth{User: username, Password: password}
+		}
+		dialer, err := proxy.SOCKS5("tcp", u.Host, auth, &net.Dialer{Timeout: dialTimeout})
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream proxy: %w", err)
+		}
+		upstream.socks = dialer.(proxy.ContextDialer)
+	default:
+		return nil, fmt.Errorf("unsupported upstream proxy scheme %q: must be \"http\" or \"socks5\"", u.Scheme)
+	}
+
+	for _, entry := range noProxy {
+		if prefix, err := ParseCIDR(entry); err == nil {
+			upstream.noProxyCIDRs = append(upstream.noProxyCIDRs, prefix)
+			continue
+		}
+		pattern, err := compileDomainPattern(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid noProxy entry %q: %w", entry, err)
+		}
+		upstream.noProxy = append(upstream.noProxy, pattern)
+	}
+
+	return upstream, nil
+}
+
+// String returns the upstream proxy's URL, which never holds credentials
+func (u *Upstream) String() string {
+	return u.url.String()
+}
+
+// SetRemoteDNS passes host names on for the upstream to resolve, for networks
+// where only the upstream can look names up, e.g. behind split-horizon DNS.
+// The names are still checked by the filter, but their addresses aren't.
+// It must be called before the proxies start.
+func (u *Upstream) SetRemoteDNS(remote bool) {
+	u.remoteDNS = remote
+}
+
+// bypasses reports whether a destination is connected to directly
+func (u *Upstream) bypasses(host string, port int) bool {
+	if addr, ok := parseIP(host); ok {
+		_, matched := matchPrefix(u.noProxyCIDRs, addr)
+		return matched
+	}
+	for _, pattern := range u.noProxy {
+		if pattern.Matches(host) && pattern.allowsPort(port, nil) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialProxy connects to the upstream proxy itself
+func (u *Upstream) dialProxy(ctx context.Context) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", u.address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to upstream proxy: %w", err)
+	}
+	return conn, nil
+}
+
+// dial connects to address through the upstream proxy. The dialer only
+// passes addresses it has checked, so the upstream never resolves a name
+// unless remote DNS is set.
+func (u *Upstream) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	if u.socks != nil {
+		conn, err := u.socks.DialContext(ctx, network, address)
+		if err != nil {
+			return nil, fmt.Errorf("upstream proxy failed to connect to %s: %w", address, err)
+		}
+		return conn, nil
+	}
+
+	conn, err := u.dialProxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if u.username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(u.username + ":" + u.password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to write to upstream proxy: %w", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read upstream proxy response: %w", err)
+	}
+	// A successful CONNECT response's body is the tunnel, so only a refusal's is closed
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		conn.Close()
+		return nil, fmt.Errorf("upstream proxy refused %s: %s", address, strings.TrimSpace(resp.Status))
+	}
+	conn.SetDeadline(time.Time{})
+
+	// Keep anything the destination sent along with the response
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
@@ -0,0 +1,84 @@
+package sandbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/sammcj/srt-go/internal/network"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// connectionLogName is the file name of the current connection log within the log directory
+const connectionLogName = "connections.jsonl"
+
+// ConnectionLog records the connections the proxies handle during a run. It
+// appends each record to a rotating JSONL file and keeps the run's records in
+// memory.
+type ConnectionLog struct {
+	mu      sync.Mutex
+	runID   string
+	file    *lumberjack.Logger // Nil when records are only kept in memory
+	records []network.ConnectionRecord
+}
+
+// NewConnectionLog creates a connection log in dir for a run
+func NewConnectionLog(dir, runID string) (*ConnectionLog, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %w", err)
+	}
+
+	return &ConnectionLog{
+		runID: runID,
+		file: &lumberjack.Logger{
+			Filename:   filepath.Join(dir, connectionLogName),
+			MaxSize:    10, // megabytes
+			MaxBackups: 3,
+			MaxAge:     0,
+			Compress:   false,
+		},
+	}, nil
+}
+
+// Add tags a record with the run ID, keeps it and appends it to the file.
+// The proxies call it concurrently.
+func (l *ConnectionLog) Add(r network.ConnectionRecord) error {
+	r.RunID = l.runID
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.records = append(l.records, r)
+	if l.file == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = l.file.Write(append(data, '\n'))
+	return err
+}
+
+// Records returns the connections recorded so far
+func (l *ConnectionLog) Records() []network.ConnectionRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]network.ConnectionRecord(nil), l.records...)
+}
+
+// Close closes the log file. Later records are only kept in memory.
+func (l *ConnectionLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
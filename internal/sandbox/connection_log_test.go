@@ -0,0 +1,74 @@
+package sandbox
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/sammcj/srt-go/internal/network"
+)
+
+func TestConnectionLog(t *testing.T) {
+	dir := t.TempDir()
+	log, err := NewConnectionLog(dir, "run-a")
+	if err != nil {
+		t.Fatalf("NewConnectionLog() error = %v", err)
+	}
+
+	records := []network.ConnectionRecord{
+		{Protocol: network.ProtocolHTTP, Host: "registry.npmjs.org", Port: 80, Decision: "allow", Method: "GET", Path: "/left-pad", Status: 200, BytesDown: 1024},
+		{Protocol: network.ProtocolSOCKS, Host: "evil.example.com", Port: 443, Decision: "deny", Rule: "defaultPolicy:deny"},
+		{Protocol: network.ProtocolDNS, Host: "github.com", Decision: "allow", QueryType: "A", Answers: []string{"140.82.112.3"}},
+	}
+	for _, r := range records {
+		if err := log.Add(r); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+	if err := log.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	// Records after closing are still returned, but not written
+	log.Add(network.ConnectionRecord{Protocol: network.ProtocolConnect, Host: "github.com", Port: 443, Decision: "allow"})
+
+	got := log.Records()
+	if len(got) != 4 {
+		t.Fatalf("Records() returned %d records, want 4", len(got))
+	}
+	for _, r := range got {
+		if r.RunID != "run-a" {
+			t.Errorf("Record for %s has run ID %q, want run-a", r.Host, r.RunID)
+		}
+	}
+
+	f, err := os.Open(filepath.Join(dir, connectionLogName))
+	if err != nil {
+		t.Fatalf("Failed to open connection log: %v", err)
+	}
+	defer f.Close()
+
+	var written []network.ConnectionRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r network.ConnectionRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("Failed to parse %q: %v", scanner.Text(), err)
+		}
+		written = append(written, r)
+	}
+
+	if len(written) != len(records) {
+		t.Fatalf("Log has %d lines, want %d", len(written), len(records))
+	}
+	for i, r := range written {
+		want := records[i]
+		want.RunID = "run-a"
+		if !reflect.DeepEqual(r, want) {
+			t.Errorf("Line %d = %+v, want %+v", i+1, r, want)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package sandbox
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sammcj/srt-go/internal/config"
+	"github.com/sammcj/srt-go/internal/filesystem"
+)
+
+// IgnoreMatcher matches violations against ignore rules compiled once at startup
+// and counts how many violations each rule suppressed
+type IgnoreMatcher struct {
+	rules      []compiledIgnoreRule
+	mu         sync.Mutex
+	suppressed []int
+}
+
+type compiledIgnoreRule struct {
+	description string
+	process     string
+	operation   string
+	target      *regexp.Regexp
+}
+
+// RuleCount is the number of violations suppressed by an ignore rule
+type RuleCount struct {
+	Rule  string `json:"rule"`
+	Count int    `json:"count"`
+}
+
+// NewIgnoreMatcher compiles the legacy ignoreViolations map and violations.ignore rules.
+// Legacy entries match paths at or beneath the given path, or the exact target
+// for entries that are not paths.
+func NewIgnoreMatcher(legacy map[string][]string, rules []config.IgnoreRule) (*IgnoreMatcher, error) {
+	m := &IgnoreMatcher{}
+
+	// Sort legacy process keys so rule order, and therefore reporting, is stable
+	processes := make([]string, 0, len(legacy))
+	for process := range legacy {
+		processes = append(processes, process)
+	}
+	sort.Strings(processes)
+
+	for _, process := range processes {
+		for _, target := range legacy[process] {
+			// Entries that aren't paths, such as domains and Mach service
+			// names, keep matching anywhere in the target as they always have
+			rule := config.IgnoreRule{Process: process, Target: target}
+			if !strings.HasPrefix(target, "/") && !strings.HasPrefix(target, "~") {
+				rule = config.IgnoreRule{Process: process, TargetRegex: ".*" + regexp.QuoteMeta(target) + ".*"}
+			}
+
+			compiled, err := compileIgnoreRule(rule)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ignoreViolations entry %q for %q: %w", target, process, err)
+			}
+			compiled.description = fmt.Sprintf("ignoreViolations[%s]: %s", process, target)
+			m.rules = append(m.rules, compiled)
+		}
+	}
+
+	for i, rule := range rules {
+		compiled, err := compileIgnoreRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ignore rule %d: %w", i, err)
+		}
+		m.rules = append(m.rules, compiled)
+	}
+
+	m.suppressed = make([]int, len(m.rules))
+
+	return m, nil
+}
+
+func compileIgnoreRule(rule config.IgnoreRule) (compiledIgnoreRule, error) {
+	compiled := compiledIgnoreRule{
+		description: describeIgnoreRule(rule),
+		process:     rule.Process,
+		operation:   rule.Operation,
+	}
+
+	if _, err := path.Match(rule.Process, ""); err != nil {
+		return compiledIgnoreRule{}, fmt.Errorf("invalid process glob %q: %w", rule.Process, err)
+	}
+	if _, err := path.Match(rule.Operation, ""); err != nil {
+		return compiledIgnoreRule{}, fmt.Errorf("invalid operation glob %q: %w", rule.Operation, err)
+	}
+
+	var expr string
+	switch {
+	case rule.TargetRegex != "":
+		expr = "^(?:" + rule.TargetRegex + ")$"
+	case rule.Target != "":
+		target := expandHome(rule.Target)
+		if filesystem.ContainsGlob(target) {
+			regex, err := filesystem.GlobToRegex(target)
+			if err != nil {
+				return compiledIgnoreRule{}, fmt.Errorf("invalid target glob %q: %w", rule.Target, err)
+			}
+			expr = regex
+		} else {
+			// Plain paths match the path itself and anything beneath it
+			expr = "^" + regexp.QuoteMeta(strings.TrimSuffix(target, "/")) + "(?:/.*)?$"
+		}
+	}
+
+	if expr != "" {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return compiledIgnoreRule{}, fmt.Errorf("invalid target pattern: %w", err)
+		}
+		compiled.target = re
+	}
+
+	return compiled, nil
+}
+
+// Match reports whether a violation should be ignored, counting it against the
+// first matching rule
+func (m *IgnoreMatcher) Match(v Violation) bool {
+	for i, rule := range m.rules {
+		if rule.matches(v) {
+			m.mu.Lock()
+			m.suppressed[i] += v.Occurrences()
+			m.mu.Unlock()
+			return true
+		}
+	}
+	return false
+}
+
+// Suppressed returns the total number of violations suppressed
+func (m *IgnoreMatcher) Suppressed() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	total := 0
+	for _, count := range m.suppressed {
+		total += count
+	}
+	return total
+}
+
+// SuppressedByRule returns suppression counts for rules that matched at least once,
+// highest count first
+func (m *IgnoreMatcher) SuppressedByRule() []RuleCount {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var counts []RuleCount
+	for i, count := range m.suppressed {
+		if count > 0 {
+			counts = append(counts, RuleCount{Rule: m.rules[i].description, Count: count})
+		}
+	}
+
+	sort.SliceStable(counts, func(i, j int) bool {
+		return counts[i].Count > counts[j].Count
+	})
+
+	return counts
+}
+
+func (r compiledIgnoreRule) matches(v Violation) bool {
+	if r.process != "" && r.process != "*" {
+		if ok, _ := path.Match(r.process, v.Process); !ok {
+			return false
+		}
+	}
+
+	if r.operation != "" && r.operation != v.Operation && r.operation != v.Category {
+		if ok, _ := path.Match(r.operation, v.Operation); !ok {
+			return false
+		}
+	}
+
+	if r.target != nil && !r.target.MatchString(v.Target) {
+		return false
+	}
+
+	return true
+}
+
+func describeIgnoreRule(rule config.IgnoreRule) string {
+	var parts []string
+	if rule.Process != "" {
+		parts = append(parts, "process="+rule.Process)
+	}
+	if rule.Operation != "" {
+		parts = append(parts, "operation="+rule.Operation)
+	}
+	if rule.Target != "" {
+		parts = append(parts, "target="+rule.Target)
+	}
+	if rule.TargetRegex != "" {
+		parts = append(parts, "targetRegex="+rule.TargetRegex)
+	}
+	return strings.Join(parts, " ")
+}
+
+// expandHome expands a leading ~ to the user's home directory
+func expandHome(p string) string {
+	if !strings.HasPrefix(p, "~") {
+		return p
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return p
+	}
+
+	return filepath.Join(home, p[1:])
+}
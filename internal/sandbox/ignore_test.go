@@ -0,0 +1,182 @@
+package sandbox
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/sammcj/srt-go/internal/config"
+	"github.com/sammcj/srt-go/internal/network"
+)
+
+func TestIgnoreMatcherLegacyEntries(t *testing.T) {
+	matcher, err := NewIgnoreMatcher(map[string][]string{
+		"*":   {"/usr/lib"},
+		"git": {"/usr/bin/ssh-agent", "com.apple.SecurityServer"},
+	}, nil)
+	if err != nil {
+		t.Fatalf("NewIgnoreMatcher() error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		v    Violation
+		want bool
+	}{
+		{"exact path", Violation{Process: "node", Target: "/usr/lib"}, true},
+		{"beneath path", Violation{Process: "node", Target: "/usr/lib/libc.dylib"}, true},
+		{"path containing pattern", Violation{Process: "node", Target: "/tmp/x/usr/lib/evil"}, false},
+		{"sibling prefix", Violation{Process: "node", Target: "/usr/libexec/foo"}, false},
+		{"process specific", Violation{Process: "git", Target: "/usr/bin/ssh-agent"}, true},
+		{"other process", Violation{Process: "curl", Target: "/usr/bin/ssh-agent"}, false},
+		{"non-path exact", Violation{Process: "git", Target: "com.apple.SecurityServer"}, true},
+		{"non-path substring", Violation{Process: "git", Target: "com.apple.SecurityServer.extra"}, true},
+		{"non-path elsewhere", Violation{Process: "git", Target: "com.apple.securityd"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matcher.Match(tt.v); got != tt.want {
+				t.Errorf("Match(%+v) = %v, want %v", tt.v, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIgnoreMatcherPreSeriesConfig(t *testing.T) {
+	// A configuration written before ignore rules, anchored paths and
+	// host:port proxy targets
+	var cfg config.Config
+	data := `{"ignoreViolations": {"*": ["/usr/lib"], "srt-proxy": ["example.com"], "node": ["cfprefsd"]}}`
+	if err := json.Unmarshal([]byte(data), &cfg); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	matcher, err := NewIgnoreMatcher(cfg.Violations, cfg.ViolationSettings.Ignore)
+	if err != nil {
+		t.Fatalf("NewIgnoreMatcher() error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		v    Violation
+		want bool
+	}{
+		{"proxy domain with port", proxyViolation(network.Decision{Domain: "example.com", Port: 443, Rule: "defaultPolicy:deny"}, false), true},
+		{"proxy subdomain", proxyViolation(network.Decision{Domain: "api.example.com", Port: 443, Rule: "defaultPolicy:deny"}, false), true},
+		{"other proxy domain", proxyViolation(network.Decision{Domain: "example.org", Port: 443, Rule: "defaultPolicy:deny"}, false), false},
+		{"mach service", Violation{Process: "node", Operation: "mach-lookup", Target: "com.apple.cfprefsd.daemon"}, true},
+		{"path", Violation{Process: "node", Target: "/usr/lib/libc.dylib"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matcher.Match(tt.v); got != tt.want {
+				t.Errorf("Match(%+v) = %v, want %v", tt.v, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIgnoreMatcherRules(t *testing.T) {
+	matcher, err := NewIgnoreMatcher(nil, []config.IgnoreRule{
+		{Process: "python3*", Operation: "file-read*", Target: "/opt/homebrew/**/*.pyc"},
+		{Operation: "mach-lookup", TargetRegex: `com\.apple\.(cfprefsd|lsd)\..*`},
+		{Operation: "file-write", Target: "/private/var/folders"},
+	})
+	if err != nil {
+		t.Fatalf("NewIgnoreMatcher() error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		v    Violation
+		want bool
+	}{
+		{
+			name: "process glob, operation glob and target glob",
+			v:    Violation{Process: "python3.12", Operation: "file-read-data", Category: CategoryFileRead, Target: "/opt/homebrew/lib/x/y.pyc"},
+			want: true,
+		},
+		{
+			name: "operation filter excludes writes",
+			v:    Violation{Process: "python3.12", Operation: "file-write-data", Category: CategoryFileWrite, Target: "/opt/homebrew/lib/x/y.pyc"},
+			want: false,
+		},
+		{
+			name: "process glob excludes other processes",
+			v:    Violation{Process: "node", Operation: "file-read-data", Category: CategoryFileRead, Target: "/opt/homebrew/lib/x/y.pyc"},
+			want: false,
+		},
+		{
+			name: "anchored regex",
+			v:    Violation{Process: "swift", Operation: "mach-lookup", Category: CategoryMach, Target: "com.apple.cfprefsd.daemon"},
+			want: true,
+		},
+		{
+			name: "regex must match whole target",
+			v:    Violation{Process: "swift", Operation: "mach-lookup", Category: CategoryMach, Target: "evil.com.apple.lsd.x"},
+			want: false,
+		},
+		{
+			name: "operation matches category",
+			v:    Violation{Process: "cc", Operation: "file-write-create", Category: CategoryFileWrite, Target: "/private/var/folders/x/T/cc.o"},
+			want: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matcher.Match(tt.v); got != tt.want {
+				t.Errorf("Match(%+v) = %v, want %v", tt.v, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIgnoreMatcherInvalidRules(t *testing.T) {
+	tests := []config.IgnoreRule{
+		{Process: "[bad"},
+		{TargetRegex: "(unclosed"},
+		{Target: "/path/[abc"},
+	}
+
+	for _, rule := range tests {
+		if _, err := NewIgnoreMatcher(nil, []config.IgnoreRule{rule}); err == nil {
+			t.Errorf("NewIgnoreMatcher(%+v) expected error", rule)
+		}
+	}
+}
+
+func TestIgnoreMatcherSuppressedCounts(t *testing.T) {
+	matcher, err := NewIgnoreMatcher(map[string][]string{"*": {"/System"}}, []config.IgnoreRule{
+		{Operation: "sysctl-read"},
+	})
+	if err != nil {
+		t.Fatalf("NewIgnoreMatcher() error = %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		matcher.Match(Violation{Operation: "sysctl-read", Target: "kern.bootargs"})
+	}
+	matcher.Match(Violation{Operation: "file-read-data", Target: "/System/Library/x"})
+	matcher.Match(Violation{Operation: "file-read-data", Target: "/Users/dev/.ssh/id_rsa"})
+
+	if got := matcher.Suppressed(); got != 4 {
+		t.Errorf("Suppressed() = %d, want 4", got)
+	}
+
+	counts := matcher.SuppressedByRule()
+	if len(counts) != 2 || counts[0].Rule != "operation=sysctl-read" || counts[0].Count != 3 {
+		t.Errorf("SuppressedByRule() = %+v", counts)
+	}
+
+	summary := NewViolationSummary()
+	summary.SetSuppressed(counts)
+
+	var buf bytes.Buffer
+	summary.Print(&buf)
+	if !strings.Contains(buf.String(), "4 violations suppressed by ignore rules") {
+		t.Errorf("Summary should report suppressed violations:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,91 @@
+package sandbox
+
+import (
+	"fmt"
+
+	"github.com/sammcj/srt-go/internal/config"
+	"github.com/sammcj/srt-go/internal/network"
+)
+
+// KillRuleExitCode is the exit status used when a kill rule terminates the
+// command (EX_NOPERM from sysexits.h)
+const KillRuleExitCode = 77
+
+// KillEvent records the kill rule that terminated a command
+type KillEvent struct {
+	Rule      string    `json:"rule"`
+	Violation Violation `json:"violation"`
+}
+
+// KillMatcher matches violations against kill rules compiled once at startup
+type KillMatcher struct {
+	rules []compiledKillRule
+}
+
+type compiledKillRule struct {
+	name   string
+	match  compiledIgnoreRule
+	domain *network.DomainPattern
+}
+
+// NewKillMatcher compiles kill rules
+func NewKillMatcher(rules []config.KillRule) (*KillMatcher, error) {
+	m := &KillMatcher{}
+
+	for i, rule := range rules {
+		match, err := compileIgnoreRule(config.IgnoreRule{
+			Operation: rule.Operation,
+			Target:    rule.Target,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("invalid kill rule %d: %w", i, err)
+		}
+
+		compiled := compiledKillRule{name: rule.Name, match: match}
+		if compiled.name == "" {
+			compiled.name = describeKillRule(rule)
+		}
+
+		if rule.Domain != "" {
+			pattern, err := network.NewDomainPattern(rule.Domain)
+			if err != nil {
+				return nil, fmt.Errorf("invalid kill rule %d domain %q: %w", i, rule.Domain, err)
+			}
+			compiled.domain = &pattern
+		}
+
+		m.rules = append(m.rules, compiled)
+	}
+
+	return m, nil
+}
+
+// Match returns the name of the first kill rule matching a violation
+func (m *KillMatcher) Match(v Violation) (string, bool) {
+	for _, rule := range m.rules {
+		if rule.matches(v) {
+			return rule.name, true
+		}
+	}
+	return "", false
+}
+
+func (r compiledKillRule) matches(v Violation) bool {
+	// Domain rules only apply to denials reported by the proxies
+	if r.domain != nil && (v.Process != proxyProcess || !r.domain.Matches(v.Target)) {
+		return false
+	}
+
+	return r.match.matches(v)
+}
+
+func describeKillRule(rule config.KillRule) string {
+	desc := describeIgnoreRule(config.IgnoreRule{Operation: rule.Operation, Target: rule.Target})
+	if rule.Domain != "" {
+		if desc != "" {
+			desc += " "
+		}
+		desc += "domain=" + rule.Domain
+	}
+	return desc
+}
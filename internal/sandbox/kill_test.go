@@ -0,0 +1,146 @@
+package sandbox
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/sammcj/srt-go/internal/config"
+	"github.com/sammcj/srt-go/internal/network"
+)
+
+func TestKillMatcher(t *testing.T) {
+	t.Setenv("HOME", "/Users/dev")
+
+	matcher, err := NewKillMatcher([]config.KillRule{
+		{Name: "ssh-keys", Operation: "file-read*", Target: "~/.ssh/**"},
+		{Domain: "*.evil.example"},
+	})
+	if err != nil {
+		t.Fatalf("NewKillMatcher() error = %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		v        Violation
+		wantRule string
+		want     bool
+	}{
+		{
+			name:     "read of ssh key",
+			v:        Violation{Process: "node", Operation: "file-read-data", Category: CategoryFileRead, Target: "/Users/dev/.ssh/id_ed25519"},
+			wantRule: "ssh-keys",
+			want:     true,
+		},
+		{
+			name: "write is not a read",
+			v:    Violation{Process: "node", Operation: "file-write-create", Category: CategoryFileWrite, Target: "/Users/dev/.ssh/id_ed25519"},
+		},
+		{
+			name: "other path",
+			v:    Violation{Process: "node", Operation: "file-read-data", Category: CategoryFileRead, Target: "/Users/dev/.sshconfig"},
+		},
+		{
+			name:     "proxy denial of matching domain",
+			v:        proxyViolation(network.Decision{Domain: "c2.evil.example", Rule: "defaultPolicy:deny"}, false),
+			wantRule: "domain=*.evil.example",
+			want:     true,
+		},
+		{
+			name: "proxy denial of other domain",
+			v:    proxyViolation(network.Decision{Domain: "example.com", Rule: "defaultPolicy:deny"}, false),
+		},
+		{
+			name: "domain rules ignore sandbox violations",
+			v:    Violation{Process: "curl", Operation: "network-outbound", Category: CategoryNetwork, Target: "c2.evil.example"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, ok := matcher.Match(tt.v)
+			if ok != tt.want || rule != tt.wantRule {
+				t.Errorf("Match() = (%q, %v), want (%q, %v)", rule, ok, tt.wantRule, tt.want)
+			}
+		})
+	}
+}
+
+func TestTerminateKillsProcessGroup(t *testing.T) {
+	// The shell's background child must die with it
+	cmd := exec.Command("sh", "-c", "sleep 30 & wait")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		t.Skipf("Cannot start shell: %v", err)
+	}
+
+	m := &Manager{pid: cmd.Process.Pid, processGroup: true}
+	v := Violation{Process: "sh", Operation: "file-read-data", Target: "/etc/shadow"}
+	m.terminate("secrets", v)
+	m.terminate("second", v)
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Command was not terminated")
+	}
+
+	// Orphaned members are reaped asynchronously, so allow them a moment to go
+	deadline := time.Now().Add(5 * time.Second)
+	for syscall.Kill(-cmd.Process.Pid, 0) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Process group still has live members")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if event := m.KillEvent(); event == nil || event.Rule != "secrets" {
+		t.Errorf("KillEvent() = %+v, want the first rule to fire", event)
+	}
+}
+
+func TestTerminateBeforeProcessStarts(t *testing.T) {
+	m := &Manager{}
+	m.terminate("secrets", Violation{Process: "sh", Operation: "file-read-data", Target: "/etc/shadow"})
+
+	cmd := exec.Command("sleep", "30")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		t.Skipf("Cannot start sleep: %v", err)
+	}
+
+	// The rule fired while the command was starting, so it's killed once recorded
+	m.setProcess(cmd.Process.Pid, true)
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("Command was not terminated")
+	}
+}
+
+func TestForegroundTerminalIgnoresPipes(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe() error = %v", err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	stdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = stdin }()
+
+	if fd, ok := foregroundTerminal(); ok {
+		t.Errorf("foregroundTerminal() = %d, true for a pipe", fd)
+	}
+}
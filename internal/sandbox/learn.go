@@ -0,0 +1,387 @@
+package sandbox
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sammcj/srt-go/internal/config"
+	"github.com/sammcj/srt-go/internal/filesystem"
+	"github.com/sammcj/srt-go/internal/network"
+)
+
+// PolicyProposal is the minimal set of configuration changes that would allow
+// the behaviour observed during a learn run
+type PolicyProposal struct {
+	AllowWrite     []string      `json:"allowWrite,omitempty"`
+	AllowUnlink    []string      `json:"allowUnlink,omitempty"`
+	RemoveDenyRead []DenyReadHit `json:"removeDenyRead,omitempty"`
+	AllowedDomains []string      `json:"allowedDomains,omitempty"`
+}
+
+// DenyReadHit is a denyRead entry that blocked an observed read
+type DenyReadHit struct {
+	Entry  string `json:"entry"`  // Entry as written in the configuration
+	Target string `json:"target"` // First path read under the entry
+}
+
+// IsEmpty reports whether the proposal contains no changes
+func (p *PolicyProposal) IsEmpty() bool {
+	return len(p.AllowWrite) == 0 &&
+		len(p.AllowUnlink) == 0 &&
+		len(p.RemoveDenyRead) == 0 &&
+		len(p.AllowedDomains) == 0
+}
+
+// Diff returns the proposal as a diff against the current configuration
+func (p *PolicyProposal) Diff() string {
+	if p.IsEmpty() {
+		return "No configuration changes needed\n"
+	}
+
+	var sb strings.Builder
+
+	writeAdditions := func(key string, values []string) {
+		if len(values) == 0 {
+			return
+		}
+		sb.WriteString(key + "\n")
+		for _, v := range values {
+			sb.WriteString(fmt.Sprintf("  + %q\n", v))
+		}
+	}
+
+	writeAdditions("filesystem.allowWrite", p.AllowWrite)
+	writeAdditions("filesystem.allowUnlink", p.AllowUnlink)
+
+	if len(p.RemoveDenyRead) > 0 {
+		sb.WriteString("filesystem.denyRead\n")
+		for _, hit := range p.RemoveDenyRead {
+			sb.WriteString(fmt.Sprintf("  - %q (read %s)\n", hit.Entry, hit.Target))
+		}
+	}
+
+	writeAdditions("network.allowedDomains", p.AllowedDomains)
+
+	return sb.String()
+}
+
+// ApplyToFile merges the proposal into the settings file at path. Fields not
+// touched by the proposal are preserved. If the file does not exist it is
+// created from the default configuration.
+func (p *PolicyProposal) ApplyToFile(path string) error {
+	settings := make(map[string]any)
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		if err := config.CreateDefaultConfigFile(path); err != nil {
+			return err
+		}
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read settings file: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return fmt.Errorf("failed to parse settings file: %w", err)
+	}
+
+	var removeDenyRead []string
+	for _, hit := range p.RemoveDenyRead {
+		removeDenyRead = append(removeDenyRead, hit.Entry)
+	}
+
+	updateListField(settings, "filesystem", "allowWrite", p.AllowWrite, nil)
+	updateListField(settings, "filesystem", "allowUnlink", p.AllowUnlink, nil)
+	updateListField(settings, "filesystem", "denyRead", nil, removeDenyRead)
+	updateListField(settings, "network", "allowedDomains", p.AllowedDomains, nil)
+
+	out, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal settings: %w", err)
+	}
+
+	if err := os.WriteFile(path, out, 0644); err != nil {
+		return fmt.Errorf("failed to write settings file: %w", err)
+	}
+
+	return nil
+}
+
+// ConfirmApply asks on out whether to merge the proposal into path and reads
+// the answer from in
+func ConfirmApply(in io.Reader, out io.Writer, path string) bool {
+	fmt.Fprintf(out, "Merge proposed changes into %s? [y/N] ", path)
+
+	answer, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && answer == "" {
+		return false
+	}
+
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// updateListField adds and removes string values in settings[section][key]
+func updateListField(settings map[string]any, section, key string, add, remove []string) {
+	if len(add) == 0 && len(remove) == 0 {
+		return
+	}
+
+	sectionMap, ok := settings[section].(map[string]any)
+	if !ok {
+		sectionMap = make(map[string]any)
+		settings[section] = sectionMap
+	}
+
+	existing, _ := sectionMap[key].([]any)
+	seen := make(map[string]bool)
+	values := make([]any, 0, len(existing)+len(add))
+
+	for _, v := range existing {
+		str, ok := v.(string)
+		if ok && slices.Contains(remove, str) {
+			continue
+		}
+		if ok {
+			seen[str] = true
+		}
+		values = append(values, v)
+	}
+
+	for _, v := range add {
+		if !seen[v] {
+			seen[v] = true
+			values = append(values, v)
+		}
+	}
+
+	sectionMap[key] = values
+}
+
+// policyLearner collects would-be denials during a learn run
+type policyLearner struct {
+	mu      sync.Mutex
+	writes  map[string]bool
+	unlinks map[string]bool
+	reads   map[string]bool
+	domains map[string]bool
+}
+
+func newPolicyLearner() *policyLearner {
+	return &policyLearner{
+		writes:  make(map[string]bool),
+		unlinks: make(map[string]bool),
+		reads:   make(map[string]bool),
+		domains: make(map[string]bool),
+	}
+}
+
+// AddViolation records a report from the report-only profile
+func (l *policyLearner) AddViolation(v Violation) {
+	if v.Target == "" || !strings.HasPrefix(v.Target, "/") {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	switch {
+	case strings.HasPrefix(v.Operation, "file-write-unlink"):
+		l.unlinks[v.Target] = true
+	case v.Category == CategoryFileWrite:
+		l.writes[v.Target] = true
+	case v.Category == CategoryFileRead:
+		l.reads[v.Target] = true
+	}
+}
+
+// AddDecision records a proxy decision, keeping domains the policy would block
+func (l *policyLearner) AddDecision(d network.Decision) {
+	// Server name, request rule and quota denials aren't fixed by allowing the domain
+	if d.Allowed || d.Domain == "" || d.ServerNameCheck || d.Method != "" || d.Quota {
+		return
+	}
+
+	// Propose the port alone when the domain is already allowed on other ports
+	entry := d.Domain
+	if d.PortDenied {
+		entry = d.Address()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.domains[entry] = true
+}
+
+// Proposal builds the minimal configuration changes for what was observed
+func (l *policyLearner) Proposal(cfg *config.Config) (*PolicyProposal, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	allowWrite, err := filesystem.NormalisePaths(cfg.Filesystem.AllowWrite)
+	if err != nil {
+		return nil, fmt.Errorf("failed to normalise allow write paths: %w", err)
+	}
+
+	allowUnlink, err := filesystem.NormalisePaths(cfg.Filesystem.AllowUnlink)
+	if err != nil {
+		return nil, fmt.Errorf("failed to normalise allow unlink paths: %w", err)
+	}
+
+	denyRead, err := filesystem.NormalisePaths(cfg.Filesystem.DenyRead)
+	if err != nil {
+		return nil, fmt.Errorf("failed to normalise deny read paths: %w", err)
+	}
+
+	proposal := &PolicyProposal{
+		AllowWrite:  minimalGlobs(uncoveredPaths(l.writes, allowWrite)),
+		AllowUnlink: minimalGlobs(uncoveredPaths(l.unlinks, allowUnlink)),
+	}
+
+	// Map reads back to the denyRead entries that blocked them
+	hits := make(map[int]string)
+	for _, target := range sortedKeys(l.reads) {
+		for i, pattern := range denyRead {
+			if _, ok := hits[i]; ok {
+				continue
+			}
+			if pathCovered(target, pattern) {
+				hits[i] = target
+			}
+		}
+	}
+	for i := range cfg.Filesystem.DenyRead {
+		if target, ok := hits[i]; ok {
+			proposal.RemoveDenyRead = append(proposal.RemoveDenyRead, DenyReadHit{
+				Entry:  cfg.Filesystem.DenyRead[i],
+				Target: target,
+			})
+		}
+	}
+
+	proposal.AllowedDomains = sortedKeys(l.domains)
+
+	return proposal, nil
+}
+
+// uncoveredPaths returns the paths not already covered by any of the patterns
+func uncoveredPaths(paths map[string]bool, patterns []string) []string {
+	var result []string
+	for _, path := range sortedKeys(paths) {
+		covered := false
+		for _, pattern := range patterns {
+			if pathCovered(path, pattern) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			result = append(result, path)
+		}
+	}
+	return result
+}
+
+// pathCovered reports whether a normalised pattern matches a path using the
+// same semantics as the generated profile (globs as regexes, otherwise subpath)
+func pathCovered(path, pattern string) bool {
+	if filesystem.ContainsGlob(pattern) {
+		matched, err := filesystem.MatchGlob(pattern, path)
+		return err == nil && matched
+	}
+
+	return path == pattern || strings.HasPrefix(path, strings.TrimSuffix(pattern, "/")+"/")
+}
+
+// minimalGlobs collapses paths into as few entries as possible: directories
+// with more than one observed path become "dir/**", single paths are kept as-is
+func minimalGlobs(paths []string) []string {
+	if len(paths) == 0 {
+		return nil
+	}
+
+	byDir := make(map[string][]string)
+	for _, path := range paths {
+		dir := filepath.Dir(path)
+		byDir[dir] = append(byDir[dir], path)
+	}
+
+	var candidates []string
+	for dir, files := range byDir {
+		switch {
+		case len(files) > 1 && collapsible(dir):
+			candidates = append(candidates, dir+"/**")
+		default:
+			candidates = append(candidates, files...)
+		}
+	}
+	sort.Strings(candidates)
+
+	// Drop entries covered by a broader directory glob
+	var result []string
+	for _, candidate := range candidates {
+		covered := false
+		for _, other := range candidates {
+			if other == candidate || !strings.HasSuffix(other, "/**") {
+				continue
+			}
+			if pathCovered(strings.TrimSuffix(candidate, "/**"), other) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			result = append(result, contractHome(candidate))
+		}
+	}
+
+	return result
+}
+
+// collapsible reports whether files in dir may be proposed as dir/**. The
+// root, top-level directories and the home directory, or its parents, are
+// far broader than anything a command needs, so their files stay listed.
+func collapsible(dir string) bool {
+	if dir == "/" || strings.Count(dir, "/") < 2 {
+		return false
+	}
+	home, err := os.UserHomeDir()
+	if err != nil || home == "" {
+		return true
+	}
+	return dir != home && !strings.HasPrefix(home, dir+"/")
+}
+
+// contractHome replaces the home directory prefix with ~
+func contractHome(path string) string {
+	home, err := os.UserHomeDir()
+	if err != nil || home == "" {
+		return path
+	}
+
+	if path == home {
+		return "~"
+	}
+	if strings.HasPrefix(path, home+"/") {
+		return "~" + path[len(home):]
+	}
+	return path
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,238 @@
+package sandbox
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sammcj/srt-go/internal/config"
+	"github.com/sammcj/srt-go/internal/network"
+)
+
+func TestMinimalGlobs(t *testing.T) {
+	t.Setenv("HOME", "/Users/dev")
+
+	tests := []struct {
+		name  string
+		paths []string
+		want  []string
+	}{
+		{
+			name:  "single file kept exact",
+			paths: []string{"/opt/tool/state.json"},
+			want:  []string{"/opt/tool/state.json"},
+		},
+		{
+			name:  "sibling files collapse to directory glob",
+			paths: []string{"/opt/tool/a", "/opt/tool/b"},
+			want:  []string{"/opt/tool/**"},
+		},
+		{
+			name:  "nested paths covered by broader glob",
+			paths: []string{"/opt/tool/a", "/opt/tool/b", "/opt/tool/cache/c"},
+			want:  []string{"/opt/tool/**"},
+		},
+		{
+			name:  "files in top-level directories kept exact",
+			paths: []string{"/a", "/b", "/opt/a", "/opt/b"},
+			want:  []string{"/a", "/b", "/opt/a", "/opt/b"},
+		},
+		{
+			name:  "files in the home directory kept exact",
+			paths: []string{"/Users/dev/.npmrc", "/Users/dev/.yarnrc"},
+			want:  []string{"~/.npmrc", "~/.yarnrc"},
+		},
+		{
+			name:  "home directory contracted",
+			paths: []string{"/Users/dev/.npmrc"},
+			want:  []string{"~/.npmrc"},
+		},
+		{
+			name:  "empty",
+			paths: nil,
+			want:  nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := minimalGlobs(tt.paths)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("minimalGlobs(%v) = %v, want %v", tt.paths, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicyLearnerProposal(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	project := filepath.Join(home, "project")
+	if err := os.MkdirAll(project, 0755); err != nil {
+		t.Fatalf("Failed to create project dir: %v", err)
+	}
+
+	cfg := &config.Config{
+		Filesystem: config.FilesystemConfig{
+			DenyRead:   []string{"~/.ssh/**", "~/.aws/**"},
+			AllowWrite: []string{project},
+		},
+	}
+
+	learner := newPolicyLearner()
+
+	// Already allowed write, should not be proposed
+	learner.AddViolation(Violation{Operation: "file-write-create", Category: CategoryFileWrite, Target: filepath.Join(project, "out.js")})
+	// New writes in the same cache directory
+	learner.AddViolation(Violation{Operation: "file-write-create", Category: CategoryFileWrite, Target: filepath.Join(home, ".cache/tool/a")})
+	learner.AddViolation(Violation{Operation: "file-write-data", Category: CategoryFileWrite, Target: filepath.Join(home, ".cache/tool/b")})
+	learner.AddViolation(Violation{Operation: "file-write-unlink", Category: CategoryFileWrite, Target: filepath.Join(home, ".cache/tool/a")})
+	// Read of a denied path
+	learner.AddViolation(Violation{Operation: "file-read-data", Category: CategoryFileRead, Target: filepath.Join(home, ".aws/config")})
+	// Read of a file srt denied for itself, never proposed
+	learner.AddViolation(Violation{Operation: "file-read-data", Category: CategoryFileRead, Target: filepath.Join(home, ".srt/ca-key.pem")})
+	// Non-path targets are ignored
+	learner.AddViolation(Violation{Operation: "mach-lookup", Category: CategoryMach, Target: "com.apple.cfprefsd.daemon"})
+
+	learner.AddDecision(network.Decision{Domain: "registry.npmjs.org", Allowed: false})
+	learner.AddDecision(network.Decision{Domain: "github.com", Allowed: true})
+	learner.AddDecision(network.Decision{Domain: "github.com", Port: 22, PortDenied: true})
+	learner.AddDecision(network.Decision{Domain: "cdn.example.com", Port: 443, Rule: "sniMismatch:github.com", ServerNameCheck: true})
+	learner.AddDecision(network.Decision{Domain: "github.com", Port: 443, Method: "POST", Path: "/", Rule: "httpRules[0]"})
+	learner.AddDecision(network.Decision{Domain: "uploads.example.com", Port: 443, Rule: "quotas:run bytesUp", Quota: true})
+
+	proposal, err := learner.Proposal(cfg)
+	if err != nil {
+		t.Fatalf("Proposal() error = %v", err)
+	}
+
+	if want := []string{"~/.cache/tool/**"}; !reflect.DeepEqual(proposal.AllowWrite, want) {
+		t.Errorf("AllowWrite = %v, want %v", proposal.AllowWrite, want)
+	}
+	if want := []string{"~/.cache/tool/a"}; !reflect.DeepEqual(proposal.AllowUnlink, want) {
+		t.Errorf("AllowUnlink = %v, want %v", proposal.AllowUnlink, want)
+	}
+	if len(proposal.RemoveDenyRead) != 1 || proposal.RemoveDenyRead[0].Entry != "~/.aws/**" {
+		t.Errorf("RemoveDenyRead = %+v, want ~/.aws/**", proposal.RemoveDenyRead)
+	}
+	if want := []string{"github.com:22", "registry.npmjs.org"}; !reflect.DeepEqual(proposal.AllowedDomains, want) {
+		t.Errorf("AllowedDomains = %v, want %v", proposal.AllowedDomains, want)
+	}
+
+	diff := proposal.Diff()
+	for _, want := range []string{`+ "~/.cache/tool/**"`, `- "~/.aws/**"`, `+ "registry.npmjs.org"`} {
+		if !strings.Contains(diff, want) {
+			t.Errorf("Diff() missing %q:\n%s", want, diff)
+		}
+	}
+}
+
+func TestPolicyProposalApplyToFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "srt-settings.json")
+	existing := `{
+  "network": {"defaultPolicy": "deny", "allowedDomains": ["github.com"]},
+  "filesystem": {"denyRead": ["~/.ssh/**", "~/.aws/**"], "allowWrite": ["."]},
+  "ripgrep": {"command": "rg"}
+}`
+	if err := os.WriteFile(path, []byte(existing), 0644); err != nil {
+		t.Fatalf("Failed to write settings: %v", err)
+	}
+
+	proposal := &PolicyProposal{
+		AllowWrite:     []string{"~/.cache/tool/**", "."},
+		RemoveDenyRead: []DenyReadHit{{Entry: "~/.aws/**", Target: "/Users/dev/.aws/config"}},
+		AllowedDomains: []string{"registry.npmjs.org"},
+	}
+
+	if err := proposal.ApplyToFile(path); err != nil {
+		t.Fatalf("ApplyToFile() error = %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read settings: %v", err)
+	}
+
+	var cfg config.Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		t.Fatalf("Updated settings are not valid: %v", err)
+	}
+
+	if want := []string{".", "~/.cache/tool/**"}; !reflect.DeepEqual(cfg.Filesystem.AllowWrite, want) {
+		t.Errorf("AllowWrite = %v, want %v", cfg.Filesystem.AllowWrite, want)
+	}
+	if want := []string{"~/.ssh/**"}; !reflect.DeepEqual(cfg.Filesystem.DenyRead, want) {
+		t.Errorf("DenyRead = %v, want %v", cfg.Filesystem.DenyRead, want)
+	}
+	if want := []string{"github.com", "registry.npmjs.org"}; !reflect.DeepEqual(cfg.Network.AllowedDomains, want) {
+		t.Errorf("AllowedDomains = %v, want %v", cfg.Network.AllowedDomains, want)
+	}
+	if cfg.Ripgrep.Command != "rg" || cfg.Network.DefaultPolicy != "deny" {
+		t.Error("Untouched settings were not preserved")
+	}
+}
+
+func TestConfirmApply(t *testing.T) {
+	tests := []struct {
+		input string
+		want  bool
+	}{
+		{"y\n", true},
+		{"YES\n", true},
+		{"n\n", false},
+		{"\n", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			var out bytes.Buffer
+			got := ConfirmApply(strings.NewReader(tt.input), &out, "/tmp/settings.json")
+			if got != tt.want {
+				t.Errorf("ConfirmApply(%q) = %v, want %v", tt.input, got, tt.want)
+			}
+			if !strings.Contains(out.String(), "/tmp/settings.json") {
+				t.Errorf("Prompt should name the settings file, got %q", out.String())
+			}
+		})
+	}
+}
+
+func TestNewManagerKeepsCallerConfig(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", "")
+
+	cfg := &config.Config{
+		LearnMode: true,
+		Network: config.NetworkConfig{
+			DefaultPolicy: "deny",
+			UpstreamProxy: config.UpstreamConfig{CredentialsFile: "/etc/proxy-auth"},
+		},
+		Filesystem: config.FilesystemConfig{DenyRead: []string{"~/.ssh/**"}},
+	}
+	m, err := NewManager(cfg)
+	if err != nil {
+		t.Fatalf("NewManager() error = %v", err)
+	}
+	defer m.Cleanup()
+
+	if want := []string{"~/.ssh/**"}; !reflect.DeepEqual(cfg.Filesystem.DenyRead, want) {
+		t.Errorf("Caller's DenyRead = %v, want %v", cfg.Filesystem.DenyRead, want)
+	}
+	keyPath, err := ViolationLogKeyPath()
+	if err != nil {
+		t.Fatalf("ViolationLogKeyPath() error = %v", err)
+	}
+	// srt's own files are kept apart from the policy, so learn mode never proposes them
+	if want := []string{"~/.ssh/**"}; !reflect.DeepEqual(m.config.Filesystem.DenyRead, want) {
+		t.Errorf("Manager's DenyRead = %v, want %v", m.config.Filesystem.DenyRead, want)
+	}
+	if want := []string{keyPath, "/etc/proxy-auth"}; !reflect.DeepEqual(m.internalPaths, want) {
+		t.Errorf("Manager's internal paths = %v, want %v", m.internalPaths, want)
+	}
+}
@@ -0,0 +1,188 @@
+package sandbox
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ChainIssue is a break in the violation log's hash chain
+type ChainIssue struct {
+	File    string `json:"file,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Seq     uint64 `json:"seq,omitempty"`
+	Problem string `json:"problem"`
+}
+
+// LogVerification is the result of checking the violation log's hash chain
+type LogVerification struct {
+	Files     []string     `json:"files"`
+	Records   int          `json:"records"`   // Chained records checked
+	Unchained int          `json:"unchained"` // Records written before chaining, which can't be checked
+	FirstSeq  uint64       `json:"firstSeq,omitempty"`
+	LastSeq   uint64       `json:"lastSeq,omitempty"`
+	Head      ChainHead    `json:"head"`
+	Issues    []ChainIssue `json:"issues,omitempty"`
+	key       []byte       // Nil when the key is missing and hashes can't be checked
+}
+
+// OK reports whether the chain verified without issues
+func (lv *LogVerification) OK() bool {
+	return len(lv.Issues) == 0
+}
+
+func (lv *LogVerification) addIssue(file string, line int, seq uint64, format string, args ...any) {
+	lv.Issues = append(lv.Issues, ChainIssue{
+		File:    filepath.Base(file),
+		Line:    line,
+		Seq:     seq,
+		Problem: fmt.Sprintf(format, args...),
+	})
+}
+
+// VerifyViolationLog checks the hash chain across the rotated and current
+// violation logs in dir with the key at keyPath, as for `srt logs verify`.
+// It detects modified, reordered and deleted records, deleted backups other
+// than the oldest, and truncation past the persisted chain head. Records
+// older than the first retained one are rotated out by design, so the chain
+// may start after seq 1.
+func VerifyViolationLog(dir, keyPath string) (*LogVerification, error) {
+	files, err := ViolationLogFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	head, err := ReadChainHead(filepath.Join(dir, chainHeadName))
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := readLogKey(keyPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	lv := &LogVerification{Files: files, Head: head, key: key}
+
+	var prev *LogRecord
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open violation log: %w", err)
+		}
+
+		err = verifyLogFile(lv, file, f, &prev)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", file, err)
+		}
+	}
+
+	if key == nil && lv.Records > 0 {
+		lv.addIssue("", 0, 0, "log key %s is missing, record hashes were not checked", keyPath)
+	}
+
+	switch {
+	case prev == nil && head.Seq > 0:
+		lv.addIssue("", 0, head.Seq, "log is empty but the chain head records seq %d", head.Seq)
+	case prev == nil:
+	case head.Seq == 0:
+		lv.addIssue("", 0, prev.Seq, "chain head is missing")
+	case head.Seq > prev.Seq:
+		lv.addIssue("", 0, prev.Seq, "log ends at seq %d but the chain head records seq %d, records were truncated", prev.Seq, head.Seq)
+	case head.Seq < prev.Seq:
+		lv.addIssue("", 0, prev.Seq, "log continues past the chain head at seq %d", head.Seq)
+	case head.Hash != prev.Hash:
+		lv.addIssue("", 0, prev.Seq, "last record does not match the chain head")
+	}
+
+	return lv, nil
+}
+
+func verifyLogFile(lv *LogVerification, file string, r io.Reader, prev **LogRecord) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+
+		record, ok := parseLogRecord(scanner.Bytes())
+		if !ok {
+			if len(scanner.Bytes()) > 0 {
+				lv.addIssue(file, line, 0, "unparseable record")
+			}
+			continue
+		}
+
+		if record.Hash == "" {
+			// Older versions did not chain records, but once the chain has
+			// started every record must carry a hash
+			if *prev != nil {
+				lv.addIssue(file, line, 0, "record without a hash inside the chain")
+			} else {
+				lv.Unchained++
+			}
+			continue
+		}
+
+		lv.Records++
+		if lv.FirstSeq == 0 {
+			lv.FirstSeq = record.Seq
+		}
+		lv.LastSeq = record.Seq
+
+		if lv.key != nil {
+			if hash, err := recordHash(record, lv.key); err != nil || hash != record.Hash {
+				lv.addIssue(file, line, record.Seq, "record was modified, its hash does not match")
+			}
+		}
+
+		if p := *prev; p != nil {
+			switch {
+			case record.Seq > p.Seq+1:
+				lv.addIssue(file, line, record.Seq, "%d records missing after seq %d", record.Seq-p.Seq-1, p.Seq)
+			case record.Seq <= p.Seq:
+				lv.addIssue(file, line, record.Seq, "out of order after seq %d", p.Seq)
+			case record.PrevHash != p.Hash:
+				lv.addIssue(file, line, record.Seq, "does not chain to seq %d", p.Seq)
+			}
+		}
+
+		*prev = &record
+	}
+
+	return scanner.Err()
+}
+
+// Print writes a human readable verification report to w
+func (lv *LogVerification) Print(w io.Writer) {
+	if lv.Records == 0 && lv.OK() {
+		fmt.Fprintf(w, "[srt-go] No chained records to verify (%d unchained)\n", lv.Unchained)
+		return
+	}
+
+	if lv.OK() {
+		fmt.Fprintf(w, "[srt-go] Violation log verified: %d records, seq %d-%d, %d files\n",
+			lv.Records, lv.FirstSeq, lv.LastSeq, len(lv.Files))
+	} else {
+		fmt.Fprintf(w, "[srt-go] Violation log verification FAILED: %d issues in %d records\n",
+			len(lv.Issues), lv.Records)
+	}
+
+	for _, issue := range lv.Issues {
+		switch {
+		case issue.File != "":
+			fmt.Fprintf(w, "  %s:%d: %s\n", issue.File, issue.Line, issue.Problem)
+		default:
+			fmt.Fprintf(w, "  %s\n", issue.Problem)
+		}
+	}
+
+	if lv.Unchained > 0 {
+		fmt.Fprintf(w, "  %d older records predate chaining and were not checked\n", lv.Unchained)
+	}
+}
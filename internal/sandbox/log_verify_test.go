@@ -0,0 +1,311 @@
+package sandbox
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testKeyPath returns where tests keep the chain key for a log in dir
+func testKeyPath(dir string) string {
+	return filepath.Join(dir, "config", logKeyName)
+}
+
+// writeChain appends n violation records through a logger in dir
+func writeChain(t *testing.T, dir string, n int) {
+	t.Helper()
+
+	logger, err := newViolationLogger(dir, testKeyPath(dir))
+	if err != nil {
+		t.Fatalf("newViolationLogger() error = %v", err)
+	}
+	defer logger.Close()
+
+	for i := range n {
+		err := logger.Write(LogRecord{
+			Time:      time.Now(),
+			RunID:     "3f9c2a7e1b6d4c08",
+			Mode:      "enforce",
+			Process:   "node",
+			Operation: "file-read-data",
+			Target:    fmt.Sprintf("/etc/f%d", i),
+		})
+		if err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+}
+
+// editLines rewrites a log file's lines through fn
+func editLines(t *testing.T, path string, fn func([]string) []string) {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	lines = fn(lines)
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// splitIntoBackups moves the first records of deny.log into rotated backups of size each
+func splitIntoBackups(t *testing.T, dir string, size, count int) {
+	t.Helper()
+
+	current := filepath.Join(dir, violationLogName)
+	editLines(t, current, func(lines []string) []string {
+		for i := range count {
+			chunk := lines[:size]
+			lines = lines[size:]
+			name := filepath.Join(dir, fmt.Sprintf("deny-2025-10-3%dT10-00-00.000.log", i))
+			if err := os.WriteFile(name, []byte(strings.Join(chunk, "\n")+"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return lines
+	})
+}
+
+// rechain edits every record in deny.log through fn and rewrites the chain
+// and its head consistently with key, as someone rewriting the log would
+func rechain(t *testing.T, dir string, key []byte, fn func(*LogRecord)) {
+	t.Helper()
+
+	var head ChainHead
+	editLines(t, filepath.Join(dir, violationLogName), func(lines []string) []string {
+		for i, line := range lines {
+			var r LogRecord
+			if err := json.Unmarshal([]byte(line), &r); err != nil {
+				t.Fatal(err)
+			}
+			fn(&r)
+			r.PrevHash = head.Hash
+			hash, err := recordHash(r, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Hash = hash
+			data, err := json.Marshal(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines[i] = string(data)
+			head = ChainHead{Seq: r.Seq, Hash: r.Hash, Time: r.Time}
+		}
+		return lines
+	})
+	if err := writeChainHead(filepath.Join(dir, chainHeadName), head); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyViolationLog(t *testing.T) {
+	tests := []struct {
+		name      string
+		tamper    func(t *testing.T, dir string)
+		wantIssue string
+	}{
+		{
+			name: "intact chain",
+		},
+		{
+			name: "intact across rotated files",
+			tamper: func(t *testing.T, dir string) {
+				splitIntoBackups(t, dir, 3, 2)
+			},
+		},
+		{
+			name: "oldest backup rotated out",
+			tamper: func(t *testing.T, dir string) {
+				splitIntoBackups(t, dir, 3, 2)
+				os.Remove(filepath.Join(dir, "deny-2025-10-30T10-00-00.000.log"))
+			},
+		},
+		{
+			name: "modified record",
+			tamper: func(t *testing.T, dir string) {
+				editLines(t, filepath.Join(dir, violationLogName), func(lines []string) []string {
+					lines[4] = strings.Replace(lines[4], "/etc/f4", "/etc/ok", 1)
+					return lines
+				})
+			},
+			wantIssue: "deny.log:5: record was modified",
+		},
+		{
+			name: "deleted record",
+			tamper: func(t *testing.T, dir string) {
+				editLines(t, filepath.Join(dir, violationLogName), func(lines []string) []string {
+					return append(lines[:3], lines[4:]...)
+				})
+			},
+			wantIssue: "1 records missing after seq 3",
+		},
+		{
+			name: "deleted middle backup",
+			tamper: func(t *testing.T, dir string) {
+				splitIntoBackups(t, dir, 3, 2)
+				os.Remove(filepath.Join(dir, "deny-2025-10-31T10-00-00.000.log"))
+			},
+			wantIssue: "3 records missing after seq 3",
+		},
+		{
+			name: "truncated tail",
+			tamper: func(t *testing.T, dir string) {
+				editLines(t, filepath.Join(dir, violationLogName), func(lines []string) []string {
+					return lines[:7]
+				})
+			},
+			wantIssue: "log ends at seq 7 but the chain head records seq 10",
+		},
+		{
+			name: "reordered records",
+			tamper: func(t *testing.T, dir string) {
+				editLines(t, filepath.Join(dir, violationLogName), func(lines []string) []string {
+					lines[2], lines[3] = lines[3], lines[2]
+					return lines
+				})
+			},
+			wantIssue: "out of order after seq 4",
+		},
+		{
+			name: "head removed",
+			tamper: func(t *testing.T, dir string) {
+				os.Remove(filepath.Join(dir, chainHeadName))
+			},
+			wantIssue: "chain head is missing",
+		},
+		{
+			name: "rewritten without the key",
+			tamper: func(t *testing.T, dir string) {
+				rechain(t, dir, []byte("guessed key"), func(r *LogRecord) {
+					if r.Target == "/etc/f4" {
+						r.Target = "/etc/ok"
+					}
+				})
+			},
+			wantIssue: "deny.log:1: record was modified",
+		},
+		{
+			name: "key removed",
+			tamper: func(t *testing.T, dir string) {
+				os.Remove(testKeyPath(dir))
+			},
+			wantIssue: "record hashes were not checked",
+		},
+		{
+			name: "hash stripped",
+			tamper: func(t *testing.T, dir string) {
+				editLines(t, filepath.Join(dir, violationLogName), func(lines []string) []string {
+					lines[5] = `{"time":"2025-10-30T10:00:00Z","mode":"enforce","process":"node","operation":"file-read-data"}`
+					return lines
+				})
+			},
+			wantIssue: "deny.log:6: record without a hash",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeChain(t, dir, 10)
+			if tt.tamper != nil {
+				tt.tamper(t, dir)
+			}
+
+			lv, err := VerifyViolationLog(dir, testKeyPath(dir))
+			if err != nil {
+				t.Fatalf("VerifyViolationLog() error = %v", err)
+			}
+
+			var buf bytes.Buffer
+			lv.Print(&buf)
+
+			if tt.wantIssue == "" {
+				if !lv.OK() {
+					t.Errorf("Expected a valid chain:\n%s", buf.String())
+				}
+				return
+			}
+			if lv.OK() || !strings.Contains(buf.String(), tt.wantIssue) {
+				t.Errorf("Expected issue %q:\n%s", tt.wantIssue, buf.String())
+			}
+		})
+	}
+}
+
+func TestVerifyViolationLogLegacyRecords(t *testing.T) {
+	dir := t.TempDir()
+	writeLogFile(t, filepath.Join(dir, violationLogName),
+		"2025/10/30 10:00:00 VIOLATION mode=enforce process=node operation=file-read-data target=/etc/hosts time=2025-10-30 10:00:00",
+	)
+	writeChain(t, dir, 3)
+
+	lv, err := VerifyViolationLog(dir, testKeyPath(dir))
+	if err != nil {
+		t.Fatalf("VerifyViolationLog() error = %v", err)
+	}
+	if !lv.OK() || lv.Unchained != 1 || lv.Records != 3 {
+		t.Errorf("VerifyViolationLog() = %+v, want 3 chained and 1 unchained record", lv)
+	}
+}
+
+func TestViolationLoggerSharesChain(t *testing.T) {
+	dir := t.TempDir()
+
+	// Concurrent runs each have their own logger on the same directory
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			writeChain(t, dir, 25)
+		}()
+	}
+	wg.Wait()
+
+	lv, err := VerifyViolationLog(dir, testKeyPath(dir))
+	if err != nil {
+		t.Fatalf("VerifyViolationLog() error = %v", err)
+	}
+	if !lv.OK() || lv.Records != 100 || lv.LastSeq != 100 {
+		var buf bytes.Buffer
+		lv.Print(&buf)
+		t.Errorf("Concurrent writers broke the chain (%d records):\n%s", lv.Records, buf.String())
+	}
+}
+
+func TestLoadOrCreateLogKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "srt", logKeyName)
+
+	key, err := loadOrCreateLogKey(path)
+	if err != nil {
+		t.Fatalf("loadOrCreateLogKey() error = %v", err)
+	}
+	if len(key) != logKeySize {
+		t.Errorf("Key is %d bytes, want %d", len(key), logKeySize)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Key file = %v, %v, want mode 0600", info, err)
+	}
+
+	again, err := loadOrCreateLogKey(path)
+	if err != nil || !bytes.Equal(again, key) {
+		t.Errorf("Second load = %x, %v, want the same key", again, err)
+	}
+
+	if err := os.WriteFile(path, []byte("short\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadOrCreateLogKey(path); err == nil {
+		t.Error("loadOrCreateLogKey() accepted an invalid key")
+	}
+}
@@ -1,7 +1,8 @@
 package sandbox
 
 import (
-	"encoding/base64"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"log/slog"
 	"os"
@@ -11,6 +12,7 @@ import (
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/sammcj/srt-go/internal/config"
 	"github.com/sammcj/srt-go/internal/filesystem"
@@ -18,34 +20,103 @@ import (
 	"github.com/sammcj/srt-go/internal/packagemanager"
 )
 
+// violationDrainDelay is how long to wait after the command exits for the
+// system log to deliver remaining violation reports
+const violationDrainDelay = 250 * time.Millisecond
+
 // Manager orchestrates sandbox execution
 type Manager struct {
-	config          *config.Config
-	httpProxy       *network.HTTPProxy
-	socksProxy      *network.SOCKSProxy
-	profilePath     string
-	violationMon    *ViolationMonitor
-	violationLogger *ViolationLogger
-	commandID       string
-	wg              sync.WaitGroup
-	stopCh          chan struct{}
-}
-
-// NewManager creates a new sandbox manager
-func NewManager(cfg *config.Config) (*Manager, error) {
+	config         *config.Config
+	httpProxy      *network.HTTPProxy
+	ca             *network.CertificateAuthority // Set when TLS interception is enabled
+	socksProxy     *network.SOCKSProxy
+	dnsServer      *network.DNSServer // Set when the DNS server is enabled
+	connections    *ConnectionLog     // Set when the proxies run
+	profilePath    string
+	internalPaths  []string // Files srt uses itself, denied to the command in every mode
+	pipeline       *violationPipeline
+	sourceOverride ViolationSource  // Replaces the log stream monitor when set
+	logger         *ViolationLogger // Chains records before they reach the other sinks
+	sinks          []ViolationSink
+	sinksOnce      sync.Once
+	summary        *ViolationSummary
+	learner        *policyLearner
+	ignore         *IgnoreMatcher
+	kill           *KillMatcher
+	killMu         sync.Mutex // Guards pid, processGroup and killEvent
+	pid            int
+	processGroup   bool
+	killEvent      *KillEvent
+	runID          string
+	wg             sync.WaitGroup
+	stopCh         chan struct{}
+}
+
+// NewManager creates a new sandbox manager. The configuration is copied, so
+// the entries and ports srt adds for itself never reach the caller's.
+func NewManager(cfg *config.Config) (_ *Manager, err error) {
+	cfg, err = config.DeepCopy(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy configuration: %w", err)
+	}
+
 	mgr := &Manager{
-		config:    cfg,
-		stopCh:    make(chan struct{}),
-		commandID: generateCommandID(),
+		config:  cfg,
+		stopCh:  make(chan struct{}),
+		summary: NewViolationSummary(),
+		runID:   generateRunID(),
+	}
+
+	// Release whatever was opened before a later step failed
+	defer func() {
+		if err != nil {
+			mgr.Cleanup()
+		}
+	}()
+
+	if cfg.LearnMode {
+		mgr.learner = newPolicyLearner()
 	}
 
+	// Compile ignore rules once, they are matched against every violation
+	ignore, err := NewIgnoreMatcher(cfg.Violations, cfg.ViolationSettings.Ignore)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile ignore rules: %w", err)
+	}
+	mgr.ignore = ignore
+
+	kill, err := NewKillMatcher(cfg.ViolationSettings.KillRules)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile kill rules: %w", err)
+	}
+	mgr.kill = kill
+
 	// Create violation logger (always created, logs all violations to file)
 	violationLogger, err := NewViolationLogger()
 	if err != nil {
 		// Don't fail if we can't create the logger, just warn
 		slog.Debug("Failed to create violation logger", "error", err)
 	} else {
-		mgr.violationLogger = violationLogger
+		mgr.logger = violationLogger
+		// The command can't read the chain key, so it can't forge a consistent chain
+		mgr.denyInternal(violationLogger.KeyPath())
+	}
+
+	// Configured sinks were asked for explicitly, so failing to create one is an error
+	sinks, err := NewViolationSinks(cfg.ViolationSettings.Sinks)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create violation sinks: %w", err)
+	}
+	mgr.sinks = append(mgr.sinks, sinks...)
+
+	// The upstream proxy's credentials and secrets stay outside the sandbox
+	if cfg.Network.UpstreamProxy.CredentialsFile != "" {
+		mgr.denyInternal(cfg.Network.UpstreamProxy.CredentialsFile)
+	}
+	for _, secret := range cfg.Network.Secrets {
+		if secret.File != "" {
+			mgr.denyInternal(secret.File)
+		}
 	}
 
 	// Determine if proxy is needed based on network configuration
@@ -61,25 +132,121 @@ func NewManager(cfg *config.Config) (*Manager, error) {
 		if err != nil {
 			return nil, fmt.Errorf("failed to create domain filter: %w", err)
 		}
+		if err := filter.SetDefaultPorts(cfg.Network.DefaultPorts); err != nil {
+			return nil, fmt.Errorf("failed to create domain filter: %w", err)
+		}
+		filter.SetMissingSNI(cfg.Network.MissingSNI)
+		if err := filter.SetCIDRs(cfg.Network.AllowedCIDRs, cfg.Network.DeniedCIDRs); err != nil {
+			return nil, fmt.Errorf("failed to create domain filter: %w", err)
+		}
+		// Secrets are only sent in requests the proxy can read, so their
+		// domains are always intercepted
+		for _, secret := range cfg.Network.Secrets {
+			cfg.Network.TLSIntercept.Domains = append(cfg.Network.TLSIntercept.Domains, secret.Domains...)
+		}
+		if err := filter.SetIntercept(cfg.Network.TLSIntercept.Domains); err != nil {
+			return nil, fmt.Errorf("failed to create domain filter: %w", err)
+		}
+		if err := filter.SetHTTPRules(httpRules(cfg.Network.HTTPRules)); err != nil {
+			return nil, fmt.Errorf("failed to create domain filter: %w", err)
+		}
+		if err := filter.SetQuotas(quotas(cfg.Network.Quotas)); err != nil {
+			return nil, fmt.Errorf("failed to create domain filter: %w", err)
+		}
+		values, err := secrets(cfg.Network.Secrets)
+		if err != nil {
+			return nil, err
+		}
+		if err := filter.SetSecrets(values); err != nil {
+			return nil, fmt.Errorf("failed to create domain filter: %w", err)
+		}
+
+		// Learn mode permits every domain and records the ones policy would block.
+		// Otherwise proxy denials are reported as violations, and allowed through in audit mode.
+		if mgr.learner != nil {
+			filter.SetReportOnly(true)
+			filter.SetDecisionHook(mgr.learner.AddDecision)
+		} else {
+			filter.SetReportOnly(cfg.IsAudit())
+			filter.SetDecisionHook(mgr.handleProxyDecision)
+		}
+
+		// Record every proxied connection, in memory if the file can't be created
+		mgr.connections = &ConnectionLog{runID: mgr.runID}
+		if dir, err := ViolationLogDir(); err != nil {
+			slog.Debug("Failed to create connection log", "error", err)
+		} else if connections, err := NewConnectionLog(dir, mgr.runID); err != nil {
+			slog.Debug("Failed to create connection log", "error", err)
+		} else {
+			mgr.connections = connections
+		}
+
+		// Allowed connections go out through the upstream proxy when one is set
+		var upstream *network.Upstream
+		if cfg.Network.UpstreamProxy.URL != "" {
+			upstream, err = newUpstream(cfg.Network.UpstreamProxy)
+			if err != nil {
+				return nil, fmt.Errorf("failed to configure upstream proxy: %w", err)
+			}
+		}
 
 		// Create HTTP proxy
 		mgr.httpProxy, err = network.NewHTTPProxy(filter, cfg.Network.HTTPProxyPort)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create HTTP proxy: %w", err)
 		}
+		mgr.httpProxy.SetConnectionHook(mgr.handleConnection)
+		mgr.httpProxy.SetUpstream(upstream)
 
 		// Update config with actual port
 		cfg.Network.HTTPProxyPort = mgr.httpProxy.Port()
 
+		// Intercepted domains are decrypted with the local CA. The sandboxed
+		// command is told to trust its certificate but can never read its key.
+		if len(cfg.Network.TLSIntercept.Domains) > 0 {
+			dir, err := ViolationLogDir()
+			if err != nil {
+				return nil, err
+			}
+			mgr.ca, err = network.LoadOrCreateCA(dir)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load TLS interception CA: %w", err)
+			}
+			mgr.httpProxy.SetCA(mgr.ca)
+			mgr.denyInternal(mgr.ca.KeyPath())
+		}
+
 		// Create SOCKS5 proxy
 		mgr.socksProxy, err = network.NewSOCKSProxy(filter, cfg.Network.SOCKSProxyPort)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create SOCKS5 proxy: %w", err)
 		}
+		mgr.socksProxy.SetConnectionHook(mgr.handleConnection)
+		mgr.socksProxy.SetUpstream(upstream)
 
 		// Update config with actual port
 		cfg.Network.SOCKSProxyPort = mgr.socksProxy.Port()
 
+		// The DNS server answers from the same filter. Addresses it answers
+		// with are checked and recorded by the SOCKS5 proxy as their names.
+		if cfg.Network.DNSServer {
+			mgr.dnsServer, err = network.NewDNSServer(filter, cfg.Network.DNSServerPort)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create DNS server: %w", err)
+			}
+			mgr.dnsServer.SetConnectionHook(mgr.handleConnection)
+			mgr.socksProxy.SetDNSServer(mgr.dnsServer)
+			cfg.Network.DNSServerPort = mgr.dnsServer.Port()
+
+			mgr.wg.Add(1)
+			go func() {
+				defer mgr.wg.Done()
+				if err := mgr.dnsServer.Start(); err != nil {
+					slog.Debug("DNS server stopped", "error", err)
+				}
+			}()
+		}
+
 		// Start proxies in background
 		mgr.wg.Add(2)
 
@@ -100,7 +267,8 @@ func NewManager(cfg *config.Config) (*Manager, error) {
 		if cfg.Verbose {
 			slog.Debug("Network proxies started",
 				"http_port", cfg.Network.HTTPProxyPort,
-				"socks_port", cfg.Network.SOCKSProxyPort)
+				"socks_port", cfg.Network.SOCKSProxyPort,
+				"dns_port", cfg.Network.DNSServerPort)
 		}
 	} else {
 		if cfg.Verbose {
@@ -114,10 +282,22 @@ func NewManager(cfg *config.Config) (*Manager, error) {
 	return mgr, nil
 }
 
+// denyInternal keeps a file srt uses itself from the command. It isn't part
+// of the caller's policy, so it's denied even when audit and learn mode only
+// report, and learn mode never proposes removing it.
+func (m *Manager) denyInternal(path string) {
+	m.internalPaths = append(m.internalPaths, path)
+}
+
 // needsNetworkProxy determines if network proxies are needed based on configuration
 func needsNetworkProxy(cfg *config.Config) bool {
-	// Proxy needed if we have allowed domains (filtering mode)
-	if len(cfg.Network.AllowedDomains) > 0 {
+	// Proxy needed in learn and audit modes to observe which domains are used
+	if cfg.LearnMode || cfg.IsAudit() {
+		return true
+	}
+
+	// Proxy needed if we have allowed domains or ranges (filtering mode)
+	if len(cfg.Network.AllowedDomains) > 0 || len(cfg.Network.AllowedCIDRs) > 0 {
 		return true
 	}
 
@@ -130,6 +310,88 @@ func needsNetworkProxy(cfg *config.Config) bool {
 	return false
 }
 
+// httpRules converts the configured HTTP rules for the proxy filter
+func httpRules(rules []config.HTTPRule) []network.HTTPRule {
+	converted := make([]network.HTTPRule, 0, len(rules))
+	for _, rule := range rules {
+		converted = append(converted, network.HTTPRule{
+			Name:    rule.Name,
+			Action:  rule.Action,
+			Methods: rule.Methods,
+			Host:    rule.Host,
+			Path:    rule.Path,
+		})
+	}
+	return converted
+}
+
+// quotas converts the configured quotas for the proxy filter
+func quotas(cfg config.QuotaConfig) (network.Quota, []network.DomainQuota) {
+	domains := make([]network.DomainQuota, 0, len(cfg.Domains))
+	for _, dq := range cfg.Domains {
+		domains = append(domains, network.DomainQuota{Domain: dq.Domain, Quota: network.Quota(dq.Quota)})
+	}
+	return network.Quota(cfg.Run), domains
+}
+
+func describeQuota(q config.Quota) string {
+	var parts []string
+	for _, limit := range []struct {
+		name  string
+		value int64
+	}{
+		{"bytesUp", q.BytesUp},
+		{"bytesDown", q.BytesDown},
+		{"requests", q.Requests},
+		{"connections", q.Connections},
+	} {
+		if limit.value > 0 {
+			parts = append(parts, fmt.Sprintf("%s=%d", limit.name, limit.value))
+		}
+	}
+	if len(parts) == 0 {
+		return "no limits"
+	}
+	return strings.Join(parts, " ")
+}
+
+// caEnv points common TLS clients at the interception CA. Tools that replace
+// their trusted roots get the bundle of system roots plus the CA, Node adds
+// the CA to its own roots.
+func (m *Manager) caEnv() []string {
+	if m.ca == nil {
+		return nil
+	}
+	return []string{
+		"SSL_CERT_FILE=" + m.ca.BundlePath(),
+		"REQUESTS_CA_BUNDLE=" + m.ca.BundlePath(),
+		"NODE_EXTRA_CA_CERTS=" + m.ca.CertPath(),
+	}
+}
+
+// commandEnv returns the command's environment, without the proxy variables
+func (m *Manager) commandEnv() []string {
+	env := withoutEnv(os.Environ(), m.config.Network.UpstreamProxy.CredentialsEnv)
+	env = secretEnv(env, m.config.Network.Secrets)
+	return append(env, fmt.Sprintf("SRT_COMMAND_ID=%s", m.runID))
+}
+
+// commandProxyEnv returns the variables pointing the command at the proxies,
+// given its environment so far
+func (m *Manager) commandProxyEnv(env []string) []string {
+	vars := proxyEnv(m.config.Network.HTTPProxyPort, m.config.Network.SOCKSProxyPort)
+	vars = append(vars, m.caEnv()...)
+	if m.dnsServer != nil {
+		vars = append(vars, fmt.Sprintf("SRT_DNS_SERVER=127.0.0.1:%d", m.dnsServer.Port()))
+	}
+
+	caBundle := ""
+	if m.ca != nil {
+		caBundle = m.ca.BundlePath()
+	}
+	return append(vars, toolEnv(env, m.config.Network.ProxyTools, m.config.Network.HTTPProxyPort, caBundle)...)
+}
+
 // DryRun shows what would be executed without actually running the command
 func (m *Manager) DryRun(command []string) error {
 	if len(command) == 0 {
@@ -153,6 +415,11 @@ func (m *Manager) DryRun(command []string) error {
 		return fmt.Errorf("failed to normalise deny read paths: %w", err)
 	}
 
+	internalPaths, err := filesystem.NormalisePaths(m.internalPaths)
+	if err != nil {
+		return fmt.Errorf("failed to normalise internal paths: %w", err)
+	}
+
 	allowWritePaths, err := filesystem.NormalisePaths(m.config.Filesystem.AllowWrite)
 	if err != nil {
 		return fmt.Errorf("failed to normalise allow write paths: %w", err)
@@ -190,8 +457,10 @@ func (m *Manager) DryRun(command []string) error {
 	profile, err := GenerateSeatbeltProfile(
 		m.config.Network.HTTPProxyPort,
 		m.config.Network.SOCKSProxyPort,
+		m.dnsPort(),
 		proxyEnabled,
 		denyReadPaths,
+		internalPaths,
 		allowWritePaths,
 		denyWritePaths,
 		allowUnlinkPaths,
@@ -199,6 +468,8 @@ func (m *Manager) DryRun(command []string) error {
 		m.config.Process.AllowSysctlRead,
 		m.config.Process.AllowMachLookup,
 		m.config.Process.AllowPosixShm,
+		m.reportOnly(),
+		m.runID,
 	)
 	if err != nil {
 		return fmt.Errorf("failed to generate Seatbelt profile: %w", err)
@@ -220,11 +491,16 @@ func (m *Manager) DryRun(command []string) error {
 
 	// Show environment variables
 	fmt.Println("[srt-go] Environment variables:")
-	fmt.Printf("  SRT_COMMAND_ID=%s\n", m.commandID)
+	fmt.Printf("  SRT_COMMAND_ID=%s\n", m.runID)
+	for _, secret := range m.config.Network.Secrets {
+		if secret.Env != "" {
+			fmt.Printf("  %s=%s\n", secret.Env, secret.Placeholder())
+		}
+	}
 	if proxyEnabled {
-		fmt.Printf("  HTTP_PROXY=http://localhost:%d\n", m.config.Network.HTTPProxyPort)
-		fmt.Printf("  HTTPS_PROXY=http://localhost:%d\n", m.config.Network.HTTPProxyPort)
-		fmt.Printf("  ALL_PROXY=socks5://localhost:%d\n", m.config.Network.SOCKSProxyPort)
+		for _, env := range m.commandProxyEnv(m.commandEnv()) {
+			fmt.Printf("  %s\n", env)
+		}
 	} else {
 		fmt.Println("  (No proxy environment variables - network fully blocked)")
 	}
@@ -239,10 +515,51 @@ func (m *Manager) DryRun(command []string) error {
 	fmt.Println()
 
 	// Show network configuration
+	if m.config.IsAudit() {
+		fmt.Println("[srt-go] Enforcement: audit (operations are allowed and reported)")
+		fmt.Println()
+	}
+
 	fmt.Println("[srt-go] Network configuration:")
 	fmt.Printf("  Default policy: %s\n", m.config.Network.DefaultPolicy)
 	fmt.Printf("  Allowed domains: %d\n", len(m.config.Network.AllowedDomains))
 	fmt.Printf("  Denied domains: %d\n", len(m.config.Network.DeniedDomains))
+	fmt.Printf("  Allowed CIDRs: %d\n", len(m.config.Network.AllowedCIDRs))
+	fmt.Printf("  Denied CIDRs: %d\n", len(m.config.Network.DeniedCIDRs))
+	if len(m.config.Network.DefaultPorts) > 0 {
+		fmt.Printf("  Default ports: %s\n", strings.Join(m.config.Network.DefaultPorts, ", "))
+	}
+	if m.config.Network.MissingSNI == "deny" {
+		fmt.Println("  Tunnels without a TLS server name: denied")
+	}
+	if len(m.config.Network.HTTPRules) > 0 {
+		fmt.Printf("  HTTP rules: %d\n", len(m.config.Network.HTTPRules))
+	}
+	if q := m.config.Network.Quotas; q.Run != (config.Quota{}) || len(q.Domains) > 0 {
+		fmt.Println("  Quotas:")
+		if q.Run != (config.Quota{}) {
+			fmt.Printf("    run: %s\n", describeQuota(q.Run))
+		}
+		for _, dq := range q.Domains {
+			fmt.Printf("    %s: %s\n", dq.Domain, describeQuota(dq.Quota))
+		}
+	}
+	if len(m.config.Network.Secrets) > 0 {
+		fmt.Println("  Secrets:")
+		for _, secret := range m.config.Network.Secrets {
+			fmt.Printf("    %s: %s\n", secret.Placeholder(), strings.Join(secret.Domains, ", "))
+		}
+	}
+	if up := m.config.Network.UpstreamProxy; up.URL != "" {
+		fmt.Printf("  Upstream proxy: %s\n", up.URL)
+		if len(up.NoProxy) > 0 {
+			fmt.Printf("  Upstream proxy bypassed for: %s\n", strings.Join(up.NoProxy, ", "))
+		}
+	}
+	if m.ca != nil {
+		fmt.Printf("  TLS interception: %s\n", strings.Join(m.config.Network.TLSIntercept.Domains, ", "))
+		fmt.Printf("  CA certificate: %s\n", m.ca.CertPath())
+	}
 	fmt.Printf("  Proxy enabled: %v\n", proxyEnabled)
 	fmt.Println()
 
@@ -251,8 +568,52 @@ func (m *Manager) DryRun(command []string) error {
 
 // Execute runs a command in the sandbox
 func (m *Manager) Execute(command []string) error {
+	exitCode, err := m.run(command)
+	if err != nil {
+		return err
+	}
+
+	if !m.config.NoSummary {
+		m.summary.Print(os.Stderr)
+	}
+
+	if event := m.KillEvent(); event != nil {
+		fmt.Fprintf(os.Stderr, "[srt-go] Command terminated by kill rule %q\n", event.Rule)
+	}
+
+	// Return exit code if command failed
+	if exitCode != 0 {
+		os.Exit(exitCode)
+	}
+
+	return nil
+}
+
+// Learn runs a command under a report-only profile and returns the minimal
+// configuration changes that would allow what it did, along with its exit code.
+// The manager must have been created with LearnMode set.
+func (m *Manager) Learn(command []string) (*PolicyProposal, int, error) {
+	if m.learner == nil {
+		return nil, 0, fmt.Errorf("manager was not created in learn mode")
+	}
+
+	exitCode, err := m.run(command)
+	if err != nil {
+		return nil, exitCode, err
+	}
+
+	proposal, err := m.learner.Proposal(m.config)
+	if err != nil {
+		return nil, exitCode, fmt.Errorf("failed to build policy proposal: %w", err)
+	}
+
+	return proposal, exitCode, nil
+}
+
+// run runs a command in the sandbox and returns its exit code
+func (m *Manager) run(command []string) (int, error) {
 	if len(command) == 0 {
-		return fmt.Errorf("no command specified")
+		return 0, fmt.Errorf("no command specified")
 	}
 
 	// Detect package managers and add their paths to allowWrite (with caching)
@@ -268,22 +629,27 @@ func (m *Manager) Execute(command []string) error {
 	// Normalise filesystem paths
 	denyReadPaths, err := filesystem.NormalisePaths(m.config.Filesystem.DenyRead)
 	if err != nil {
-		return fmt.Errorf("failed to normalise deny read paths: %w", err)
+		return 0, fmt.Errorf("failed to normalise deny read paths: %w", err)
+	}
+
+	internalPaths, err := filesystem.NormalisePaths(m.internalPaths)
+	if err != nil {
+		return 0, fmt.Errorf("failed to normalise internal paths: %w", err)
 	}
 
 	allowWritePaths, err := filesystem.NormalisePaths(m.config.Filesystem.AllowWrite)
 	if err != nil {
-		return fmt.Errorf("failed to normalise allow write paths: %w", err)
+		return 0, fmt.Errorf("failed to normalise allow write paths: %w", err)
 	}
 
 	denyWritePaths, err := filesystem.NormalisePaths(m.config.Filesystem.DenyWrite)
 	if err != nil {
-		return fmt.Errorf("failed to normalise deny write paths: %w", err)
+		return 0, fmt.Errorf("failed to normalise deny write paths: %w", err)
 	}
 
 	allowUnlinkPaths, err := filesystem.NormalisePaths(m.config.Filesystem.AllowUnlink)
 	if err != nil {
-		return fmt.Errorf("failed to normalise allow unlink paths: %w", err)
+		return 0, fmt.Errorf("failed to normalise allow unlink paths: %w", err)
 	}
 
 	// Get mandatory deny paths (dangerous files in allowed write dirs)
@@ -308,8 +674,10 @@ func (m *Manager) Execute(command []string) error {
 	profile, err := GenerateSeatbeltProfile(
 		m.config.Network.HTTPProxyPort,
 		m.config.Network.SOCKSProxyPort,
+		m.dnsPort(),
 		proxyEnabled,
 		denyReadPaths,
+		internalPaths,
 		allowWritePaths,
 		denyWritePaths,
 		allowUnlinkPaths,
@@ -317,15 +685,17 @@ func (m *Manager) Execute(command []string) error {
 		m.config.Process.AllowSysctlRead,
 		m.config.Process.AllowMachLookup,
 		m.config.Process.AllowPosixShm,
+		m.reportOnly(),
+		m.runID,
 	)
 	if err != nil {
-		return fmt.Errorf("failed to generate Seatbelt profile: %w", err)
+		return 0, fmt.Errorf("failed to generate Seatbelt profile: %w", err)
 	}
 
 	// Write profile to temporary file
 	m.profilePath = filepath.Join(os.TempDir(), fmt.Sprintf("srt-profile-%d.sb", os.Getpid()))
 	if err := os.WriteFile(m.profilePath, []byte(profile), 0600); err != nil {
-		return fmt.Errorf("failed to write profile: %w", err)
+		return 0, fmt.Errorf("failed to write profile: %w", err)
 	}
 
 	if m.config.Verbose {
@@ -335,36 +705,22 @@ func (m *Manager) Execute(command []string) error {
 
 	// Validate the generated profile
 	if err := ValidateProfile(m.profilePath); err != nil {
-		return fmt.Errorf("profile validation failed: %w", err)
+		return 0, fmt.Errorf("profile validation failed: %w", err)
 	}
 
 	if m.config.Verbose {
 		slog.Debug("Seatbelt profile validation passed")
 	}
 
+	m.writeRunRecord(RecordRunStart, command, nil)
+
 	// Start violation monitoring (always monitor, not just in verbose mode)
-	mon, err := NewViolationMonitor(m.commandID)
-	if err != nil {
+	if m.sourceOverride != nil {
+		m.startViolations(m.sourceOverride)
+	} else if mon, err := NewViolationMonitor(m.runID); err != nil {
 		slog.Debug("Failed to start violation monitor", "error", err)
 	} else {
-		m.violationMon = mon
-		m.violationMon.Start()
-
-		// Process violations in background
-		go func() {
-			for v := range m.violationMon.Violations() {
-				if !ShouldIgnoreViolation(v, m.config.Violations) {
-					// Always log to file if logger is available
-					if m.violationLogger != nil {
-						m.violationLogger.LogViolation(v)
-					}
-					// Also log to stderr if verbose
-					if m.config.Verbose {
-						LogViolation(v)
-					}
-				}
-			}
-		}()
+		m.startViolations(mon)
 	}
 
 	// Build sandbox-exec command
@@ -374,15 +730,25 @@ func (m *Manager) Execute(command []string) error {
 	cmd := exec.Command("sandbox-exec", args...)
 
 	// Set environment variables
-	cmd.Env = append(os.Environ(), fmt.Sprintf("SRT_COMMAND_ID=%s", m.commandID))
+	cmd.Env = m.commandEnv()
 
 	// Set proxy environment variables only if proxies are enabled
 	if proxyEnabled {
-		cmd.Env = append(cmd.Env,
-			fmt.Sprintf("HTTP_PROXY=http://localhost:%d", m.config.Network.HTTPProxyPort),
-			fmt.Sprintf("HTTPS_PROXY=http://localhost:%d", m.config.Network.HTTPProxyPort),
-			fmt.Sprintf("ALL_PROXY=socks5://localhost:%d", m.config.Network.SOCKSProxyPort),
-		)
+		cmd.Env = append(cmd.Env, m.commandProxyEnv(cmd.Env)...)
+	}
+
+	// Run in a new process group so kill rules can terminate everything the
+	// command started. The group takes over the terminal when srt has it, so
+	// interactive programs can still read from it and receive its signals.
+	terminal := -1
+	if len(m.config.ViolationSettings.KillRules) > 0 {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		if fd, ok := foregroundTerminal(); ok {
+			terminal = fd
+			// Ctty is the child's descriptor, which is the same as stdin is inherited
+			cmd.SysProcAttr.Foreground = true
+			cmd.SysProcAttr.Ctty = fd
+		}
 	}
 
 	// Inherit stdio for interactive commands
@@ -406,17 +772,266 @@ func (m *Manager) Execute(command []string) error {
 	}
 
 	// Execute and wait
-	err = cmd.Run()
+	if err := cmd.Start(); err != nil {
+		if terminal >= 0 {
+			m.reclaimTerminal(terminal)
+		}
+		m.finishViolations()
+		m.endRun(command, nil)
+		return 0, fmt.Errorf("command execution failed: %w", err)
+	}
 
-	// Return exit code if command failed
-	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			os.Exit(exitErr.ExitCode())
+	m.setProcess(cmd.Process.Pid, cmd.SysProcAttr != nil && cmd.SysProcAttr.Setpgid)
+
+	err = cmd.Wait()
+	if terminal >= 0 {
+		m.reclaimTerminal(terminal)
+	}
+
+	// Collect remaining violations before reporting
+	m.finishViolations()
+
+	exitCode := 0
+	switch {
+	case m.KillEvent() != nil:
+		exitCode = KillRuleExitCode
+	case err != nil:
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			m.endRun(command, nil)
+			return 0, fmt.Errorf("command execution failed: %w", err)
 		}
-		return fmt.Errorf("command execution failed: %w", err)
+		exitCode = exitErr.ExitCode()
 	}
 
-	return nil
+	m.endRun(command, &exitCode)
+	return exitCode, nil
+}
+
+// handleViolation records a violation reported by the monitor
+func (m *Manager) handleViolation(v Violation) {
+	// In learn mode every report is a would-be denial to learn from
+	if m.learner != nil {
+		m.learner.AddViolation(v)
+		return
+	}
+
+	// Kill rules enforce policy, so they apply before ignore rules and not in audit mode
+	killed := false
+	if !m.config.IsAudit() {
+		if rule, ok := m.kill.Match(v); ok {
+			m.terminate(rule, v)
+			killed = true
+		}
+	}
+
+	if !killed && m.ignore.Match(v) {
+		return
+	}
+
+	// Reports in audit mode are operations that would have been denied
+	if m.config.IsAudit() {
+		v.Audit = true
+	}
+
+	m.writeRecord(newLogRecord(m.runID, v))
+	// Also log to stderr if verbose
+	if m.config.Verbose {
+		LogViolation(v)
+	}
+	m.summary.Add(v)
+}
+
+// writeRecord appends a record to the violation log, then forwards the chained
+// record to the configured sinks so remote copies carry the chain hashes
+func (m *Manager) writeRecord(record LogRecord) {
+	if m.logger != nil {
+		chained, err := m.logger.Append(record)
+		if err != nil {
+			slog.Debug("Failed to write violation log", "error", err)
+		} else {
+			record = chained
+		}
+	}
+
+	for _, sink := range m.sinks {
+		if err := sink.Write(record); err != nil {
+			slog.Debug("Failed to write violation to sink", "error", err)
+		}
+	}
+}
+
+// writeRunRecord logs the start or end of the run
+func (m *Manager) writeRunRecord(kind string, command []string, exitCode *int) {
+	mode := "enforce"
+	switch {
+	case m.learner != nil:
+		mode = "learn"
+	case m.config.IsAudit():
+		mode = "audit"
+	}
+
+	record := LogRecord{
+		Time:     time.Now(),
+		Kind:     kind,
+		RunID:    m.runID,
+		Mode:     mode,
+		Process:  filepath.Base(command[0]),
+		ExitCode: exitCode,
+	}
+	if kind == RecordRunStart {
+		record.Command = strings.Join(command, " ")
+	}
+
+	m.writeRecord(record)
+}
+
+// handleProxyDecision reports domains the proxies deny, or would deny in audit mode
+func (m *Manager) handleProxyDecision(d network.Decision) {
+	if d.Allowed {
+		return
+	}
+
+	m.handleViolation(proxyViolation(d, m.config.IsAudit()))
+}
+
+// handleConnection records a connection the proxies finished with
+func (m *Manager) handleConnection(r network.ConnectionRecord) {
+	if err := m.connections.Add(r); err != nil {
+		slog.Debug("Failed to write connection log", "error", err)
+	}
+}
+
+// terminate kills the sandboxed process group the first time a kill rule fires
+func (m *Manager) terminate(rule string, v Violation) {
+	m.killMu.Lock()
+	defer m.killMu.Unlock()
+
+	if m.killEvent != nil {
+		return
+	}
+	m.killEvent = &KillEvent{Rule: rule, Violation: v}
+
+	fmt.Fprintf(os.Stderr, "[srt-go] Kill rule %q matched %s %s (%s), terminating command\n",
+		rule, v.Operation, v.Target, v.Process)
+
+	if m.pid > 0 {
+		m.killGroup()
+	}
+}
+
+// setProcess records the started command. A kill rule may have fired while
+// it was starting, in which case it's killed straight away.
+func (m *Manager) setProcess(pid int, processGroup bool) {
+	m.killMu.Lock()
+	defer m.killMu.Unlock()
+
+	m.pid = pid
+	m.processGroup = processGroup
+	if m.killEvent != nil {
+		m.killGroup()
+	}
+}
+
+// killGroup kills the command's process group, killMu must be held
+func (m *Manager) killGroup() {
+	// A negative pid signals the whole process group created with Setpgid
+	if err := syscall.Kill(-m.pid, syscall.SIGKILL); err != nil {
+		slog.Debug("Failed to kill process group", "pid", m.pid, "error", err)
+	}
+}
+
+// KillEvent returns the kill rule that terminated the command, or nil
+func (m *Manager) KillEvent() *KillEvent {
+	m.killMu.Lock()
+	defer m.killMu.Unlock()
+	return m.killEvent
+}
+
+// dnsPort returns the DNS server's port, or 0 when it isn't running
+func (m *Manager) dnsPort() int {
+	if m.dnsServer == nil {
+		return 0
+	}
+	return m.dnsServer.Port()
+}
+
+// reportOnly reports whether the profile should allow everything and report
+// would-be denials instead of enforcing them
+func (m *Manager) reportOnly() bool {
+	return m.learner != nil || m.config.IsAudit()
+}
+
+// RunID returns the ID that tags this run's profile denials and log records
+func (m *Manager) RunID() string {
+	return m.runID
+}
+
+// Summary returns the violations aggregated during the run
+func (m *Manager) Summary() *ViolationSummary {
+	return m.summary
+}
+
+// Connections returns the connections the proxies handled during the run,
+// nil when the run had no proxies
+func (m *Manager) Connections() []network.ConnectionRecord {
+	if m.connections == nil {
+		return nil
+	}
+	return m.connections.Records()
+}
+
+// SetViolationSource replaces the live log stream monitor, e.g. with a
+// ChannelSource. It must be called before Execute or Learn.
+func (m *Manager) SetViolationSource(src ViolationSource) {
+	m.sourceOverride = src
+}
+
+// startViolations starts a source and processes its violations in the background
+func (m *Manager) startViolations(src ViolationSource) {
+	m.pipeline = newViolationPipeline(src, m.handleViolation, defaultDedupeWindow, defaultPipelineBuffer)
+	m.pipeline.start()
+}
+
+// finishViolations waits briefly for late violation reports, then stops the
+// source and waits for the pipeline to drain
+func (m *Manager) finishViolations() {
+	if m.pipeline != nil {
+		time.Sleep(violationDrainDelay)
+		m.pipeline.stop()
+		m.summary.SetDropped(m.pipeline.stats().Dropped)
+	}
+
+	m.summary.SetSuppressed(m.ignore.SuppressedByRule())
+}
+
+// endRun logs the end of the run and flushes the sinks. Execute may exit the
+// process before Cleanup runs, so this can't wait until then.
+func (m *Manager) endRun(command []string, exitCode *int) {
+	m.writeRunRecord(RecordRunEnd, command, exitCode)
+	m.closeSinks()
+}
+
+// PipelineStats returns the violation pipeline counters for the run
+func (m *Manager) PipelineStats() PipelineStats {
+	if m.pipeline == nil {
+		return PipelineStats{}
+	}
+	return m.pipeline.stats()
+}
+
+// closeSinks flushes and closes the violation sinks once
+func (m *Manager) closeSinks() {
+	m.sinksOnce.Do(func() {
+		if m.logger != nil {
+			m.logger.Close()
+		}
+		for _, sink := range m.sinks {
+			if err := sink.Close(); err != nil {
+				slog.Warn("Violation sink did not close cleanly", "error", err)
+			}
+		}
+	})
 }
 
 // Cleanup cleans up resources
@@ -424,14 +1039,12 @@ func (m *Manager) Cleanup() {
 	close(m.stopCh)
 
 	// Stop violation monitoring
-	if m.violationMon != nil {
-		m.violationMon.Stop()
+	if m.pipeline != nil {
+		m.pipeline.src.Stop()
 	}
 
-	// Close violation logger
-	if m.violationLogger != nil {
-		m.violationLogger.Close()
-	}
+	// Flush and close violation sinks
+	m.closeSinks()
 
 	// Stop proxies
 	if m.httpProxy != nil {
@@ -440,10 +1053,17 @@ func (m *Manager) Cleanup() {
 	if m.socksProxy != nil {
 		m.socksProxy.Stop()
 	}
+	if m.dnsServer != nil {
+		m.dnsServer.Stop()
+	}
 
 	// Wait for goroutines
 	m.wg.Wait()
 
+	if m.connections != nil {
+		m.connections.Close()
+	}
+
 	// Remove profile file
 	if m.profilePath != "" {
 		os.Remove(m.profilePath)
@@ -456,7 +1076,8 @@ func (m *Manager) setupCleanup() {
 
 	go func() {
 		select {
-		case <-sigCh:
+		case sig := <-sigCh:
+			m.forwardSignal(sig)
 			m.Cleanup()
 			os.Exit(130) // Standard exit code for SIGINT
 		case <-m.stopCh:
@@ -465,7 +1086,30 @@ func (m *Manager) setupCleanup() {
 	}()
 }
 
-func generateCommandID() string {
-	// Generate a unique ID for this command execution
-	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("srt-%d", os.Getpid())))
+// forwardSignal passes a signal on to the command when it runs in its own
+// process group, as signals sent to srt alone don't reach it
+func (m *Manager) forwardSignal(sig os.Signal) {
+	m.killMu.Lock()
+	defer m.killMu.Unlock()
+
+	if s, ok := sig.(syscall.Signal); ok && m.processGroup && m.pid > 0 {
+		syscall.Kill(-m.pid, s)
+	}
+}
+
+// reclaimTerminal takes the terminal back from the command's process group
+func (m *Manager) reclaimTerminal(fd int) {
+	if err := reclaimTerminal(fd); err != nil {
+		slog.Debug("Failed to reclaim terminal", "error", err)
+	}
+}
+
+// generateRunID returns a random ID that tags this run's profile denials and log records
+func generateRunID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		// Fall back to something unique to this process rather than failing the run
+		return fmt.Sprintf("%016x", uint64(os.Getpid())<<32|uint64(time.Now().UnixNano()&0xffffffff))
+	}
+	return hex.EncodeToString(b)
 }
@@ -0,0 +1,185 @@
+package sandbox
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sammcj/srt-go/internal/config"
+	"github.com/sammcj/srt-go/internal/network"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestNewManagerReleasesOnError(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", "")
+
+	// A free port for the HTTP proxy, and a taken one so the SOCKS proxy fails after it
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	httpPort := free.Addr().(*net.TCPAddr).Port
+	free.Close()
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer taken.Close()
+
+	cfg := &config.Config{
+		Network: config.NetworkConfig{
+			DefaultPolicy:  "allow",
+			HTTPProxyPort:  httpPort,
+			SOCKSProxyPort: taken.Addr().(*net.TCPAddr).Port,
+		},
+	}
+	if _, err := NewManager(cfg); err == nil {
+		t.Fatal("NewManager() should fail when the SOCKS port is taken")
+	}
+
+	// The HTTP proxy's listener was closed on the way out
+	l, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", fmt.Sprint(httpPort)))
+	if err != nil {
+		t.Fatalf("HTTP proxy port still in use after NewManager failed: %v", err)
+	}
+	l.Close()
+}
+
+func TestAuditManagerDeniesInternalPaths(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", "")
+
+	cfg := &config.Config{
+		Enforcement: config.EnforcementAudit,
+		Network: config.NetworkConfig{
+			DefaultPolicy: "deny",
+			UpstreamProxy: config.UpstreamConfig{CredentialsFile: "/etc/proxy-auth"},
+		},
+	}
+	m, err := NewManager(cfg)
+	if err != nil {
+		t.Fatalf("NewManager() error = %v", err)
+	}
+	defer m.Cleanup()
+
+	if !m.reportOnly() {
+		t.Fatal("Audit manager should generate a report-only profile")
+	}
+	keyPath, err := ViolationLogKeyPath()
+	if err != nil {
+		t.Fatalf("ViolationLogKeyPath() error = %v", err)
+	}
+
+	profile, err := GenerateSeatbeltProfile(
+		m.config.Network.HTTPProxyPort,
+		m.config.Network.SOCKSProxyPort,
+		m.dnsPort(),
+		true,
+		nil,
+		m.internalPaths,
+		nil, nil, nil,
+		false, false, false, false,
+		m.reportOnly(),
+		m.runID,
+	)
+	if err != nil {
+		t.Fatalf("GenerateSeatbeltProfile() error = %v", err)
+	}
+
+	// Audit only reports the policy, but the log key and credentials stay unreadable
+	for _, path := range []string{keyPath, "/etc/proxy-auth"} {
+		want := fmt.Sprintf("(deny file-read* (subpath \"%s\")%s)", path, messageModifier(m.runID))
+		if !strings.Contains(profile, want) {
+			t.Errorf("Audit profile missing %q:\n%s", want, profile)
+		}
+	}
+}
+
+func TestManagerRunsDNSServer(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", "")
+
+	cfg := &config.Config{
+		Network: config.NetworkConfig{
+			DefaultPolicy:  "deny",
+			AllowedDomains: []string{"github.com"},
+			DNSServer:      true,
+		},
+	}
+	m, err := NewManager(cfg)
+	if err != nil {
+		t.Fatalf("NewManager() error = %v", err)
+	}
+	defer m.Cleanup()
+
+	if m.dnsServer == nil {
+		t.Fatal("DNS server not started")
+	}
+	server := fmt.Sprintf("127.0.0.1:%d", m.dnsServer.Port())
+	if env := m.commandProxyEnv(nil); !slices.Contains(env, "SRT_DNS_SERVER="+server) {
+		t.Errorf("Command environment %v doesn't point at the DNS server", env)
+	}
+
+	profile, err := GenerateSeatbeltProfile(
+		m.config.Network.HTTPProxyPort,
+		m.config.Network.SOCKSProxyPort,
+		m.dnsPort(),
+		true,
+		nil, m.internalPaths, nil, nil, nil,
+		false, false, false, false,
+		m.reportOnly(),
+		m.runID,
+	)
+	if err != nil {
+		t.Fatalf("GenerateSeatbeltProfile() error = %v", err)
+	}
+	if want := fmt.Sprintf("(allow network* (remote ip \"localhost:%d\"))", m.dnsServer.Port()); !strings.Contains(profile, want) {
+		t.Errorf("Profile missing %q:\n%s", want, profile)
+	}
+
+	// A denied name is answered without a lookup, and the query is logged
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 7, RecursionDesired: true})
+	builder.StartQuestions()
+	builder.Question(dnsmessage.Question{Name: dnsmessage.MustNewName("evil.example."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+	query, err := builder.Finish()
+	if err != nil {
+		t.Fatalf("Building query error = %v", err)
+	}
+	conn, err := net.Dial("udp", server)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(query); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	buf := make([]byte, 512)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(buf[:n]); err != nil {
+		t.Fatalf("Unpack() error = %v", err)
+	}
+	if msg.RCode != dnsmessage.RCodeNameError {
+		t.Errorf("RCode = %v, want NXDOMAIN", msg.RCode)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		records := m.connections.Records()
+		if len(records) == 1 && records[0].Protocol == network.ProtocolDNS && records[0].Host == "evil.example" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Connection log = %+v, want the DNS query", records)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,174 @@
+package sandbox
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Pipeline defaults
+const (
+	defaultPipelineBuffer = 1024
+	defaultDedupeWindow   = time.Second
+)
+
+// PipelineStats counts events passing through the violation pipeline
+type PipelineStats struct {
+	Received     int64 `json:"received"`     // Events read from the source
+	Deduplicated int64 `json:"deduplicated"` // Repeats folded into another event's count
+	Dropped      int64 `json:"dropped"`      // Events lost because a buffer was full
+	Delivered    int64 `json:"delivered"`    // Events passed to the handler
+}
+
+// droppingSource is implemented by sources that drop events rather than block
+type droppingSource interface {
+	Dropped() int64
+}
+
+// dedupeKey identifies repeats of the same event
+type dedupeKey struct {
+	process   string
+	operation string
+	target    string
+	audit     bool
+}
+
+// pendingRepeat collects repeats of an event within its dedupe window
+type pendingRepeat struct {
+	started time.Time
+	last    Violation
+	count   int
+}
+
+// violationPipeline moves violations from a source to a handler without ever
+// blocking the source. The first occurrence of an event is delivered at once,
+// so kill rules react immediately. Identical events within the window are
+// counted and delivered as one event carrying the repeat count when the window
+// closes. Events that do not fit in the bounded queue are dropped and counted.
+type violationPipeline struct {
+	src    ViolationSource
+	handle func(Violation)
+	window time.Duration
+	queue  chan Violation
+	done   chan struct{}
+
+	received     atomic.Int64
+	deduplicated atomic.Int64
+	dropped      atomic.Int64
+	delivered    atomic.Int64
+}
+
+func newViolationPipeline(src ViolationSource, handle func(Violation), window time.Duration, buffer int) *violationPipeline {
+	return &violationPipeline{
+		src:    src,
+		handle: handle,
+		window: window,
+		queue:  make(chan Violation, buffer),
+		done:   make(chan struct{}),
+	}
+}
+
+// start starts the source and the pipeline goroutines
+func (p *violationPipeline) start() {
+	p.src.Start()
+	go p.dedupe()
+	go p.deliver()
+}
+
+// stop stops the source, then waits until every pending event, including
+// collected repeats, has been handled
+func (p *violationPipeline) stop() {
+	p.src.Stop()
+	<-p.done
+}
+
+// stats returns the pipeline counters, including drops inside the source
+func (p *violationPipeline) stats() PipelineStats {
+	stats := PipelineStats{
+		Received:     p.received.Load(),
+		Deduplicated: p.deduplicated.Load(),
+		Dropped:      p.dropped.Load(),
+		Delivered:    p.delivered.Load(),
+	}
+
+	if src, ok := p.src.(droppingSource); ok {
+		stats.Dropped += src.Dropped()
+	}
+
+	return stats
+}
+
+func (p *violationPipeline) dedupe() {
+	defer close(p.queue)
+
+	pending := make(map[dedupeKey]*pendingRepeat)
+
+	ticker := time.NewTicker(p.window)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case v, ok := <-p.src.Violations():
+			if !ok {
+				// Source exhausted, flush every collected repeat before closing
+				for key, r := range pending {
+					p.flushRepeat(r)
+					delete(pending, key)
+				}
+				return
+			}
+
+			p.received.Add(1)
+			now := time.Now()
+			key := dedupeKey{process: v.Process, operation: v.Operation, target: v.Target, audit: v.Audit}
+
+			if r, ok := pending[key]; ok {
+				if now.Sub(r.started) < p.window {
+					r.count += v.Occurrences()
+					r.last = v
+					p.deduplicated.Add(1)
+					continue
+				}
+				p.flushRepeat(r)
+			}
+
+			pending[key] = &pendingRepeat{started: now}
+			p.enqueue(v)
+
+		case now := <-ticker.C:
+			for key, r := range pending {
+				if now.Sub(r.started) >= p.window {
+					p.flushRepeat(r)
+					delete(pending, key)
+				}
+			}
+		}
+	}
+}
+
+// flushRepeat delivers the repeats collected for an event, if there were any
+func (p *violationPipeline) flushRepeat(r *pendingRepeat) {
+	if r.count == 0 {
+		return
+	}
+
+	v := r.last
+	v.Count = r.count
+	p.enqueue(v)
+}
+
+func (p *violationPipeline) enqueue(v Violation) {
+	select {
+	case p.queue <- v:
+	default:
+		p.dropped.Add(1)
+	}
+}
+
+func (p *violationPipeline) deliver() {
+	defer close(p.done)
+
+	for v := range p.queue {
+		p.handle(v)
+		p.delivered.Add(1)
+	}
+}
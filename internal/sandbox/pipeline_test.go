@@ -0,0 +1,251 @@
+package sandbox
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder collects violations handed to the pipeline's handler
+type recorder struct {
+	mu         sync.Mutex
+	violations []Violation
+}
+
+func (r *recorder) handle(v Violation) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.violations = append(r.violations, v)
+}
+
+func (r *recorder) all() []Violation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Violation(nil), r.violations...)
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPipelineDeduplicates(t *testing.T) {
+	src := NewChannelSource(100)
+	rec := &recorder{}
+	p := newViolationPipeline(src, rec.handle, time.Hour, 100)
+	p.start()
+
+	shadow := Violation{Process: "python3", Operation: "file-read-data", Target: "/etc/shadow"}
+	for range 5 {
+		src.Send(shadow)
+	}
+	src.Send(Violation{Process: "python3", Operation: "file-read-data", Target: "/etc/hosts"})
+	src.Send(Violation{Process: "node", Operation: "file-read-data", Target: "/etc/shadow"})
+	src.Send(shadow)
+
+	// First occurrences are delivered straight away, before the window closes
+	waitFor(t, "first occurrences", func() bool { return len(rec.all()) == 3 })
+
+	p.stop()
+
+	got := rec.all()
+	if len(got) != 4 {
+		t.Fatalf("Delivered %d events, want 4: %+v", len(got), got)
+	}
+
+	// Stopping flushes the collected repeats as a single event
+	last := got[3]
+	if last.Target != "/etc/shadow" || last.Process != "python3" || last.Count != 5 {
+		t.Errorf("Flushed event = %+v, want python3 /etc/shadow with count 5", last)
+	}
+
+	summary := NewViolationSummary()
+	for _, v := range got {
+		summary.Add(v)
+	}
+	if summary.Total() != 8 {
+		t.Errorf("Summary total = %d, want every report counted (8)", summary.Total())
+	}
+
+	stats := p.stats()
+	want := PipelineStats{Received: 8, Deduplicated: 5, Delivered: 4}
+	if stats != want {
+		t.Errorf("stats() = %+v, want %+v", stats, want)
+	}
+}
+
+func TestPipelineWindowExpiry(t *testing.T) {
+	src := NewChannelSource(100)
+	rec := &recorder{}
+	p := newViolationPipeline(src, rec.handle, 20*time.Millisecond, 100)
+	p.start()
+	defer p.stop()
+
+	v := Violation{Process: "curl", Operation: "network-outbound", Target: "example.com"}
+	src.Send(v)
+	src.Send(v)
+	src.Send(v)
+
+	// The repeats are flushed by the ticker without waiting for stop
+	waitFor(t, "repeats to flush", func() bool { return len(rec.all()) == 2 })
+
+	if got := rec.all()[1].Count; got != 2 {
+		t.Errorf("Flushed count = %d, want 2", got)
+	}
+
+	// After the window a new occurrence is delivered immediately again
+	src.Send(v)
+	waitFor(t, "new window", func() bool { return len(rec.all()) == 3 })
+	if got := rec.all()[2].Count; got != 0 {
+		t.Errorf("New window event count = %d, want 0", got)
+	}
+}
+
+func TestPipelineDropsWhenHandlerBlocks(t *testing.T) {
+	src := NewChannelSource(100)
+	release := make(chan struct{})
+	rec := &recorder{}
+	handle := func(v Violation) {
+		<-release
+		rec.handle(v)
+	}
+
+	p := newViolationPipeline(src, handle, time.Hour, 2)
+	p.start()
+
+	// One event is held by the handler, two fit in the queue, the rest drop
+	for i := range 10 {
+		src.Send(Violation{Process: "sh", Operation: "file-write-create", Target: fmt.Sprintf("/tmp/f%d", i)})
+	}
+	waitFor(t, "events to be read", func() bool { return p.stats().Received == 10 })
+
+	close(release)
+	p.stop()
+
+	stats := p.stats()
+	if stats.Delivered+stats.Dropped != 10 {
+		t.Errorf("Delivered %d + dropped %d, want 10 accounted for", stats.Delivered, stats.Dropped)
+	}
+	if stats.Dropped == 0 {
+		t.Error("Expected events to be dropped while the handler was blocked")
+	}
+	if int64(len(rec.all())) != stats.Delivered {
+		t.Errorf("Handler saw %d events, stats report %d", len(rec.all()), stats.Delivered)
+	}
+}
+
+func TestPipelineDrainsOnStop(t *testing.T) {
+	src := NewChannelSource(100)
+	rec := &recorder{}
+	handle := func(v Violation) {
+		time.Sleep(time.Millisecond)
+		rec.handle(v)
+	}
+
+	p := newViolationPipeline(src, handle, time.Hour, 100)
+	p.start()
+
+	for i := range 50 {
+		src.Send(Violation{Process: "sh", Operation: "file-read-data", Target: fmt.Sprintf("/etc/f%d", i)})
+	}
+	p.stop()
+
+	if got := len(rec.all()); got != 50 {
+		t.Errorf("Handled %d events after stop, want all 50", got)
+	}
+
+	// Stop is safe to call again, e.g. from Cleanup
+	p.src.Stop()
+}
+
+func TestViolationMonitorNeverBlocks(t *testing.T) {
+	r, w := io.Pipe()
+	mon := newViolationMonitor(r, func() { w.Close() }, nil, "", 4)
+	mon.Start()
+
+	line := `{"eventMessage":"Sandbox: python3(123) deny(1) file-read-data /etc/shadow","timestamp":"2025-10-30 10:15:30.123456+1100"}` + "\n"
+
+	// Nobody reads Violations, so the writes only finish if the monitor drops
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.Write([]byte(strings.Repeat(line, 20)))
+		mon.Stop()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Log stream writer blocked on a full monitor")
+	}
+
+	// The scanner may still hold buffered lines once the writer returns
+	waitFor(t, "monitor drops", func() bool { return mon.Dropped() == 16 })
+
+	var got int
+	for range mon.Violations() {
+		got++
+	}
+
+	if got != 4 || mon.Dropped() != 16 {
+		t.Errorf("Buffered %d and dropped %d, want 4 and 16", got, mon.Dropped())
+	}
+}
+
+func TestPipelineCountsSourceDrops(t *testing.T) {
+	r, w := io.Pipe()
+	mon := newViolationMonitor(r, func() { w.Close() }, nil, "", 1)
+	p := newViolationPipeline(mon, func(Violation) {}, time.Hour, 10)
+
+	// Fill the monitor's buffer before the pipeline starts reading from it
+	mon.Start()
+	line := `{"eventMessage":"Sandbox: sh(1) deny(1) file-write-create /tmp/x","timestamp":"2025-10-30 10:15:30.123456+1100"}` + "\n"
+	w.Write([]byte(strings.Repeat(line, 3)))
+	waitFor(t, "monitor drops", func() bool { return mon.Dropped() == 2 })
+
+	go p.dedupe()
+	go p.deliver()
+	p.stop()
+
+	if stats := p.stats(); stats.Dropped != 2 || stats.Received != 1 {
+		t.Errorf("stats() = %+v, want the source's 2 drops and 1 received", stats)
+	}
+}
+
+func TestPipelineReceivesDefaultDenials(t *testing.T) {
+	// Operations the profile has no rule for are denied by its tagged
+	// default, so they reach the run's pipeline like any other denial
+	src, err := NewReplaySource(filepath.Join("testdata", "log_stream_default.ndjson"), "3f9c2a7e1b6d4c08")
+	if err != nil {
+		t.Fatalf("NewReplaySource() error = %v", err)
+	}
+	rec := &recorder{}
+	p := newViolationPipeline(src, rec.handle, time.Hour, 100)
+	p.start()
+	waitFor(t, "the tagged denials", func() bool { return len(rec.all()) == 3 })
+	p.stop()
+
+	var got []string
+	for _, v := range rec.all() {
+		got = append(got, fmt.Sprintf("%s %s %s", v.Process, v.Operation, v.Target))
+	}
+	want := []string{
+		"node iokit-open IOSurfaceRootUserClient",
+		"sh process-fork ",
+		"python3 system-socket ",
+	}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("Delivered %q, want %q", got, want)
+	}
+}
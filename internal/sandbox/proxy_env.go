@@ -0,0 +1,96 @@
+package sandbox
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// proxyEnv points the command at the proxies under every common spelling of
+// the proxy variables. NO_PROXY is cleared, as the sandbox blocks connections
+// sent around the proxies; the upstream proxy's noProxy applies in srt.
+func proxyEnv(httpPort, socksPort int) []string {
+	httpProxy := fmt.Sprintf("http://localhost:%d", httpPort)
+	socksProxy := fmt.Sprintf("socks5://localhost:%d", socksPort)
+
+	return []string{
+		"HTTP_PROXY=" + httpProxy,
+		"HTTPS_PROXY=" + httpProxy,
+		"ALL_PROXY=" + socksProxy,
+		"http_proxy=" + httpProxy,
+		"https_proxy=" + httpProxy,
+		"all_proxy=" + socksProxy,
+		"NO_PROXY=",
+		"no_proxy=",
+	}
+}
+
+// toolEnv points tools that ignore the proxy variables at the HTTP proxy,
+// and at the interception CA bundle when caBundle is set. Settings are made
+// through each tool's environment, which overrides its config files for
+// this run without changing them. env is the command's environment so far.
+func toolEnv(env []string, tools []string, httpPort int, caBundle string) []string {
+	httpProxy := fmt.Sprintf("http://localhost:%d", httpPort)
+
+	var vars []string
+	for _, tool := range tools {
+		switch tool {
+		case "npm":
+			vars = append(vars, "npm_config_proxy="+httpProxy, "npm_config_https_proxy="+httpProxy, "npm_config_noproxy=")
+			if caBundle != "" {
+				vars = append(vars, "npm_config_cafile="+caBundle)
+			}
+		case "pip":
+			vars = append(vars, "PIP_PROXY="+httpProxy)
+			if caBundle != "" {
+				vars = append(vars, "PIP_CERT="+caBundle)
+			}
+		case "git":
+			settings := [][2]string{{"http.proxy", httpProxy}}
+			if caBundle != "" {
+				settings = append(settings, [2]string{"http.sslCAInfo", caBundle})
+			}
+			vars = append(vars, gitConfigEnv(env, settings)...)
+		case "cargo":
+			vars = append(vars, "CARGO_HTTP_PROXY="+httpProxy)
+			if caBundle != "" {
+				vars = append(vars, "CARGO_HTTP_CAINFO="+caBundle)
+			}
+		case "java":
+			// Read by every JVM, including Gradle and Maven daemons
+			options := fmt.Sprintf("-Dhttp.proxyHost=localhost -Dhttp.proxyPort=%d -Dhttps.proxyHost=localhost -Dhttps.proxyPort=%d", httpPort, httpPort)
+			if existing := lookupEnv(env, "JAVA_TOOL_OPTIONS"); existing != "" {
+				options = existing + " " + options
+			}
+			vars = append(vars, "JAVA_TOOL_OPTIONS="+options)
+		}
+	}
+	return vars
+}
+
+// gitConfigEnv adds settings to git's command line configuration in the
+// environment, after any the environment already has
+func gitConfigEnv(env []string, settings [][2]string) []string {
+	count, _ := strconv.Atoi(lookupEnv(env, "GIT_CONFIG_COUNT"))
+
+	vars := make([]string, 0, 2*len(settings)+1)
+	for i, setting := range settings {
+		vars = append(vars,
+			fmt.Sprintf("GIT_CONFIG_KEY_%d=%s", count+i, setting[0]),
+			fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", count+i, setting[1]),
+		)
+	}
+	return append(vars, fmt.Sprintf("GIT_CONFIG_COUNT=%d", count+len(settings)))
+}
+
+// lookupEnv returns the last value of the named variable in env, as the
+// command would see it
+func lookupEnv(env []string, name string) string {
+	value := ""
+	for _, entry := range env {
+		if v, ok := strings.CutPrefix(entry, name+"="); ok {
+			value = v
+		}
+	}
+	return value
+}
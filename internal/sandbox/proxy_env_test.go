@@ -0,0 +1,89 @@
+package sandbox
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestProxyEnv(t *testing.T) {
+	got := proxyEnv(8080, 1080)
+	want := []string{
+		"HTTP_PROXY=http://localhost:8080",
+		"HTTPS_PROXY=http://localhost:8080",
+		"ALL_PROXY=socks5://localhost:1080",
+		"http_proxy=http://localhost:8080",
+		"https_proxy=http://localhost:8080",
+		"all_proxy=socks5://localhost:1080",
+		"NO_PROXY=",
+		"no_proxy=",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("proxyEnv() = %q, want %q", got, want)
+	}
+}
+
+func TestToolEnv(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      []string
+		tools    []string
+		caBundle string
+		want     []string
+	}{
+		{
+			name: "no tools",
+			want: nil,
+		},
+		{
+			name:  "npm and pip",
+			tools: []string{"npm", "pip"},
+			want: []string{
+				"npm_config_proxy=http://localhost:8080",
+				"npm_config_https_proxy=http://localhost:8080",
+				"npm_config_noproxy=",
+				"PIP_PROXY=http://localhost:8080",
+			},
+		},
+		{
+			name:     "CA bundle",
+			tools:    []string{"pip", "cargo"},
+			caBundle: "/tmp/ca-bundle.pem",
+			want: []string{
+				"PIP_PROXY=http://localhost:8080",
+				"PIP_CERT=/tmp/ca-bundle.pem",
+				"CARGO_HTTP_PROXY=http://localhost:8080",
+				"CARGO_HTTP_CAINFO=/tmp/ca-bundle.pem",
+			},
+		},
+		{
+			name:     "git after existing settings",
+			env:      []string{"GIT_CONFIG_COUNT=1", "GIT_CONFIG_KEY_0=user.name", "GIT_CONFIG_VALUE_0=Alice"},
+			tools:    []string{"git"},
+			caBundle: "/tmp/ca-bundle.pem",
+			want: []string{
+				"GIT_CONFIG_KEY_1=http.proxy",
+				"GIT_CONFIG_VALUE_1=http://localhost:8080",
+				"GIT_CONFIG_KEY_2=http.sslCAInfo",
+				"GIT_CONFIG_VALUE_2=/tmp/ca-bundle.pem",
+				"GIT_CONFIG_COUNT=3",
+			},
+		},
+		{
+			name:  "java keeps existing options",
+			env:   []string{"JAVA_TOOL_OPTIONS=-Xmx2g"},
+			tools: []string{"java"},
+			want: []string{
+				"JAVA_TOOL_OPTIONS=-Xmx2g -Dhttp.proxyHost=localhost -Dhttp.proxyPort=8080 -Dhttps.proxyHost=localhost -Dhttps.proxyPort=8080",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := toolEnv(tt.env, tt.tools, 8080, tt.caBundle)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("toolEnv() = %q\nwant %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -8,18 +8,37 @@ import (
 	"github.com/sammcj/srt-go/internal/filesystem"
 )
 
-// GenerateSeatbeltProfile generates a Seatbelt profile from paths and process permissions
+// GenerateSeatbeltProfile generates a Seatbelt profile from paths and process permissions.
+// Denials are tagged with runID so the violation monitor only sees this run's reports.
+// dnsPort is the DNS server's UDP port, or 0 when it isn't running.
+// internalPaths are srt's own files, denied to the command even when reportOnly is set.
 func GenerateSeatbeltProfile(
-	httpProxyPort, socksProxyPort int,
+	httpProxyPort, socksProxyPort, dnsPort int,
 	enableProxy bool,
-	denyReadPaths, allowWritePaths, denyWritePaths, allowUnlinkPaths []string,
+	denyReadPaths, internalPaths, allowWritePaths, denyWritePaths, allowUnlinkPaths []string,
 	allowFork, allowSysctlRead, allowMachLookup, allowPosixShm bool,
+	reportOnly bool,
+	runID string,
 ) (string, error) {
 	var sb strings.Builder
 
+	deny := func(operation, filter string) string {
+		return denyRule(reportOnly, runID, operation, filter)
+	}
+
 	// Version declaration
 	sb.WriteString("(version 1)\n\n")
 
+	// Report-only profiles permit everything, reporting operations that would be denied
+	if reportOnly {
+		sb.WriteString("; Report-only - allow everything, report would-be denials\n")
+		sb.WriteString(fmt.Sprintf("(allow default (with report)%s)\n\n", messageModifier(runID)))
+	} else {
+		// Explicit so operations without a rule below are tagged like the rest
+		sb.WriteString("; Deny everything not allowed below\n")
+		sb.WriteString(fmt.Sprintf("(deny default%s)\n\n", messageModifier(runID)))
+	}
+
 	// Process operations - configurable permissions
 	sb.WriteString("; Process operations\n")
 	sb.WriteString("(allow process-exec*)\n")
@@ -41,14 +60,18 @@ func GenerateSeatbeltProfile(
 	if enableProxy {
 		// Deny all except proxies
 		sb.WriteString("; Network - deny all except proxies\n")
-		sb.WriteString("(deny network*)\n")
+		sb.WriteString(deny("network*", ""))
 		sb.WriteString(fmt.Sprintf("(allow network* (remote ip \"localhost:%d\"))\n", httpProxyPort))
 		sb.WriteString(fmt.Sprintf("(allow network* (remote ip \"localhost:%d\"))\n", socksProxyPort))
+		if dnsPort > 0 {
+			sb.WriteString(fmt.Sprintf("(allow network* (remote ip \"localhost:%d\"))\n", dnsPort))
+		}
 		sb.WriteString("\n")
 	} else {
 		// Deny all network access
 		sb.WriteString("; Network - deny all\n")
-		sb.WriteString("(deny network*)\n\n")
+		sb.WriteString(deny("network*", ""))
+		sb.WriteString("\n")
 	}
 
 	// File reads - allow by default, deny specific
@@ -63,9 +86,9 @@ func GenerateSeatbeltProfile(
 				if err != nil {
 					return "", fmt.Errorf("failed to convert glob %q: %w", path, err)
 				}
-				sb.WriteString(fmt.Sprintf("(deny file-read* (regex #\"%s\"))\n", regex))
+				sb.WriteString(deny("file-read*", fmt.Sprintf("(regex #\"%s\")", regex)))
 			} else {
-				sb.WriteString(fmt.Sprintf("(deny file-read* (subpath \"%s\"))\n", path))
+				sb.WriteString(deny("file-read*", fmt.Sprintf("(subpath \"%s\")", path)))
 			}
 		}
 		sb.WriteString("\n")
@@ -73,7 +96,8 @@ func GenerateSeatbeltProfile(
 
 	// File writes - deny by default, allow specific
 	sb.WriteString("; Filesystem writes - deny by default\n")
-	sb.WriteString("(deny file-write*)\n\n")
+	sb.WriteString(deny("file-write*", ""))
+	sb.WriteString("\n")
 
 	if len(allowWritePaths) > 0 {
 		sb.WriteString("; Allow writes to specific paths\n")
@@ -100,9 +124,9 @@ func GenerateSeatbeltProfile(
 				if err != nil {
 					return "", fmt.Errorf("failed to convert glob %q: %w", path, err)
 				}
-				sb.WriteString(fmt.Sprintf("(deny file-write* (regex #\"%s\"))\n", regex))
+				sb.WriteString(deny("file-write*", fmt.Sprintf("(regex #\"%s\")", regex)))
 			} else {
-				sb.WriteString(fmt.Sprintf("(deny file-write* (subpath \"%s\"))\n", path))
+				sb.WriteString(deny("file-write*", fmt.Sprintf("(subpath \"%s\")", path)))
 			}
 		}
 		sb.WriteString("\n")
@@ -110,7 +134,8 @@ func GenerateSeatbeltProfile(
 
 	// File unlink/deletion - deny by default, allow specific
 	sb.WriteString("; File unlink/deletion - deny by default\n")
-	sb.WriteString("(deny file-write-unlink)\n\n")
+	sb.WriteString(deny("file-write-unlink", ""))
+	sb.WriteString("\n")
 
 	if len(allowUnlinkPaths) > 0 {
 		sb.WriteString("; Allow unlink in specific paths\n")
@@ -128,9 +153,41 @@ func GenerateSeatbeltProfile(
 		sb.WriteString("\n")
 	}
 
+	// srt's own files are denied even in report-only profiles, and last so no
+	// allow rule above reaches them
+	if len(internalPaths) > 0 {
+		sb.WriteString("; Deny srt's own files, always enforced\n")
+		for _, path := range internalPaths {
+			sb.WriteString(fmt.Sprintf("(deny file-read* (subpath \"%s\")%s)\n", path, messageModifier(runID)))
+		}
+		sb.WriteString("\n")
+	}
+
 	return sb.String(), nil
 }
 
+// denyRule returns a deny rule for the operation and optional filter. In
+// report-only mode the operation is allowed with a report instead.
+func denyRule(reportOnly bool, runID, operation, filter string) string {
+	if filter != "" {
+		filter = " " + filter
+	}
+
+	if reportOnly {
+		return fmt.Sprintf("(allow %s%s (with report)%s)\n", operation, filter, messageModifier(runID))
+	}
+
+	return fmt.Sprintf("(deny %s%s%s)\n", operation, filter, messageModifier(runID))
+}
+
+// messageModifier returns the modifier that tags reports with the run ID
+func messageModifier(runID string) string {
+	if runID == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (with message \"%s\")", RunTag(runID))
+}
+
 // ValidateProfile validates a Seatbelt profile both syntactically and by live testing
 func ValidateProfile(profilePath string) error {
 	// Phase 1: Syntax validation
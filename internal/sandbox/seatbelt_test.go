@@ -3,6 +3,7 @@ package sandbox
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -160,13 +161,16 @@ func TestGenerateSeatbeltProfile(t *testing.T) {
 	// Test with proxy disabled
 	t.Run("proxy disabled - network fully blocked", func(t *testing.T) {
 		profile, err := GenerateSeatbeltProfile(
-			0, 0, // ports don't matter when proxy is disabled
+			0, 0, 0, // ports don't matter when proxy is disabled
 			false, // enableProxy = false
 			[]string{},
 			[]string{},
 			[]string{},
 			[]string{},
+			[]string{},
 			true, true, true, true,
+			false, // reportOnly
+			"",    // runID
 		)
 
 		if err != nil {
@@ -199,8 +203,10 @@ func TestGenerateSeatbeltProfile(t *testing.T) {
 			profile, err := GenerateSeatbeltProfile(
 				tt.httpPort,
 				tt.socksPort,
+				0,    // dnsPort
 				true, // enableProxy
 				tt.denyReadPaths,
+				nil, // internalPaths
 				tt.allowWritePaths,
 				tt.denyWritePaths,
 				tt.allowUnlinkPaths,
@@ -208,6 +214,8 @@ func TestGenerateSeatbeltProfile(t *testing.T) {
 				tt.allowSysctlRead,
 				tt.allowMachLookup,
 				tt.allowPosixShm,
+				false, // reportOnly
+				"",    // runID
 			)
 
 			if err != nil {
@@ -240,6 +248,110 @@ func TestGenerateSeatbeltProfile(t *testing.T) {
 	}
 }
 
+func TestGenerateSeatbeltProfileReportOnly(t *testing.T) {
+	profile, err := GenerateSeatbeltProfile(
+		8080, 1080, 0,
+		true,
+		[]string{"/home/user/.ssh"},
+		[]string{"/home/user/.config/srt/log.key"},
+		[]string{"/tmp"},
+		[]string{"/tmp/.env"},
+		[]string{},
+		false, false, false, false,
+		true, // reportOnly
+		"",   // runID
+	)
+	if err != nil {
+		t.Fatalf("GenerateSeatbeltProfile() error = %v", err)
+	}
+
+	wantContains := []string{
+		"(allow default (with report))",
+		"(allow network* (with report))",
+		"(allow network* (remote ip \"localhost:8080\"))",
+		"(allow file-read* (subpath \"/home/user/.ssh\") (with report))",
+		"(allow file-write* (with report))",
+		"(allow file-write* (subpath \"/tmp\"))",
+		"(allow file-write* (subpath \"/tmp/.env\") (with report))",
+		"(allow file-write-unlink (with report))",
+		// srt's own files stay denied while everything else is only reported
+		"(deny file-read* (subpath \"/home/user/.config/srt/log.key\"))",
+	}
+	for _, want := range wantContains {
+		if !containsString(profile, want) {
+			t.Errorf("Report-only profile missing %q", want)
+		}
+	}
+
+	if got := strings.Count(profile, "(deny "); got != 1 {
+		t.Errorf("Report-only profile should only deny srt's own files, found %d deny rules:\n%s", got, profile)
+	}
+
+	if !hasBalancedParentheses(profile) {
+		t.Error("Report-only profile has unbalanced parentheses")
+	}
+}
+
+func TestGenerateSeatbeltProfileRunTag(t *testing.T) {
+	const runID = "3f9c2a7e1b6d4c08"
+
+	tests := []struct {
+		name       string
+		reportOnly bool
+		want       []string
+	}{
+		{
+			name: "enforcing",
+			want: []string{
+				`(deny default (with message "srt:3f9c2a7e1b6d4c08"))`,
+				`(deny network* (with message "srt:3f9c2a7e1b6d4c08"))`,
+				`(deny file-read* (subpath "/home/user/.ssh") (with message "srt:3f9c2a7e1b6d4c08"))`,
+				`(deny file-write-unlink (with message "srt:3f9c2a7e1b6d4c08"))`,
+				`(allow file-write* (subpath "/tmp"))`,
+				`(deny file-read* (subpath "/home/user/.config/srt/log.key") (with message "srt:3f9c2a7e1b6d4c08"))`,
+			},
+		},
+		{
+			name:       "report-only",
+			reportOnly: true,
+			want: []string{
+				`(allow default (with report) (with message "srt:3f9c2a7e1b6d4c08"))`,
+				`(allow file-write* (with report) (with message "srt:3f9c2a7e1b6d4c08"))`,
+				`(deny file-read* (subpath "/home/user/.config/srt/log.key") (with message "srt:3f9c2a7e1b6d4c08"))`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profile, err := GenerateSeatbeltProfile(
+				8080, 1080, 0,
+				true,
+				[]string{"/home/user/.ssh"},
+				[]string{"/home/user/.config/srt/log.key"},
+				[]string{"/tmp"},
+				nil,
+				nil,
+				false, false, false, false,
+				tt.reportOnly,
+				runID,
+			)
+			if err != nil {
+				t.Fatalf("GenerateSeatbeltProfile() error = %v", err)
+			}
+
+			for _, want := range tt.want {
+				if !containsString(profile, want) {
+					t.Errorf("Profile missing %q:\n%s", want, profile)
+				}
+			}
+			if !hasBalancedParentheses(profile) {
+				t.Error("Profile has unbalanced parentheses")
+			}
+		})
+	}
+}
+
 // Helper function to check if a string contains a substring
 func containsString(s, substr string) bool {
 	return len(s) >= len(substr) && (s == substr || len(substr) == 0 ||
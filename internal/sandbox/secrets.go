@@ -0,0 +1,80 @@
+package sandbox
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sammcj/srt-go/internal/config"
+	"github.com/sammcj/srt-go/internal/filesystem"
+	"github.com/sammcj/srt-go/internal/network"
+)
+
+// readSecret reads a value kept from the sandboxed command, from the
+// environment variable env or else the file. Errors never include the value.
+func readSecret(env, file string) (string, error) {
+	if env != "" {
+		value, ok := os.LookupEnv(env)
+		if !ok {
+			return "", fmt.Errorf("variable %s is not set", env)
+		}
+		return strings.TrimSpace(value), nil
+	}
+
+	path, err := filesystem.NormalisePath(file)
+	if err != nil {
+		return "", fmt.Errorf("invalid file: %w", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read file: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// secrets reads the configured secrets for the proxy filter
+func secrets(cfgs []config.SecretConfig) ([]network.Secret, error) {
+	converted := make([]network.Secret, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		value, err := readSecret(cfg.Env, cfg.File)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read secret %s: %w", cfg.Name, err)
+		}
+		if value == "" {
+			return nil, fmt.Errorf("secret %s is empty", cfg.Name)
+		}
+		converted = append(converted, network.Secret{
+			Name:        cfg.Name,
+			Placeholder: cfg.Placeholder(),
+			Value:       value,
+			Domains:     cfg.Domains,
+		})
+	}
+	return converted, nil
+}
+
+// secretEnv gives the sandboxed command placeholders in place of the secrets
+// read from its environment
+func secretEnv(env []string, cfgs []config.SecretConfig) []string {
+	for _, cfg := range cfgs {
+		if cfg.Env == "" {
+			continue
+		}
+		env = append(withoutEnv(env, cfg.Env), cfg.Env+"="+cfg.Placeholder())
+	}
+	return env
+}
+
+// withoutEnv returns env without the named variable
+func withoutEnv(env []string, name string) []string {
+	if name == "" {
+		return env
+	}
+	filtered := make([]string, 0, len(env))
+	for _, entry := range env {
+		if !strings.HasPrefix(entry, name+"=") {
+			filtered = append(filtered, entry)
+		}
+	}
+	return filtered
+}
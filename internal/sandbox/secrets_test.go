@@ -0,0 +1,62 @@
+package sandbox
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sammcj/srt-go/internal/config"
+)
+
+func TestSecrets(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "npm-token")
+	if err := os.WriteFile(file, []byte("npm_real\n"), 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	t.Setenv("SRT_TEST_GITHUB_TOKEN", "ghp_real")
+	t.Setenv("SRT_TEST_EMPTY_TOKEN", "")
+
+	got, err := secrets([]config.SecretConfig{
+		{Name: "GITHUB", Env: "SRT_TEST_GITHUB_TOKEN", Domains: []string{"github.com"}},
+		{Name: "NPM", File: file, Domains: []string{"registry.npmjs.org"}},
+	})
+	if err != nil {
+		t.Fatalf("secrets() error = %v", err)
+	}
+	if len(got) != 2 || got[0].Placeholder != "SRT_SECRET_GITHUB" || got[0].Value != "ghp_real" || got[1].Value != "npm_real" {
+		t.Errorf("secrets() = %+v", got)
+	}
+
+	for _, cfg := range []config.SecretConfig{
+		{Name: "UNSET", Env: "SRT_TEST_UNSET_TOKEN"},
+		{Name: "EMPTY", Env: "SRT_TEST_EMPTY_TOKEN"},
+		{Name: "MISSING", File: filepath.Join(t.TempDir(), "missing")},
+	} {
+		if _, err := secrets([]config.SecretConfig{cfg}); err == nil {
+			t.Errorf("secrets() accepted secret %s", cfg.Name)
+		}
+	}
+}
+
+func TestSecretEnv(t *testing.T) {
+	env := []string{"PATH=/usr/bin", "GITHUB_TOKEN=ghp_real"}
+	got := secretEnv(env, []config.SecretConfig{
+		{Name: "GITHUB", Env: "GITHUB_TOKEN"},
+		{Name: "NPM", File: "/tmp/npm-token"},
+	})
+	if strings.Join(got, " ") != "PATH=/usr/bin GITHUB_TOKEN=SRT_SECRET_GITHUB" {
+		t.Errorf("secretEnv() = %q", got)
+	}
+}
+
+func TestWithoutEnv(t *testing.T) {
+	env := []string{"PATH=/usr/bin", "PROXY_AUTH=bob:hunter2", "PROXY_AUTH_MODE=basic"}
+	got := withoutEnv(env, "PROXY_AUTH")
+	if strings.Join(got, " ") != "PATH=/usr/bin PROXY_AUTH_MODE=basic" {
+		t.Errorf("withoutEnv() = %q", got)
+	}
+	if len(withoutEnv(env, "")) != len(env) {
+		t.Error("withoutEnv() with no name removed variables")
+	}
+}
@@ -0,0 +1,379 @@
+package sandbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"log/syslog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sammcj/srt-go/internal/config"
+)
+
+// Webhook sink defaults, used when the configuration leaves a value at zero
+const (
+	defaultWebhookBatchSize     = 50
+	defaultWebhookFlushInterval = 2 * time.Second
+	defaultWebhookMaxRetries    = 3
+	defaultWebhookQueueSize     = 1000
+	webhookRequestTimeout       = 10 * time.Second
+	webhookRetryDelay           = 500 * time.Millisecond
+	webhookCloseTimeout         = 5 * time.Second // Longest Close waits for queued records once the run has ended
+)
+
+// socketWriteTimeout bounds how long a slow socket reader can hold up violation processing
+const socketWriteTimeout = time.Second
+
+// ViolationSink receives violation records once ignore rules have been applied.
+// Write must not block for long as it is called from the violation-processing goroutine.
+type ViolationSink interface {
+	Write(r LogRecord) error
+	Close() error
+}
+
+// NewViolationSinks creates the sinks enabled in cfg
+func NewViolationSinks(cfg config.SinksConfig) ([]ViolationSink, error) {
+	var sinks []ViolationSink
+
+	if cfg.Syslog.Enabled {
+		sink, err := NewSyslogSink(cfg.Syslog)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+
+	if cfg.Socket.Path != "" {
+		sinks = append(sinks, NewSocketSink(expandHome(cfg.Socket.Path)))
+	}
+
+	if cfg.Webhook.URL != "" {
+		sinks = append(sinks, NewWebhookSink(cfg.Webhook))
+	}
+
+	return sinks, nil
+}
+
+// SyslogSink forwards violations to the local syslog daemon as JSON messages
+type SyslogSink struct {
+	writer *syslog.Writer
+}
+
+// NewSyslogSink connects to the local syslog daemon
+func NewSyslogSink(cfg config.SyslogSinkConfig) (*SyslogSink, error) {
+	tag := cfg.Tag
+	if tag == "" {
+		tag = "srt"
+	}
+
+	writer, err := syslog.New(syslog.LOG_WARNING|syslog.LOG_USER, tag)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to syslog: %w", err)
+	}
+
+	return &SyslogSink{writer: writer}, nil
+}
+
+// Write sends a record to syslog, at notice level for audit records
+func (s *SyslogSink) Write(r LogRecord) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	if r.Mode == "audit" {
+		return s.writer.Notice(string(data))
+	}
+	return s.writer.Warning(string(data))
+}
+
+// Close closes the syslog connection
+func (s *SyslogSink) Close() error {
+	return s.writer.Close()
+}
+
+// SocketSink streams violations as JSON lines to a unix-domain socket. The
+// connection is made on first write and re-established after errors, so the
+// listener may start after srt.
+type SocketSink struct {
+	path string
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// NewSocketSink creates a sink for the socket at path
+func NewSocketSink(path string) *SocketSink {
+	return &SocketSink{path: path}
+}
+
+// Write sends a record over the socket, connecting if needed
+func (s *SocketSink) Write(r LogRecord) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		conn, err := net.DialTimeout("unix", s.path, socketWriteTimeout)
+		if err != nil {
+			return fmt.Errorf("failed to connect to violation socket: %w", err)
+		}
+		s.conn = conn
+	}
+
+	s.conn.SetWriteDeadline(time.Now().Add(socketWriteTimeout))
+	if _, err := s.conn.Write(append(data, '\n')); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return fmt.Errorf("failed to write to violation socket: %w", err)
+	}
+
+	return nil
+}
+
+// Close closes the socket connection
+func (s *SocketSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// WebhookSink posts violations to an HTTP endpoint in batches. Records are
+// queued without blocking; when the queue is full new records are dropped and
+// counted. Failed batches are retried with exponential backoff.
+type WebhookSink struct {
+	url          string
+	headers      map[string]string
+	client       *http.Client
+	batchSize    int
+	flushEvery   time.Duration
+	maxRetries   int
+	retryDelay   time.Duration
+	closeTimeout time.Duration
+	ctx          context.Context // Cancelled when Close gives up, ending requests and retries
+	cancel       context.CancelFunc
+
+	mu      sync.RWMutex // Guards closed so writes never race with closing the queue
+	closed  bool
+	queue   chan LogRecord
+	done    chan struct{}
+	pending atomic.Int64 // Queued or in a batch being sent
+	dropped atomic.Int64
+	failed  atomic.Int64
+}
+
+// webhookPayload is the body of each webhook request
+type webhookPayload struct {
+	Records []LogRecord `json:"records"`
+}
+
+// NewWebhookSink creates a webhook sink and starts its delivery goroutine
+func NewWebhookSink(cfg config.WebhookSinkConfig) *WebhookSink {
+	return newWebhookSink(cfg, webhookRetryDelay)
+}
+
+func newWebhookSink(cfg config.WebhookSinkConfig, retryDelay time.Duration) *WebhookSink {
+	s := &WebhookSink{
+		url:          cfg.URL,
+		headers:      make(map[string]string, len(cfg.Headers)),
+		client:       &http.Client{Timeout: webhookRequestTimeout},
+		batchSize:    cfg.BatchSize,
+		flushEvery:   time.Duration(cfg.FlushIntervalMs) * time.Millisecond,
+		maxRetries:   defaultWebhookMaxRetries,
+		retryDelay:   retryDelay,
+		closeTimeout: webhookCloseTimeout,
+		done:         make(chan struct{}),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	if cfg.MaxRetries != nil {
+		s.maxRetries = *cfg.MaxRetries
+	}
+
+	// Expand environment variables so credentials need not live in the config file
+	for k, v := range cfg.Headers {
+		s.headers[k] = os.ExpandEnv(v)
+	}
+
+	if s.batchSize == 0 {
+		s.batchSize = defaultWebhookBatchSize
+	}
+	if s.flushEvery == 0 {
+		s.flushEvery = defaultWebhookFlushInterval
+	}
+
+	queueSize := cfg.QueueSize
+	if queueSize == 0 {
+		queueSize = defaultWebhookQueueSize
+	}
+	s.queue = make(chan LogRecord, queueSize)
+
+	go s.deliver()
+
+	return s
+}
+
+// Write queues a record for delivery, dropping it if the queue is full
+func (s *WebhookSink) Write(r LogRecord) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		s.dropped.Add(1)
+		return fmt.Errorf("webhook sink closed, violation dropped")
+	}
+
+	select {
+	case s.queue <- r:
+		s.pending.Add(1)
+		return nil
+	default:
+		s.dropped.Add(1)
+		return fmt.Errorf("webhook queue full, violation dropped")
+	}
+}
+
+// Close delivers queued records and stops the sink. An unreachable webhook
+// can't hold up srt's exit: after the close timeout, requests and retries
+// are abandoned and the records still waiting are reported as undelivered.
+func (s *WebhookSink) Close() error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mu.Unlock()
+
+	var undelivered int64
+	select {
+	case <-s.done:
+	case <-time.After(s.closeTimeout):
+		undelivered = s.pending.Load()
+	}
+	s.cancel()
+
+	dropped, failed := s.dropped.Load(), s.failed.Load()
+	if dropped > 0 || failed > 0 || undelivered > 0 {
+		return fmt.Errorf("webhook sink lost violations: %d dropped from a full queue, %d in failed batches, %d undelivered when closing timed out", dropped, failed, undelivered)
+	}
+	return nil
+}
+
+// Dropped returns the number of records dropped because the queue was full
+func (s *WebhookSink) Dropped() int64 {
+	return s.dropped.Load()
+}
+
+func (s *WebhookSink) deliver() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.flushEvery)
+	defer ticker.Stop()
+
+	batch := make([]LogRecord, 0, s.batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := s.send(batch); err != nil && s.ctx.Err() == nil {
+			s.failed.Add(int64(len(batch)))
+			slog.Debug("Failed to deliver violations to webhook", "records", len(batch), "error", err)
+		}
+		s.pending.Add(-int64(len(batch)))
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case r, ok := <-s.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, r)
+			if len(batch) >= s.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// send posts a batch, retrying connection errors, 429 and 5xx responses
+func (s *WebhookSink) send(batch []LogRecord) error {
+	body, err := json.Marshal(webhookPayload{Records: batch})
+	if err != nil {
+		return fmt.Errorf("failed to encode webhook payload: %w", err)
+	}
+
+	delay := s.retryDelay
+	for attempt := 0; ; attempt++ {
+		err = s.post(body)
+		if err == nil {
+			return nil
+		}
+		var retryable retryableError
+		if !errors.As(err, &retryable) || attempt >= s.maxRetries {
+			return err
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-s.ctx.Done():
+			return err
+		}
+		delay *= 2
+	}
+}
+
+// retryableError marks webhook failures worth retrying
+type retryableError struct {
+	err error
+}
+
+func (e retryableError) Error() string { return e.err.Error() }
+
+func (e retryableError) Unwrap() error { return e.err }
+
+func (s *WebhookSink) post(body []byte) error {
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return retryableError{fmt.Errorf("webhook request failed: %w", err)}
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return retryableError{fmt.Errorf("webhook returned %s", resp.Status)}
+	default:
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+}
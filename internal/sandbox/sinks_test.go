@@ -0,0 +1,226 @@
+package sandbox
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sammcj/srt-go/internal/config"
+)
+
+func TestSocketSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "v.sock")
+	sink := NewSocketSink(path)
+	defer sink.Close()
+
+	// No listener yet, the write fails and the sink retries on the next one
+	if err := sink.Write(LogRecord{Process: "early"}); err == nil {
+		t.Error("Expected error writing before the listener exists")
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	received := make(chan LogRecord, 2)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			var r LogRecord
+			if json.Unmarshal(scanner.Bytes(), &r) == nil {
+				received <- r
+			}
+		}
+	}()
+
+	for _, process := range []string{"node", "git"} {
+		if err := sink.Write(LogRecord{Process: process, Operation: "file-read-data"}); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+
+	for _, want := range []string{"node", "git"} {
+		select {
+		case r := <-received:
+			if r.Process != want {
+				t.Errorf("Received process %q, want %q", r.Process, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Timed out waiting for socket record")
+		}
+	}
+}
+
+func TestWebhookSinkBatches(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		batches [][]LogRecord
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("Authorization header = %q", r.Header.Get("Authorization"))
+		}
+		var payload webhookPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("Failed to decode payload: %v", err)
+		}
+		mu.Lock()
+		batches = append(batches, payload.Records)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	t.Setenv("SRT_TEST_WEBHOOK_TOKEN", "secret")
+	sink := NewWebhookSink(config.WebhookSinkConfig{
+		URL:             server.URL,
+		Headers:         map[string]string{"Authorization": "Bearer ${SRT_TEST_WEBHOOK_TOKEN}"},
+		BatchSize:       2,
+		FlushIntervalMs: 60000,
+	})
+
+	for i := 0; i < 5; i++ {
+		if err := sink.Write(LogRecord{PID: i}); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+
+	// Close flushes the final partial batch
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(batches) != 3 || len(batches[0]) != 2 || len(batches[2]) != 1 {
+		t.Errorf("Unexpected batches: %+v", batches)
+	}
+
+	if err := sink.Write(LogRecord{}); err == nil {
+		t.Error("Expected error writing to a closed sink")
+	}
+}
+
+func TestWebhookSinkRetries(t *testing.T) {
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	sink := newWebhookSink(config.WebhookSinkConfig{URL: server.URL, MaxRetries: intPtr(3)}, time.Millisecond)
+	sink.Write(LogRecord{Process: "node"})
+	if err := sink.Close(); err != nil {
+		t.Errorf("Close() error = %v, batch should succeed on third attempt", err)
+	}
+	if got := attempts.Load(); got != 3 {
+		t.Errorf("attempts = %d, want 3", got)
+	}
+}
+
+func TestWebhookSinkGivesUp(t *testing.T) {
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	sink := newWebhookSink(config.WebhookSinkConfig{URL: server.URL, MaxRetries: intPtr(3)}, time.Millisecond)
+	sink.Write(LogRecord{Process: "node"})
+	if err := sink.Close(); err == nil {
+		t.Error("Close() should report the failed batch")
+	}
+	if got := attempts.Load(); got != 1 {
+		t.Errorf("attempts = %d, client errors should not be retried", got)
+	}
+}
+
+func TestWebhookSinkRetriesDisabled(t *testing.T) {
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	sink := newWebhookSink(config.WebhookSinkConfig{URL: server.URL, MaxRetries: intPtr(0)}, time.Millisecond)
+	sink.Write(LogRecord{Process: "node"})
+	if err := sink.Close(); err == nil {
+		t.Error("Close() should report the failed batch")
+	}
+	if got := attempts.Load(); got != 1 {
+		t.Errorf("attempts = %d, want 1 with maxRetries 0", got)
+	}
+}
+
+func TestWebhookSinkCloseTimesOut(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	sink := newWebhookSink(config.WebhookSinkConfig{URL: server.URL, BatchSize: 1}, time.Millisecond)
+	sink.closeTimeout = 50 * time.Millisecond
+	sink.Write(LogRecord{PID: 1})
+	sink.Write(LogRecord{PID: 2})
+
+	start := time.Now()
+	err := sink.Close()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Close() took %v with an unresponsive webhook", elapsed)
+	}
+	if err == nil || !strings.Contains(err.Error(), "2 undelivered") {
+		t.Errorf("Close() error = %v, want 2 undelivered", err)
+	}
+}
+
+func TestWebhookSinkBoundedQueue(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+
+	sink := NewWebhookSink(config.WebhookSinkConfig{URL: server.URL, BatchSize: 1, QueueSize: 2})
+
+	// The first record is taken by the blocked sender, then the queue fills
+	dropped := 0
+	for i := 0; i < 10; i++ {
+		if err := sink.Write(LogRecord{PID: i}); err != nil {
+			dropped++
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(release)
+	sink.Close()
+
+	if dropped == 0 || sink.Dropped() != int64(dropped) {
+		t.Errorf("dropped = %d, Dropped() = %d, want a matching non-zero count", dropped, sink.Dropped())
+	}
+}
+
+func intPtr(n int) *int {
+	return &n
+}
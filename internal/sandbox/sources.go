@@ -0,0 +1,310 @@
+package sandbox
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/sammcj/srt-go/internal/config"
+)
+
+// ViolationSource produces violations for the processing pipeline. The
+// Violations channel is closed once the source is exhausted or stopped.
+type ViolationSource interface {
+	Start()
+	Violations() <-chan Violation
+	Stop()
+}
+
+// ReplaySource reads violations from a recorded file. It accepts output from
+// `log stream --style ndjson`, a JSON array from `log show --style json`, and
+// srt's own violation log.
+type ReplaySource struct {
+	file       *os.File
+	runID      string
+	violations chan Violation
+	stopCh     chan struct{}
+	stopOnce   sync.Once
+	mu         sync.Mutex // Guards started and err
+	started    bool
+	err        error
+}
+
+// NewReplaySource opens a recorded log. When runID is set, sandbox messages
+// not tagged with it are skipped.
+func NewReplaySource(path, runID string) (*ReplaySource, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open violation log: %w", err)
+	}
+
+	return &ReplaySource{
+		file:       f,
+		runID:      runID,
+		violations: make(chan Violation, 100),
+		stopCh:     make(chan struct{}),
+	}, nil
+}
+
+// Start begins reading the file
+func (s *ReplaySource) Start() {
+	s.mu.Lock()
+	s.started = true
+	s.mu.Unlock()
+
+	go func() {
+		defer close(s.violations)
+		defer s.file.Close()
+
+		if err := s.read(); err != nil {
+			s.mu.Lock()
+			s.err = err
+			s.mu.Unlock()
+		}
+	}()
+}
+
+// Violations returns the violations channel
+func (s *ReplaySource) Violations() <-chan Violation {
+	return s.violations
+}
+
+// Stop stops reading, it is safe to call more than once
+func (s *ReplaySource) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stopCh)
+
+		// The reading goroutine closes the file, unless it never started
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if !s.started {
+			s.file.Close()
+			close(s.violations)
+		}
+	})
+}
+
+// Err returns the error that ended reading early, if any. It is only
+// meaningful once the Violations channel has been closed.
+func (s *ReplaySource) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *ReplaySource) read() error {
+	reader := bufio.NewReader(s.file)
+
+	// Skip leading whitespace to tell a JSON array from line-delimited records
+	for {
+		b, err := reader.Peek(1)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read violation log: %w", err)
+		}
+		if b[0] != ' ' && b[0] != '\t' && b[0] != '\r' && b[0] != '\n' {
+			break
+		}
+		reader.ReadByte()
+	}
+
+	if b, _ := reader.Peek(1); b[0] == '[' {
+		return s.readArray(reader)
+	}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if !s.emit(scanner.Bytes()) {
+			return nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read violation log: %w", err)
+	}
+	return nil
+}
+
+func (s *ReplaySource) readArray(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	if _, err := dec.Token(); err != nil {
+		return fmt.Errorf("failed to parse violation log: %w", err)
+	}
+
+	for dec.More() {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return fmt.Errorf("failed to parse violation log: %w", err)
+		}
+		if !s.emit(raw) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// emit sends the violation in a recorded entry, returning false once stopped
+func (s *ReplaySource) emit(data []byte) bool {
+	v, ok := parseRecordedViolation(data, s.runID)
+	if !ok {
+		return true
+	}
+
+	select {
+	case s.violations <- v:
+		return true
+	case <-s.stopCh:
+		return false
+	}
+}
+
+// parseRecordedViolation decodes a `log` entry or a violation log record
+func parseRecordedViolation(data []byte, runID string) (Violation, bool) {
+	data = bytes.TrimSpace(data)
+
+	var probe struct {
+		EventMessage *string `json:"eventMessage"`
+	}
+	if len(data) > 0 && data[0] == '{' && json.Unmarshal(data, &probe) == nil && probe.EventMessage != nil {
+		return parseLogStreamLine(data, runID)
+	}
+
+	record, ok := parseLogRecord(data)
+	if !ok || record.Operation == "" {
+		return Violation{}, false
+	}
+	if runID != "" && record.RunID != runID {
+		return Violation{}, false
+	}
+
+	return record.toViolation(), true
+}
+
+// toViolation converts a violation log record back into a Violation
+func (r LogRecord) toViolation() Violation {
+	category := r.Category
+	if category == "" {
+		category = OperationCategory(r.Operation)
+	}
+
+	return Violation{
+		Process:   r.Process,
+		PID:       r.PID,
+		Operation: r.Operation,
+		Category:  category,
+		Target:    r.Target,
+		Timestamp: r.Time,
+		Audit:     r.Mode == "audit",
+		Count:     r.Count,
+	}
+}
+
+// ChannelSource is a source fed by Send, for tests and embedding
+type ChannelSource struct {
+	mu         sync.Mutex // Guards stopped
+	stopped    bool
+	stopCh     chan struct{}
+	sending    sync.WaitGroup // Sends in progress, the channel closes once they return
+	violations chan Violation
+}
+
+// NewChannelSource creates a source buffering up to size violations
+func NewChannelSource(size int) *ChannelSource {
+	return &ChannelSource{
+		stopCh:     make(chan struct{}),
+		violations: make(chan Violation, size),
+	}
+}
+
+// Start does nothing, violations are delivered as they are sent
+func (s *ChannelSource) Start() {}
+
+// Send delivers a violation, blocking while the buffer is full. Violations
+// sent after Stop, or blocked when it is called, are discarded.
+func (s *ChannelSource) Send(v Violation) {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return
+	}
+	s.sending.Add(1)
+	s.mu.Unlock()
+	defer s.sending.Done()
+
+	select {
+	case s.violations <- v:
+	case <-s.stopCh:
+	}
+}
+
+// Violations returns the violations channel
+func (s *ChannelSource) Violations() <-chan Violation {
+	return s.violations
+}
+
+// Stop closes the source, it is safe to call more than once
+func (s *ChannelSource) Stop() {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return
+	}
+	s.stopped = true
+	close(s.stopCh)
+	s.mu.Unlock()
+
+	// Blocked sends give up on stopCh, then nothing can send on the channel
+	s.sending.Wait()
+	close(s.violations)
+}
+
+// ReplayViolations runs violations from src through the ignore rules in cfg
+// and returns the resulting summary, without running a command
+func ReplayViolations(cfg *config.Config, src ViolationSource) (*ViolationSummary, error) {
+	ignore, err := NewIgnoreMatcher(cfg.Violations, cfg.ViolationSettings.Ignore)
+	if err != nil {
+		src.Stop()
+		return nil, fmt.Errorf("failed to compile ignore rules: %w", err)
+	}
+
+	summary := NewViolationSummary()
+
+	src.Start()
+	for v := range src.Violations() {
+		if ignore.Match(v) {
+			continue
+		}
+		summary.Add(v)
+	}
+	src.Stop()
+
+	summary.SetSuppressed(ignore.SuppressedByRule())
+
+	return summary, nil
+}
+
+// ReplayFile replays a recorded log, as for `srt violations replay <file>`.
+// When runID is set only that run's violations are included.
+func ReplayFile(cfg *config.Config, path, runID string) (*ViolationSummary, error) {
+	src, err := NewReplaySource(path, runID)
+	if err != nil {
+		return nil, err
+	}
+
+	summary, err := ReplayViolations(cfg, src)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := src.Err(); err != nil {
+		return nil, err
+	}
+
+	return summary, nil
+}
@@ -0,0 +1,173 @@
+package sandbox
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sammcj/srt-go/internal/config"
+)
+
+func collectSource(t *testing.T, src ViolationSource) []Violation {
+	t.Helper()
+
+	var violations []Violation
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for v := range src.Violations() {
+			violations = append(violations, v)
+		}
+	}()
+
+	src.Start()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out reading source")
+	}
+	src.Stop()
+
+	return violations
+}
+
+func TestReplaySourceFormats(t *testing.T) {
+	dir := t.TempDir()
+	denyLog := filepath.Join(dir, "deny.log")
+	writeLogFile(t, denyLog,
+		logLine(t, LogRecord{Time: time.Now(), RunID: "3f9c2a7e1b6d4c08", Mode: "audit", Process: "node", Operation: "file-write-create", Target: "/Users/dev/.npmrc"}),
+		logLine(t, LogRecord{Time: time.Now(), RunID: "a41d07c5e92f8b13", Mode: "enforce", Process: "git", Operation: "file-read-data", Target: "/etc/hosts"}),
+		"2025/01/15 14:32:01 VIOLATION process=npm operation=file-read-data target=/Users/dev/.ssh/id_rsa time=2025-01-15 14:32:01",
+	)
+
+	tests := []struct {
+		name      string
+		path      string
+		runID     string
+		processes []string
+	}{
+		{"log stream ndjson", filepath.Join("testdata", "log_stream_tagged.ndjson"), "3f9c2a7e1b6d4c08", []string{"cat", "touch", "curl"}},
+		{"log show json array", filepath.Join("testdata", "log_show.json"), "", []string{"python3.12", "python3.12"}},
+		{"violation log", denyLog, "", []string{"node", "git", "npm"}},
+		{"violation log for one run", denyLog, "3f9c2a7e1b6d4c08", []string{"node"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, err := NewReplaySource(tt.path, tt.runID)
+			if err != nil {
+				t.Fatalf("NewReplaySource() error = %v", err)
+			}
+
+			var processes []string
+			for _, v := range collectSource(t, src) {
+				processes = append(processes, v.Process)
+			}
+			if strings.Join(processes, ",") != strings.Join(tt.processes, ",") {
+				t.Errorf("processes = %v, want %v", processes, tt.processes)
+			}
+			if err := src.Err(); err != nil {
+				t.Errorf("Err() = %v", err)
+			}
+		})
+	}
+}
+
+func TestReplayFile(t *testing.T) {
+	cfg := &config.Config{
+		ViolationSettings: config.ViolationsConfig{
+			Ignore: []config.IgnoreRule{{Process: "python3*", Target: "/opt/homebrew/**"}},
+		},
+	}
+
+	summary, err := ReplayFile(cfg, filepath.Join("testdata", "log_show.json"), "")
+	if err != nil {
+		t.Fatalf("ReplayFile() error = %v", err)
+	}
+
+	entries := summary.Entries()
+	if summary.Total() != 1 || len(entries) != 1 || entries[0].Target != "/Users/dev/.aws/credentials" {
+		t.Errorf("Unexpected summary entries: %+v", entries)
+	}
+	if suppressed := summary.Suppressed(); len(suppressed) != 1 || suppressed[0].Count != 1 {
+		t.Errorf("Suppressed() = %+v, want one rule with one match", suppressed)
+	}
+
+	if _, err := ReplayFile(cfg, filepath.Join(t.TempDir(), "missing.json"), ""); err == nil {
+		t.Error("Expected error for missing file")
+	}
+}
+
+func TestManagerProcessesChannelSource(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	cfg := &config.Config{
+		Network: config.NetworkConfig{DefaultPolicy: "deny"},
+		ViolationSettings: config.ViolationsConfig{
+			Ignore: []config.IgnoreRule{{Operation: "sysctl-read"}},
+		},
+	}
+	m, err := NewManager(cfg)
+	if err != nil {
+		t.Fatalf("NewManager() error = %v", err)
+	}
+	defer m.Cleanup()
+
+	src := NewChannelSource(10)
+	m.startViolations(src)
+
+	src.Send(Violation{Process: "node", Operation: "file-read-data", Category: CategoryFileRead, Target: "/Users/dev/.ssh/id_ed25519", Timestamp: time.Now()})
+	src.Send(Violation{Process: "node", Operation: "sysctl-read", Category: CategorySysctl, Target: "kern.bootargs", Timestamp: time.Now()})
+	src.Stop()
+	src.Send(Violation{Process: "late", Operation: "file-read-data"})
+
+	m.finishViolations()
+
+	if got := m.Summary().Total(); got != 1 {
+		t.Errorf("Summary total = %d, want 1", got)
+	}
+
+	records, err := ReadViolationLog(filepath.Join(home, ".srt"), LogQuery{RunID: m.RunID()})
+	if err != nil {
+		t.Fatalf("ReadViolationLog() error = %v", err)
+	}
+	if len(records) != 1 || records[0].Target != "/Users/dev/.ssh/id_ed25519" {
+		t.Errorf("Logged records = %+v", records)
+	}
+}
+
+func TestChannelSourceStopWhileSendBlocks(t *testing.T) {
+	src := NewChannelSource(1)
+	src.Send(Violation{Process: "first"})
+
+	// The buffer is full, so this send blocks until Stop
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		src.Send(Violation{Process: "second"})
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		src.Stop()
+	}()
+	for _, ch := range []chan struct{}{stopped, sent} {
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Stop deadlocked with a blocked Send")
+		}
+	}
+
+	var got []string
+	for v := range src.Violations() {
+		got = append(got, v.Process)
+	}
+	if len(got) != 1 || got[0] != "first" {
+		t.Errorf("Violations = %v, want [first]", got)
+	}
+}
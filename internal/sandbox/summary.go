@@ -0,0 +1,245 @@
+package sandbox
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// maxSummaryEntries limits how many entries are printed in the end-of-run summary
+const maxSummaryEntries = 20
+
+// maxSummaryIgnoreRules limits how many ignore rules are listed in the summary
+const maxSummaryIgnoreRules = 5
+
+// SummaryEntry is a group of violations sharing an operation and target
+type SummaryEntry struct {
+	Operation string    `json:"operation"`
+	Category  string    `json:"category"`
+	Target    string    `json:"target"`
+	Processes []string  `json:"processes"`
+	Count     int       `json:"count"`
+	FirstSeen time.Time `json:"firstSeen"`
+	ConfigKey string    `json:"configKey,omitempty"` // Config key that would need to change to allow it
+}
+
+type summaryKey struct {
+	operation string
+	target    string
+}
+
+// ViolationSummary aggregates violations observed during a run
+type ViolationSummary struct {
+	mu         sync.Mutex
+	entries    map[summaryKey]*SummaryEntry
+	total      int
+	audit      bool // Violations were recorded in audit mode
+	suppressed []RuleCount
+	dropped    int64 // Reports lost before they could be recorded
+}
+
+// NewViolationSummary creates an empty violation summary
+func NewViolationSummary() *ViolationSummary {
+	return &ViolationSummary{
+		entries: make(map[summaryKey]*SummaryEntry),
+	}
+}
+
+// Add records a violation in the summary
+func (s *ViolationSummary) Add(v Violation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := v.Occurrences()
+	s.total += n
+	if v.Audit {
+		s.audit = true
+	}
+
+	key := summaryKey{operation: v.Operation, target: v.Target}
+	entry, ok := s.entries[key]
+	if !ok {
+		entry = &SummaryEntry{
+			Operation: v.Operation,
+			Category:  v.Category,
+			Target:    v.Target,
+			FirstSeen: v.Timestamp,
+			ConfigKey: ConfigKeyForViolation(v),
+		}
+		s.entries[key] = entry
+	}
+
+	entry.Count += n
+	if v.Timestamp.Before(entry.FirstSeen) {
+		entry.FirstSeen = v.Timestamp
+	}
+	if v.Process != "" && !slices.Contains(entry.Processes, v.Process) {
+		entry.Processes = append(entry.Processes, v.Process)
+	}
+}
+
+// SetSuppressed records how many violations each ignore rule suppressed
+func (s *ViolationSummary) SetSuppressed(counts []RuleCount) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.suppressed = counts
+}
+
+// Suppressed returns the violations suppressed by each ignore rule
+func (s *ViolationSummary) Suppressed() []RuleCount {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]RuleCount(nil), s.suppressed...)
+}
+
+// SetDropped records how many reports were dropped because the pipeline was full
+func (s *ViolationSummary) SetDropped(n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dropped = n
+}
+
+// Dropped returns the number of reports dropped before they could be recorded
+func (s *ViolationSummary) Dropped() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+// Total returns the number of violations recorded
+func (s *ViolationSummary) Total() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.total
+}
+
+// Entries returns the summary entries sorted by operation, then first occurrence
+func (s *ViolationSummary) Entries() []SummaryEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := make([]SummaryEntry, 0, len(s.entries))
+	for _, entry := range s.entries {
+		e := *entry
+		e.Processes = append([]string(nil), entry.Processes...)
+		entries = append(entries, e)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Operation != entries[j].Operation {
+			return entries[i].Operation < entries[j].Operation
+		}
+		if !entries[i].FirstSeen.Equal(entries[j].FirstSeen) {
+			return entries[i].FirstSeen.Before(entries[j].FirstSeen)
+		}
+		return entries[i].Target < entries[j].Target
+	})
+
+	return entries
+}
+
+// Print writes a compact, human readable summary to w
+func (s *ViolationSummary) Print(w io.Writer) {
+	entries := s.Entries()
+	suppressed := s.Suppressed()
+	dropped := s.Dropped()
+	if len(entries) == 0 && len(suppressed) == 0 && dropped == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	audit := s.audit
+	s.mu.Unlock()
+
+	switch {
+	case len(entries) == 0:
+	case audit:
+		fmt.Fprintf(w, "[srt-go] Audit - would deny: %d total, %d unique\n", s.Total(), len(entries))
+	default:
+		fmt.Fprintf(w, "[srt-go] Sandbox violations: %d total, %d unique\n", s.Total(), len(entries))
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for i, e := range entries {
+		if i == maxSummaryEntries {
+			break
+		}
+
+		target := e.Target
+		if target == "" {
+			target = "-"
+		}
+
+		configKey := e.ConfigKey
+		if configKey == "" {
+			configKey = "not configurable"
+		}
+
+		fmt.Fprintf(tw, "  %s\t%s\tx%d\tfirst %s\t(%s)\n",
+			e.Operation,
+			target,
+			e.Count,
+			e.FirstSeen.Format("15:04:05"),
+			configKey,
+		)
+	}
+	tw.Flush()
+
+	if len(entries) > maxSummaryEntries {
+		fmt.Fprintf(w, "  ... and %d more (see ~/.srt/deny.log)\n", len(entries)-maxSummaryEntries)
+	}
+
+	// Always report suppressed violations so ignore rules can't hide everything silently
+	if len(suppressed) > 0 {
+		total := 0
+		for _, rc := range suppressed {
+			total += rc.Count
+		}
+
+		fmt.Fprintf(w, "[srt-go] %d violations suppressed by ignore rules\n", total)
+		for i, rc := range suppressed {
+			if i == maxSummaryIgnoreRules {
+				fmt.Fprintf(w, "  ... and %d more rules\n", len(suppressed)-maxSummaryIgnoreRules)
+				break
+			}
+			fmt.Fprintf(w, "  x%d  %s\n", rc.Count, rc.Rule)
+		}
+	}
+
+	// Counts above are incomplete when reports were dropped, so say so
+	if dropped > 0 {
+		fmt.Fprintf(w, "[srt-go] %d violation reports dropped, counts are incomplete\n", dropped)
+	}
+}
+
+// ConfigKeyForViolation returns the configuration key that would need to change
+// to allow the violation, or an empty string if it is not configurable
+func ConfigKeyForViolation(v Violation) string {
+	operation := strings.TrimSuffix(v.Operation, "*")
+
+	switch {
+	case strings.HasPrefix(operation, "file-read"):
+		return "filesystem.denyRead"
+	case operation == "file-write-unlink":
+		return "filesystem.allowUnlink"
+	case strings.HasPrefix(operation, "file-write"):
+		return "filesystem.allowWrite"
+	case operation == "network-outbound" && !strings.HasPrefix(v.Target, "/"):
+		return "network.allowedDomains"
+	case operation == "process-fork":
+		return "process.allowFork"
+	case strings.HasPrefix(operation, "sysctl-read"):
+		return "process.allowSysctlRead"
+	case strings.HasPrefix(operation, "mach-lookup"):
+		return "process.allowMachLookup"
+	case strings.HasPrefix(operation, "ipc-posix-shm"):
+		return "process.allowPosixShm"
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,126 @@
+package sandbox
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestViolationSummaryGroupsByOperationAndTarget(t *testing.T) {
+	base := time.Date(2025, 11, 3, 9, 0, 0, 0, time.UTC)
+	summary := NewViolationSummary()
+
+	summary.Add(Violation{Process: "node", Operation: "file-write-create", Category: CategoryFileWrite, Target: "/Users/dev/.npmrc", Timestamp: base.Add(2 * time.Second)})
+	summary.Add(Violation{Process: "npm", Operation: "file-write-create", Category: CategoryFileWrite, Target: "/Users/dev/.npmrc", Timestamp: base})
+	summary.Add(Violation{Process: "node", Operation: "file-write-create", Category: CategoryFileWrite, Target: "/Users/dev/.npmrc", Timestamp: base.Add(time.Second)})
+	summary.Add(Violation{Process: "cat", Operation: "file-read-data", Category: CategoryFileRead, Target: "/Users/dev/.ssh/id_rsa", Timestamp: base})
+
+	if got := summary.Total(); got != 4 {
+		t.Errorf("Total() = %d, want 4", got)
+	}
+
+	entries := summary.Entries()
+	if len(entries) != 2 {
+		t.Fatalf("Entries() returned %d entries, want 2", len(entries))
+	}
+
+	// Sorted by operation name
+	if entries[0].Operation != "file-read-data" {
+		t.Errorf("First entry operation = %q, want file-read-data", entries[0].Operation)
+	}
+
+	write := entries[1]
+	if write.Count != 3 {
+		t.Errorf("Count = %d, want 3", write.Count)
+	}
+	if !write.FirstSeen.Equal(base) {
+		t.Errorf("FirstSeen = %v, want %v", write.FirstSeen, base)
+	}
+	if len(write.Processes) != 2 {
+		t.Errorf("Processes = %v, want node and npm", write.Processes)
+	}
+	if write.ConfigKey != "filesystem.allowWrite" {
+		t.Errorf("ConfigKey = %q, want filesystem.allowWrite", write.ConfigKey)
+	}
+}
+
+func TestConfigKeyForViolation(t *testing.T) {
+	tests := []struct {
+		operation string
+		target    string
+		want      string
+	}{
+		{"file-read-data", "/Users/dev/.aws/credentials", "filesystem.denyRead"},
+		{"file-write-unlink", "/Users/dev/project/a", "filesystem.allowUnlink"},
+		{"file-write-create", "/Users/dev/project/a", "filesystem.allowWrite"},
+		{"network-outbound", "93.184.216.34:443", "network.allowedDomains"},
+		{"network-outbound", "/private/var/run/mDNSResponder", ""},
+		{"process-fork", "", "process.allowFork"},
+		{"sysctl-read", "kern.bootargs", "process.allowSysctlRead"},
+		{"mach-lookup", "com.apple.cfprefsd.daemon", "process.allowMachLookup"},
+		{"ipc-posix-shm-read-data", "apple.shm.notification_center", "process.allowPosixShm"},
+		{"iokit-open", "IOSurfaceRootUserClient", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.operation+" "+tt.target, func(t *testing.T) {
+			got := ConfigKeyForViolation(Violation{Operation: tt.operation, Target: tt.target})
+			if got != tt.want {
+				t.Errorf("ConfigKeyForViolation() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestViolationSummaryPrint(t *testing.T) {
+	var buf bytes.Buffer
+
+	// Empty summaries print nothing
+	NewViolationSummary().Print(&buf)
+	if buf.Len() != 0 {
+		t.Errorf("Empty summary printed %q", buf.String())
+	}
+
+	summary := NewViolationSummary()
+	for i := 0; i < maxSummaryEntries+5; i++ {
+		summary.Add(Violation{
+			Operation: "file-write-create",
+			Target:    fmt.Sprintf("/tmp/file-%02d", i),
+			Timestamp: time.Now(),
+		})
+	}
+	summary.Print(&buf)
+
+	out := buf.String()
+	if !strings.Contains(out, "25 total, 25 unique") {
+		t.Errorf("Summary header missing counts:\n%s", out)
+	}
+	if !strings.Contains(out, "and 5 more") {
+		t.Errorf("Summary should truncate long output:\n%s", out)
+	}
+	if !strings.Contains(out, "filesystem.allowWrite") {
+		t.Errorf("Summary should name the config key:\n%s", out)
+	}
+}
+
+func TestViolationSummaryCountsRepeats(t *testing.T) {
+	summary := NewViolationSummary()
+	summary.Add(Violation{Operation: "file-read-data", Target: "/etc/shadow"})
+	summary.Add(Violation{Operation: "file-read-data", Target: "/etc/shadow", Count: 9})
+	summary.SetDropped(3)
+
+	if got := summary.Total(); got != 10 {
+		t.Errorf("Total() = %d, want 10", got)
+	}
+	if got := summary.Entries()[0].Count; got != 10 {
+		t.Errorf("Entry count = %d, want 10", got)
+	}
+
+	var buf bytes.Buffer
+	summary.Print(&buf)
+	if !strings.Contains(buf.String(), "3 violation reports dropped") {
+		t.Errorf("Summary should report drops:\n%s", buf.String())
+	}
+}
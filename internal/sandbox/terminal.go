@@ -0,0 +1,49 @@
+package sandbox
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"unsafe"
+)
+
+// foregroundTerminal returns the descriptor of the terminal on stdin when
+// srt's process group is its foreground group, so a command run in its own
+// group can be given the terminal. It reports false for pipes, files and
+// when srt itself runs in the background.
+func foregroundTerminal() (int, bool) {
+	fd := int(os.Stdin.Fd())
+	pgrp, err := tcgetpgrp(fd)
+	if err != nil || pgrp != syscall.Getpgrp() {
+		return 0, false
+	}
+	return fd, true
+}
+
+// reclaimTerminal makes srt's process group the terminal's foreground group
+// again once the command has finished with it. SIGTTOU is ignored meanwhile,
+// as srt is in the background until the call succeeds.
+func reclaimTerminal(fd int) error {
+	signal.Ignore(syscall.SIGTTOU)
+	defer signal.Reset(syscall.SIGTTOU)
+	return tcsetpgrp(fd, syscall.Getpgrp())
+}
+
+// tcgetpgrp returns the terminal's foreground process group, failing when
+// fd isn't a terminal
+func tcgetpgrp(fd int) (int, error) {
+	var pgrp int32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(syscall.TIOCGPGRP), uintptr(unsafe.Pointer(&pgrp))); errno != 0 {
+		return 0, errno
+	}
+	return int(pgrp), nil
+}
+
+// tcsetpgrp makes pgrp the terminal's foreground process group
+func tcsetpgrp(fd, pgrp int) error {
+	p := int32(pgrp)
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(syscall.TIOCSPGRP), uintptr(unsafe.Pointer(&p))); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package sandbox
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sammcj/srt-go/internal/config"
+	"github.com/sammcj/srt-go/internal/network"
+)
+
+// newUpstream creates the upstream proxy the srt proxies connect through,
+// reading its credentials from the configured variable or file
+func newUpstream(cfg config.UpstreamConfig) (*network.Upstream, error) {
+	username, password, err := upstreamCredentials(cfg)
+	if err != nil {
+		return nil, err
+	}
+	upstream, err := network.NewUpstream(cfg.URL, username, password, cfg.NoProxy)
+	if err != nil {
+		return nil, err
+	}
+	upstream.SetRemoteDNS(cfg.RemoteDNS)
+	return upstream, nil
+}
+
+// upstreamCredentials returns the "user:password" credentials for the
+// upstream proxy, or empty strings when none are configured
+func upstreamCredentials(cfg config.UpstreamConfig) (string, string, error) {
+	if cfg.CredentialsEnv == "" && cfg.CredentialsFile == "" {
+		return "", "", nil
+	}
+	credentials, err := readSecret(cfg.CredentialsEnv, cfg.CredentialsFile)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read upstream proxy credentials: %w", err)
+	}
+
+	// Never include the credentials in errors
+	username, password, ok := strings.Cut(credentials, ":")
+	if !ok || username == "" {
+		return "", "", fmt.Errorf("upstream proxy credentials must be \"user:password\"")
+	}
+	return username, password, nil
+}
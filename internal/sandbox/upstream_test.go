@@ -0,0 +1,53 @@
+package sandbox
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sammcj/srt-go/internal/config"
+)
+
+func TestUpstreamCredentials(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "proxy-auth")
+	if err := os.WriteFile(file, []byte("alice:s3cret:with-colon\n"), 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	badFile := filepath.Join(dir, "bad-auth")
+	if err := os.WriteFile(badFile, []byte("s3cret"), 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	t.Setenv("SRT_TEST_PROXY_AUTH", "bob:hunter2")
+
+	tests := []struct {
+		name         string
+		cfg          config.UpstreamConfig
+		wantUser     string
+		wantPassword string
+		wantErr      bool
+	}{
+		{name: "none", cfg: config.UpstreamConfig{}},
+		{name: "environment", cfg: config.UpstreamConfig{CredentialsEnv: "SRT_TEST_PROXY_AUTH"}, wantUser: "bob", wantPassword: "hunter2"},
+		{name: "file", cfg: config.UpstreamConfig{CredentialsFile: file}, wantUser: "alice", wantPassword: "s3cret:with-colon"},
+		{name: "unset variable", cfg: config.UpstreamConfig{CredentialsEnv: "SRT_TEST_PROXY_AUTH_UNSET"}, wantErr: true},
+		{name: "missing file", cfg: config.UpstreamConfig{CredentialsFile: filepath.Join(dir, "missing")}, wantErr: true},
+		{name: "no user", cfg: config.UpstreamConfig{CredentialsFile: badFile}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, password, err := upstreamCredentials(tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("upstreamCredentials() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && strings.Contains(err.Error(), "s3cret") {
+				t.Errorf("Error %q shows the password", err)
+			}
+			if user != tt.wantUser || password != tt.wantPassword {
+				t.Errorf("upstreamCredentials() = %q, %q, want %q, %q", user, password, tt.wantUser, tt.wantPassword)
+			}
+		})
+	}
+}
@@ -0,0 +1,381 @@
+package sandbox
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sammcj/srt-go/internal/config"
+)
+
+// Output formats for WriteLogRecords
+const (
+	LogFormatTable = "table"
+	LogFormatJSON  = "json"
+)
+
+// logFollowInterval is how often FollowViolationLog checks the log for new records
+const logFollowInterval = 500 * time.Millisecond
+
+// LogQuery filters records read from the violation log. Zero values match everything.
+// Process and Operation accept globs, Operation also matches a category, and
+// Target uses the same anchored path and glob semantics as ignore rules.
+type LogQuery struct {
+	Since     time.Time
+	Until     time.Time
+	RunID     string
+	Process   string
+	Operation string
+	Target    string
+
+	IncludeRuns bool // Include run start and end records, which only RunID and time filter
+}
+
+// logFilter is a compiled LogQuery
+type logFilter struct {
+	query LogQuery
+	rule  compiledIgnoreRule
+}
+
+func compileLogQuery(q LogQuery) (*logFilter, error) {
+	rule, err := compileIgnoreRule(config.IgnoreRule{
+		Process:   q.Process,
+		Operation: q.Operation,
+		Target:    q.Target,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid log query: %w", err)
+	}
+
+	return &logFilter{query: q, rule: rule}, nil
+}
+
+func (f *logFilter) matches(r LogRecord) bool {
+	if !f.query.Since.IsZero() && r.Time.Before(f.query.Since) {
+		return false
+	}
+	if !f.query.Until.IsZero() && r.Time.After(f.query.Until) {
+		return false
+	}
+	if f.query.RunID != "" && r.RunID != f.query.RunID {
+		return false
+	}
+	if r.Kind != "" {
+		return f.query.IncludeRuns
+	}
+
+	return f.rule.matches(Violation{
+		Process:   r.Process,
+		Operation: r.Operation,
+		Category:  r.Category,
+		Target:    r.Target,
+	})
+}
+
+// ViolationLogFiles returns the rotated backups and the current violation log in
+// dir, oldest first. Files that do not exist are omitted.
+func ViolationLogFiles(dir string) ([]string, error) {
+	// lumberjack names backups deny-<timestamp>.log, which sort chronologically
+	backups, err := filepath.Glob(filepath.Join(dir, "deny-*.log"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list rotated logs: %w", err)
+	}
+	sort.Strings(backups)
+
+	files := backups
+	current := filepath.Join(dir, violationLogName)
+	if _, err := os.Stat(current); err == nil {
+		files = append(files, current)
+	}
+
+	return files, nil
+}
+
+// ReadViolationLog reads the rotated and current violation logs in dir and
+// returns the records matching q, oldest first
+func ReadViolationLog(dir string, q LogQuery) ([]LogRecord, error) {
+	filter, err := compileLogQuery(q)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := ViolationLogFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []LogRecord
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open violation log: %w", err)
+		}
+
+		err = scanLogRecords(f, func(r LogRecord) {
+			if filter.matches(r) {
+				records = append(records, r)
+			}
+		})
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", file, err)
+		}
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Time.Before(records[j].Time)
+	})
+
+	return records, nil
+}
+
+// FollowViolationLog calls fn for each record matching q appended to the current
+// violation log in dir until ctx is cancelled. Rotation is detected and the new
+// file is read from the start.
+func FollowViolationLog(ctx context.Context, dir string, q LogQuery, fn func(LogRecord)) error {
+	filter, err := compileLogQuery(q)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, violationLogName)
+
+	var (
+		file    *os.File
+		offset  int64
+		partial []byte
+		started bool
+	)
+	defer func() {
+		if file != nil {
+			file.Close()
+		}
+	}()
+
+	ticker := time.NewTicker(logFollowInterval)
+	defer ticker.Stop()
+
+	for {
+		info, statErr := os.Stat(path)
+
+		// Reopen when the file appears, is replaced by rotation or is truncated
+		if statErr == nil && file != nil {
+			current, err := file.Stat()
+			if err != nil || !os.SameFile(current, info) || info.Size() < offset {
+				file.Close()
+				file = nil
+			}
+		}
+
+		if statErr == nil && file == nil {
+			f, err := os.Open(path)
+			if err == nil {
+				file = f
+				offset = 0
+				partial = nil
+
+				// Skip records already in the log at startup, like tail -f. Files
+				// created later by rotation are read from the start.
+				if !started {
+					offset, _ = file.Seek(0, io.SeekEnd)
+				}
+			}
+		}
+		started = true
+
+		if file != nil {
+			data, err := io.ReadAll(file)
+			if err != nil {
+				return fmt.Errorf("failed to read violation log: %w", err)
+			}
+			offset += int64(len(data))
+
+			partial = append(partial, data...)
+			for {
+				idx := bytes.IndexByte(partial, '\n')
+				if idx < 0 {
+					break
+				}
+				if r, ok := parseLogRecord(partial[:idx]); ok && filter.matches(r) {
+					fn(r)
+				}
+				partial = partial[idx+1:]
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// WriteLogRecords writes records to w as an aligned table or as JSON lines
+func WriteLogRecords(w io.Writer, records []LogRecord, format string) error {
+	switch format {
+	case LogFormatJSON:
+		enc := json.NewEncoder(w)
+		for _, r := range records {
+			if err := enc.Encode(r); err != nil {
+				return fmt.Errorf("failed to encode log record: %w", err)
+			}
+		}
+		return nil
+	case LogFormatTable, "":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "TIME\tRUN\tMODE\tPROCESS\tOPERATION\tTARGET")
+		for _, r := range records {
+			operation, target := r.Operation, r.Target
+			switch r.Kind {
+			case RecordRunStart:
+				operation, target = r.Kind, r.Command
+			case RecordRunEnd:
+				operation, target = r.Kind, "did not start"
+				if r.ExitCode != nil {
+					target = fmt.Sprintf("exit %d", *r.ExitCode)
+				}
+			}
+
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+				r.Time.Local().Format("2006-01-02 15:04:05"),
+				r.RunID,
+				r.Mode,
+				r.Process,
+				operation,
+				target,
+			)
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unknown log format %q (must be %q or %q)", format, LogFormatTable, LogFormatJSON)
+	}
+}
+
+func scanLogRecords(r io.Reader, fn func(LogRecord)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		if record, ok := parseLogRecord(scanner.Bytes()); ok {
+			fn(record)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// parseLogRecord parses a JSON log line, falling back to the text format written
+// by earlier versions
+func parseLogRecord(line []byte) (LogRecord, bool) {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return LogRecord{}, false
+	}
+
+	if line[0] == '{' {
+		var record LogRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return LogRecord{}, false
+		}
+		return record, true
+	}
+
+	return parseLegacyLogLine(string(line))
+}
+
+// legacyLogKeys are the fields of the text log format, in the order they were written
+var legacyLogKeys = []string{"mode", "process", "pid", "operation", "category", "target", "time"}
+
+// parseLegacyLogLine parses "<date> <time> VIOLATION key=value ..." lines
+func parseLegacyLogLine(line string) (LogRecord, bool) {
+	_, rest, ok := strings.Cut(line, " VIOLATION ")
+	if !ok {
+		return LogRecord{}, false
+	}
+
+	// Values may contain spaces, so split on the known keys rather than on
+	// whitespace. Keys are written in order and the target, the only free
+	// text, comes just before the time: earlier keys are found ahead of the
+	// first " target=", and the time at the last " time=".
+	type field struct {
+		key   string
+		start int
+	}
+	line = " " + rest
+	targetAt := strings.Index(line, " target=")
+	limit := len(line)
+	if targetAt >= 0 {
+		limit = targetAt
+	}
+
+	var fields []field
+	pos := 0
+	for _, key := range legacyLogKeys {
+		idx := -1
+		switch key {
+		case "target":
+			idx = targetAt
+		case "time":
+			idx = strings.LastIndex(line, " time=")
+		default:
+			if pos <= limit {
+				if i := strings.Index(line[pos:limit], " "+key+"="); i >= 0 {
+					idx = pos + i
+				}
+			}
+		}
+		if idx < pos {
+			continue
+		}
+		fields = append(fields, field{key: key, start: idx})
+		pos = idx + 1
+	}
+
+	values := make(map[string]string)
+	for i, f := range fields {
+		end := len(rest)
+		if i+1 < len(fields) {
+			end = fields[i+1].start - 1
+		}
+		values[f.key] = rest[f.start+len(f.key)+1 : end]
+	}
+
+	record := LogRecord{
+		Mode:      values["mode"],
+		Process:   values["process"],
+		Operation: values["operation"],
+		Category:  values["category"],
+		Target:    values["target"],
+	}
+	if record.Mode == "" {
+		record.Mode = "enforce"
+	}
+	if record.Category == "" && record.Operation != "" {
+		record.Category = OperationCategory(record.Operation)
+	}
+	if unquoted, err := strconv.Unquote(record.Target); err == nil {
+		record.Target = unquoted
+	}
+	if pid, err := strconv.Atoi(values["pid"]); err == nil {
+		record.PID = pid
+	}
+
+	ts, err := time.ParseInLocation("2006-01-02 15:04:05", values["time"], time.Local)
+	if err != nil {
+		return LogRecord{}, false
+	}
+	record.Time = ts
+
+	return record, true
+}
@@ -0,0 +1,231 @@
+package sandbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeLogFile(t *testing.T, path string, lines ...string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+}
+
+func logLine(t *testing.T, r LogRecord) string {
+	t.Helper()
+	data, err := json.Marshal(r)
+	if err != nil {
+		t.Fatalf("Failed to marshal record: %v", err)
+	}
+	return string(data)
+}
+
+func TestReadViolationLog(t *testing.T) {
+	dir := t.TempDir()
+	base := time.Date(2025, 1, 15, 22, 0, 0, 0, time.Local)
+
+	// Rotated backup with a line from the old text format
+	writeLogFile(t, filepath.Join(dir, "deny-2025-01-15T23-00-00.000.log"),
+		"2025/01/15 22:00:00 VIOLATION process=npm operation=file-read-data target=/Users/dev/.ssh/id_rsa time=2025-01-15 22:00:00",
+		logLine(t, LogRecord{Time: base.Add(time.Minute), RunID: "run-a", Mode: "enforce", Process: "node", Operation: "file-write-create", Category: CategoryFileWrite, Target: "/Users/dev/.npmrc"}),
+	)
+	writeLogFile(t, filepath.Join(dir, violationLogName),
+		logLine(t, LogRecord{Time: base.Add(2 * time.Hour), RunID: "run-b", Mode: "audit", Process: "python3.12", Operation: "file-read-data", Category: CategoryFileRead, Target: "/Users/dev/.aws/config"}),
+		"not a log line",
+		logLine(t, LogRecord{Time: base.Add(3 * time.Hour), RunID: "run-b", Mode: "enforce", Process: "srt-proxy", Operation: "network-outbound", Category: CategoryNetwork, Target: "evil.example.com"}),
+	)
+
+	tests := []struct {
+		name    string
+		query   LogQuery
+		targets []string
+	}{
+		{
+			name:    "all records oldest first",
+			query:   LogQuery{},
+			targets: []string{"/Users/dev/.ssh/id_rsa", "/Users/dev/.npmrc", "/Users/dev/.aws/config", "evil.example.com"},
+		},
+		{
+			name:    "time range",
+			query:   LogQuery{Since: base.Add(30 * time.Second), Until: base.Add(2 * time.Hour)},
+			targets: []string{"/Users/dev/.npmrc", "/Users/dev/.aws/config"},
+		},
+		{
+			name:    "run id",
+			query:   LogQuery{RunID: "run-b"},
+			targets: []string{"/Users/dev/.aws/config", "evil.example.com"},
+		},
+		{
+			name:    "process glob",
+			query:   LogQuery{Process: "python3*"},
+			targets: []string{"/Users/dev/.aws/config"},
+		},
+		{
+			name:    "operation category",
+			query:   LogQuery{Operation: CategoryFileRead},
+			targets: []string{"/Users/dev/.ssh/id_rsa", "/Users/dev/.aws/config"},
+		},
+		{
+			name:    "target pattern",
+			query:   LogQuery{Target: "/Users/dev/.*/**"},
+			targets: []string{"/Users/dev/.ssh/id_rsa", "/Users/dev/.aws/config"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := ReadViolationLog(dir, tt.query)
+			if err != nil {
+				t.Fatalf("ReadViolationLog() error = %v", err)
+			}
+
+			var targets []string
+			for _, r := range records {
+				targets = append(targets, r.Target)
+			}
+			if strings.Join(targets, ",") != strings.Join(tt.targets, ",") {
+				t.Errorf("targets = %v, want %v", targets, tt.targets)
+			}
+		})
+	}
+}
+
+func TestParseLegacyLogLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want LogRecord
+	}{
+		{
+			line: "2025/01/15 14:32:01 VIOLATION process=Code Helper (Plugin) operation=file-read-data target=/Users/dev/My Docs/a.txt time=2025-01-15 14:32:01",
+			want: LogRecord{Mode: "enforce", Process: "Code Helper (Plugin)", Operation: "file-read-data", Category: CategoryFileRead, Target: "/Users/dev/My Docs/a.txt"},
+		},
+		{
+			line: `2025/01/15 14:32:01 VIOLATION mode=audit process=git pid=42 operation=mach-lookup category=mach target="com.apple.lsd" time=2025-01-15 14:32:01`,
+			want: LogRecord{Mode: "audit", Process: "git", PID: 42, Operation: "mach-lookup", Category: CategoryMach, Target: "com.apple.lsd"},
+		},
+		{
+			line: "2025/01/15 14:32:01 VIOLATION process=node operation=file-write-create target=/tmp/a op=x target=b category=c time=d time=2025-01-15 14:32:01",
+			want: LogRecord{Mode: "enforce", Process: "node", Operation: "file-write-create", Category: CategoryFileWrite, Target: "/tmp/a op=x target=b category=c time=d"},
+		},
+	}
+
+	for _, tt := range tests {
+		got, ok := parseLegacyLogLine(tt.line)
+		if !ok {
+			t.Fatalf("parseLegacyLogLine(%q) failed", tt.line)
+		}
+		tt.want.Time = time.Date(2025, 1, 15, 14, 32, 1, 0, time.Local)
+		if !got.Time.Equal(tt.want.Time) {
+			t.Errorf("Time = %v, want %v", got.Time, tt.want.Time)
+		}
+		got.Time = tt.want.Time
+		if got != tt.want {
+			t.Errorf("parseLegacyLogLine() = %+v, want %+v", got, tt.want)
+		}
+	}
+}
+
+func TestWriteLogRecords(t *testing.T) {
+	records := []LogRecord{{Time: time.Now(), RunID: "run-a", Mode: "enforce", Process: "node", Operation: "file-read-data", Target: "/etc/hosts"}}
+
+	var table bytes.Buffer
+	if err := WriteLogRecords(&table, records, LogFormatTable); err != nil {
+		t.Fatalf("WriteLogRecords(table) error = %v", err)
+	}
+	if !strings.Contains(table.String(), "PROCESS") || !strings.Contains(table.String(), "/etc/hosts") {
+		t.Errorf("Unexpected table output:\n%s", table.String())
+	}
+
+	var out bytes.Buffer
+	if err := WriteLogRecords(&out, records, LogFormatJSON); err != nil {
+		t.Fatalf("WriteLogRecords(json) error = %v", err)
+	}
+	var decoded LogRecord
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil || decoded.RunID != "run-a" {
+		t.Errorf("JSON output did not round trip: %v %q", err, out.String())
+	}
+
+	if err := WriteLogRecords(&out, records, "yaml"); err == nil {
+		t.Error("Expected error for unknown format")
+	}
+}
+
+func TestReadViolationLogRunRecords(t *testing.T) {
+	dir := t.TempDir()
+	exitCode := 1
+	writeLogFile(t, filepath.Join(dir, violationLogName),
+		logLine(t, LogRecord{Time: time.Now(), Kind: RecordRunStart, RunID: "run-a", Mode: "enforce", Process: "npm", Command: "npm install"}),
+		logLine(t, LogRecord{Time: time.Now(), RunID: "run-a", Mode: "enforce", Process: "node", Operation: "file-read-data", Target: "/etc/hosts"}),
+		logLine(t, LogRecord{Time: time.Now(), Kind: RecordRunEnd, RunID: "run-a", Mode: "enforce", Process: "npm", ExitCode: &exitCode}),
+	)
+
+	violations, err := ReadViolationLog(dir, LogQuery{RunID: "run-a"})
+	if err != nil || len(violations) != 1 {
+		t.Fatalf("ReadViolationLog() = %d records, %v, want only the violation", len(violations), err)
+	}
+
+	all, err := ReadViolationLog(dir, LogQuery{RunID: "run-a", IncludeRuns: true})
+	if err != nil || len(all) != 3 {
+		t.Fatalf("ReadViolationLog(IncludeRuns) = %d records, %v, want 3", len(all), err)
+	}
+
+	var table bytes.Buffer
+	if err := WriteLogRecords(&table, all, LogFormatTable); err != nil {
+		t.Fatalf("WriteLogRecords() error = %v", err)
+	}
+	for _, want := range []string{"run-start", "npm install", "run-end", "exit 1"} {
+		if !strings.Contains(table.String(), want) {
+			t.Errorf("Table missing %q:\n%s", want, table.String())
+		}
+	}
+}
+
+func TestFollowViolationLog(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, violationLogName)
+	writeLogFile(t, path, logLine(t, LogRecord{Time: time.Now(), Process: "old", Operation: "file-read-data"}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	got := make(chan LogRecord, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- FollowViolationLog(ctx, dir, LogQuery{Process: "new*"}, func(r LogRecord) { got <- r })
+	}()
+
+	// Let the follower open the file and seek to its end
+	time.Sleep(2 * logFollowInterval)
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open log: %v", err)
+	}
+	f.WriteString(logLine(t, LogRecord{Time: time.Now(), Process: "skipped", Operation: "file-read-data"}) + "\n")
+	f.WriteString(logLine(t, LogRecord{Time: time.Now(), Process: "new-proc", Operation: "file-read-data"}) + "\n")
+	f.Close()
+
+	select {
+	case r := <-got:
+		if r.Process != "new-proc" {
+			t.Errorf("Followed record process = %q, want new-proc", r.Process)
+		}
+	case <-ctx.Done():
+		t.Fatal("Timed out waiting for followed record")
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("FollowViolationLog() error = %v", err)
+	}
+	if len(got) != 0 {
+		t.Errorf("Unexpected extra records: %d", len(got))
+	}
+}
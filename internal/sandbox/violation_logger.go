@@ -1,62 +1,206 @@
 package sandbox
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"gopkg.in/natefinch/lumberjack.v2"
 )
 
-// ViolationLogger handles logging violations to a rotating file
+// violationLogName is the file name of the current violation log within the log directory
+const violationLogName = "deny.log"
+
+// Files beside the violation log holding the hash chain head and the write lock
+const (
+	chainHeadName = "deny.log.head"
+	chainLockName = "deny.log.lock"
+)
+
+// logKeyName is the file name of the key the hash chain is computed with. It
+// lives in the user config directory rather than beside the log, and
+// sandboxed commands can't read it.
+const logKeyName = "log.key"
+
+// logKeySize is the length in bytes of a new chain key
+const logKeySize = 32
+
+// Record kinds. Violation records leave Kind empty.
+const (
+	RecordRunStart = "run-start"
+	RecordRunEnd   = "run-end"
+)
+
+// LogRecord is a single entry in the violation log. Records written by the
+// file logger are hash chained: Hash is an HMAC of the record including
+// PrevHash, the Hash of the record before it.
+type LogRecord struct {
+	Time      time.Time `json:"time"`
+	Kind      string    `json:"kind,omitempty"` // Empty for violations, or RecordRunStart/RecordRunEnd
+	RunID     string    `json:"runId,omitempty"`
+	Mode      string    `json:"mode"` // "enforce" or "audit", or "learn" on run records as learn runs log no violations
+	Process   string    `json:"process"`
+	PID       int       `json:"pid,omitempty"`
+	Operation string    `json:"operation"`
+	Category  string    `json:"category,omitempty"`
+	Target    string    `json:"target,omitempty"`
+	Count     int       `json:"count,omitempty"`    // Repeats folded into this record, 0 for a single report
+	Command   string    `json:"command,omitempty"`  // Run start records only
+	ExitCode  *int      `json:"exitCode,omitempty"` // Run end records, nil if the command did not start
+	Seq       uint64    `json:"seq,omitempty"`
+	PrevHash  string    `json:"prevHash,omitempty"`
+	Hash      string    `json:"hash,omitempty"`
+}
+
+// ChainHead is the last record in the hash chain, persisted beside the log so
+// truncation can be detected
+type ChainHead struct {
+	Seq  uint64    `json:"seq"`
+	Hash string    `json:"hash"`
+	Time time.Time `json:"time"`
+}
+
+// ViolationLogger is the sink that logs violations to a rotating file. Every
+// record extends a hash chain shared by all runs writing to the directory.
 type ViolationLogger struct {
-	logger *log.Logger
-	file   *lumberjack.Logger
+	mu       sync.Mutex
+	file     *lumberjack.Logger
+	headPath string
+	lockPath string
+	keyPath  string
+	key      []byte
+}
+
+// ViolationLogDir returns the directory holding the violation logs (~/.srt)
+func ViolationLogDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get home directory: %w", err)
+	}
+
+	return filepath.Join(home, ".srt"), nil
+}
+
+// ViolationLogKeyPath returns the path of the key the violation log is
+// chained with (srt/log.key in the user config directory)
+func ViolationLogKeyPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get config directory: %w", err)
+	}
+
+	return filepath.Join(dir, "srt", logKeyName), nil
 }
 
 // NewViolationLogger creates a new violation logger
 func NewViolationLogger() (*ViolationLogger, error) {
 	// Determine log file path
-	home, err := os.UserHomeDir()
+	logDir, err := ViolationLogDir()
+	if err != nil {
+		return nil, err
+	}
+
+	keyPath, err := ViolationLogKeyPath()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get home directory: %w", err)
+		return nil, err
 	}
 
-	logDir := filepath.Join(home, ".srt")
-	logPath := filepath.Join(logDir, "deny.log")
+	return newViolationLogger(logDir, keyPath)
+}
 
+func newViolationLogger(logDir, keyPath string) (*ViolationLogger, error) {
 	// Ensure directory exists
 	if err := os.MkdirAll(logDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create log directory: %w", err)
 	}
 
+	key, err := loadOrCreateLogKey(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
 	// Configure rotating file logger
 	rotatingFile := &lumberjack.Logger{
-		Filename:   logPath,
+		Filename:   filepath.Join(logDir, violationLogName),
 		MaxSize:    512, // kilobytes (512KB as requested)
 		MaxBackups: 3,   // keep 3 old log files
 		MaxAge:     0,   // don't delete based on age
 		Compress:   false,
 	}
 
-	// Create logger with the rotating file as output
-	logger := log.New(rotatingFile, "", log.LstdFlags)
-
 	return &ViolationLogger{
-		logger: logger,
-		file:   rotatingFile,
+		file:     rotatingFile,
+		headPath: filepath.Join(logDir, chainHeadName),
+		lockPath: filepath.Join(logDir, chainLockName),
+		keyPath:  keyPath,
+		key:      key,
 	}, nil
 }
 
-// LogViolation logs a violation to the file
-func (vl *ViolationLogger) LogViolation(v Violation) {
-	vl.logger.Printf("VIOLATION process=%s operation=%s target=%s time=%s",
-		v.Process,
-		v.Operation,
-		v.Target,
-		v.Timestamp.Format("2006-01-02 15:04:05"),
-	)
+// KeyPath returns the path of the chain key, which sandboxed commands must not read
+func (vl *ViolationLogger) KeyPath() string {
+	return vl.keyPath
+}
+
+// Write appends a record to the file as a JSON line
+func (vl *ViolationLogger) Write(r LogRecord) error {
+	_, err := vl.Append(r)
+	return err
+}
+
+// Append chains a record to the last one written by any run, appends it to the
+// file and persists the new chain head. It returns the chained record.
+func (vl *ViolationLogger) Append(r LogRecord) (LogRecord, error) {
+	vl.mu.Lock()
+	defer vl.mu.Unlock()
+
+	// Concurrent runs share the chain, so serialise appends across processes
+	lock, err := os.OpenFile(vl.lockPath, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return r, fmt.Errorf("failed to open log lock: %w", err)
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return r, fmt.Errorf("failed to lock violation log: %w", err)
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	head, err := ReadChainHead(vl.headPath)
+	if err != nil {
+		return r, err
+	}
+
+	r.Seq = head.Seq + 1
+	r.PrevHash = head.Hash
+	if r.Hash, err = recordHash(r, vl.key); err != nil {
+		return r, err
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return r, err
+	}
+
+	// Another run may have rotated the file since our last write, closing
+	// makes lumberjack reopen (and rotate if needed) the current file
+	if err := vl.file.Close(); err != nil {
+		return r, err
+	}
+	if _, err := vl.file.Write(append(data, '\n')); err != nil {
+		return r, err
+	}
+
+	return r, writeChainHead(vl.headPath, ChainHead{Seq: r.Seq, Hash: r.Hash, Time: r.Time})
 }
 
 // Close closes the log file
@@ -66,3 +210,133 @@ func (vl *ViolationLogger) Close() error {
 	}
 	return nil
 }
+
+// recordHash returns the hex HMAC-SHA256 of the record's JSON encoding without its Hash
+func recordHash(r LogRecord, key []byte) (string, error) {
+	r.Hash = ""
+	data, err := json.Marshal(r)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode log record: %w", err)
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// loadOrCreateLogKey reads the chain key, creating it on first use
+func loadOrCreateLogKey(path string) ([]byte, error) {
+	key, err := readLogKey(path)
+	if !errors.Is(err, os.ErrNotExist) {
+		return key, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create log key directory: %w", err)
+	}
+
+	key = make([]byte, logKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate log key: %w", err)
+	}
+
+	// Written aside and linked into place, so concurrent first runs agree on
+	// one key and never read a half written one
+	tmp, err := os.CreateTemp(filepath.Dir(path), logKeyName+".*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("failed to write log key: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.WriteString(hex.EncodeToString(key) + "\n")
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write log key: %w", err)
+	}
+
+	if err := os.Link(tmp.Name(), path); errors.Is(err, os.ErrExist) {
+		return readLogKey(path)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to write log key: %w", err)
+	}
+
+	return key, nil
+}
+
+// readLogKey reads the chain key at path
+func readLogKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read log key: %w", err)
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) < logKeySize {
+		return nil, fmt.Errorf("invalid log key in %s", path)
+	}
+
+	return key, nil
+}
+
+// ReadChainHead reads a persisted chain head. A missing file is an empty chain.
+func ReadChainHead(path string) (ChainHead, error) {
+	var head ChainHead
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return head, nil
+	}
+	if err != nil {
+		return head, fmt.Errorf("failed to read chain head: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &head); err != nil {
+		return head, fmt.Errorf("failed to parse chain head %s: %w", path, err)
+	}
+
+	return head, nil
+}
+
+// writeChainHead replaces the head file atomically, so a crash can't leave it half written
+func writeChainHead(path string, head ChainHead) error {
+	data, err := json.Marshal(head)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write chain head: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write chain head: %w", err)
+	}
+
+	return nil
+}
+
+func newLogRecord(runID string, v Violation) LogRecord {
+	mode := "enforce"
+	if v.Audit {
+		mode = "audit"
+	}
+
+	ts := v.Timestamp
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+
+	return LogRecord{
+		Time:      ts,
+		RunID:     runID,
+		Mode:      mode,
+		Process:   v.Process,
+		PID:       v.PID,
+		Operation: v.Operation,
+		Category:  v.Category,
+		Target:    v.Target,
+		Count:     v.Count,
+	}
+}
@@ -0,0 +1,180 @@
+package sandbox
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Operation categories reported for parsed sandbox messages
+const (
+	CategoryFileRead  = "file-read"
+	CategoryFileWrite = "file-write"
+	CategoryFile      = "file"
+	CategoryNetwork   = "network"
+	CategoryMach      = "mach"
+	CategoryProcess   = "process"
+	CategorySysctl    = "sysctl"
+	CategoryIOKit     = "iokit"
+	CategoryIPC       = "ipc"
+	CategorySignal    = "signal"
+	CategoryOther     = "other"
+)
+
+// sandboxMessagePattern matches "Sandbox: proc(pid) deny(n) operation target".
+// The process name is matched greedily so names containing spaces or parentheses
+// still resolve to the final "(pid)" group before the action.
+var sandboxMessagePattern = regexp.MustCompile(
+	`^Sandbox:\s+(.+)\((\d+)\)\s+(deny|allow)\((\d+)\)\s+(\S+)(?:\s+(.*))?$`,
+)
+
+// runTagPrefix starts the message attached to profile denials, followed by the run ID
+const runTagPrefix = "srt:"
+
+// runTagPattern matches a run tag as a separate word anywhere in a sandbox message
+var runTagPattern = regexp.MustCompile(`(?:^|\s)` + runTagPrefix + `([0-9a-f]+)(?:\s|$)`)
+
+// logTimestampLayout is the timestamp format used by `log stream --style ndjson`
+const logTimestampLayout = "2006-01-02 15:04:05.999999-0700"
+
+// SandboxMessage is a parsed sandbox kernel message
+type SandboxMessage struct {
+	Process   string
+	PID       int
+	Action    string // "deny" or "allow"
+	Count     int
+	Operation string
+	Category  string
+	Target    string
+	RunID     string // From the profile's run tag, empty for untagged messages
+}
+
+// RunTag returns the message attached to a run's profile denials
+func RunTag(runID string) string {
+	return runTagPrefix + runID
+}
+
+// ParseSandboxMessage parses a message in the
+// "Sandbox: proc(pid) deny(n) operation target" format, removing the run tag
+// from the target. Returns false if the message is not a sandbox report.
+func ParseSandboxMessage(msg string) (SandboxMessage, bool) {
+	msg = strings.TrimSpace(msg)
+
+	// Some log styles include the message on several lines, only the first is relevant
+	if idx := strings.IndexByte(msg, '\n'); idx != -1 {
+		msg = strings.TrimSpace(msg[:idx])
+	}
+
+	var runID string
+	if m := runTagPattern.FindStringSubmatchIndex(msg); m != nil {
+		runID = msg[m[2]:m[3]]
+		msg = strings.TrimSpace(msg[:m[0]] + " " + msg[m[1]:])
+	}
+
+	m := sandboxMessagePattern.FindStringSubmatch(msg)
+	if m == nil {
+		return SandboxMessage{}, false
+	}
+
+	pid, err := strconv.Atoi(m[2])
+	if err != nil {
+		return SandboxMessage{}, false
+	}
+
+	count, err := strconv.Atoi(m[4])
+	if err != nil {
+		return SandboxMessage{}, false
+	}
+
+	return SandboxMessage{
+		Process:   strings.TrimSpace(m[1]),
+		PID:       pid,
+		Action:    m[3],
+		Count:     count,
+		Operation: m[5],
+		Category:  OperationCategory(m[5]),
+		Target:    strings.TrimSpace(m[6]),
+		RunID:     runID,
+	}, true
+}
+
+// OperationCategory returns the category for a Seatbelt operation name,
+// e.g. "file-write-unlink" is "file-write" and "mach-lookup" is "mach"
+func OperationCategory(operation string) string {
+	operation = strings.TrimSuffix(operation, "*")
+
+	switch {
+	case strings.HasPrefix(operation, "file-read"):
+		return CategoryFileRead
+	case strings.HasPrefix(operation, "file-write"):
+		return CategoryFileWrite
+	case strings.HasPrefix(operation, "file-"):
+		return CategoryFile
+	case strings.HasPrefix(operation, "network"):
+		return CategoryNetwork
+	case strings.HasPrefix(operation, "mach"):
+		return CategoryMach
+	case strings.HasPrefix(operation, "process"):
+		return CategoryProcess
+	case strings.HasPrefix(operation, "sysctl"):
+		return CategorySysctl
+	case strings.HasPrefix(operation, "iokit"):
+		return CategoryIOKit
+	case strings.HasPrefix(operation, "ipc"):
+		return CategoryIPC
+	case strings.HasPrefix(operation, "signal"):
+		return CategorySignal
+	default:
+		return CategoryOther
+	}
+}
+
+// logStreamEntry is a single entry from `log stream --style ndjson`
+type logStreamEntry struct {
+	EventMessage string `json:"eventMessage"`
+	Timestamp    string `json:"timestamp"`
+}
+
+// parseLogStreamLine decodes a single ndjson line from `log stream`.
+// Returns false for non-JSON lines (such as the "Filtering the log data" banner),
+// entries that are not sandbox reports, and, when runID is set, reports not
+// tagged with that run ID.
+func parseLogStreamLine(line []byte, runID string) (Violation, bool) {
+	var entry logStreamEntry
+	if err := json.Unmarshal(line, &entry); err != nil {
+		return Violation{}, false
+	}
+
+	return entry.toViolation(runID)
+}
+
+// toViolation converts a log entry into a Violation.
+// Returns false if the entry is not a sandbox report for runID.
+func (e logStreamEntry) toViolation(runID string) (Violation, bool) {
+	msg, ok := ParseSandboxMessage(e.EventMessage)
+	if !ok {
+		return Violation{}, false
+	}
+
+	if runID != "" && msg.RunID != runID {
+		return Violation{}, false
+	}
+
+	ts, err := time.Parse(logTimestampLayout, e.Timestamp)
+	if err != nil {
+		ts = time.Now()
+	}
+
+	return Violation{
+		Process:   msg.Process,
+		PID:       msg.PID,
+		Action:    msg.Action,
+		Operation: msg.Operation,
+		Category:  msg.Category,
+		Target:    msg.Target,
+		Message:   e.EventMessage,
+		Timestamp: ts,
+	}, true
+}
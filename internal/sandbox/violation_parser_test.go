@@ -0,0 +1,226 @@
+package sandbox
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// messageFixture is an entry in testdata/sandbox_messages.json
+type messageFixture struct {
+	Message   string `json:"message"`
+	Process   string `json:"process"`
+	PID       int    `json:"pid"`
+	Action    string `json:"action"`
+	Operation string `json:"operation"`
+	Category  string `json:"category"`
+	Target    string `json:"target"`
+}
+
+func loadMessageFixtures(t *testing.T) []messageFixture {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("testdata", "sandbox_messages.json"))
+	if err != nil {
+		t.Fatalf("Failed to read fixtures: %v", err)
+	}
+
+	var fixtures []messageFixture
+	if err := json.Unmarshal(data, &fixtures); err != nil {
+		t.Fatalf("Failed to parse fixtures: %v", err)
+	}
+
+	return fixtures
+}
+
+func TestParseSandboxMessageFixtures(t *testing.T) {
+	for _, tt := range loadMessageFixtures(t) {
+		t.Run(tt.Message, func(t *testing.T) {
+			got, ok := ParseSandboxMessage(tt.Message)
+			if !ok {
+				t.Fatalf("ParseSandboxMessage(%q) failed to parse", tt.Message)
+			}
+
+			if got.Process != tt.Process {
+				t.Errorf("Process = %q, want %q", got.Process, tt.Process)
+			}
+			if got.PID != tt.PID {
+				t.Errorf("PID = %d, want %d", got.PID, tt.PID)
+			}
+			if got.Action != tt.Action {
+				t.Errorf("Action = %q, want %q", got.Action, tt.Action)
+			}
+			if got.Operation != tt.Operation {
+				t.Errorf("Operation = %q, want %q", got.Operation, tt.Operation)
+			}
+			if got.Category != tt.Category {
+				t.Errorf("Category = %q, want %q", got.Category, tt.Category)
+			}
+			if got.Target != tt.Target {
+				t.Errorf("Target = %q, want %q", got.Target, tt.Target)
+			}
+		})
+	}
+}
+
+func TestParseSandboxMessageRejectsOtherMessages(t *testing.T) {
+	tests := []string{
+		"",
+		"sandboxd: reporting 2 violations",
+		"Sandbox: missing pid deny(1) file-read-data /tmp",
+		"Sandbox: cat(12) permit(1) file-read-data /tmp",
+		"kernel: Sandbox: cat(12) deny(1) file-read-data /tmp",
+	}
+
+	for _, msg := range tests {
+		t.Run(msg, func(t *testing.T) {
+			if _, ok := ParseSandboxMessage(msg); ok {
+				t.Errorf("ParseSandboxMessage(%q) parsed, want rejection", msg)
+			}
+		})
+	}
+}
+
+func TestOperationCategory(t *testing.T) {
+	tests := []struct {
+		operation string
+		want      string
+	}{
+		{"file-read*", CategoryFileRead},
+		{"file-read-xattr", CategoryFileRead},
+		{"file-write-unlink", CategoryFileWrite},
+		{"file-write-mode", CategoryFileWrite},
+		{"file-link", CategoryFile},
+		{"network*", CategoryNetwork},
+		{"mach-register", CategoryMach},
+		{"process-exec", CategoryProcess},
+		{"sysctl-write", CategorySysctl},
+		{"iokit-get-properties", CategoryIOKit},
+		{"ipc-posix-sem", CategoryIPC},
+		{"signal", CategorySignal},
+		{"system-socket", CategoryOther},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.operation, func(t *testing.T) {
+			if got := OperationCategory(tt.operation); got != tt.want {
+				t.Errorf("OperationCategory(%q) = %q, want %q", tt.operation, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLogStreamLine(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "log_stream.ndjson"))
+	if err != nil {
+		t.Fatalf("Failed to open fixture: %v", err)
+	}
+	defer f.Close()
+
+	var violations []Violation
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if v, ok := parseLogStreamLine(scanner.Bytes(), ""); ok {
+			violations = append(violations, v)
+		}
+	}
+
+	if len(violations) != 3 {
+		t.Fatalf("Parsed %d violations, want 3", len(violations))
+	}
+
+	first := violations[0]
+	if first.Process != "cat" || first.PID != 41235 || first.Operation != "file-read-data" {
+		t.Errorf("Unexpected first violation: %+v", first)
+	}
+
+	wantTime := time.Date(2025, 11, 3, 9, 14, 2, 481203000, time.FixedZone("", 11*60*60))
+	if !first.Timestamp.Equal(wantTime) {
+		t.Errorf("Timestamp = %v, want %v", first.Timestamp, wantTime)
+	}
+
+	if got := violations[1].Target; got != "/Users/dev/Library/Application Support/Code/state.json" {
+		t.Errorf("Target with spaces = %q", got)
+	}
+
+	if got := violations[2].Category; got != CategoryMach {
+		t.Errorf("Category = %q, want %q", got, CategoryMach)
+	}
+}
+
+func TestParseLogStreamLineRunTag(t *testing.T) {
+	const (
+		runA = "3f9c2a7e1b6d4c08"
+		runB = "a41d07c5e92f8b13"
+	)
+
+	parseFixture := func(runID string) []Violation {
+		f, err := os.Open(filepath.Join("testdata", "log_stream_tagged.ndjson"))
+		if err != nil {
+			t.Fatalf("Failed to open fixture: %v", err)
+		}
+		defer f.Close()
+
+		var violations []Violation
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if v, ok := parseLogStreamLine(scanner.Bytes(), runID); ok {
+				violations = append(violations, v)
+			}
+		}
+		return violations
+	}
+
+	// Concurrent runs only see their own reports, untagged reports belong to no run
+	runAViolations := parseFixture(runA)
+	if len(runAViolations) != 3 {
+		t.Fatalf("Run A parsed %d violations, want 3", len(runAViolations))
+	}
+	for _, v := range runAViolations {
+		if strings.Contains(v.Target, runTagPrefix) {
+			t.Errorf("Target still contains the run tag: %q", v.Target)
+		}
+	}
+	if got := runAViolations[1].Target; got != "/Users/dev/Library/Application Support/Code/state.json" {
+		t.Errorf("Target with spaces = %q", got)
+	}
+	if got := runAViolations[2]; got.Action != "allow" || got.Target != "93.184.216.34:443" {
+		t.Errorf("Unexpected report: %+v", got)
+	}
+
+	runBViolations := parseFixture(runB)
+	if len(runBViolations) != 1 || runBViolations[0].Process != "node" {
+		t.Errorf("Run B violations = %+v, want only the node report", runBViolations)
+	}
+
+	if got := parseFixture(""); len(got) != 5 {
+		t.Errorf("Parsing without a run ID returned %d violations, want 5", len(got))
+	}
+}
+
+func TestParseSandboxMessageRunTag(t *testing.T) {
+	tests := []struct {
+		msg        string
+		wantTarget string
+		wantRunID  string
+	}{
+		{"Sandbox: cat(1) deny(1) file-read-data /etc/hosts srt:0123456789abcdef", "/etc/hosts", "0123456789abcdef"},
+		{"Sandbox: cat(1) deny(1) file-read-data /tmp/srt:notatag", "/tmp/srt:notatag", ""},
+		{"Sandbox: sh(1) deny(1) process-fork srt:0123456789abcdef", "", "0123456789abcdef"},
+		{"Sandbox: cat(1) deny(1) file-read-data /etc/hosts", "/etc/hosts", ""},
+	}
+
+	for _, tt := range tests {
+		msg, ok := ParseSandboxMessage(tt.msg)
+		if !ok {
+			t.Fatalf("ParseSandboxMessage(%q) failed", tt.msg)
+		}
+		if msg.Target != tt.wantTarget || msg.RunID != tt.wantRunID {
+			t.Errorf("ParseSandboxMessage(%q) target=%q runID=%q, want %q %q", tt.msg, msg.Target, msg.RunID, tt.wantTarget, tt.wantRunID)
+		}
+	}
+}
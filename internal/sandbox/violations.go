@@ -2,43 +2,68 @@ package sandbox
 
 import (
 	"bufio"
-	"encoding/json"
 	"fmt"
+	"io"
 	"log/slog"
 	"os/exec"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/sammcj/srt-go/internal/network"
 )
 
 // Violation represents a sandbox violation
 type Violation struct {
 	Process   string    `json:"process"`
-	Message   string    `json:"eventMessage"`
+	PID       int       `json:"pid,omitempty"`
+	Action    string    `json:"action,omitempty"`  // "deny", or "allow" for reports from report-only rules
+	Operation string    `json:"operation"`         // Full operation name, e.g. "file-write-unlink"
+	Category  string    `json:"category"`          // Operation category, e.g. "file-write"
+	Target    string    `json:"target,omitempty"`  // Exact target, may contain spaces
+	Message   string    `json:"message,omitempty"` // Raw sandbox message
 	Timestamp time.Time `json:"timestamp"`
-	Target    string
-	Operation string
+	Audit     bool      `json:"audit,omitempty"` // Permitted in audit mode, would be denied when enforcing
+	Count     int       `json:"count,omitempty"` // Repeats folded into this event by the pipeline, 0 for a single event
+}
+
+// Occurrences returns how many sandbox reports the violation stands for
+func (v Violation) Occurrences() int {
+	if v.Count > 1 {
+		return v.Count
+	}
+	return 1
 }
 
-// ViolationMonitor monitors sandbox violations from system log
+// monitorBufferSize bounds the reports buffered between log stream and the pipeline
+const monitorBufferSize = 1024
+
+// ViolationMonitor monitors sandbox violations from system log. It never
+// blocks the log stream reader, reports that do not fit in the buffer are
+// dropped and counted.
 type ViolationMonitor struct {
-	cmd        *exec.Cmd
-	scanner    *bufio.Scanner
+	reader     io.Reader
+	kill       func() // Ends the stream, the reader then drains to EOF
+	wait       func() // Releases the stream once it has been read to EOF
 	violations chan Violation
-	stopCh     chan struct{}
-	commandID  string
+	stopOnce   sync.Once
+	runID      string
+	dropped    atomic.Int64
 }
 
-// NewViolationMonitor creates a new violation monitor
-func NewViolationMonitor(commandID string) (*ViolationMonitor, error) {
-	// Build predicate to filter sandboxd logs containing our command ID
+// NewViolationMonitor creates a monitor for sandbox reports tagged with runID
+func NewViolationMonitor(runID string) (*ViolationMonitor, error) {
+	// Reports come from the kernel, so filter on the tag the profile attaches
+	// to its denials rather than on the reporting process
 	predicate := fmt.Sprintf(
-		"process == 'sandboxd' AND eventMessage CONTAINS '%s'",
-		commandID,
+		"eventMessage CONTAINS 'Sandbox:' AND eventMessage CONTAINS '%s'",
+		RunTag(runID),
 	)
 
+	// ndjson emits one entry per line, unlike the json style which pretty-prints an array
 	cmd := exec.Command("log", "stream",
 		"--predicate", predicate,
-		"--style", "json",
+		"--style", "ndjson",
 		"--level", "default",
 	)
 
@@ -51,36 +76,50 @@ func NewViolationMonitor(commandID string) (*ViolationMonitor, error) {
 		return nil, fmt.Errorf("failed to start log stream: %w", err)
 	}
 
+	// Wait closes the pipe, so it only runs once the reader has seen EOF
+	kill := func() { cmd.Process.Kill() }
+	wait := func() { cmd.Wait() }
+
+	return newViolationMonitor(stdout, kill, wait, runID, monitorBufferSize), nil
+}
+
+func newViolationMonitor(r io.Reader, kill, wait func(), runID string, buffer int) *ViolationMonitor {
 	return &ViolationMonitor{
-		cmd:        cmd,
-		scanner:    bufio.NewScanner(stdout),
-		violations: make(chan Violation, 100),
-		stopCh:     make(chan struct{}),
-		commandID:  commandID,
-	}, nil
+		reader:     r,
+		kill:       kill,
+		wait:       wait,
+		violations: make(chan Violation, buffer),
+		runID:      runID,
+	}
 }
 
 // Start begins monitoring violations
 func (m *ViolationMonitor) Start() {
 	go func() {
+		// Only this goroutine sends, so closing here can't race with a send
 		defer close(m.violations)
 
-		for m.scanner.Scan() {
+		scanner := bufio.NewScanner(m.reader)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			v, ok := parseLogStreamLine(scanner.Bytes(), m.runID)
+			if !ok {
+				continue
+			}
+
 			select {
-			case <-m.stopCh:
-				return
+			case m.violations <- v:
 			default:
-				line := m.scanner.Text()
-
-				var v Violation
-				if err := json.Unmarshal([]byte(line), &v); err != nil {
-					continue
-				}
-
-				m.parseViolation(&v)
-				m.violations <- v
+				m.dropped.Add(1)
 			}
 		}
+		if err := scanner.Err(); err != nil {
+			slog.Debug("Violation monitor stopped reading", "error", err)
+		}
+
+		if m.wait != nil {
+			m.wait()
+		}
 	}()
 }
 
@@ -89,63 +128,64 @@ func (m *ViolationMonitor) Violations() <-chan Violation {
 	return m.violations
 }
 
-// Stop stops monitoring
+// Stop ends the log stream, it is safe to call more than once. Reports
+// already read are still delivered before the Violations channel closes.
 func (m *ViolationMonitor) Stop() {
-	close(m.stopCh)
-	if m.cmd.Process != nil {
-		m.cmd.Process.Kill()
-	}
+	m.stopOnce.Do(m.kill)
 }
 
-func (m *ViolationMonitor) parseViolation(v *Violation) {
-	// Parse the violation message to extract operation and target
-	// Format: "Sandbox: process(pid) deny(1) operation target"
-	msg := v.Message
-
-	// Extract operation
-	if strings.Contains(msg, "file-read") {
-		v.Operation = "file-read"
-	} else if strings.Contains(msg, "file-write") {
-		v.Operation = "file-write"
-	} else if strings.Contains(msg, "network") {
-		v.Operation = "network"
-	}
-
-	// Extract target (last part of message)
-	parts := strings.Fields(msg)
-	if len(parts) > 0 {
-		v.Target = parts[len(parts)-1]
-	}
+// Dropped returns the number of reports dropped because the buffer was full
+func (m *ViolationMonitor) Dropped() int64 {
+	return m.dropped.Load()
 }
 
-// ShouldIgnoreViolation checks if a violation should be ignored
-func ShouldIgnoreViolation(v Violation, ignoreMap map[string][]string) bool {
-	// Check for command-specific ignores
-	if patterns, ok := ignoreMap[v.Process]; ok {
-		for _, pattern := range patterns {
-			if strings.Contains(v.Target, pattern) {
-				return true
-			}
-		}
+// proxyProcess is the process name given to violations reported by the proxies
+const proxyProcess = "srt-proxy"
+
+// proxyViolation converts a proxy filter decision into a violation
+func proxyViolation(d network.Decision, audit bool) Violation {
+	action := "deny"
+	if audit {
+		action = "allow"
 	}
 
-	// Check for global ignores
-	if patterns, ok := ignoreMap["*"]; ok {
-		for _, pattern := range patterns {
-			if strings.Contains(v.Target, pattern) {
-				return true
-			}
-		}
+	// Request rule decisions name the request, e.g. "POST github.com:443/org/repo"
+	request := d.Address()
+	if d.Method != "" {
+		request = d.Method + " " + request + d.Path
 	}
 
-	return false
+	return Violation{
+		Process:   proxyProcess,
+		Action:    action,
+		Operation: "network-outbound",
+		Category:  CategoryNetwork,
+		Target:    d.Address(),
+		Message:   fmt.Sprintf("proxy %s %s (%s)", action, request, d.Rule),
+		Timestamp: time.Now(),
+		Audit:     audit,
+	}
 }
 
 // LogViolation logs a violation
 func LogViolation(v Violation) {
+	if v.Audit {
+		slog.Warn("Sandbox audit: would deny",
+			"process", v.Process,
+			"pid", v.PID,
+			"operation", v.Operation,
+			"category", v.Category,
+			"target", v.Target,
+			"time", v.Timestamp,
+		)
+		return
+	}
+
 	slog.Warn("Sandbox violation",
 		"process", v.Process,
+		"pid", v.PID,
 		"operation", v.Operation,
+		"category", v.Category,
 		"target", v.Target,
 		"time", v.Timestamp,
 	)
@@ -0,0 +1,56 @@
+package sandbox
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/sammcj/srt-go/internal/network"
+)
+
+func TestProxyViolation(t *testing.T) {
+	d := network.Decision{Domain: "evil.example", Allowed: false, Rule: "defaultPolicy:deny"}
+
+	audit := proxyViolation(d, true)
+	if !audit.Audit || audit.Action != "allow" {
+		t.Errorf("Audit violation = %+v, want audit with allow action", audit)
+	}
+	if audit.Operation != "network-outbound" || audit.Category != CategoryNetwork || audit.Target != "evil.example" {
+		t.Errorf("Unexpected audit violation fields: %+v", audit)
+	}
+	if !strings.Contains(audit.Message, "defaultPolicy:deny") {
+		t.Errorf("Message %q should name the rule", audit.Message)
+	}
+	if got := ConfigKeyForViolation(audit); got != "network.allowedDomains" {
+		t.Errorf("ConfigKeyForViolation() = %q, want network.allowedDomains", got)
+	}
+
+	enforced := proxyViolation(d, false)
+	if enforced.Audit || enforced.Action != "deny" {
+		t.Errorf("Enforced violation = %+v, want deny action", enforced)
+	}
+}
+
+func TestProxyViolationRequestRule(t *testing.T) {
+	d := network.Decision{Domain: "github.com", Port: 443, Method: "POST", Path: "/other/repo", Rule: "httpRules[1]"}
+
+	v := proxyViolation(d, false)
+	if v.Target != "github.com:443" {
+		t.Errorf("Target = %q, want the address", v.Target)
+	}
+	if want := "proxy deny POST github.com:443/other/repo (httpRules[1])"; v.Message != want {
+		t.Errorf("Message = %q, want %q", v.Message, want)
+	}
+}
+
+func TestAuditSummaryHeader(t *testing.T) {
+	summary := NewViolationSummary()
+	summary.Add(Violation{Operation: "file-write-create", Target: "/tmp/a", Audit: true})
+
+	var buf bytes.Buffer
+	summary.Print(&buf)
+
+	if !strings.Contains(buf.String(), "Audit - would deny: 1 total") {
+		t.Errorf("Audit summary header missing:\n%s", buf.String())
+	}
+}